@@ -0,0 +1,88 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+	Admin http api of the alarm service, eg: for inspecting and resharding the workers at runtime.
+*/
+
+const shutdownTimeout = 5 * time.Second
+
+type AdminServer struct {
+	mux        *http.ServeMux
+	httpServer *http.Server
+	listener   net.Listener
+}
+
+// AdminServerCreateNew port 0 means random port.
+func AdminServerCreateNew(port int) (*AdminServer, error) {
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+
+	s := &AdminServer{
+		mux:        mux,
+		httpServer: &http.Server{Handler: mux},
+		listener:   listener,
+	}
+
+	return s, nil
+}
+
+func (s *AdminServer) Handle(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+func (s *AdminServer) Address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *AdminServer) Start() {
+	go func() {
+		log.Infof("admin server listening on: %v\n", s.Address())
+
+		if err := s.httpServer.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("admin server stopped, error: %v\n", err)
+		}
+	}()
+}
+
+func (s *AdminServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		log.Warnf("admin server did not shutdown gracefully, error: %v\n", err)
+	}
+}
+
+// -------------------
+
+type errorResponse struct {
+	Error string
+}
+
+func writeJson(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Warnf("could not write admin response, error: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err string) {
+	writeJson(w, statusCode, errorResponse{Error: err})
+}
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	. "alarm/health"
+	"net/http"
+)
+
+/*
+	GET /healthz  --> liveness, 200 or 503 with the failing checks
+	GET /readyz   --> readiness, 200 or 503 with the failing checks
+*/
+
+const livenessPath = "/healthz"
+const readinessPath = "/readyz"
+
+func (s *AdminServer) RegisterHealthEndpoints(healthChecks *HealthChecks) {
+	s.Handle(livenessPath, healthHandler(healthChecks.Liveness))
+	s.Handle(readinessPath, healthHandler(healthChecks.Readiness))
+}
+
+func healthHandler(probe func() HealthReport) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
+			return
+		}
+
+		report := probe()
+		if report.Healthy {
+			writeJson(w, http.StatusOK, report)
+		} else {
+			writeJson(w, http.StatusServiceUnavailable, report)
+		}
+	}
+}
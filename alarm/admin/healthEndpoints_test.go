@@ -0,0 +1,65 @@
+package admin
+
+import (
+	. "alarm/health"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthEndpoints_reportFailingChecks(t *testing.T) {
+
+	// given
+	var connected int32 = 0
+	healthChecks := HealthChecksCreateNew()
+	healthChecks.AddReadinessCheck("transport", func() error {
+		if atomic.LoadInt32(&connected) == 0 {
+			return errors.New("disconnected")
+		}
+		return nil
+	})
+	healthChecks.AddLivenessCheck("workers", func() error {
+		return nil
+	})
+
+	adminServer, err := AdminServerCreateNew(0)
+	if err != nil {
+		t.Fatalf("could not create admin server, error: %v", err)
+	}
+	adminServer.RegisterHealthEndpoints(healthChecks)
+	adminServer.Start()
+	defer adminServer.Stop()
+
+	baseUrl := "http://" + adminServer.Address()
+
+
+	// when - then
+	report := getHealthReport(t, baseUrl+readinessPath, http.StatusServiceUnavailable)
+	if report.Checks["transport"] != "disconnected" {
+		t.Errorf("the reason should have been reported, got: %v", report)
+	}
+
+	getHealthReport(t, baseUrl+livenessPath, http.StatusOK)
+
+	atomic.StoreInt32(&connected, 1)
+	report = getHealthReport(t, baseUrl+readinessPath, http.StatusOK)
+	if !report.Healthy || report.Checks["transport"] != "ok" {
+		t.Errorf("should have been ready, got: %v", report)
+	}
+}
+
+func getHealthReport(t *testing.T, url string, expectedStatusCode int) HealthReport {
+	resp, err := http.Get(url)
+	if err != nil || resp.StatusCode != expectedStatusCode {
+		t.Fatalf("unexpected response: %v, error: %v", resp, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var report HealthReport
+	_ = json.NewDecoder(resp.Body).Decode(&report)
+	return report
+}
@@ -0,0 +1,70 @@
+package admin
+
+import (
+	. "alarm/message"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+	GET    /admin/users/{userId}/alarms/{alarmId}/history  --> the transitions of the alarm
+	GET    /admin/users/{userId}/alarms?at={RFC3339}       --> the active alarms of the user as of the time (now if omitted)
+
+	with ?tenant={tenant} for a user of a tenant (multi-tenancy enabled).
+*/
+
+const usersPath = "/admin/users/"
+
+func (s *AdminServer) RegisterHistoryEndpoints(workerPool *AlarmMessageWorkerPool) {
+
+	s.Handle(usersPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
+			return
+		}
+
+		// Note: {userId}/alarms or {userId}/alarms/{alarmId}/history
+		segments := strings.Split(strings.TrimPrefix(r.URL.Path, usersPath), "/")
+		userId := segments[0]
+		if tenant := r.URL.Query().Get("tenant"); len(tenant) > 0 {
+			userId = TenantUserId(tenant, userId)
+		}
+
+		switch {
+
+		case len(segments) == 2 && len(segments[0]) > 0 && segments[1] == "alarms":
+			at := time.Now()
+			if value := r.URL.Query().Get("at"); len(value) > 0 {
+				parsed, err := time.Parse(time.RFC3339Nano, value)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, "invalid time, expected RFC3339: "+value)
+					return
+				}
+				at = parsed
+			}
+
+			activeAlarms, err := workerPool.ActiveAlarmsAt(userId, at)
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			writeJson(w, http.StatusOK, activeAlarms)
+
+		case len(segments) == 4 && len(segments[0]) > 0 && segments[1] == "alarms" && len(segments[2]) > 0 && segments[3] == "history":
+			timeline, err := workerPool.AlarmTimeline(userId, segments[2])
+			if err != nil {
+				statusCode := http.StatusServiceUnavailable
+				if err == ErrAlarmNotFound {
+					statusCode = http.StatusNotFound
+				}
+				writeError(w, statusCode, err.Error())
+				return
+			}
+			writeJson(w, http.StatusOK, timeline)
+
+		default:
+			writeError(w, http.StatusNotFound, "not found: "+r.URL.Path)
+		}
+	})
+}
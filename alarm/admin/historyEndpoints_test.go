@@ -0,0 +1,86 @@
+package admin
+
+import (
+	. "alarm/message"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHistoryEndpoints_timelineAndActiveAlarmsAt(t *testing.T) {
+
+	// given
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	pool := AlarmMessageWorkerPoolCreateNew(2, 10, func(i int) *AlarmMessageWorker {
+		alarmStatusChangedMessages := make(chan AlarmStatusChangedMessage, 10)
+		sendAlarmDigestMessages := make(chan SendAlarmDigestMessage, 10)
+		workerName := "alarmMessagesWorker#" + strconv.Itoa(i)
+		worker := AlarmMessageWorkerCreateNew(&workerName, &i, &alarmStatusChangedMessages, &sendAlarmDigestMessages, &alarmDigestMessagesChan)
+		worker.KeepHistory(AlarmHistoryOptions{MaxTransitions: 10})
+		return worker
+	})
+
+	adminServer, err := AdminServerCreateNew(0)
+	if err != nil {
+		t.Fatalf("could not create admin server, error: %v", err)
+	}
+	adminServer.RegisterHistoryEndpoints(pool)
+	adminServer.Start()
+	defer adminServer.Stop()
+
+	baseUrl := "http://" + adminServer.Address() + usersPath
+
+	criticalAt := time.Date(2021, 8, 17, 14, 0, 0, 0, time.UTC)
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CRITICAL", ChangedAt: criticalAt})
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CLEARED", ChangedAt: criticalAt.Add(10 * time.Minute)})
+	for tries := 0; tries < 500 && (pool.Workers()[0].ProcessedMessages()+pool.Workers()[1].ProcessedMessages()) < 2; tries++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+
+	// when - then
+	resp, err := http.Get(baseUrl + "u1/alarms/a1/history")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not get the timeline, response: %v, error: %v", resp, err)
+	}
+	var timeline AlarmTimeline
+	_ = json.NewDecoder(resp.Body).Decode(&timeline)
+	_ = resp.Body.Close()
+	if timeline.Status != "CLEARED" || len(timeline.Transitions) != 2 || timeline.Transitions[0].Status != "CRITICAL" {
+		t.Errorf("invalid timeline: %v", timeline)
+	}
+
+	resp, err = http.Get(baseUrl + "u1/alarms?at=" + criticalAt.Add(5*time.Minute).Format(time.RFC3339))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not get the active alarms, response: %v, error: %v", resp, err)
+	}
+	var activeAlarms UserActiveAlarmsAt
+	_ = json.NewDecoder(resp.Body).Decode(&activeAlarms)
+	_ = resp.Body.Close()
+	if len(activeAlarms.ActiveAlarms) != 1 || activeAlarms.ActiveAlarms[0].AlarmId != "a1" {
+		t.Errorf("expected a1 to be active, got: %v", activeAlarms)
+	}
+
+	resp, err = http.Get(baseUrl + "u1/alarms")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not get the current active alarms, response: %v, error: %v", resp, err)
+	}
+	activeAlarms = UserActiveAlarmsAt{}
+	_ = json.NewDecoder(resp.Body).Decode(&activeAlarms)
+	_ = resp.Body.Close()
+	if len(activeAlarms.ActiveAlarms) != 0 {
+		t.Errorf("expected no active alarms now, got: %v", activeAlarms)
+	}
+
+	resp, err = http.Get(baseUrl + "u1/alarms/a2/history")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found for an unknown alarm, response: %v, error: %v", resp, err)
+	}
+
+	resp, err = http.Get(baseUrl + "u1/alarms?at=yesterday")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request for an invalid time, response: %v, error: %v", resp, err)
+	}
+}
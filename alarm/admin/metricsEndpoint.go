@@ -0,0 +1,21 @@
+package admin
+
+import (
+	. "alarm/metrics"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+const metricsPath = "/metrics"
+
+// RegisterMetricsEndpoint GET /metrics --> metrics in the prometheus text format
+func (s *AdminServer) RegisterMetricsEndpoint(registry *Registry) {
+
+	s.Handle(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		if err := registry.WritePrometheus(w); err != nil {
+			log.Warnf("could not write metrics, error: %v\n", err)
+		}
+	})
+}
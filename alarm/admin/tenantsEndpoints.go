@@ -0,0 +1,23 @@
+package admin
+
+import (
+	. "alarm/message"
+	"net/http"
+)
+
+/*
+	GET    /admin/tenants  --> lists the tenants with their usage (users, alarms) and quotas
+*/
+
+const tenantsPath = "/admin/tenants"
+
+func (s *AdminServer) RegisterTenantEndpoints(tenants *TenantRegistry) {
+
+	s.Handle(tenantsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
+			return
+		}
+		writeJson(w, http.StatusOK, tenants.Usage())
+	})
+}
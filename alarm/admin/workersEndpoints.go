@@ -0,0 +1,70 @@
+package admin
+
+import (
+	. "alarm/message"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+	GET    /admin/workers       --> lists the workers with their mailbox depths
+	POST   /admin/workers       --> adds a worker (users get resharded)
+	DELETE /admin/workers/{id}  --> removes a worker (users get resharded)
+*/
+
+const workersPath = "/admin/workers"
+
+type addWorkerResponse struct {
+	Id           DistributionId
+	TotalWorkers int
+}
+
+type removeWorkerResponse struct {
+	TotalWorkers int
+}
+
+func (s *AdminServer) RegisterWorkerPoolEndpoints(workerPool *AlarmMessageWorkerPool) {
+
+	s.Handle(workersPath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+
+		case http.MethodGet:
+			writeJson(w, http.StatusOK, workerPool.WorkersInfo())
+
+		case http.MethodPost:
+			id, err := workerPool.AddWorker()
+			if err != nil {
+				writeError(w, http.StatusConflict, err.Error())
+				return
+			}
+			writeJson(w, http.StatusCreated, addWorkerResponse{Id: id, TotalWorkers: workerPool.Size()})
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
+		}
+	})
+
+	s.Handle(workersPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
+			return
+		}
+
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, workersPath+"/"), 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid worker id")
+			return
+		}
+
+		if err := workerPool.RemoveWorker(DistributionId(id)); err != nil {
+			statusCode := http.StatusConflict
+			if err == ErrWorkerNotFound {
+				statusCode = http.StatusNotFound
+			}
+			writeError(w, statusCode, err.Error())
+			return
+		}
+		writeJson(w, http.StatusOK, removeWorkerResponse{TotalWorkers: workerPool.Size()})
+	})
+}
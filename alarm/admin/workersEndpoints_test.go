@@ -0,0 +1,73 @@
+package admin
+
+import (
+	. "alarm/message"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestWorkersEndpoints_addListAndRemoveWorker(t *testing.T) {
+
+	// given
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	pool := AlarmMessageWorkerPoolCreateNew(2, 10, func(i int) *AlarmMessageWorker {
+		alarmStatusChangedMessages := make(chan AlarmStatusChangedMessage, 10)
+		sendAlarmDigestMessages := make(chan SendAlarmDigestMessage, 10)
+		workerName := "alarmMessagesWorker#" + strconv.Itoa(i)
+		return AlarmMessageWorkerCreateNew(&workerName, &i, &alarmStatusChangedMessages, &sendAlarmDigestMessages, &alarmDigestMessagesChan)
+	})
+
+	adminServer, err := AdminServerCreateNew(0)
+	if err != nil {
+		t.Fatalf("could not create admin server, error: %v", err)
+	}
+	adminServer.RegisterWorkerPoolEndpoints(pool)
+	adminServer.Start()
+	defer adminServer.Stop()
+
+	baseUrl := "http://" + adminServer.Address() + workersPath
+
+
+	// when - then
+	resp, err := http.Post(baseUrl, "application/json", nil)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("could not add worker, response: %v, error: %v", resp, err)
+	}
+	var added addWorkerResponse
+	_ = json.NewDecoder(resp.Body).Decode(&added)
+	_ = resp.Body.Close()
+	if added.Id != 2 || added.TotalWorkers != 3 {
+		t.Errorf("invalid add worker response: %v", added)
+	}
+
+	resp, err = http.Get(baseUrl)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not list workers, response: %v, error: %v", resp, err)
+	}
+	var workers []AlarmMessageWorkerInfo
+	_ = json.NewDecoder(resp.Body).Decode(&workers)
+	_ = resp.Body.Close()
+	if len(workers) != 3 {
+		t.Errorf("expected 3 workers, got: %v", workers)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, baseUrl+"/0", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("could not remove worker, response: %v, error: %v", resp, err)
+	}
+	_ = resp.Body.Close()
+
+	req, _ = http.NewRequest(http.MethodDelete, baseUrl+"/0", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("removing a missing worker should respond not found, response: %v, error: %v", resp, err)
+	}
+	_ = resp.Body.Close()
+
+	if pool.Size() != 2 {
+		t.Errorf("expected 2 workers, got: %v", pool.Size())
+	}
+}
@@ -1,176 +1,766 @@
 package main
 
 import (
+	. "alarm/admin"
 	. "alarm/error"
 	. "alarm/fileutil"
+	. "alarm/health"
 	. "alarm/message"
-	"github.com/nats-io/nats.go"
+	. "alarm/metrics"
+	. "alarm/tracing"
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 
-const sendLogsToFile = false
+func BootstrapAlarmService(transport Transport, props *AppConfigProperties, produceTestTraffic bool) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
 
-func BootstrapAlarmService(serverConnection *nats.Conn, props *AppConfigProperties, produceTestTraffic bool) {
-
-	// setup logging
-	if sendLogsToFile {
-		file, err := os.OpenFile("info.log", os.O_APPEND|os.O_WRONLY, os.ModeAppend)
-		if err != nil {
-			log.Fatal(err)
-		}
+	runAlarmService(transport, props, produceTestTraffic, stop)
+}
 
-		defer func(file *os.File) {
-			_ = file.Close()
-		}(file)
+// runAlarmService runs until a signal is received from stop, then the deferred cleanups run in reverse order.
+func runAlarmService(transport Transport, props *AppConfigProperties, produceTestTraffic bool, stop <-chan os.Signal) {
 
-		log.SetOutput(file)
-		log.SetFormatter(&log.JSONFormatter{})
+	// setup logging
+	logFile := registerLogFile(props)
+	if logFile != nil {
+		defer func() {
+			_ = logFile.Close()
+		}()
 	}
-	log.SetLevel(log.DebugLevel)
+	applyLogSettings(props)
 
 
 	// setup error handling
 	defer GlobalErrorHandler()
 
 
+	// setup tracing
+	stopTracing := registerTracing(props)
+	defer func() {
+		log.Debugf("[DEFER-CLEAR-RESOURCES] will flush and stop tracing now...")
+		stopTracing()
+	}()
+
+
+	// setup the subjects, used by all the listeners and producers below
+	SetTopicNames(topicNames(props))
+
+
 	// listen for incoming messages and process them for topics:  [AlarmStatusChanged, SendAlarmDigest]
 	alarmStatusChangedMessagesChan := make(chan AlarmStatusChangedMessage,  props.FetchAsInt("alarmStatusChangedMessagesChan"))
 	sendAlarmDigestMessagesChan := make(chan SendAlarmDigestMessage, props.FetchAsInt("sendAlarmDigestMessagesChan"))
 	alarmDigestMessagesChan := make(chan AlarmDigestMessage, props.FetchAsInt("alarmDigestMessagesChan"))
+	alarmEscalatedMessagesChan := make(chan AlarmEscalatedMessage, props.FetchAsInt("alarmEscalatedMessagesChan"))
 
+	// Note: the input channels get closed once the listeners have unsubscribed (see CONSUMERS).
 	defer func() {
-		log.Debugf("[DEFER-CLEAR-RESOURCES] will close alarmStatusChangedMessagesChan, sendAlarmDigestMessagesChan and alarmDigestMessagesChan channels now...")
-		close(alarmStatusChangedMessagesChan)
-		close(sendAlarmDigestMessagesChan)
+		log.Debugf("[DEFER-CLEAR-RESOURCES] will close alarmDigestMessagesChan and alarmEscalatedMessagesChan channels now...")
 		close(alarmDigestMessagesChan)
+		close(alarmEscalatedMessagesChan)
 	}()
 
 
-	// PRODUCERS
-	registerProducers(props, serverConnection, alarmDigestMessagesChan)
+	// HEALTH
+	// Note: not ready until the whole service has been registered (see the end of the bootstrap).
+	var started int32 = 0
+	healthChecks := HealthChecksCreateNew()
+	healthChecks.AddReadinessCheck("startup", func() error {
+		if atomic.LoadInt32(&started) == 0 {
+			return errors.New("starting")
+		}
+		return nil
+	})
+	healthChecks.AddReadinessCheck("transport", func() error {
+		return CheckTransportConnected(transport)
+	})
+
+
+	// WRITE-AHEAD LOG
+	// Note: stopped after the workers have exited, so they do not append anymore.
+	wal := registerWriteAheadLog(props)
+	if wal != nil {
+		defer func() {
+			log.Debugf("[DEFER-CLEAR-RESOURCES] will close write-ahead log now...")
+			wal.Stop()
+		}()
+	}
+
+
+	// TENANTS
+	tenants := registerTenants(props)
 
 
 	// WORKERS
-	alarmMessageWorkersByDistributionId := registerWorkers(props, alarmDigestMessagesChan)
+	alarmMessageWorkerPool := registerWorkers(props, alarmDigestMessagesChan, alarmEscalatedMessagesChan, wal, tenants)
 	defer func() {
-		log.Debugf("[DEFER-CLEAR-RESOURCES] will close alarmMessageWorkersByDistributionId now...")
+		log.Debugf("[DEFER-CLEAR-RESOURCES] will stop alarmMessageWorkerPool now...")
+		alarmMessageWorkerPool.Stop()
+	}()
+
+
+	// ADMIN
+	// Note: started before the restore, so /readyz reports it while it runs.
+	registerWorkersHealthChecks(props, healthChecks, alarmMessageWorkerPool)
+	adminServer := registerAdminServer(props, alarmMessageWorkerPool, healthChecks, tenants)
+	if adminServer != nil {
+		defer func() {
+			log.Debugf("[DEFER-CLEAR-RESOURCES] will stop admin server now...")
+			adminServer.Stop()
+		}()
+	}
+
 
-		for _, v := range alarmMessageWorkersByDistributionId {
-			close(*v.AlarmStatusChangedMessages)
-			close(*v.SendAlarmDigestMessages)
+	// DIGEST DELIVERY
+	digestDeliveryTracker := registerDigestDeliveryTracker(props, transport, alarmMessageWorkerPool, tenants)
+	if digestDeliveryTracker != nil {
+		defer func() {
+			log.Debugf("[DEFER-CLEAR-RESOURCES] will stop digestDeliveryTracker now...")
+			digestDeliveryTracker.Stop()
+		}()
+	}
+
+
+	// ESCALATIONS
+	escalator := registerEscalator(props, transport, alarmMessageWorkerPool, tenants, alarmEscalatedMessagesChan)
+	if escalator != nil {
+		defer func() {
+			log.Debugf("[DEFER-CLEAR-RESOURCES] will stop escalator now...")
+			escalator.Stop()
+		}()
+	}
+
+
+	// PRODUCERS
+	// Note: after the delivery tracker, in jetstream mode they publish to its stream.
+	producers := registerProducers(props, transport, alarmDigestMessagesChan, digestDeliveryTracker, tenants)
+	registerProducersHealthChecks(props, healthChecks, producers)
+
+
+	// SNAPSHOTS
+	// Note: stopped after the consumers and the hot user throttler, and before the workers, so the final snapshot drains
+	//		 the mailboxes and has every message already received.
+	// Note: not ready until the state of the workers has been restored (snapshots, then the write-ahead log on top).
+	var restored int32 = 0
+	healthChecks.AddReadinessCheck("restore", func() error {
+		if atomic.LoadInt32(&restored) == 0 {
+			return errors.New("restoring the state of the workers")
 		}
+		return nil
+	})
+	snapshotter := registerSnapshotter(props, alarmMessageWorkerPool, wal)
+	atomic.StoreInt32(&restored, 1)
+	if snapshotter != nil {
+		defer func() {
+			log.Debugf("[DEFER-CLEAR-RESOURCES] will take the final snapshot now...")
+			snapshotter.Stop()
+		}()
+	}
+
+
+	// AUTOSCALER
+	autoscaler := registerAutoscaler(props, alarmMessageWorkerPool)
+	if autoscaler != nil {
+		defer func() {
+			log.Debugf("[DEFER-CLEAR-RESOURCES] will stop autoscaler now...")
+			autoscaler.Stop()
+		}()
+	}
+
+
+	// RETENTION
+	retentionSweeper := registerRetentionSweeper(props, alarmMessageWorkerPool)
+	defer func() {
+		log.Debugf("[DEFER-CLEAR-RESOURCES] will stop retention sweeper now...")
+		retentionSweeper.Stop()
 	}()
 
 
+	// HOT USERS
+	var dispatcher MessageDispatcher = alarmMessageWorkerPool
+	hotUserThrottler := registerHotUserThrottler(props, alarmMessageWorkerPool)
+	if hotUserThrottler != nil {
+		dispatcher = hotUserThrottler
+		defer func() {
+			log.Debugf("[DEFER-CLEAR-RESOURCES] will stop hotUserThrottler now...")
+			hotUserThrottler.Stop()
+		}()
+	}
+
+
 	// CONSUMERS
-	registerConsumers(props, alarmStatusChangedMessagesChan, alarmMessageWorkersByDistributionId, sendAlarmDigestMessagesChan)
+	// Note: the listeners (unsubscribed first) do not send to the input channels anymore, so these can be closed, and the
+	//		 consumers finish dispatching what is left in them before the throttler and the snapshots stop.
+	consumers := registerConsumers(props, alarmStatusChangedMessagesChan, dispatcher, sendAlarmDigestMessagesChan)
+	defer func() {
+		log.Debugf("[DEFER-CLEAR-RESOURCES] will close alarmStatusChangedMessagesChan and sendAlarmDigestMessagesChan channels and wait for the consumers now...")
+		close(alarmStatusChangedMessagesChan)
+		close(sendAlarmDigestMessagesChan)
+		consumers.Wait()
+	}()
+
+
+	// CONFIG RELOAD
+	configWatcher := registerConfigWatcher(props, hotUserThrottler, autoscaler, retentionSweeper)
+	defer func() {
+		log.Debugf("[DEFER-CLEAR-RESOURCES] will stop config watcher now...")
+		configWatcher.Stop()
+	}()
 
 
 	// LISTENERS
 	alarmStatusChangedTopicSubscriptions,
 	sendAlarmDigestTopicSubscriptions,
-	alarmDigestTopicSubscription := registerListeners(props, serverConnection, alarmStatusChangedMessagesChan, sendAlarmDigestMessagesChan)
+	alarmDigestTopicSubscription := registerListeners(props, transport, alarmStatusChangedMessagesChan, sendAlarmDigestMessagesChan, tenants)
+	historyQuerySubscriptions := RegisterAlarmHistoryQueryResponder("alarmHistoryQueryResponder", transport, alarmMessageWorkerPool, tenants)
+	alarmQuerySubscriptions := RegisterAlarmQueryResponders("alarmQueryResponder", transport, alarmMessageWorkerPool, tenants,
+		props.FetchAsDuration("alarmQueryTimeoutMs"))
 	defer func() {
 		log.Debugf("[DEFER-CLEAR-RESOURCES] will close alarmStatusChangedTopicSubscriptions now...")
 
 		for _, subscription := range alarmStatusChangedTopicSubscriptions {
-			AsyncUnsubscribe(subscription, subscription.Subject)
+			AsyncUnsubscribe(subscription, subscription.Subject())
 		}
 	}()
 	defer func() {
 		log.Debugf("[DEFER-CLEAR-RESOURCES] will close sendAlarmDigestTopicSubscriptions now...")
 
 		for _, subscription := range sendAlarmDigestTopicSubscriptions {
-			AsyncUnsubscribe(subscription, subscription.Subject)
+			AsyncUnsubscribe(subscription, subscription.Subject())
 		}
 	}()
 	defer func() {
 		log.Debugf("[DEFER-CLEAR-RESOURCES] will close alarmDigestTopicSubscription now...")
-		AsyncUnsubscribe(alarmDigestTopicSubscription, alarmDigestTopicSubscription.Subject)
+		AsyncUnsubscribe(alarmDigestTopicSubscription, alarmDigestTopicSubscription.Subject())
+	}()
+	defer func() {
+		log.Debugf("[DEFER-CLEAR-RESOURCES] will close historyQuerySubscriptions now...")
+
+		for _, subscription := range historyQuerySubscriptions {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
+	}()
+	defer func() {
+		log.Debugf("[DEFER-CLEAR-RESOURCES] will close alarmQuerySubscriptions now...")
+
+		for _, subscription := range alarmQuerySubscriptions {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
 	}()
 
 
 
+	var subscriptions []TransportSubscription
+	subscriptions = append(subscriptions, alarmStatusChangedTopicSubscriptions...)
+	subscriptions = append(subscriptions, sendAlarmDigestTopicSubscriptions...)
+	subscriptions = append(subscriptions, alarmDigestTopicSubscription)
+	subscriptions = append(subscriptions, historyQuerySubscriptions...)
+	subscriptions = append(subscriptions, alarmQuerySubscriptions...)
+	if digestDeliveryTracker != nil {
+		subscriptions = append(subscriptions, digestDeliveryTracker.Subscriptions()...)
+	}
+	healthChecks.AddReadinessCheck("subscriptions", func() error {
+		return CheckSubscriptionsActive(subscriptions)
+	})
+
+	atomic.StoreInt32(&started, 1)
+	log.Infof("alarm service started\n")
+
+
+
 	// --- produce some test traffic ---
 	alarmStatusChangedListeners := props.FetchAsInt("alarmStatusChangedListeners")
 	sendAlarmDigestListeners := props.FetchAsInt("sendAlarmDigestListeners")
 	if produceTestTraffic {
-		go EmulateTraffic(-1, serverConnection, alarmStatusChangedListeners, sendAlarmDigestListeners,
+		go EmulateTraffic(-1, transport, alarmStatusChangedListeners, sendAlarmDigestListeners,
 			500, 1000)
 	}
 
 
-	select {}
+	// Note: on SIGINT/SIGTERM the deferred cleanups run in reverse order: the listeners get unsubscribed, the consumers
+	//		 drained, the final snapshot taken, and only then the workers and the write-ahead log get stopped.
+	received := <-stop
+
+	atomic.StoreInt32(&started, 0)
+	log.Infof("alarm service stopping (%v)...\n", received)
 }
 
-func registerListeners(props *AppConfigProperties, serverConnection *nats.Conn,
-	alarmStatusChangedMessagesChan chan AlarmStatusChangedMessage, sendAlarmDigestMessagesChan chan SendAlarmDigestMessage) ([]*nats.Subscription, []*nats.Subscription, *nats.Subscription) {
+func registerListeners(props *AppConfigProperties, transport Transport,
+	alarmStatusChangedMessagesChan chan AlarmStatusChangedMessage, sendAlarmDigestMessagesChan chan SendAlarmDigestMessage, tenants *TenantRegistry) ([]TransportSubscription, []TransportSubscription, TransportSubscription) {
+
+	// Note: the tenants have their own subjects, the unprefixed ones are not subscribed (see tenants.go).
+	if tenants != nil {
+		alarmStatusChangedTopicSubscriptions, sendAlarmDigestTopicSubscriptions := RegisterTenantTopicListeners("tenantTopicListener", transport, tenants,
+			alarmStatusChangedMessagesChan, sendAlarmDigestMessagesChan, true)
+
+		alarmDigestTopicSubscription := RegisterAlarmDigestTopicListener("alarmDigestTopicListener", transport, TenantSubject("*", Topics().AlarmDigest),
+			true, nil)
+
+		return alarmStatusChangedTopicSubscriptions, sendAlarmDigestTopicSubscriptions, alarmDigestTopicSubscription
+	}
 
 	alarmStatusChangedListeners := props.FetchAsInt("alarmStatusChangedListeners")
-	alarmStatusChangedTopicSubscriptions := RegisterAlarmStatusChangedTopicListeners("alarmStatusChangedTopicListener", alarmStatusChangedListeners, serverConnection,
+	alarmStatusChangedTopicSubscriptions := RegisterAlarmStatusChangedTopicListeners("alarmStatusChangedTopicListener", alarmStatusChangedListeners, transport,
 		alarmStatusChangedMessagesChan, true, true)
 
 
 	sendAlarmDigestListeners := props.FetchAsInt("sendAlarmDigestListeners")
-	sendAlarmDigestTopicSubscriptions := RegisterSendAlarmDigestTopicListeners("sendAlarmDigestTopicListener", sendAlarmDigestListeners, serverConnection,
+	sendAlarmDigestTopicSubscriptions := RegisterSendAlarmDigestTopicListeners("sendAlarmDigestTopicListener", sendAlarmDigestListeners, transport,
 		sendAlarmDigestMessagesChan, true, true)
 
 
+	// Note: the wildcard subscriptions are optional, see wildcardUserIdToken.
+	alarmStatusChangedWildcardSubscriptions, sendAlarmDigestWildcardSubscriptions := RegisterWildcardTopicListeners("wildcardTopicListener",
+		alarmStatusChangedListeners, sendAlarmDigestListeners, transport, alarmStatusChangedMessagesChan, sendAlarmDigestMessagesChan, true)
+	alarmStatusChangedTopicSubscriptions = append(alarmStatusChangedTopicSubscriptions, alarmStatusChangedWildcardSubscriptions...)
+	sendAlarmDigestTopicSubscriptions = append(sendAlarmDigestTopicSubscriptions, sendAlarmDigestWildcardSubscriptions...)
+
+
 	// Note: this is used for debugging purposes and see if we produce correct message.
-	alarmDigestTopicSubscription := RegisterAlarmDigestTopicListener("alarmDigestTopicListener", serverConnection, AlarmDigestTopic,
+	alarmDigestTopicSubscription := RegisterAlarmDigestTopicListener("alarmDigestTopicListener", transport, Topics().AlarmDigest,
 		true, nil)
 
 	return alarmStatusChangedTopicSubscriptions, sendAlarmDigestTopicSubscriptions, alarmDigestTopicSubscription
 }
 
 
-func registerConsumers(props *AppConfigProperties, alarmStatusChangedMessagesChan chan AlarmStatusChangedMessage, alarmMessageWorkersByDistributionId map[DistributionId]*AlarmMessageWorker, sendAlarmDigestMessagesChan chan SendAlarmDigestMessage) {
+func topicNames(props *AppConfigProperties) TopicNames {
+	return TopicNames{
+		AlarmStatusChanged:         props.FetchAsString("alarmStatusChangedSubject"),
+		SendAlarmDigest:            props.FetchAsString("sendAlarmDigestSubject"),
+		AlarmDigest:                props.FetchAsString("alarmDigestSubject"),
+		AlarmDigestDelivered:       props.FetchAsString("alarmDigestDeliveredSubject"),
+		AlarmEscalated:             props.FetchAsString("alarmEscalatedSubject"),
+		AlarmHistoryQuery:          props.FetchAsString("alarmHistoryQuerySubject"),
+		AlarmQueryActiveAlarms:     props.FetchAsString("alarmQueryActiveAlarmsSubject"),
+		AlarmQueryAlarm:            props.FetchAsString("alarmQueryAlarmSubject"),
+		AlarmQueryStats:            props.FetchAsString("alarmQueryStatsSubject"),
+		AlarmQueryLastDigest:       props.FetchAsString("alarmQueryLastDigestSubject"),
+		ShardPattern:               props.FetchAsString("shardSubjectPattern"),
+		DeadLetter:                 props.FetchAsString("deadLetterSubject"),
+		AlarmStatusChangedWildcard: props.FetchAsString("alarmStatusChangedWildcardSubject"),
+		SendAlarmDigestWildcard:    props.FetchAsString("sendAlarmDigestWildcardSubject"),
+		UserIdToken:                props.FetchAsInt("wildcardUserIdToken"),
+	}
+}
+
+// registerConsumers the returned wait group is done once the channels are closed and drained.
+func registerConsumers(props *AppConfigProperties, alarmStatusChangedMessagesChan chan AlarmStatusChangedMessage, dispatcher MessageDispatcher, sendAlarmDigestMessagesChan chan SendAlarmDigestMessage) *sync.WaitGroup {
+	consumers := &sync.WaitGroup{}
+
 	alarmStatusChangedMessagesConsumers := props.FetchAsInt("alarmStatusChangedMessagesConsumers")
 	for i := 0; i < alarmStatusChangedMessagesConsumers; i++ {
 		consumerId := "alarmStatusChangedConsumer#" + strconv.Itoa(i)
-		go AlarmStatusChangedMessagesConsumer(alarmStatusChangedMessagesChan, consumerId, &alarmMessageWorkersByDistributionId)
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			AlarmStatusChangedMessagesConsumer(alarmStatusChangedMessagesChan, consumerId, dispatcher)
+		}()
 	}
 
 	sendAlarmDigestMessagesConsumers := props.FetchAsInt("sendAlarmDigestMessagesConsumers")
 	for i := 0; i < sendAlarmDigestMessagesConsumers; i++ {
 		consumerId := "sendAlarmDigestConsumer#" + strconv.Itoa(i)
-		go SendAlarmDigestMessagesConsumer(sendAlarmDigestMessagesChan, consumerId, &alarmMessageWorkersByDistributionId)
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			SendAlarmDigestMessagesConsumer(sendAlarmDigestMessagesChan, consumerId, dispatcher)
+		}()
+	}
+
+	return consumers
+}
+
+
+func registerWriteAheadLog(props *AppConfigProperties) *WriteAheadLog {
+	walDir := props.FetchAsString("walDir")
+	if len(walDir) == 0 {
+		log.Infof("write-ahead log is disabled\n")
+		return nil
 	}
+
+	wal, err := WriteAheadLogCreateNew(WriteAheadLogOptions{
+		Dir:           walDir,
+		SegmentBytes:  int64(props.FetchAsInt("walSegmentBytes")),
+		Fsync:         WalFsyncPolicy(props.FetchAsString("walFsync")),
+		FsyncInterval: props.FetchAsDuration("walFsyncIntervalMs"),
+	})
+	if err != nil {
+		panic(CouldNotOpenWriteAheadLogError{Msg: err.Error()})
+	}
+	wal.Start()
+
+	return wal
 }
 
 
-func registerWorkers(props *AppConfigProperties, alarmDigestMessagesChan chan AlarmDigestMessage) map[DistributionId]*AlarmMessageWorker {
+func registerTenants(props *AppConfigProperties) *TenantRegistry {
+	names := props.FetchAsStringList("tenants")
+	if len(names) == 0 {
+		log.Infof("multi-tenancy is disabled\n")
+		return nil
+	}
+
+	// Note: the defaults apply to every tenant, tenant.<name>.* override them.
+	quotas := make(map[string]TenantQuotas)
+	for _, name := range names {
+		overrides := props.Section(tenantSection + "." + name)
+		quotas[name] = TenantQuotas{
+			MaxUsers:           overrides.FetchAsIntOrDefault("maxUsers", props.FetchAsInt("tenantMaxUsers")),
+			MaxAlarms:          overrides.FetchAsIntOrDefault("maxAlarms", props.FetchAsInt("tenantMaxAlarms")),
+			RateLimitPerSecond: float64(overrides.FetchAsIntOrDefault("rateLimitPerSecond", props.FetchAsInt("tenantRateLimitPerSecond"))),
+		}
+		log.Infof("tenant: %v, quotas: %+v\n", name, quotas[name])
+	}
+
+	return TenantRegistryCreateNew(quotas)
+}
+
+
+func registerWorkers(props *AppConfigProperties, alarmDigestMessagesChan chan AlarmDigestMessage, alarmEscalatedMessagesChan chan AlarmEscalatedMessage,
+	wal *WriteAheadLog, tenants *TenantRegistry) *AlarmMessageWorkerPool {
 	alarmStatusChangedMessagesTotalWorkers := props.FetchAsInt("alarmStatusChangedMessagesTotalWorkers")
-	alarmMessageWorkersByDistributionId := make(map[DistributionId]*AlarmMessageWorker)
-	for i := 0; i < alarmStatusChangedMessagesTotalWorkers; i++ {
+	workersVirtualNodes := props.FetchAsInt("workersVirtualNodes")
+
+	alarmStatusChangedMessagesCapacity := props.FetchAsInt("alarmStatusChangedMessages")
+	sendAlarmDigestMessagesCapacity := props.FetchAsInt("sendAlarmDigestMessages")
+
+	historyOptions := AlarmHistoryOptions{
+		MaxTransitions: props.FetchAsInt("historyMaxTransitions"),
+		MaxAge:         props.FetchAsDuration("historyMaxAgeMs"),
+	}
+
+	digestReplayOptions := AlarmDigestReplayOptions{
+		RequestIdWindow: props.FetchAsDuration("digestRequestIdWindowMs"),
+		LastDigestTtl:   props.FetchAsDuration("lastDigestTtlMs"),
+	}
+
+	deliveryOptions := digestDeliveryOptions(props)
+	escalationOptions := alarmEscalationOptions(props)
 
-		alarmStatusChangedMessages := make(chan AlarmStatusChangedMessage, props.FetchAsInt("alarmStatusChangedMessages"))
-		sendAlarmDigestMessages := make(chan SendAlarmDigestMessage, props.FetchAsInt("sendAlarmDigestMessages"))
+	// Note: the factory is used also for the workers which get added at runtime (resharding).
+	return AlarmMessageWorkerPoolCreateNew(alarmStatusChangedMessagesTotalWorkers, workersVirtualNodes, func(i int) *AlarmMessageWorker {
+
+		alarmStatusChangedMessages := make(chan AlarmStatusChangedMessage, alarmStatusChangedMessagesCapacity)
+		sendAlarmDigestMessages := make(chan SendAlarmDigestMessage, sendAlarmDigestMessagesCapacity)
 
 		workerName := "alarmMessagesWorker#" + strconv.Itoa(i)
 		worker := AlarmMessageWorkerCreateNew(&workerName, &i, &alarmStatusChangedMessages, &sendAlarmDigestMessages, &alarmDigestMessagesChan)
+		if wal != nil {
+			worker.EnableWriteAheadLog(wal)
+		}
+		worker.KeepHistory(historyOptions)
+		worker.RetainDigests(digestReplayOptions)
+		worker.RequireDeliveryConfirmation(deliveryOptions)
+		worker.IsolateTenants(tenants)
+		worker.EscalateAlarms(escalationOptions, &alarmEscalatedMessagesChan)
+		return worker
+	})
+}
+
+
+func alarmEscalationOptions(props *AppConfigProperties) AlarmEscalationOptions {
+	rules, err := ParseEscalationRules(props.FetchAsStringList("escalationRules"))
+	if err != nil {
+		panic(InvalidConfigurationError{Msg: err.Error()})
+	}
+
+	return AlarmEscalationOptions{
+		Rules:              rules,
+		EvaluationInterval: props.FetchAsDuration("escalationEvaluationIntervalMs"),
+	}
+}
+
+func registerEscalator(props *AppConfigProperties, transport Transport, alarmMessageWorkerPool *AlarmMessageWorkerPool,
+	tenants *TenantRegistry, alarmEscalatedMessagesChan chan AlarmEscalatedMessage) *AlarmEscalator {
+
+	options := alarmEscalationOptions(props)
+	if len(options.Rules) == 0 {
+		log.Infof("alarm escalations are disabled\n")
+		return nil
+	}
+
+	escalator := AlarmEscalatorCreateNew(alarmMessageWorkerPool, transport, tenants, alarmEscalatedMessagesChan, options)
+	escalator.Start()
+	return escalator
+}
+
+func digestDeliveryOptions(props *AppConfigProperties) AlarmDigestDeliveryOptions {
+	return AlarmDigestDeliveryOptions{
+		Mode:           DigestDeliveryMode(props.FetchAsString("digestDeliveryMode")),
+		ConfirmTimeout: props.FetchAsDuration("digestConfirmTimeoutMs"),
+		Unconfirmed:    UnconfirmedDigestPolicy(props.FetchAsString("digestUnconfirmedPolicy")),
+		MaxResends:     props.FetchAsInt("digestMaxResends"),
+		StreamName:     props.FetchAsString("digestStreamName"),
+	}
+}
+
+func registerDigestDeliveryTracker(props *AppConfigProperties, transport Transport, alarmMessageWorkerPool *AlarmMessageWorkerPool, tenants *TenantRegistry) *AlarmDigestDeliveryTracker {
+	options := digestDeliveryOptions(props)
+	if options.Mode == DigestDeliveryFireAndForget {
+		log.Infof("digest delivery confirmations are disabled\n")
+		return nil
+	}
+
+	tracker, err := AlarmDigestDeliveryTrackerCreateNew(alarmMessageWorkerPool, transport, tenants, options)
+	if err != nil {
+		panic(CouldNotSetupDigestDeliveryError{Msg: err.Error()})
+	}
+	tracker.Start()
+
+	return tracker
+}
+
+
+func registerSnapshotter(props *AppConfigProperties, alarmMessageWorkerPool *AlarmMessageWorkerPool, wal *WriteAheadLog) *AlarmStateSnapshotter {
+	snapshotDir := props.FetchAsString("snapshotDir")
+	if len(snapshotDir) == 0 {
+		log.Infof("snapshots are disabled\n")
+		return nil
+	}
+
+	snapshotter := AlarmStateSnapshotterCreateNew(alarmMessageWorkerPool, snapshotDir, props.FetchAsDuration("snapshotIntervalMs"))
+	snapshotter.Restore()
+	if wal != nil {
+		// Note: the entries since the latest snapshots, on top of them.
+		wal.Replay(alarmMessageWorkerPool)
+		snapshotter.UseWriteAheadLog(wal)
+	}
+	snapshotter.Start()
+
+	return snapshotter
+}
+
+
+func registerHotUserThrottler(props *AppConfigProperties, alarmMessageWorkerPool *AlarmMessageWorkerPool) *HotUserThrottler {
+	hotUserRateLimitPerSecond := props.FetchAsInt("hotUserRateLimitPerSecond")
+	if hotUserRateLimitPerSecond <= 0 {
+		log.Infof("hot user throttling is disabled\n")
+		return nil
+	}
+
+	hotUserThrottler := HotUserThrottlerCreateNew(alarmMessageWorkerPool, HotUserThrottlerOptions{
+		RatePerSecond:         float64(hotUserRateLimitPerSecond),
+		Burst:                 props.FetchAsInt("hotUserBurst"),
+		Mode:                  HotUserMode(props.FetchAsString("hotUserMode")),
+		Exemptions:            props.FetchAsStringList("hotUserExemptions"),
+		CoalesceFlushInterval: props.FetchAsDuration("hotUserCoalesceFlushIntervalMs"),
+		OverflowCooldown:      props.FetchAsDuration("hotUserOverflowCooldownMs"),
+	})
+	hotUserThrottler.Start()
+
+	return hotUserThrottler
+}
+
+
+func registerAutoscaler(props *AppConfigProperties, alarmMessageWorkerPool *AlarmMessageWorkerPool) *AlarmMessageWorkerAutoscaler {
+	if !props.FetchAsBool("autoscalerEnabled") {
+		log.Infof("autoscaler is disabled\n")
+		return nil
+	}
+
+	autoscaler := AlarmMessageWorkerAutoscalerCreateNew(alarmMessageWorkerPool, autoscalerOptions(props))
+	autoscaler.Start()
+
+	return autoscaler
+}
+
+func autoscalerOptions(props *AppConfigProperties) AutoscalerOptions {
+	return AutoscalerOptions{
+		MinWorkers:                         props.FetchAsInt("autoscalerMinWorkers"),
+		MaxWorkers:                         props.FetchAsInt("autoscalerMaxWorkers"),
+		SampleInterval:                     props.FetchAsDuration("autoscalerSampleIntervalMs"),
+		ScaleUpMailboxUtilizationPercent:   props.FetchAsInt("autoscalerScaleUpMailboxUtilizationPercent"),
+		ScaleDownMailboxUtilizationPercent: props.FetchAsInt("autoscalerScaleDownMailboxUtilizationPercent"),
+		ScaleUpLatency:                     props.FetchAsDuration("autoscalerScaleUpLatencyMs"),
+		ScaleDownSamples:                   props.FetchAsInt("autoscalerScaleDownSamples"),
+	}
+}
+
+
+func registerRetentionSweeper(props *AppConfigProperties, alarmMessageWorkerPool *AlarmMessageWorkerPool) *AlarmRetentionSweeper {
+	retentionSweeper := AlarmRetentionSweeperCreateNew(alarmMessageWorkerPool, retentionOptions(props))
+	retentionSweeper.Start()
+
+	return retentionSweeper
+}
+
+func retentionOptions(props *AppConfigProperties) AlarmRetentionOptions {
+	return AlarmRetentionOptions{
+		ClearedAlarmTtl:    props.FetchAsDuration("retentionClearedAlarmTtlMs"),
+		IdleUserTtl:        props.FetchAsDuration("retentionIdleUserTtlMs"),
+		MaxAlarmsPerWorker: props.FetchAsInt("retentionMaxAlarmsPerWorker"),
+		SweepInterval:      props.FetchAsDuration("retentionSweepIntervalMs"),
+	}
+}
+
+
+func registerConfigWatcher(props *AppConfigProperties, hotUserThrottler *HotUserThrottler, autoscaler *AlarmMessageWorkerAutoscaler, retentionSweeper *AlarmRetentionSweeper) *ConfigWatcher {
+	configWatcher := ConfigWatcherCreateNew(*props, AlarmServiceConfigSchema)
+
+	configWatcher.OnReload(func(props AppConfigProperties, changed map[string]bool) error {
+		if changed["logLevel"] || changed["logFormat"] || changed["logMessageSampling"] {
+			applyLogSettings(&props)
+		}
+		return nil
+	})
+
+	// Note: enabling or disabling the hot user throttling (hotUserRateLimitPerSecond=0) needs a restart, so its changes are
+	//		 rejected like the non-reloadable ones (the running values are kept).
+	configWatcher.RequireRestart(func(next AppConfigProperties) bool {
+		return hotUserThrottler == nil
+	}, "hotUserRateLimitPerSecond", "hotUserBurst", "hotUserExemptions", "hotUserOverflowCooldownMs")
+	configWatcher.RequireRestart(func(next AppConfigProperties) bool {
+		return next.FetchAsInt("hotUserRateLimitPerSecond") <= 0
+	}, "hotUserRateLimitPerSecond")
+
+	configWatcher.OnReload(func(props AppConfigProperties, changed map[string]bool) error {
+		if !changed["hotUserRateLimitPerSecond"] && !changed["hotUserBurst"] && !changed["hotUserExemptions"] && !changed["hotUserOverflowCooldownMs"] {
+			return nil
+		}
+
+		hotUserThrottler.SetLimits(float64(props.FetchAsInt("hotUserRateLimitPerSecond")), props.FetchAsInt("hotUserBurst"),
+			props.FetchAsStringList("hotUserExemptions"), props.FetchAsDuration("hotUserOverflowCooldownMs"))
+		return nil
+	})
+
+	configWatcher.OnReload(func(props AppConfigProperties, changed map[string]bool) error {
+		if autoscaler != nil {
+			autoscaler.SetOptions(autoscalerOptions(&props))
+		}
+		return nil
+	})
 
-		go worker.Consume()
-		alarmMessageWorkersByDistributionId[DistributionId(i)] = worker
+	configWatcher.OnReload(func(props AppConfigProperties, changed map[string]bool) error {
+		retentionSweeper.SetOptions(retentionOptions(&props))
+		return nil
+	})
 
+	configWatcher.Start(props.FetchAsDuration("configReloadIntervalMs"))
+
+	return configWatcher
+}
+
+func registerTracing(props *AppConfigProperties) func() {
+	stopTracing, err := SetupTracing(TracingOptions{
+		Exporter:      props.FetchAsString("tracingExporter"),
+		File:          props.FetchAsString("tracingFile"),
+		SampleRatio:   float64(props.FetchAsInt("tracingSamplePercent")) / 100,
+		ShutdownAfter: 5 * time.Second,
+	})
+	if err != nil {
+		panic(CouldNotSetupTracingError{Msg: err.Error()})
+	}
+
+	return stopTracing
+}
+
+func registerLogFile(props *AppConfigProperties) *RotatingFileWriter {
+	logFile := props.FetchAsString("logFile")
+	if len(logFile) == 0 {
+		return nil
+	}
+
+	writer, err := RotatingFileWriterCreateNew(logFile, int64(props.FetchAsInt("logFileMaxSizeMb"))*1024*1024, props.FetchAsInt("logFileMaxBackups"))
+	if err != nil {
+		log.Fatal(err)
 	}
-	return alarmMessageWorkersByDistributionId
+	log.SetOutput(writer)
+
+	return writer
 }
 
+func applyLogSettings(props *AppConfigProperties) {
+	level, err := log.ParseLevel(props.FetchAsString("logLevel"))
+	if err != nil {
+		panic(InvalidConfigurationError{Msg: err.Error()})
+	}
+	log.SetLevel(level)
 
-func registerProducers(props *AppConfigProperties, serverConnection *nats.Conn, alarmDigestMessagesChan chan AlarmDigestMessage) {
+	if props.FetchAsString("logFormat") == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
+	}
+
+	SetMessageLogSampling(props.FetchAsInt("logMessageSampling"))
+}
+
+
+func registerWorkersHealthChecks(props *AppConfigProperties, healthChecks *HealthChecks, alarmMessageWorkerPool *AlarmMessageWorkerPool) {
+	livenessThreshold := props.FetchAsDuration("livenessThresholdMs")
+
+	healthChecks.AddReadinessCheck("workers", alarmMessageWorkerPool.CheckWorkersStarted)
+	healthChecks.AddLivenessCheck("workers", func() error {
+		return alarmMessageWorkerPool.CheckWorkersProgress(livenessThreshold)
+	})
+}
+
+func registerProducersHealthChecks(props *AppConfigProperties, healthChecks *HealthChecks, producers []*AlarmDigestMessageProducer) {
+	livenessThreshold := props.FetchAsDuration("livenessThresholdMs")
+
+	healthChecks.AddLivenessCheck("producers", func() error {
+		for _, producer := range producers {
+			if err := producer.CheckNotBlocked(livenessThreshold); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+
+func registerAdminServer(props *AppConfigProperties, alarmMessageWorkerPool *AlarmMessageWorkerPool, healthChecks *HealthChecks, tenants *TenantRegistry) *AdminServer {
+	adminHttpPort := props.FetchAsInt("adminHttpPort")
+	if adminHttpPort < 0 {
+		log.Infof("admin server is disabled\n")
+		return nil
+	}
+
+	adminServer, err := AdminServerCreateNew(adminHttpPort)
+	if err != nil {
+		panic(CouldNotStartAdminServerError{Msg: err.Error()})
+	}
+	adminServer.RegisterWorkerPoolEndpoints(alarmMessageWorkerPool)
+	adminServer.RegisterHistoryEndpoints(alarmMessageWorkerPool)
+	if tenants != nil {
+		adminServer.RegisterTenantEndpoints(tenants)
+	}
+	adminServer.RegisterMetricsEndpoint(DefaultRegistry)
+	adminServer.RegisterHealthEndpoints(healthChecks)
+	adminServer.Start()
+
+	return adminServer
+}
+
+
+func registerProducers(props *AppConfigProperties, transport Transport, alarmDigestMessagesChan chan AlarmDigestMessage, digestDeliveryTracker *AlarmDigestDeliveryTracker, tenants *TenantRegistry) []*AlarmDigestMessageProducer {
 	alarmDigestMessageProducers := props.FetchAsInt("alarmDigestMessageProducers")
+
+	producers := make([]*AlarmDigestMessageProducer, 0, alarmDigestMessageProducers)
 	for i := 0; i < alarmDigestMessageProducers; i++ {
 
 		workerName := "alarmDigestMessageProducer#" + strconv.Itoa(i)
-		topicName := AlarmDigestTopic
-		worker := AlarmDigestMessageProducerCreateNew(&workerName, &i, &topicName, serverConnection, &alarmDigestMessagesChan)
+		topicName := Topics().AlarmDigest
+		worker := AlarmDigestMessageProducerCreateNew(&workerName, &i, &topicName, transport, &alarmDigestMessagesChan)
+		worker.TrackDeliveries(digestDeliveryTracker)
+		worker.IsolateTenants(tenants)
 
 		go worker.Produce()
+		producers = append(producers, worker)
 	}
+
+	return producers
 }
 
 
@@ -2,13 +2,19 @@ package main
 
 import (
 	"alarm/domain"
-	. "alarm/error"
 	. "alarm/fileutil"
 	. "alarm/message"
+	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -29,27 +35,45 @@ import (
 
  */
 func TestBootstrapAlarmService_integrationTest1(t *testing.T) {
+	t.Parallel()
 
+	// get the transport on top of nats server (embedded by default)
+	integrationTest1(t, testNatsTransport(t))
+}
 
+func TestBootstrapAlarmService_integrationTest1_inMemoryTransport(t *testing.T) {
+	t.Parallel()
 
-	// given
-
-
-	// get the connection to nats server
-	serverConnection, err := ServerConnection()
-	if err != nil {
-		panic(CouldNotConnectToServerError{Msg: err.Error()})
-	}
+	transport := InMemoryTransportCreateNew()
 	defer func() {
-		log.Debugf("[DEFER-CLEAR-RESOURCES] will close nats server connection now...")
-		serverConnection.Close()
+		_ = transport.Drain()
 	}()
 
+	integrationTest1(t, transport)
+}
+
+func integrationTest1(t *testing.T, transport Transport) {
+
+	// given
+
 	// get properties
-	props := ReadPropertiesFile("test-config.properties")
-	props.PrintInfo()
+	props := LoadAlarmServiceConfig("test-config.properties", nil)
 
-	go BootstrapAlarmService(serverConnection, &props, false)
+	go BootstrapAlarmService(transport, &props, false)
+	waitForServiceSubscriptions(t, transport, &props)
+
+
+	var totalMessagesReceived uint64 = 0
+
+	sub := RegisterAlarmDigestTopicListener("testRegisterAlarmDigestListener", transport,
+		AlarmDigestTopic, true, func(message AlarmDigestMessage) {
+
+			fmt.Printf("~~~received alarm digest message %v~~~\n", message)
+			atomic.AddUint64(&totalMessagesReceived, 1)
+		})
+	defer func() {
+		AsyncUnsubscribe(sub, sub.Subject())
+	}()
 
 
 	alarmStatusChangedListeners := props.FetchAsInt("alarmStatusChangedListeners")
@@ -60,7 +84,7 @@ func TestBootstrapAlarmService_integrationTest1(t *testing.T) {
 	// user X
 	alarmIdX, _ := uuid.NewUUID()
 	userIdX, _ := uuid.NewUUID()
-	_, _ = EmulateAlarmStatusChangedMessage(serverConnection, &domain.Alarm{
+	_, _ = EmulateAlarmStatusChangedMessage(transport, &domain.Alarm{
 		Id:        domain.AlarmId(alarmIdX.String()),
 		UserId:    domain.UserId(userIdX.String()),
 		Status:    domain.CRITICAL,
@@ -70,7 +94,7 @@ func TestBootstrapAlarmService_integrationTest1(t *testing.T) {
 	// user Y
 	alarmIdY, _ := uuid.NewUUID()
 	userIdY, _ := uuid.NewUUID()
-	_, _ = EmulateAlarmStatusChangedMessage(serverConnection, &domain.Alarm{
+	_, _ = EmulateAlarmStatusChangedMessage(transport, &domain.Alarm{
 		Id:        domain.AlarmId(alarmIdY.String()),
 		UserId:    domain.UserId(userIdY.String()),
 		Status:    domain.WARNING,
@@ -80,14 +104,14 @@ func TestBootstrapAlarmService_integrationTest1(t *testing.T) {
 	// user Z
 	alarmIdZ, _ := uuid.NewUUID()
 	userIdZ, _ := uuid.NewUUID()
-	_, _ = EmulateAlarmStatusChangedMessage(serverConnection, &domain.Alarm{
+	_, _ = EmulateAlarmStatusChangedMessage(transport, &domain.Alarm{
 		Id:        domain.AlarmId(alarmIdZ.String()),
 		UserId:    domain.UserId(userIdZ.String()),
 		Status:    domain.CRITICAL,
 		CreatedAt: time.Now(),
 	}, time.Now(), alarmStatusChangedListeners)
 
-	_, _ = EmulateAlarmStatusChangedMessage(serverConnection, &domain.Alarm{
+	_, _ = EmulateAlarmStatusChangedMessage(transport, &domain.Alarm{
 		Id:        domain.AlarmId(alarmIdZ.String()),
 		UserId:    domain.UserId(userIdZ.String()),
 		Status:    domain.CLEARED,
@@ -96,29 +120,17 @@ func TestBootstrapAlarmService_integrationTest1(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 400)
 
-	_, _ = EmulateSendAlarmDigestMessage(serverConnection, userIdX.String(), sendAlarmDigestListeners)
+	_, _ = EmulateSendAlarmDigestMessage(transport, userIdX.String(), sendAlarmDigestListeners)
 
-	_, _ = EmulateSendAlarmDigestMessage(serverConnection, userIdY.String(), sendAlarmDigestListeners)
+	_, _ = EmulateSendAlarmDigestMessage(transport, userIdY.String(), sendAlarmDigestListeners)
 
-	_, _ = EmulateSendAlarmDigestMessage(serverConnection, userIdZ.String(), sendAlarmDigestListeners)
+	_, _ = EmulateSendAlarmDigestMessage(transport, userIdZ.String(), sendAlarmDigestListeners)
 
 
 
 
 
 	// then
-	var totalMessagesReceived uint64 = 0
-
-	sub := RegisterAlarmDigestTopicListener("testRegisterAlarmDigestListener", serverConnection,
-		AlarmDigestTopic, true, func(message AlarmDigestMessage) {
-
-			fmt.Printf("~~~received alarm digest message %v~~~\n", message)
-			atomic.AddUint64(&totalMessagesReceived, 1)
-		})
-	defer func() {
-		AsyncUnsubscribe(sub, sub.Subject)
-	}()
-
 	tries := 15
 	currentTry := 0
 	for {
@@ -145,3 +157,277 @@ func TestBootstrapAlarmService_integrationTest1(t *testing.T) {
 
 
 }
+
+
+/*
+	The scenarios of the verify command (see trafficVerifiers.go and scenarios/) against the service.
+*/
+func TestBootstrapAlarmService_verificationScenarios(t *testing.T) {
+	t.Parallel()
+
+	scenarios, err := LoadScenarios("scenarios/specification.yaml")
+	if err != nil {
+		t.Fatalf("could not load scenarios, error: %v", err)
+	}
+	scenarios = append(scenarios, DefaultVerificationScenarios()...)
+
+	// given
+	transport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	props := LoadAlarmServiceConfig("test-config.properties", nil)
+
+	go BootstrapAlarmService(transport, &props, false)
+	waitForServiceSubscriptions(t, transport, &props)
+
+
+	// when
+	results := VerifyScenarios(transport, scenarios, VerificationOptions{
+		ReplayOptions: ReplayOptions{StepDelay: 20 * time.Millisecond},
+		Timeout:       5 * time.Second,
+		Grace:         100 * time.Millisecond,
+	})
+
+
+	// then
+	if len(results) != len(scenarios) {
+		t.Fatalf("expected a result per scenario, got: %v", results)
+	}
+	for _, result := range results {
+		if !result.Passed {
+			t.Errorf("scenario: %v failed: %v", result.Scenario, result.Failures)
+		}
+	}
+}
+
+
+/*
+	Scenario:
+
+	* the service runs with snapshots, write-ahead log and a hot user throttler (so messages wait in every buffer)
+	* AlarmStatusChanged messages of new alarms are published continuously
+	* SIGTERM is received while they are still being published
+
+	* Make sure the service stops without panics, and that after a restart every message the listener has received is
+	  in the restored state
+*/
+func TestBootstrapAlarmService_gracefulShutdownWhilePublishing(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := t.TempDir()
+	overrides := PropertyOverrides{
+		"snapshotDir":               filepath.Join(dir, "snapshots"),
+		"walDir":                    filepath.Join(dir, "wal"),
+		"hotUserRateLimitPerSecond": "50",
+		"hotUserBurst":              "10",
+		"adminHttpPort":             "-1",
+	}
+	props := LoadAlarmServiceConfig("test-config.properties", overrides)
+
+	transport := &receivedCountingTransport{InMemoryTransport: InMemoryTransportCreateNew(), subject: Topics().Shard(Topics().AlarmStatusChanged, 0)}
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		runAlarmService(transport, &props, false, stop)
+	}()
+	waitForServiceSubscriptions(t, transport, &props)
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; ; i++ {
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			data, _ := json.Marshal(AlarmStatusChangedMessage{UserId: "u1", AlarmId: "a" + strconv.Itoa(i), Status: "CRITICAL", ChangedAt: time.Now()})
+			_ = PublishMessage(transport, transport.subject, data)
+		}
+	}()
+
+
+	// when
+	for atomic.LoadInt64(&transport.received) < 200 {
+		time.Sleep(time.Millisecond)
+	}
+	stop <- syscall.SIGTERM
+
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("the service did not stop")
+	}
+	<-published
+	received := atomic.LoadInt64(&transport.received)
+
+
+	// then - restarted on the same snapshots and write-ahead log
+	restartedTransport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = restartedTransport.Drain()
+	}()
+	restartedStop := make(chan os.Signal, 1)
+	restarted := make(chan struct{})
+	go func() {
+		defer close(restarted)
+		runAlarmService(restartedTransport, &props, false, restartedStop)
+	}()
+	defer func() {
+		restartedStop <- syscall.SIGTERM
+		<-restarted
+	}()
+	waitForServiceSubscriptions(t, restartedTransport, &props)
+
+	query, _ := json.Marshal(AlarmQueryMessage{UserId: "u1"})
+	reply, err := restartedTransport.Request(&TransportMessage{Subject: Topics().AlarmQueryStats, Data: query}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("could not query the restored state, error: %v", err)
+	}
+	var stats AlarmQueryReply
+	if err := json.Unmarshal(reply.Data, &stats); err != nil || stats.Stats == nil {
+		t.Fatalf("unexpected reply: %v, error: %v", string(reply.Data), err)
+	}
+	if int64(stats.Stats.Alarms) != received {
+		t.Errorf("the restored state should have every received message, received: %v, restored alarms: %v", received, stats.Stats.Alarms)
+	}
+}
+
+/*
+	Scenario:
+
+	* the service restores its workers from a snapshot which can not be read yet (a named pipe, nothing written to it)
+
+	* Make sure /readyz fails with the restore while it runs, and passes it once the snapshot has been read
+*/
+func TestBootstrapAlarmService_notReadyWhileRestoring(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := t.TempDir()
+	snapshotDir := filepath.Join(dir, "snapshots")
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		t.Fatalf("could not create the snapshot dir, error: %v", err)
+	}
+	pendingSnapshot := filepath.Join(snapshotDir, "worker-0.snapshot")
+	if err := syscall.Mkfifo(pendingSnapshot, 0644); err != nil {
+		t.Fatalf("could not create the snapshot pipe, error: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("could not find a free port, error: %v", err)
+	}
+	adminHttpPort := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	overrides := PropertyOverrides{
+		"snapshotDir":   snapshotDir,
+		"adminHttpPort": strconv.Itoa(adminHttpPort),
+	}
+	props := LoadAlarmServiceConfig("test-config.properties", overrides)
+
+	transport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		runAlarmService(transport, &props, false, stop)
+	}()
+	defer func() {
+		stop <- syscall.SIGTERM
+		<-stopped
+	}()
+	// Note: also when the test fails, otherwise the restore blocks the stop.
+	var released sync.Once
+	releaseSnapshot := func() {
+		released.Do(func() {
+			pipe, err := os.OpenFile(pendingSnapshot, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatalf("could not open the snapshot pipe, error: %v", err)
+			}
+			_ = pipe.Close()
+		})
+	}
+	defer releaseSnapshot()
+	readyz := "http://127.0.0.1:" + strconv.Itoa(adminHttpPort) + "/readyz"
+
+
+	// when
+	statusCode, checks := waitForReadiness(t, readyz)
+
+
+	// then - the restore blocks on the snapshot
+	if statusCode != http.StatusServiceUnavailable || checks["restore"] != "restoring the state of the workers" {
+		t.Errorf("expected the restore to fail readiness, got: %v %v", statusCode, checks)
+	}
+
+
+	// when - the snapshot can be read (empty, so quarantined)
+	releaseSnapshot()
+	waitForServiceSubscriptions(t, transport, &props)
+
+
+	// then
+	for tries := 0; checks["restore"] != "ok"; tries++ {
+		if tries > 100 {
+			t.Fatalf("expected the restore to pass readiness, got: %v", checks)
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, checks = waitForReadiness(t, readyz)
+	}
+}
+
+// waitForReadiness returns the first answer of the readiness endpoint, once the admin server listens.
+func waitForReadiness(t *testing.T, url string) (int, map[string]string) {
+	for tries := 0; ; tries++ {
+		response, err := http.Get(url)
+		if err != nil {
+			if tries > 100 {
+				t.Fatalf("the admin server did not start, error: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		var report struct {
+			Checks map[string]string
+		}
+		err = json.NewDecoder(response.Body).Decode(&report)
+		_ = response.Body.Close()
+		if err != nil {
+			t.Fatalf("could not decode the readiness report, error: %v", err)
+		}
+		return response.StatusCode, report.Checks
+	}
+}
+
+// receivedCountingTransport counts the messages the handlers of the subject have returned from.
+type receivedCountingTransport struct {
+	*InMemoryTransport
+
+	subject  string
+	received int64
+}
+
+func (t *receivedCountingTransport) Subscribe(subject string, handler func(msg *TransportMessage)) (TransportSubscription, error) {
+	if subject != t.subject {
+		return t.InMemoryTransport.Subscribe(subject, handler)
+	}
+	return t.InMemoryTransport.Subscribe(subject, func(msg *TransportMessage) {
+		handler(msg)
+		atomic.AddInt64(&t.received, 1)
+	})
+}
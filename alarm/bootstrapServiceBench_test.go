@@ -1,10 +1,7 @@
 package main
 
 import (
-	. "alarm/error"
-	. "alarm/fileutil"
 	. "alarm/message"
-	log "github.com/sirupsen/logrus"
 	"testing"
 	"time"
 )
@@ -17,21 +14,14 @@ func BenchmarkTestBootstrapAlarmService_1(t *testing.B) {
 	// given
 
 
-	// get the connection to nats server
-	serverConnection, err := ServerConnection()
-	if err != nil {
-		panic(CouldNotConnectToServerError{Msg: err.Error()})
-	}
-	defer func() {
-		log.Debugf("[DEFER-CLEAR-RESOURCES] will close nats server connection now...")
-		serverConnection.Close()
-	}()
+	// get the transport on top of nats server (embedded by default)
+	transport := testNatsTransport(t)
 
 	// get properties
-	props := ReadPropertiesFile("test-config-bench.properties")
-	props.PrintInfo()
+	props := LoadAlarmServiceConfig("test-config-bench.properties", nil)
 
-	go BootstrapAlarmService(serverConnection, &props, false)
+	go BootstrapAlarmService(transport, &props, false)
+	waitForServiceSubscriptions(t, transport, &props)
 
 
 
@@ -39,7 +29,7 @@ func BenchmarkTestBootstrapAlarmService_1(t *testing.B) {
 	// when - then
 	alarmStatusChangedListeners := props.FetchAsInt("alarmStatusChangedListeners")
 	sendAlarmDigestListeners := props.FetchAsInt("sendAlarmDigestListeners")
-	EmulateTraffic(200, serverConnection, alarmStatusChangedListeners, sendAlarmDigestListeners, 60, 15)
+	EmulateTraffic(200, transport, alarmStatusChangedListeners, sendAlarmDigestListeners, 60, 15)
 
 
 
@@ -0,0 +1,32 @@
+package main
+
+import (
+	. "alarm/error"
+	. "alarm/fileutil"
+	"flag"
+	"fmt"
+)
+
+func configCommand(args []string) {
+
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Println("Usage: alarm config check [flags]")
+		panic(InvalidCommandError{Msg: "unknown config command, expected: check"})
+	}
+
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	configFile, configOverrides := configFlags(flags)
+	_ = flags.Parse(args[1:])
+
+
+	// Note: the same precedence as serve (flags > ALARM_* env variables > config file), so the effective config is checked.
+	props, err := LoadConfig(*configFile, AlarmServiceConfigSchema, configEnvPrefix, configOverrides)
+	if err != nil {
+		panic(InvalidConfigurationError{Msg: err.Error()})
+	}
+
+	for _, line := range props.EffectiveConfig(AlarmServiceConfigSchema) {
+		fmt.Println(line)
+	}
+	fmt.Printf("\nconfig: %v is valid\n", *configFile)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	. "alarm/error"
+	. "alarm/fileutil"
+	. "alarm/message"
+	. "alarm/tracing"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// the section of the per tenant quotas, eg: tenant.productA.maxUsers=1000
+const tenantSection = "tenant"
+
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// the prefix of the env variables which override the properties, eg: ALARM_ADMIN_HTTP_PORT
+const configEnvPrefix = "ALARM"
+
+var AlarmServiceConfigSchema = ConfigSchema{
+	Properties: []ConfigProperty{
+
+		// logging & config
+		{Label: "logLevel", Kind: StringProperty, Default: Default("info"), Allowed: []string{"panic", "fatal", "error", "warn", "info", "debug", "trace"}, Reloadable: true},
+		{Label: "logFormat", Kind: StringProperty, Default: Default("text"), Allowed: []string{"text", "json"}, Reloadable: true},
+		{Label: "logMessageSampling", Kind: IntProperty, Default: Default("1"), Min: Limit(1), Reloadable: true},
+		{Label: "logFile", Kind: StringProperty, Default: Default("")},
+		{Label: "logFileMaxSizeMb", Kind: IntProperty, Default: Default("100"), Min: Limit(1)},
+		{Label: "logFileMaxBackups", Kind: IntProperty, Default: Default("5"), Min: Limit(0)},
+		{Label: "configReloadIntervalMs", Kind: DurationProperty, Default: Default("0"), Min: Limit(0)},
+
+		// tracing
+		{Label: "tracingExporter", Kind: StringProperty, Default: Default(NoExporter), Allowed: []string{NoExporter, StdoutExporter, FileExporter}},
+		{Label: "tracingFile", Kind: StringProperty, Default: Default("traces.json")},
+		{Label: "tracingSamplePercent", Kind: IntProperty, Default: Default("100"), Min: Limit(0), Max: Limit(100)},
+
+		// nats
+		{Label: "natsUrl", Kind: StringProperty, Default: Default(nats.DefaultURL), Secret: true}, // Note: may contain credentials
+
+		// channels
+		{Label: "alarmStatusChangedMessagesChan", Kind: IntProperty, Default: Default("500"), Min: Limit(0)},
+		{Label: "sendAlarmDigestMessagesChan", Kind: IntProperty, Default: Default("500"), Min: Limit(0)},
+		{Label: "alarmDigestMessagesChan", Kind: IntProperty, Default: Default("500"), Min: Limit(0)},
+		{Label: "alarmEscalatedMessagesChan", Kind: IntProperty, Default: Default("500"), Min: Limit(0)},
+		{Label: "alarmStatusChangedMessages", Kind: IntProperty, Default: Default("75"), Min: Limit(1)},
+		{Label: "sendAlarmDigestMessages", Kind: IntProperty, Default: Default("75"), Min: Limit(1)},
+
+		// workers
+		{Label: "alarmDigestMessageProducers", Kind: IntProperty, Default: Default("1"), Min: Limit(1)},
+		{Label: "alarmStatusChangedMessagesTotalWorkers", Kind: IntProperty, Default: Default("30"), Min: Limit(1)},
+		{Label: "workersVirtualNodes", Kind: IntProperty, Default: Default("100"), Min: Limit(1)},
+
+		// snapshots
+		{Label: "snapshotDir", Kind: StringProperty, Default: Default("")},
+		{Label: "snapshotIntervalMs", Kind: DurationProperty, Default: Default("60000"), Min: Limit(0)},
+
+		// write-ahead log
+		{Label: "walDir", Kind: StringProperty, Default: Default("")},
+		{Label: "walFsync", Kind: StringProperty, Default: Default(string(WalFsyncInterval)), Allowed: []string{string(WalFsyncAlways), string(WalFsyncInterval), string(WalFsyncNever)}},
+		{Label: "walFsyncIntervalMs", Kind: DurationProperty, Default: Default("1000"), Min: Limit(1)},
+		{Label: "walSegmentBytes", Kind: IntProperty, Default: Default("16777216"), Min: Limit(1024)},
+
+		// autoscaler
+		{Label: "autoscalerEnabled", Kind: BoolProperty, Default: Default("false")},
+		{Label: "autoscalerMinWorkers", Kind: IntProperty, Default: Default("10"), Min: Limit(1), Reloadable: true},
+		{Label: "autoscalerMaxWorkers", Kind: IntProperty, Default: Default("100"), Min: Limit(1), Reloadable: true},
+		{Label: "autoscalerSampleIntervalMs", Kind: DurationProperty, Default: Default("1000"), Min: Limit(1)},
+		{Label: "autoscalerScaleUpMailboxUtilizationPercent", Kind: IntProperty, Default: Default("70"), Min: Limit(0), Max: Limit(100), Reloadable: true},
+		{Label: "autoscalerScaleUpLatencyMs", Kind: DurationProperty, Default: Default("50"), Min: Limit(0), Reloadable: true},
+		{Label: "autoscalerScaleDownMailboxUtilizationPercent", Kind: IntProperty, Default: Default("5"), Min: Limit(0), Max: Limit(100), Reloadable: true},
+		{Label: "autoscalerScaleDownSamples", Kind: IntProperty, Default: Default("30"), Min: Limit(1), Reloadable: true},
+
+		// retention
+		{Label: "retentionClearedAlarmTtlMs", Kind: DurationProperty, Default: Default("0"), Min: Limit(0), Reloadable: true},
+		{Label: "retentionIdleUserTtlMs", Kind: DurationProperty, Default: Default("0"), Min: Limit(0), Reloadable: true},
+		{Label: "retentionMaxAlarmsPerWorker", Kind: IntProperty, Default: Default("0"), Min: Limit(0), Reloadable: true},
+		{Label: "retentionSweepIntervalMs", Kind: DurationProperty, Default: Default("60000"), Min: Limit(1)},
+
+		// history
+		{Label: "historyMaxTransitions", Kind: IntProperty, Default: Default("0"), Min: Limit(0)},
+		{Label: "historyMaxAgeMs", Kind: DurationProperty, Default: Default("86400000"), Min: Limit(0)},
+
+		// digests
+		{Label: "digestRequestIdWindowMs", Kind: DurationProperty, Default: Default("0"), Min: Limit(0)},
+		{Label: "lastDigestTtlMs", Kind: DurationProperty, Default: Default("0"), Min: Limit(0)},
+		{Label: "digestDeliveryMode", Kind: StringProperty, Default: Default(string(DigestDeliveryFireAndForget)), Allowed: []string{string(DigestDeliveryFireAndForget), string(DigestDeliveryConfirm), string(DigestDeliveryJetStream)}},
+		{Label: "digestConfirmTimeoutMs", Kind: DurationProperty, Default: Default("30000"), Min: Limit(1)},
+		{Label: "digestUnconfirmedPolicy", Kind: StringProperty, Default: Default(string(ResendUnconfirmedDigests)), Allowed: []string{string(ResendUnconfirmedDigests), string(MergeUnconfirmedDigests)}},
+		{Label: "digestMaxResends", Kind: IntProperty, Default: Default("3"), Min: Limit(0)},
+		{Label: "digestStreamName", Kind: StringProperty, Default: Default("ALARM_DIGESTS")},
+
+		// escalations
+		{Label: "escalationRules", Kind: StringListProperty, Default: Default("")},
+		{Label: "escalationEvaluationIntervalMs", Kind: DurationProperty, Default: Default("60000"), Min: Limit(1)},
+
+		// queries
+		{Label: "alarmQueryTimeoutMs", Kind: DurationProperty, Default: Default("2000"), Min: Limit(1)},
+
+		// tenants
+		{Label: "tenants", Kind: StringListProperty, Default: Default("")},
+		{Label: "tenantMaxUsers", Kind: IntProperty, Default: Default("0"), Min: Limit(0)},
+		{Label: "tenantMaxAlarms", Kind: IntProperty, Default: Default("0"), Min: Limit(0)},
+		{Label: "tenantRateLimitPerSecond", Kind: IntProperty, Default: Default("0"), Min: Limit(0)},
+
+		// hot users
+		{Label: "hotUserRateLimitPerSecond", Kind: IntProperty, Default: Default("0"), Min: Limit(0), Reloadable: true},
+		{Label: "hotUserBurst", Kind: IntProperty, Default: Default("400"), Min: Limit(1), Reloadable: true},
+		{Label: "hotUserMode", Kind: StringProperty, Default: Default(string(CoalesceHotUsers)), Allowed: []string{string(CoalesceHotUsers), string(OverflowHotUsers)}},
+		{Label: "hotUserExemptions", Kind: StringListProperty, Default: Default(""), Reloadable: true},
+		{Label: "hotUserCoalesceFlushIntervalMs", Kind: DurationProperty, Default: Default("100"), Min: Limit(1)},
+		{Label: "hotUserOverflowCooldownMs", Kind: DurationProperty, Default: Default("60000"), Min: Limit(0), Reloadable: true},
+
+		// consumers
+		{Label: "alarmStatusChangedMessagesConsumers", Kind: IntProperty, Default: Default("1"), Min: Limit(1)},
+		{Label: "sendAlarmDigestMessagesConsumers", Kind: IntProperty, Default: Default("1"), Min: Limit(1)},
+
+		// listeners
+		{Label: "alarmStatusChangedListeners", Kind: IntProperty, Default: Default("1"), Min: Limit(1)},
+		{Label: "sendAlarmDigestListeners", Kind: IntProperty, Default: Default("1"), Min: Limit(1)},
+
+		// subjects
+		{Label: "alarmStatusChangedSubject", Kind: StringProperty, Default: Default(AlarmStatusChangedTopic)},
+		{Label: "sendAlarmDigestSubject", Kind: StringProperty, Default: Default(SendAlarmDigestTopic)},
+		{Label: "alarmDigestSubject", Kind: StringProperty, Default: Default(AlarmDigestTopic)},
+		{Label: "alarmDigestDeliveredSubject", Kind: StringProperty, Default: Default(AlarmDigestDeliveredTopic)},
+		{Label: "alarmEscalatedSubject", Kind: StringProperty, Default: Default(AlarmEscalatedTopic)},
+		{Label: "alarmHistoryQuerySubject", Kind: StringProperty, Default: Default(AlarmHistoryQueryTopic)},
+		{Label: "alarmQueryActiveAlarmsSubject", Kind: StringProperty, Default: Default(AlarmQueryActiveAlarmsTopic)},
+		{Label: "alarmQueryAlarmSubject", Kind: StringProperty, Default: Default(AlarmQueryAlarmTopic)},
+		{Label: "alarmQueryStatsSubject", Kind: StringProperty, Default: Default(AlarmQueryStatsTopic)},
+		{Label: "alarmQueryLastDigestSubject", Kind: StringProperty, Default: Default(AlarmQueryLastDigestTopic)},
+		{Label: "shardSubjectPattern", Kind: StringProperty, Default: Default(DefaultTopicNames().ShardPattern)},
+		{Label: "deadLetterSubject", Kind: StringProperty, Default: Default("")},
+		{Label: "alarmStatusChangedWildcardSubject", Kind: StringProperty, Default: Default("")},
+		{Label: "sendAlarmDigestWildcardSubject", Kind: StringProperty, Default: Default("")},
+		{Label: "wildcardUserIdToken", Kind: IntProperty, Default: Default("-1")},
+
+		// admin
+		{Label: "adminHttpPort", Kind: IntProperty, Default: Default("-1"), Min: Limit(-1), Max: Limit(65535)},
+		{Label: "livenessThresholdMs", Kind: DurationProperty, Default: Default("30000"), Min: Limit(1)},
+	},
+
+	Sections: []string{tenantSection},
+
+	Constraints: []ConfigConstraint{
+		validateTenants,
+		validateSubjects,
+		func(props AppConfigProperties) error {
+			if _, err := ParseEscalationRules(props.FetchAsStringList("escalationRules")); err != nil {
+				return fmt.Errorf("escalationRules: %v", err)
+			}
+			return nil
+		},
+		func(props AppConfigProperties) error {
+			if len(props.FetchAsString("walDir")) > 0 && len(props.FetchAsString("snapshotDir")) == 0 {
+				return fmt.Errorf("walDir: needs snapshotDir, the write-ahead log gets compacted by the snapshots")
+			}
+			return nil
+		},
+		func(props AppConfigProperties) error {
+			if !props.FetchAsBool("autoscalerEnabled") {
+				return nil
+			}
+			if props.FetchAsInt("autoscalerMinWorkers") > props.FetchAsInt("autoscalerMaxWorkers") {
+				return fmt.Errorf("autoscalerMinWorkers: should not be greater than autoscalerMaxWorkers")
+			}
+			if props.FetchAsInt("autoscalerScaleDownMailboxUtilizationPercent") >= props.FetchAsInt("autoscalerScaleUpMailboxUtilizationPercent") {
+				return fmt.Errorf("autoscalerScaleDownMailboxUtilizationPercent: should be less than autoscalerScaleUpMailboxUtilizationPercent")
+			}
+			return nil
+		},
+	},
+}
+
+// validateTenants the names of the tenants are subject tokens, the tenant.<name>.* overrides are known quotas of known tenants.
+func validateTenants(props AppConfigProperties) error {
+	tenants := make(map[string]bool)
+	for _, name := range props.FetchAsStringList("tenants") {
+		if !tenantNamePattern.MatchString(name) {
+			return fmt.Errorf("tenants: %q is not a valid tenant name (letters, digits, - and _)", name)
+		}
+		tenants[name] = true
+	}
+
+	section := props.Section(tenantSection)
+	for _, label := range section.Labels() {
+		tokens := strings.Split(label, ".")
+		if len(tokens) != 2 || !tenants[tokens[0]] {
+			return fmt.Errorf("%v.%v: not a quota of a configured tenant", tenantSection, label)
+		}
+		switch tokens[1] {
+		case "maxUsers", "maxAlarms", "rateLimitPerSecond":
+			if value, err := strconv.Atoi(section.FetchAsString(label)); err != nil || value < 0 {
+				return fmt.Errorf("%v.%v: should be a non negative int", tenantSection, label)
+			}
+		default:
+			return fmt.Errorf("%v.%v: unknown quota, expected maxUsers, maxAlarms or rateLimitPerSecond", tenantSection, label)
+		}
+	}
+	return nil
+}
+
+// validateSubjects the subjects are distinct from each other, the wildcards do not receive the messages of the other listeners.
+func validateSubjects(props AppConfigProperties) error {
+	topics := topicNames(&props)
+
+	shards := props.FetchAsInt("alarmStatusChangedListeners")
+	if props.FetchAsInt("sendAlarmDigestListeners") > shards {
+		shards = props.FetchAsInt("sendAlarmDigestListeners")
+	}
+	if err := topics.Validate(shards); err != nil {
+		return fmt.Errorf("subjects: %v", err)
+	}
+
+	wildcards := len(topics.AlarmStatusChangedWildcard) > 0 || len(topics.SendAlarmDigestWildcard) > 0
+	if wildcards && len(props.FetchAsStringList("tenants")) > 0 {
+		return fmt.Errorf("subjects: the wildcard subjects are not supported with tenants")
+	}
+	return nil
+}
+
+// LoadAlarmServiceConfig resolves the config (flags > ALARM_* env variables > file > defaults), validates it and prints it.
+func LoadAlarmServiceConfig(filename string, overrides PropertyOverrides) AppConfigProperties {
+	props, err := LoadConfig(filename, AlarmServiceConfigSchema, configEnvPrefix, overrides)
+	if err != nil {
+		panic(InvalidConfigurationError{Msg: err.Error()})
+	}
+
+	props.PrintEffectiveConfig(AlarmServiceConfigSchema)
+	return props
+}
@@ -12,6 +12,19 @@ type Alarm struct {
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	// Note: for the escalation rules (see alarmEscalation.go), the ChangedAt of the transition into the current status
+	//		 and the ActiveFor of the latest rule applied since (0 if not escalated).
+	StatusSince    time.Time
+	EscalatedAfter time.Duration
+
+	History []AlarmTransition // Note: oldest first, bounded (see alarmMessageWorkerHistory.go), empty if not kept
+}
+
+type AlarmTransition struct {
+	Status     AlarmStatus
+	ChangedAt  time.Time // Note: as reported by the source of the alarm
+	ReceivedAt time.Time // Note: when the worker applied it
 }
 
 type AlarmId string
@@ -58,3 +71,26 @@ func AlarmStatusAsString(status AlarmStatus) string {
 func IsActiveAlarm(alarm *Alarm) bool {
 	return alarm.Status == CRITICAL || alarm.Status == WARNING
 }
+
+// StatusAt the transition in effect at the time (the latest one which changed at or before it), false if the history
+// does not reach back that far.
+func StatusAt(alarm *Alarm, at time.Time) (AlarmTransition, bool) {
+	var found AlarmTransition
+	exists := false
+
+	// Note: changes may arrive out of order, so not the latest received but the latest changed one.
+	for _, transition := range alarm.History {
+		if transition.ChangedAt.After(at) {
+			continue
+		}
+		if !exists || !transition.ChangedAt.Before(found.ChangedAt) {
+			found = transition
+			exists = true
+		}
+	}
+	return found, exists
+}
+
+func IsActiveStatus(status AlarmStatus) bool {
+	return status == CRITICAL || status == WARNING
+}
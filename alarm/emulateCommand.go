@@ -0,0 +1,87 @@
+package main
+
+import (
+	. "alarm/error"
+	. "alarm/message"
+	"flag"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+func emulateCommand(args []string) {
+
+	flags := flag.NewFlagSet("emulate", flag.ExitOnError)
+	configFile, configOverrides := configFlags(flags)
+	natsUrl := flags.String("nats-url", "", "the nats server of the service (default: natsUrl of the config)")
+	shots := flags.Int("shots", 100, "the number of shots (-1 runs forever)")
+	bursts := flags.Int("bursts", 10, "the alarm status changes of every shot")
+	rate := flags.Float64("rate", 10, "the shots per second")
+	users := flags.Int("users", 0, "the size of the pool of users (0 picks a new user per alarm status change)")
+	alarmsPerUser := flags.Int("alarms-per-user", 3, "the alarms of every user of the pool")
+	statusMix := flags.String("status-mix", "CRITICAL=1", "the weights of the statuses, eg: CRITICAL=60,WARNING=30,CLEARED=10")
+	digestPercent := flags.Int("digest-percent", 100, "the percent of the alarm status changes followed by a digest request")
+	scenarioFiles := flags.String("scenarios", "", "comma separated scenario files (.yaml, .json) to replay instead of the generated traffic")
+	speed := flags.Float64("speed", 1, "the replay speed of the scenario timelines (1: real time, 60: a minute per second, 0: no pauses)")
+	stepDelayMs := flags.Int("step-delay-ms", 10, "the minimum pause between the steps of a scenario")
+	_ = flags.Parse(args)
+
+	mix, err := ParseStatusMix(*statusMix)
+	if err != nil {
+		panic(InvalidCommandError{Msg: err.Error()})
+	}
+	if *rate <= 0 {
+		panic(InvalidCommandError{Msg: "rate should be positive"})
+	}
+
+	props := loadClientConfig(*configFile, configOverrides)
+	if len(*natsUrl) == 0 {
+		*natsUrl = props.FetchAsString("natsUrl")
+	}
+
+	serverConnection := connectTo(*natsUrl)
+	transport := NatsTransportCreateNew(serverConnection)
+
+	if len(*scenarioFiles) > 0 {
+		replayScenarioFiles(transport, *scenarioFiles, ReplayOptions{
+			Speed:     *speed,
+			StepDelay: time.Duration(*stepDelayMs) * time.Millisecond,
+		})
+		return
+	}
+
+
+	options := EmulationOptions{
+		Shots:                       *shots,
+		Bursts:                      *bursts,
+		WaitTimeInMs:                int64(float64(time.Second/time.Millisecond) / *rate),
+		Users:                       *users,
+		AlarmsPerUser:               *alarmsPerUser,
+		StatusMix:                   mix,
+		DigestPercent:               *digestPercent,
+		AlarmStatusChangedListeners: props.FetchAsInt("alarmStatusChangedListeners"),
+		SendAlarmDigestListeners:    props.FetchAsInt("sendAlarmDigestListeners"),
+	}
+	log.Infof("emulating traffic: %+v\n", options)
+
+	startedAt := time.Now()
+	EmulateTrafficWith(transport, options)
+
+	// Note: drain flushes the messages which are still buffered by the client.
+	_ = transport.Drain()
+	log.Infof("emulated traffic published in: %v\n", time.Since(startedAt))
+}
+
+func replayScenarioFiles(transport Transport, scenarioFiles string, options ReplayOptions) {
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	for _, scenario := range loadScenarioFiles(scenarioFiles) {
+		log.Infof("replaying scenario: %v\n", scenario.Name)
+
+		// Note: the expected digests are ignored, see the verify command.
+		if err := ReplayScenario(transport, scenario, options); err != nil {
+			panic(CouldNotPublishMessageError{Msg: err.Error()})
+		}
+	}
+}
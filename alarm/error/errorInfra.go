@@ -22,6 +22,36 @@ func GlobalErrorHandler() {
 		case CouldNotUnsubscribeFromTopicError:
 			log.Fatal("could not unsubscribe from topic, message: ", errorMsg.Details())
 
+		case CouldNotStartEmbeddedServerError:
+			log.Fatal("could not start embedded nats server, message: ", errorMsg.Details())
+
+		case CouldNotStartAdminServerError:
+			log.Fatal("could not start admin server, message: ", errorMsg.Details())
+
+		case InvalidConfigurationError:
+			log.Fatal("invalid configuration, message: ", errorMsg.Details())
+
+		case CouldNotSetupTracingError:
+			log.Fatal("could not setup tracing, message: ", errorMsg.Details())
+
+		case InvalidCommandError:
+			log.Fatal("invalid command, message: ", errorMsg.Details())
+
+		case CouldNotQueryAdminServerError:
+			log.Fatal("could not query admin server, message: ", errorMsg.Details())
+
+		case CouldNotPublishMessageError:
+			log.Fatal("could not publish message, message: ", errorMsg.Details())
+
+		case VerificationFailedError:
+			log.Fatal("verification failed, message: ", errorMsg.Details())
+
+		case CouldNotOpenWriteAheadLogError:
+			log.Fatal("could not open write-ahead log, message: ", errorMsg.Details())
+
+		case CouldNotSetupDigestDeliveryError:
+			log.Fatal("could not setup digest delivery, message: ", errorMsg.Details())
+
 		default:
 			log.Fatal("unknown error occurred, message: ", err)
 		}
@@ -47,6 +77,46 @@ type CouldNotUnsubscribeFromTopicError struct {
 	Msg string
 }
 
+type CouldNotStartEmbeddedServerError struct {
+	Msg string
+}
+
+type CouldNotStartAdminServerError struct {
+	Msg string
+}
+
+type InvalidConfigurationError struct {
+	Msg string
+}
+
+type CouldNotSetupTracingError struct {
+	Msg string
+}
+
+type InvalidCommandError struct {
+	Msg string
+}
+
+type CouldNotQueryAdminServerError struct {
+	Msg string
+}
+
+type CouldNotPublishMessageError struct {
+	Msg string
+}
+
+type VerificationFailedError struct {
+	Msg string
+}
+
+type CouldNotOpenWriteAheadLogError struct {
+	Msg string
+}
+
+type CouldNotSetupDigestDeliveryError struct {
+	Msg string
+}
+
 func (err *CouldNotConnectToServerError) Details() string {
 	res := "could not connect to server, error: " + (*err).Msg
 	return res
@@ -61,3 +131,53 @@ func (err *CouldNotUnsubscribeFromTopicError) Details() string {
 	res := "could not unsubscribe from topic, error: " + (*err).Msg
 	return res
 }
+
+func (err *CouldNotStartEmbeddedServerError) Details() string {
+	res := "could not start embedded server, error: " + (*err).Msg
+	return res
+}
+
+func (err *CouldNotStartAdminServerError) Details() string {
+	res := "could not start admin server, error: " + (*err).Msg
+	return res
+}
+
+func (err *InvalidConfigurationError) Details() string {
+	res := "invalid configuration, error: " + (*err).Msg
+	return res
+}
+
+func (err *CouldNotSetupTracingError) Details() string {
+	res := "could not setup tracing, error: " + (*err).Msg
+	return res
+}
+
+func (err *InvalidCommandError) Details() string {
+	res := "invalid command, error: " + (*err).Msg
+	return res
+}
+
+func (err *CouldNotQueryAdminServerError) Details() string {
+	res := "could not query admin server, error: " + (*err).Msg
+	return res
+}
+
+func (err *CouldNotPublishMessageError) Details() string {
+	res := "could not publish message, error: " + (*err).Msg
+	return res
+}
+
+func (err *VerificationFailedError) Details() string {
+	res := "verification failed, error: " + (*err).Msg
+	return res
+}
+
+func (err *CouldNotOpenWriteAheadLogError) Details() string {
+	res := "could not open write-ahead log, error: " + (*err).Msg
+	return res
+}
+
+func (err *CouldNotSetupDigestDeliveryError) Details() string {
+	res := "could not setup digest delivery, error: " + (*err).Msg
+	return res
+}
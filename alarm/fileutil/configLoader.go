@@ -0,0 +1,246 @@
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	The config file format is picked by its extension:
+
+		.properties (or no extension) --> flat label=value lines
+		.yaml / .yml                  --> nested sections
+		.toml                         --> nested sections
+
+	Nested sections are flattened to dotted labels, so every format ends up in the same AppConfigProperties:
+
+		nats:                              nats.servers=nats://a:4222,nats://b:4222
+		  servers: [nats://a:4222, ...]    workers.count=30
+		workers:                           sinks.0.type=webhook
+		  count: 30                        sinks.0.url=http://...
+		sinks:                             sinks.1.type=log
+		  - type: webhook
+		    url: http://...
+		  - type: log
+
+	LoadConfig then maps the dotted labels of nested sections onto the flat camelCase labels of the schema (see
+	MapNestedLabels), so these two files are the same config:
+
+		hotUser:                           hotUserRateLimitPerSecond=200
+		  rateLimitPerSecond: 200          hotUserBurst=400
+		  burst: 400
+
+	* lists of values     --> comma separated (see FetchAsStringList)
+	* lists of sections   --> indexed labels (see SectionList)
+	* include             --> a file (or a list of files) which gets loaded first, the including file wins on conflicts,
+	                          relative paths are resolved against the directory of the including file
+*/
+
+const includeLabel = "include"
+
+type configParser func(content []byte) (map[string]string, error)
+
+var configParsers = map[string]configParser{
+	"":            parseProperties,
+	".properties": parseProperties,
+	".yaml":       parseYaml,
+	".yml":        parseYaml,
+	".toml":       parseToml,
+}
+
+// ReadConfigFile reads the config file (and its includes), an empty filename returns empty properties.
+func ReadConfigFile(filename string) AppConfigProperties {
+	config := AppConfigProperties{v: make(map[string]string), source: &configSource{filename: filename}}
+
+	if len(filename) == 0 {
+		return config
+	}
+
+	if err := config.readFile(filename, make(map[string]bool)); err != nil {
+		panic(err)
+	}
+
+	return config
+}
+
+func (props AppConfigProperties) readFile(filename string, including map[string]bool) error {
+
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if including[path] {
+		return errors.New("config file: " + filename + " includes itself")
+	}
+	including[path] = true
+	defer delete(including, path)
+
+	parser, supported := configParsers[strings.ToLower(filepath.Ext(filename))]
+	if !supported {
+		return errors.New("config file: " + filename + " has unsupported extension (.properties, .yaml, .yml, .toml)")
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	properties, err := parser(content)
+	if err != nil {
+		return fmt.Errorf("config file: %v, error: %w", filename, err)
+	}
+	props.source.files = append(props.source.files, filename)
+
+	// Note: the includes first, so the properties of this file override the included ones.
+	for _, include := range splitList(properties[includeLabel]) {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+		if err := props.readFile(include, including); err != nil {
+			return err
+		}
+	}
+	delete(properties, includeLabel)
+
+	for label, value := range properties {
+		props.v[label] = value
+	}
+
+	return nil
+}
+
+
+// Section returns the properties under the label, without the prefix, eg: Section("nats") --> servers, user, ...
+func (props AppConfigProperties) Section(label string) AppConfigProperties {
+	section := AppConfigProperties{v: make(map[string]string), source: props.source}
+
+	prefix := label + "."
+	for l, value := range props.v {
+		if strings.HasPrefix(l, prefix) {
+			section.v[strings.TrimPrefix(l, prefix)] = value
+		}
+	}
+
+	return section
+}
+
+// SectionList returns the sections of a list, eg: SectionList("sinks") --> sinks.0.*, sinks.1.*, ...
+func (props AppConfigProperties) SectionList(label string) []AppConfigProperties {
+	var sections []AppConfigProperties
+
+	for i := 0; ; i++ {
+		section := props.Section(label + "." + strconv.Itoa(i))
+		if len(section.v) == 0 {
+			return sections
+		}
+		sections = append(sections, section)
+	}
+}
+
+// Labels returns the sorted labels of the properties
+func (props AppConfigProperties) Labels() []string {
+	labels := make([]string, 0, len(props.v))
+	for label := range props.v {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+
+// ------------------- nested formats -------------------
+
+func parseYaml(content []byte) (map[string]string, error) {
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+
+	properties := make(map[string]string)
+	flatten("", document, properties)
+	return properties, nil
+}
+
+func parseToml(content []byte) (map[string]string, error) {
+	var document map[string]interface{}
+	if err := toml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+
+	properties := make(map[string]string)
+	flatten("", document, properties)
+	return properties, nil
+}
+
+func flatten(label string, value interface{}, properties map[string]string) {
+
+	switch v := value.(type) {
+
+	case map[string]interface{}:
+		for key, nested := range v {
+			flatten(join(label, key), nested, properties)
+		}
+
+	case []map[string]interface{}: // Note: toml array of tables
+		for i, nested := range v {
+			flatten(join(label, strconv.Itoa(i)), nested, properties)
+		}
+
+	case []interface{}:
+		if !isScalarList(v) {
+			for i, nested := range v {
+				flatten(join(label, strconv.Itoa(i)), nested, properties)
+			}
+			return
+		}
+
+		values := make([]string, 0, len(v))
+		for _, element := range v {
+			values = append(values, scalar(element))
+		}
+		properties[label] = strings.Join(values, ",")
+
+	default:
+		properties[label] = scalar(v)
+	}
+}
+
+func isScalarList(list []interface{}) bool {
+	for _, element := range list {
+		switch element.(type) {
+		case map[string]interface{}, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+func scalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func join(label string, key string) string {
+	if len(label) == 0 {
+		return key
+	}
+	return label + "." + key
+}
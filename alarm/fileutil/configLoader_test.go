@@ -0,0 +1,185 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadConfigFile_yamlNestedSections(t *testing.T) {
+
+	// given
+	dir := testConfigFiles(t, map[string]string{
+		"config.yaml": `
+include: base.properties
+nats:
+  servers: [nats://a:4222, nats://b:4222]
+workers:
+  count: 30
+  enabled: true
+sinks:
+  - type: webhook
+    url: http://localhost/hook
+  - type: log
+`,
+		"base.properties": "workers.count=10\nadminHttpPort=8090\n",
+	})
+
+
+	// when
+	props := ReadConfigFile(filepath.Join(dir, "config.yaml"))
+
+
+	// then
+	if v := props.FetchAsStringList("nats.servers"); !reflect.DeepEqual(v, []string{"nats://a:4222", "nats://b:4222"}) {
+		t.Errorf("unexpected servers: %v", v)
+	}
+	if v := props.FetchAsInt("workers.count"); v != 30 {
+		t.Errorf("the including file should override the included one, got: %v", v)
+	}
+	if v := props.FetchAsInt("adminHttpPort"); v != 8090 {
+		t.Errorf("included property should have been loaded, got: %v", v)
+	}
+	if v := props.Section("workers").FetchAsBool("enabled"); !v {
+		t.Errorf("unexpected section value: %v", v)
+	}
+
+	sinks := props.SectionList("sinks")
+	if len(sinks) != 2 || sinks[0].FetchAsString("url") != "http://localhost/hook" || sinks[1].FetchAsString("type") != "log" {
+		t.Errorf("unexpected sinks: %v", sinks)
+	}
+	if props.Has("include") {
+		t.Errorf("include should not be a property")
+	}
+}
+
+func TestReadConfigFile_tomlNestedSections(t *testing.T) {
+
+	// given
+	dir := testConfigFiles(t, map[string]string{
+		"config.toml": `
+adminHttpPort = 8090
+
+[workers]
+count = 30
+
+[[sinks]]
+type = "webhook"
+
+[[sinks]]
+type = "log"
+`,
+	})
+
+
+	// when
+	props := ReadConfigFile(filepath.Join(dir, "config.toml"))
+
+
+	// then
+	if v := props.FetchAsInt("workers.count"); v != 30 {
+		t.Errorf("unexpected workers.count: %v", v)
+	}
+	if v := props.FetchAsInt("adminHttpPort"); v != 8090 {
+		t.Errorf("unexpected adminHttpPort: %v", v)
+	}
+	if sinks := props.SectionList("sinks"); len(sinks) != 2 || sinks[1].FetchAsString("type") != "log" {
+		t.Errorf("unexpected sinks: %v", sinks)
+	}
+}
+
+func TestLoadConfig_nestedSectionsMappedToTheFlatLabels(t *testing.T) {
+
+	// given
+	schema := ConfigSchema{
+		Properties: []ConfigProperty{
+			{Label: "hotUserRateLimitPerSecond", Kind: IntProperty, Default: Default("0")},
+			{Label: "hotUserBurst", Kind: IntProperty, Default: Default("400")},
+			{Label: "autoscalerScaleUpLatencyMs", Kind: IntProperty, Default: Default("50")},
+			{Label: "tenantMaxUsers", Kind: IntProperty, Default: Default("0")},
+		},
+		Sections: []string{"tenant"},
+	}
+	dir := testConfigFiles(t, map[string]string{
+		"config.yaml": `
+hotUser:
+  rateLimitPerSecond: 200
+  burst: 300
+hotUserBurst: 500
+autoscaler:
+  scaleUp:
+    latencyMs: 20
+tenant:
+  maxUsers: 10
+  productA:
+    maxUsers: 1000
+`,
+		"config.toml": `
+[hotUser]
+rateLimitPerSecond = 100
+`,
+	})
+
+
+	// when
+	yamlProps, yamlErr := LoadConfig(filepath.Join(dir, "config.yaml"), schema, "TEST", PropertyOverrides{})
+	tomlProps, tomlErr := LoadConfig(filepath.Join(dir, "config.toml"), schema, "TEST", PropertyOverrides{})
+
+
+	// then
+	if yamlErr != nil || tomlErr != nil {
+		t.Fatalf("unexpected errors: %v, %v", yamlErr, tomlErr)
+	}
+	if v := yamlProps.FetchAsInt("hotUserRateLimitPerSecond"); v != 200 {
+		t.Errorf("the nested key should be mapped to the flat label, got: %v", v)
+	}
+	if v := yamlProps.FetchAsInt("hotUserBurst"); v != 500 {
+		t.Errorf("the flat label should win over the nested key, got: %v", v)
+	}
+	if v := yamlProps.FetchAsDuration("autoscalerScaleUpLatencyMs"); v != 20*time.Millisecond {
+		t.Errorf("the deeply nested key should be mapped to the flat label, got: %v", v)
+	}
+	if v := yamlProps.FetchAsInt("tenantMaxUsers"); v != 10 {
+		t.Errorf("the nested key of a section should be mapped to the flat label, got: %v", v)
+	}
+	if v := yamlProps.Section("tenant").Section("productA").FetchAsInt("maxUsers"); v != 1000 {
+		t.Errorf("the labels of the section should be kept, got: %v", v)
+	}
+	if yamlProps.Has("hotUser.rateLimitPerSecond") {
+		t.Errorf("the nested label should have been replaced by the flat one")
+	}
+	if v := tomlProps.FetchAsInt("hotUserRateLimitPerSecond"); v != 100 {
+		t.Errorf("the nested toml key should be mapped to the flat label, got: %v", v)
+	}
+}
+
+func TestReadConfigFile_includeCycle(t *testing.T) {
+
+	// given
+	dir := testConfigFiles(t, map[string]string{
+		"a.properties": "include=b.properties\n",
+		"b.properties": "include=a.properties\n",
+	})
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("include cycle should have been rejected")
+		}
+	}()
+
+
+	// when
+	ReadConfigFile(filepath.Join(dir, "a.properties"))
+}
@@ -0,0 +1,342 @@
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+	The configuration is resolved with the following precedence (highest first):
+
+		1. flags          --> --set alarmStatusChangedMessagesTotalWorkers=50
+		2. env variables  --> ALARM_ALARM_STATUS_CHANGED_MESSAGES_TOTAL_WORKERS=50
+		3. the file       --> config.properties (or .yaml, .toml - see ReadConfigFile)
+		4. the defaults of the schema
+
+	and then gets validated against the schema, so a wrong value fails the startup instead of panicking later
+	at the first FetchAsXXX call.
+*/
+
+const redactedValue = "******"
+
+type ConfigPropertyKind int
+
+const (
+	IntProperty ConfigPropertyKind = iota
+	StringProperty
+	BoolProperty
+	DurationProperty
+	StringListProperty
+)
+
+func (kind ConfigPropertyKind) String() string {
+	switch kind {
+	case IntProperty:
+		return "int"
+	case StringProperty:
+		return "string"
+	case BoolProperty:
+		return "bool"
+	case DurationProperty:
+		return "duration"
+	case StringListProperty:
+		return "string list"
+	}
+	return "unknown"
+}
+
+type ConfigProperty struct {
+	Label   string
+	Kind    ConfigPropertyKind
+	Default *string // Note: nil means the property is required
+	Min     *int    // Note: only for IntProperty, and DurationProperty (in milliseconds)
+	Max     *int    // Note: only for IntProperty, and DurationProperty (in milliseconds)
+	Allowed []string
+	Secret  bool // Note: redacted in the effective config dump
+
+	// Note: can be changed at runtime (see ConfigWatcher), the rest of the properties need a restart.
+	Reloadable bool
+}
+
+// ConfigConstraint validates relations between properties, eg: min workers <= max workers
+type ConfigConstraint func(props AppConfigProperties) error
+
+type ConfigSchema struct {
+	Properties  []ConfigProperty
+	Constraints []ConfigConstraint
+
+	// Note: free form labels under these prefixes, eg: tenant --> tenant.<name>.maxUsers, validated by the constraints.
+	Sections []string
+}
+
+// Default is a helper for the optional fields of ConfigProperty
+func Default(v string) *string {
+	return &v
+}
+
+// Limit is a helper for the optional fields of ConfigProperty
+func Limit(v int) *int {
+	return &v
+}
+
+
+// ------------------- loading -------------------
+
+// LoadConfig reads the file, applies the env and flag overrides and validates the result against the schema.
+func LoadConfig(filename string, schema ConfigSchema, envPrefix string, overrides PropertyOverrides) (AppConfigProperties, error) {
+	props := ReadConfigFile(filename)
+	props.source.envPrefix = envPrefix
+	props.source.overrides = overrides
+
+	props.MapNestedLabels(schema)
+	props.ApplyEnvOverrides(envPrefix, os.Environ(), schema)
+
+	for label, value := range overrides {
+		props.Set(label, value)
+	}
+
+	err := props.Validate(schema)
+	return props, err
+}
+
+// ApplyEnvOverrides overrides the properties of the schema (and the file) from env variables named EnvVarName(prefix, label)
+func (props AppConfigProperties) ApplyEnvOverrides(prefix string, environ []string, schema ConfigSchema) {
+
+	labels := make(map[string]string)
+	for label := range props.v {
+		labels[EnvVarName(prefix, label)] = label
+	}
+	for _, property := range schema.Properties {
+		labels[EnvVarName(prefix, property.Label)] = property.Label
+	}
+
+	for _, variable := range environ {
+		equal := strings.Index(variable, "=")
+		if equal < 0 {
+			continue
+		}
+
+		if label, exists := labels[variable[:equal]]; exists {
+			log.Debugf("property: %v is overridden by env variable: %v\n", label, variable[:equal])
+			props.Set(label, variable[equal+1:])
+		}
+	}
+}
+
+// MapNestedLabels renames the dotted labels of nested sections to the camelCase label of the schema, eg:
+// hotUser.rateLimitPerSecond --> hotUserRateLimitPerSecond. The rest of the labels (eg: of the schema sections) are kept.
+func (props AppConfigProperties) MapNestedLabels(schema ConfigSchema) {
+	for label, value := range props.v {
+		if !strings.Contains(label, ".") {
+			continue
+		}
+		if _, exists := schema.property(label); exists {
+			continue
+		}
+
+		camelCase := CamelCaseLabel(label)
+		if _, exists := schema.property(camelCase); !exists {
+			continue
+		}
+
+		// Note: a flat label of the same file wins over the nested one
+		if !props.Has(camelCase) {
+			props.Set(camelCase, value)
+		}
+		delete(props.v, label)
+	}
+}
+
+// CamelCaseLabel joins the segments of a dotted label in camelCase, eg: autoscaler.scaleUp.latencyMs --> autoscalerScaleUpLatencyMs
+func CamelCaseLabel(label string) string {
+	segments := strings.Split(label, ".")
+	for i := 1; i < len(segments); i++ {
+		if len(segments[i]) > 0 {
+			segments[i] = strings.ToUpper(segments[i][:1]) + segments[i][1:]
+		}
+	}
+	return strings.Join(segments, "")
+}
+
+// EnvVarName converts a camelCase (or dotted) label to its env variable, eg: (ALARM, adminHttpPort) --> ALARM_ADMIN_HTTP_PORT
+func EnvVarName(prefix string, label string) string {
+	var name strings.Builder
+	name.WriteString(prefix)
+	name.WriteString("_")
+
+	for i, r := range label {
+		if r == '.' {
+			name.WriteString("_")
+			continue
+		}
+		if unicode.IsUpper(r) && i > 0 {
+			name.WriteString("_")
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+
+	return name.String()
+}
+
+
+// PropertyOverrides is a flag.Value which collects repeated --set label=value flags
+type PropertyOverrides map[string]string
+
+func (overrides PropertyOverrides) String() string {
+	pairs := make([]string, 0, len(overrides))
+	for label, value := range overrides {
+		pairs = append(pairs, label+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (overrides PropertyOverrides) Set(pair string) error {
+	equal := strings.Index(pair, "=")
+	if equal <= 0 {
+		return errors.New("expected label=value, got: " + pair)
+	}
+	overrides[strings.TrimSpace(pair[:equal])] = strings.TrimSpace(pair[equal+1:])
+	return nil
+}
+
+
+// ------------------- validation -------------------
+
+// Validate fills the defaults of the missing properties and returns all the violations of the schema at once.
+func (props AppConfigProperties) Validate(schema ConfigSchema) error {
+	var violations []string
+
+	known := make(map[string]bool)
+	for _, property := range schema.Properties {
+		known[property.Label] = true
+
+		if !props.Has(property.Label) {
+			if property.Default == nil {
+				violations = append(violations, property.Label+": is required")
+				continue
+			}
+			props.Set(property.Label, *property.Default)
+		}
+
+		if err := property.validate(props.v[property.Label]); err != nil {
+			violations = append(violations, property.Label+": "+err.Error())
+		}
+	}
+
+	for label := range props.v {
+		if !known[label] && !schema.inSection(label) {
+			log.Warnf("property: %v is not part of the config schema (typo?)\n", label)
+		}
+	}
+
+	// Note: the constraints can safely fetch the properties only if these are valid
+	if len(violations) == 0 {
+		for _, constraint := range schema.Constraints {
+			if err := constraint(props); err != nil {
+				violations = append(violations, err.Error())
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		return errors.New(strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+func (property ConfigProperty) validate(value string) error {
+
+	switch property.Kind {
+	case IntProperty:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an int", value)
+		}
+		if property.Min != nil && v < *property.Min {
+			return fmt.Errorf("%v is less than %v", v, *property.Min)
+		}
+		if property.Max != nil && v > *property.Max {
+			return fmt.Errorf("%v is greater than %v", v, *property.Max)
+		}
+
+	case BoolProperty:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%q is not a bool", value)
+		}
+
+	case DurationProperty:
+		v, err := parseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", value)
+		}
+		if property.Min != nil && v < time.Duration(*property.Min)*time.Millisecond {
+			return fmt.Errorf("%v is less than %vms", v, *property.Min)
+		}
+		if property.Max != nil && v > time.Duration(*property.Max)*time.Millisecond {
+			return fmt.Errorf("%v is greater than %vms", v, *property.Max)
+		}
+	}
+
+	if len(property.Allowed) > 0 {
+		for _, allowed := range property.Allowed {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %v", value, property.Allowed)
+	}
+
+	return nil
+}
+
+
+// ------------------- effective config -------------------
+
+// EffectiveConfig returns the sorted label=value lines of the properties, the secrets of the schema are redacted.
+func (props AppConfigProperties) EffectiveConfig(schema ConfigSchema) []string {
+	lines := make([]string, 0, len(props.v))
+	for label, value := range props.v {
+		lines = append(lines, label+"="+schema.printable(label, value))
+	}
+	sort.Strings(lines)
+
+	return lines
+}
+
+func (props AppConfigProperties) PrintEffectiveConfig(schema ConfigSchema) {
+	log.Infof("effective config: %v\n", strings.Join(props.EffectiveConfig(schema), " "))
+}
+
+func (schema ConfigSchema) inSection(label string) bool {
+	for _, section := range schema.Sections {
+		if strings.HasPrefix(label, section+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (schema ConfigSchema) property(label string) (ConfigProperty, bool) {
+	for _, property := range schema.Properties {
+		if property.Label == label {
+			return property, true
+		}
+	}
+	return ConfigProperty{}, false
+}
+
+func (schema ConfigSchema) printable(label string, value string) string {
+	if property, exists := schema.property(label); exists && property.Secret && len(value) > 0 {
+		return redactedValue
+	}
+	return value
+}
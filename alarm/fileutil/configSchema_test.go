@@ -0,0 +1,162 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSchema = ConfigSchema{
+	Properties: []ConfigProperty{
+		{Label: "workers", Kind: IntProperty, Min: Limit(1)},
+		{Label: "capacity", Kind: IntProperty, Default: Default("75"), Min: Limit(0), Max: Limit(1000), Reloadable: true},
+		{Label: "enabled", Kind: BoolProperty, Default: Default("false")},
+		{Label: "interval", Kind: DurationProperty, Default: Default("100ms")},
+		{Label: "timeoutMs", Kind: DurationProperty, Default: Default("2000"), Min: Limit(1)},
+		{Label: "mode", Kind: StringProperty, Default: Default("coalesce"), Allowed: []string{"coalesce", "overflow"}},
+		{Label: "exemptions", Kind: StringListProperty, Default: Default("")},
+		{Label: "password", Kind: StringProperty, Default: Default(""), Secret: true},
+	},
+}
+
+func testPropertiesFile(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "test.properties")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadConfig_precedence(t *testing.T) {
+
+	// given
+	filename := testPropertiesFile(t, "# comment\nworkers = 10\ncapacity=20\nmode=overflow\n")
+	t.Setenv("TEST_WORKERS", "20")
+	t.Setenv("TEST_CAPACITY", "30")
+	t.Setenv("TEST_EXEMPTIONS", " userA, ,userB ")
+
+	overrides := PropertyOverrides{}
+	_ = overrides.Set("capacity = 40")
+
+
+	// when
+	props, err := LoadConfig(filename, testSchema, "TEST", overrides)
+
+
+	// then
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := props.FetchAsInt("workers"); v != 20 {
+		t.Errorf("env should override the file, got: %v", v)
+	}
+	if v := props.FetchAsInt("capacity"); v != 40 {
+		t.Errorf("flag should override env and file, got: %v", v)
+	}
+	if v := props.FetchAsString("mode"); v != "overflow" {
+		t.Errorf("file should override the default, got: %v", v)
+	}
+	if v := props.FetchAsDuration("interval"); v != 100*time.Millisecond {
+		t.Errorf("default should have been used, got: %v", v)
+	}
+	if v := props.FetchAsBool("enabled"); v {
+		t.Errorf("default should have been used, got: %v", v)
+	}
+	if v := props.FetchAsStringList("exemptions"); !reflect.DeepEqual(v, []string{"userA", "userB"}) {
+		t.Errorf("unexpected list: %v", v)
+	}
+}
+
+func TestValidate_reportsAllViolations(t *testing.T) {
+
+	// given
+	props := ReadPropertiesFile(testPropertiesFile(t, "capacity=1001\nenabled=maybe\nmode=drop\n"))
+
+
+	// when
+	err := props.Validate(testSchema)
+
+
+	// then
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, violation := range []string{"workers: is required", "capacity: 1001 is greater than 1000", "enabled:", "mode:"} {
+		if !strings.Contains(err.Error(), violation) {
+			t.Errorf("expected violation %q in: %v", violation, err)
+		}
+	}
+}
+
+func TestDurationProperty_plainNumberIsMilliseconds(t *testing.T) {
+
+	// given
+	plain := ReadPropertiesFile(testPropertiesFile(t, "workers=1\ntimeoutMs=1500\n"))
+	withUnit := ReadPropertiesFile(testPropertiesFile(t, "workers=1\ntimeoutMs=2s\n"))
+	belowMin := ReadPropertiesFile(testPropertiesFile(t, "workers=1\ntimeoutMs=0\n"))
+
+
+	// when
+	plainErr, withUnitErr, belowMinErr := plain.Validate(testSchema), withUnit.Validate(testSchema), belowMin.Validate(testSchema)
+
+
+	// then
+	if plainErr != nil || withUnitErr != nil {
+		t.Fatalf("unexpected errors: %v, %v", plainErr, withUnitErr)
+	}
+	if v := plain.FetchAsDuration("timeoutMs"); v != 1500*time.Millisecond {
+		t.Errorf("a plain number should be in milliseconds, got: %v", v)
+	}
+	if v := withUnit.FetchAsDuration("timeoutMs"); v != 2*time.Second {
+		t.Errorf("a duration should keep its unit, got: %v", v)
+	}
+	if belowMinErr == nil || !strings.Contains(belowMinErr.Error(), "timeoutMs: 0s is less than 1ms") {
+		t.Errorf("expected the min (in milliseconds) to be validated, got: %v", belowMinErr)
+	}
+}
+
+func TestEffectiveConfig_redactsSecrets(t *testing.T) {
+
+	// given
+	props := ReadPropertiesFile(testPropertiesFile(t, "workers=1\npassword=s3cr3t\n"))
+	if err := props.Validate(testSchema); err != nil {
+		t.Fatal(err)
+	}
+
+
+	// when
+	lines := strings.Join(props.EffectiveConfig(testSchema), "\n")
+
+
+	// then
+	if strings.Contains(lines, "s3cr3t") || !strings.Contains(lines, "password="+redactedValue) {
+		t.Errorf("password should have been redacted: %v", lines)
+	}
+	if !strings.Contains(lines, "workers=1") {
+		t.Errorf("workers should have been printed: %v", lines)
+	}
+}
+
+func TestFetchWithDefaults(t *testing.T) {
+
+	props := ReadPropertiesFile("")
+
+	if v := props.FetchAsIntOrDefault("missing", 5); v != 5 {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := props.FetchAsDurationOrDefault("missing", time.Second); v != time.Second {
+		t.Errorf("unexpected: %v", v)
+	}
+	if v := props.FetchAsStringListOrDefault("missing", []string{"a"}); !reflect.DeepEqual(v, []string{"a"}) {
+		t.Errorf("unexpected: %v", v)
+	}
+}
+
+func TestEnvVarName(t *testing.T) {
+	if v := EnvVarName("ALARM", "adminHttpPort"); v != "ALARM_ADMIN_HTTP_PORT" {
+		t.Errorf("unexpected: %v", v)
+	}
+}
@@ -0,0 +1,238 @@
+package fileutil
+
+import (
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+	Hot reload of the configuration: the watcher reloads the config (same file, env variables and flags as the
+	startup) when the file (or an included file) gets modified or the process receives SIGHUP, and:
+
+	* reloadable properties     --> the changes are passed to the reload handlers (eg: log level, per user limits)
+	* non-reloadable properties --> the changes are rejected (logged as a diff), the running value is kept until a restart
+
+	A reloadable property may need a restart in the running setup only (eg: the limits of a feature disabled at startup),
+	see RequireRestart, its changes are rejected the same way then.
+
+	An invalid file is rejected as a whole, the running configuration stays untouched. So is a reload which a handler
+	could not apply, so the next reload tries its changes again.
+*/
+
+type ConfigChange struct {
+	Label      string
+	Old        string
+	New        string
+	Reloadable bool
+}
+
+// ConfigReloadHandler applies the changed (reloadable) properties, an error is logged and does not stop the other handlers,
+// the reload is not committed then (the handlers should be idempotent, they get the same changes on the next reload).
+type ConfigReloadHandler func(props AppConfigProperties, changed map[string]bool) error
+
+type ConfigWatcher struct {
+	mutex sync.Mutex
+
+	schema   ConfigSchema
+	current  AppConfigProperties
+	handlers []ConfigReloadHandler
+	restarts map[string][]func(next AppConfigProperties) bool
+
+	modTime time.Time
+	stop    chan struct{}
+}
+
+func ConfigWatcherCreateNew(props AppConfigProperties, schema ConfigSchema) *ConfigWatcher {
+	return &ConfigWatcher{
+		schema:  schema,
+		current:  props,
+		restarts: make(map[string][]func(next AppConfigProperties) bool),
+		modTime: filesModTime(props.source.files),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (w *ConfigWatcher) OnReload(handler ConfigReloadHandler) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.handlers = append(w.handlers, handler)
+}
+
+// RequireRestart the changes of the (reloadable) labels are rejected like the non-reloadable ones, as long as when
+// returns true for the reloaded config.
+func (w *ConfigWatcher) RequireRestart(when func(next AppConfigProperties) bool, labels ...string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, label := range labels {
+		w.restarts[label] = append(w.restarts[label], when)
+	}
+}
+
+// Start watches for SIGHUP and, if pollInterval > 0, for modifications of the file.
+func (w *ConfigWatcher) Start(pollInterval time.Duration) {
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hangups)
+
+		// Note: a nil channel never fires, so without polling only SIGHUP reloads.
+		var poll <-chan time.Time
+		if pollInterval > 0 {
+			ticker := time.NewTicker(pollInterval)
+			defer ticker.Stop()
+			poll = ticker.C
+		}
+
+		for {
+			select {
+			case <-hangups:
+				log.Infof("[configWatcher] received SIGHUP, reloading config\n")
+				w.Reload()
+
+			case <-poll:
+				if modTime := w.currentModTime(); !modTime.Equal(w.modTime) {
+					w.modTime = modTime
+					log.Infof("[configWatcher] config file (or an included file) was modified, reloading config\n")
+					w.Reload()
+				}
+
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (w *ConfigWatcher) Stop() {
+	close(w.stop)
+}
+
+// Reload loads the config again and applies the reloadable changes, returns the changes which got applied.
+func (w *ConfigWatcher) Reload() []ConfigChange {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	source := w.current.source
+	next, err := LoadConfig(source.filename, w.schema, source.envPrefix, source.overrides)
+	if err != nil {
+		log.Errorf("[configWatcher] rejected config reload, error: %v\n", err)
+		return nil
+	}
+
+	var applied []ConfigChange
+	changed := make(map[string]bool)
+	for _, change := range w.diff(next) {
+		if !change.Reloadable || w.requiresRestart(next, change.Label) {
+			log.Warnf("[configWatcher] rejected change (needs restart) --- %v: %v --> %v\n", change.Label, change.Old, change.New)
+			w.keepCurrent(next, change.Label)
+			continue
+		}
+
+		log.Infof("[configWatcher] applying change --- %v: %v --> %v\n", change.Label, change.Old, change.New)
+		applied = append(applied, change)
+		changed[change.Label] = true
+	}
+
+	if len(applied) == 0 {
+		return nil
+	}
+
+	// Note: the kept running values together with the new ones may violate a constraint, eg: min workers > max workers.
+	if err := next.Validate(w.schema); err != nil {
+		log.Errorf("[configWatcher] rejected config reload, error: %v\n", err)
+		return nil
+	}
+
+	failed := false
+	for _, handler := range w.handlers {
+		if err := handler(next, changed); err != nil {
+			log.Errorf("[configWatcher] could not apply config reload, error: %v\n", err)
+			failed = true
+		}
+	}
+
+	// Note: the running config is kept, so the next reload diffs against it and tries the changes again.
+	if failed {
+		return nil
+	}
+	w.current = next
+
+	return applied
+}
+
+// diff returns the sorted changes between the running and the next config, the secrets are redacted.
+func (w *ConfigWatcher) diff(next AppConfigProperties) []ConfigChange {
+
+	labels := make(map[string]bool)
+	for label := range w.current.v {
+		labels[label] = true
+	}
+	for label := range next.v {
+		labels[label] = true
+	}
+
+	var changes []ConfigChange
+	for label := range labels {
+		oldValue, newValue := w.current.v[label], next.v[label]
+		if oldValue == newValue {
+			continue
+		}
+
+		property, _ := w.schema.property(label)
+		changes = append(changes, ConfigChange{
+			Label:      label,
+			Old:        w.schema.printable(label, oldValue),
+			New:        w.schema.printable(label, newValue),
+			Reloadable: property.Reloadable,
+		})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Label < changes[j].Label
+	})
+	return changes
+}
+
+func (w *ConfigWatcher) requiresRestart(next AppConfigProperties, label string) bool {
+	for _, when := range w.restarts[label] {
+		if when(next) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *ConfigWatcher) keepCurrent(next AppConfigProperties, label string) {
+	if value, exists := w.current.v[label]; exists {
+		next.v[label] = value
+	} else {
+		delete(next.v, label)
+	}
+}
+
+func (w *ConfigWatcher) currentModTime() time.Time {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return filesModTime(w.current.source.files)
+}
+
+// filesModTime returns the latest modification time of the files (the config file and its includes)
+func filesModTime(files []string) time.Time {
+	var latest time.Time
+	for _, filename := range files {
+		if info, err := os.Stat(filename); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
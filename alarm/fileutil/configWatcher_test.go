@@ -0,0 +1,166 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestConfigWatcher_appliesOnlyReloadableChanges(t *testing.T) {
+
+	// given
+	filename := testPropertiesFile(t, "workers=10\ncapacity=20\n")
+	props, err := LoadConfig(filename, testSchema, "TEST", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := ConfigWatcherCreateNew(props, testSchema)
+
+	var reloaded AppConfigProperties
+	var changed map[string]bool
+	watcher.OnReload(func(props AppConfigProperties, c map[string]bool) error {
+		reloaded, changed = props, c
+		return nil
+	})
+
+
+	// when
+	if err := os.WriteFile(filename, []byte("workers=50\ncapacity=30\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	applied := watcher.Reload()
+
+
+	// then
+	if len(applied) != 1 || applied[0].Label != "capacity" || applied[0].Old != "20" || applied[0].New != "30" {
+		t.Fatalf("only capacity should have been applied, got: %v", applied)
+	}
+	if !changed["capacity"] || changed["workers"] {
+		t.Errorf("unexpected changed properties: %v", changed)
+	}
+	if v := reloaded.FetchAsInt("capacity"); v != 30 {
+		t.Errorf("capacity should have been reloaded, got: %v", v)
+	}
+	if v := reloaded.FetchAsInt("workers"); v != 10 {
+		t.Errorf("workers is not reloadable, the running value should have been kept, got: %v", v)
+	}
+}
+
+func TestConfigWatcher_rejectsInvalidConfig(t *testing.T) {
+
+	// given
+	filename := testPropertiesFile(t, "workers=10\ncapacity=20\n")
+	props, err := LoadConfig(filename, testSchema, "TEST", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := ConfigWatcherCreateNew(props, testSchema)
+	watcher.OnReload(func(props AppConfigProperties, changed map[string]bool) error {
+		t.Errorf("invalid config should not have been applied")
+		return nil
+	})
+
+
+	// when
+	if err := os.WriteFile(filename, []byte("workers=10\ncapacity=-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	applied := watcher.Reload()
+
+
+	// then
+	if applied != nil {
+		t.Errorf("nothing should have been applied, got: %v", applied)
+	}
+}
+
+func TestConfigWatcher_retriesChangeRejectedByHandler(t *testing.T) {
+
+	// given
+	filename := testPropertiesFile(t, "workers=10\ncapacity=20\n")
+	props, err := LoadConfig(filename, testSchema, "TEST", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := ConfigWatcherCreateNew(props, testSchema)
+
+	reject := true
+	var changed map[string]bool
+	watcher.OnReload(func(props AppConfigProperties, c map[string]bool) error {
+		changed = c
+		if reject {
+			return errors.New("capacity rejected")
+		}
+		return nil
+	})
+
+	if err := os.WriteFile(filename, []byte("workers=10\ncapacity=30\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+
+	// when
+	rejected := watcher.Reload()
+	reject = false
+	retried := watcher.Reload()
+
+
+	// then
+	if rejected != nil {
+		t.Errorf("a rejected change should not be reported as applied, got: %v", rejected)
+	}
+	if len(retried) != 1 || retried[0].Label != "capacity" || retried[0].Old != "20" || !changed["capacity"] {
+		t.Errorf("expected the rejected change to be applied on the next reload, got: %v", retried)
+	}
+	if watcher.Reload() != nil {
+		t.Errorf("expected nothing left to apply")
+	}
+}
+
+func TestConfigWatcher_rejectsChangeWhichRequiresRestart(t *testing.T) {
+
+	// given
+	filename := testPropertiesFile(t, "workers=10\ncapacity=20\n")
+	props, err := LoadConfig(filename, testSchema, "TEST", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := ConfigWatcherCreateNew(props, testSchema)
+	watcher.RequireRestart(func(next AppConfigProperties) bool {
+		return next.FetchAsInt("capacity") > 100
+	}, "capacity")
+
+	var reloaded []int
+	watcher.OnReload(func(props AppConfigProperties, changed map[string]bool) error {
+		reloaded = append(reloaded, props.FetchAsInt("capacity"))
+		return nil
+	})
+
+
+	// when
+	if err := os.WriteFile(filename, []byte("workers=10\ncapacity=200\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rejected := watcher.Reload()
+
+	if err := os.WriteFile(filename, []byte("workers=10\ncapacity=30\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	applied := watcher.Reload()
+
+
+	// then
+	if rejected != nil {
+		t.Errorf("a change which requires a restart should not be applied, got: %v", rejected)
+	}
+	if len(applied) != 1 || applied[0].Old != "20" || applied[0].New != "30" {
+		t.Errorf("expected the running value to have been kept, then the change to be applied, got: %v", applied)
+	}
+	if len(reloaded) != 1 || reloaded[0] != 30 {
+		t.Errorf("expected the handlers to get the allowed change only, got: %v", reloaded)
+	}
+}
@@ -2,26 +2,55 @@ package fileutil
 
 import (
 	"bufio"
-	log "github.com/sirupsen/logrus"
-	"os"
+	"bytes"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type AppConfigProperties struct {
 	v map[string]string
+
+	// Note: how the properties were loaded, so they can be reloaded the same way.
+	source *configSource
+}
+
+type configSource struct {
+	filename  string
+	files     []string // Note: the file and its includes
+	envPrefix string
+	overrides PropertyOverrides
 }
 
 
 func (props AppConfigProperties) FetchAsInt(label string) int {
 
-	value, exists := props.v[label]
+	v, err := strconv.Atoi(props.fetch(label))
+	if err != nil {
+		panic(err)
+	}
 
-	if !exists {
-		panic("label: "+ label + " is not defined in props")
+	return v
+}
+
+func (props AppConfigProperties) FetchAsString(label string) string {
+	return props.fetch(label)
+}
+
+func (props AppConfigProperties) FetchAsBool(label string) bool {
+
+	v, err := strconv.ParseBool(props.fetch(label))
+	if err != nil {
+		panic(err)
 	}
 
-	v, err := strconv.Atoi(value)
+	return v
+}
+
+// FetchAsDuration parses values like 1500ms, 2s, 1m30s, a plain number is in milliseconds (eg: snapshotIntervalMs=60000)
+func (props AppConfigProperties) FetchAsDuration(label string) time.Duration {
+
+	v, err := parseDuration(props.fetch(label))
 	if err != nil {
 		panic(err)
 	}
@@ -29,26 +58,99 @@ func (props AppConfigProperties) FetchAsInt(label string) int {
 	return v
 }
 
-func (props AppConfigProperties) PrintInfo() {
-	log.Debugln("AppConfigProperties loaded: ", props.v)
+// FetchAsStringList splits a comma separated value, blank elements are skipped
+func (props AppConfigProperties) FetchAsStringList(label string) []string {
+	return splitList(props.fetch(label))
 }
 
-func ReadPropertiesFile(filename string) AppConfigProperties {
-	config := AppConfigProperties{v: make(map[string]string)}
 
-	if len(filename) == 0 {
-		return config
+// ------------------- with defaults -------------------
+// Note: the default is returned only when the label is missing, a malformed value still panics.
+
+func (props AppConfigProperties) FetchAsIntOrDefault(label string, defaultValue int) int {
+	if !props.Has(label) {
+		return defaultValue
 	}
-	file, err := os.Open(filename)
-	if err != nil {
-		panic(err)
+	return props.FetchAsInt(label)
+}
+
+func (props AppConfigProperties) FetchAsStringOrDefault(label string, defaultValue string) string {
+	if !props.Has(label) {
+		return defaultValue
+	}
+	return props.FetchAsString(label)
+}
+
+func (props AppConfigProperties) FetchAsBoolOrDefault(label string, defaultValue bool) bool {
+	if !props.Has(label) {
+		return defaultValue
 	}
+	return props.FetchAsBool(label)
+}
 
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
+func (props AppConfigProperties) FetchAsDurationOrDefault(label string, defaultValue time.Duration) time.Duration {
+	if !props.Has(label) {
+		return defaultValue
+	}
+	return props.FetchAsDuration(label)
+}
 
-	scanner := bufio.NewScanner(file)
+func (props AppConfigProperties) FetchAsStringListOrDefault(label string, defaultValue []string) []string {
+	if !props.Has(label) {
+		return defaultValue
+	}
+	return props.FetchAsStringList(label)
+}
+
+
+func (props AppConfigProperties) Has(label string) bool {
+	_, exists := props.v[label]
+	return exists
+}
+
+func (props AppConfigProperties) Set(label string, value string) {
+	props.v[label] = strings.TrimSpace(value)
+}
+
+func (props AppConfigProperties) fetch(label string) string {
+
+	value, exists := props.v[label]
+
+	if !exists {
+		panic("label: "+ label + " is not defined in props")
+	}
+
+	return value
+}
+
+// parseDuration a plain number is in milliseconds, so the ...Ms properties keep their values.
+func parseDuration(value string) (time.Duration, error) {
+	if ms, err := strconv.Atoi(value); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); len(element) > 0 {
+			list = append(list, element)
+		}
+	}
+	return list
+}
+
+// ReadPropertiesFile is kept for compatibility, the format is picked by the extension of the file (see ReadConfigFile)
+func ReadPropertiesFile(filename string) AppConfigProperties {
+	return ReadConfigFile(filename)
+}
+
+// parseProperties parses the flat label=value format, lines starting with # are comments
+func parseProperties(content []byte) (map[string]string, error) {
+	properties := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
 	for scanner.Scan() {
 
 		line := scanner.Text()
@@ -63,16 +165,12 @@ func ReadPropertiesFile(filename string) AppConfigProperties {
 					if len(line) > equal {
 						value = strings.TrimSpace(line[equal+1:])
 					}
-					config.v[key] = value
+					properties[key] = value
 				}
 			}
 
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		panic(err)
-	}
-
-	return config
-}
\ No newline at end of file
+	return properties, scanner.Err()
+}
@@ -0,0 +1,102 @@
+package fileutil
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+/*
+	A file sink (eg: for the logs) which rotates the file when it exceeds the max size:
+
+		info.log --> info.log.1 --> info.log.2 --> ... --> info.log.<maxBackups> --> deleted
+*/
+
+type RotatingFileWriter struct {
+	mutex sync.Mutex
+
+	filename   string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func RotatingFileWriterCreateNew(filename string, maxSize int64, maxBackups int) (*RotatingFileWriter, error) {
+	w := &RotatingFileWriter{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingFileWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// Note: a single write bigger than the max size still goes to a (fresh) file.
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingFileWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.file.Close()
+}
+
+func (w *RotatingFileWriter) open() error {
+	file, err := os.OpenFile(w.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *RotatingFileWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	if w.maxBackups <= 0 {
+		_ = os.Remove(w.filename)
+		return w.open()
+	}
+
+	_ = os.Remove(w.backup(w.maxBackups))
+	for i := w.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(w.backup(i), w.backup(i+1))
+	}
+	if err := os.Rename(w.filename, w.backup(1)); err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+func (w *RotatingFileWriter) backup(i int) string {
+	return w.filename + "." + strconv.Itoa(i)
+}
@@ -0,0 +1,40 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFileWriter_keepsMaxBackups(t *testing.T) {
+
+	// given
+	filename := filepath.Join(t.TempDir(), "info.log")
+	writer, err := RotatingFileWriterCreateNew(filename, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = writer.Close()
+	}()
+
+
+	// when
+	for _, line := range []string{"line-0001\n", "line-0002\n", "line-0003\n", "line-0004\n"} {
+		if _, err := writer.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+
+	// then
+	for file, expected := range map[string]string{filename: "line-0004\n", filename + ".1": "line-0003\n", filename + ".2": "line-0002\n"} {
+		content, err := os.ReadFile(file)
+		if err != nil || string(content) != expected {
+			t.Errorf("file: %v, expected: %q, got: %q (%v)", file, expected, content, err)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only 2 backups should have been kept")
+	}
+}
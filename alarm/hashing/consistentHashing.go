@@ -0,0 +1,132 @@
+package hashing
+
+import (
+	"sort"
+	"strconv"
+)
+
+/*
+	Consistent hash ring with virtual nodes.
+
+	Each node (eg: a worker id) is placed on the ring virtualNodes times, and a key belongs to the first virtual node
+	found clockwise from the hash of the key. So adding or removing a node only remaps ~1/N of the keys, instead of
+	almost all of them as the hash(key) % N approach does.
+
+	Note: the ring is immutable (Add/Remove return a new ring), so it can be shared between goroutines without locks.
+*/
+
+const DefaultVirtualNodes = 100
+
+type ConsistentHashRing struct {
+	virtualNodes int
+
+	nodes []uint32
+	ring  []virtualNode
+}
+
+type virtualNode struct {
+	hash uint32
+	node uint32
+}
+
+func ConsistentHashRingCreateNew(virtualNodes int, nodes ...uint32) *ConsistentHashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+
+	r := &ConsistentHashRing{virtualNodes: virtualNodes}
+	for _, node := range nodes {
+		if !r.Contains(node) {
+			r.nodes = append(r.nodes, node)
+		}
+	}
+	r.build()
+
+	return r
+}
+
+func (r *ConsistentHashRing) Add(node uint32) *ConsistentHashRing {
+	if r.Contains(node) {
+		return r
+	}
+
+	nodes := append(append([]uint32(nil), r.nodes...), node)
+	return ConsistentHashRingCreateNew(r.virtualNodes, nodes...)
+}
+
+func (r *ConsistentHashRing) Remove(node uint32) *ConsistentHashRing {
+	nodes := make([]uint32, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		if n != node {
+			nodes = append(nodes, n)
+		}
+	}
+	return ConsistentHashRingCreateNew(r.virtualNodes, nodes...)
+}
+
+func (r *ConsistentHashRing) Contains(node uint32) bool {
+	for _, n := range r.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ConsistentHashRing) Nodes() []uint32 {
+	nodes := append([]uint32(nil), r.nodes...)
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i] < nodes[j]
+	})
+	return nodes
+}
+
+func (r *ConsistentHashRing) Size() int {
+	return len(r.nodes)
+}
+
+// Locate returns the node which owns the key, panics if the ring is empty.
+func (r *ConsistentHashRing) Locate(key string) uint32 {
+	if len(r.ring) == 0 {
+		panic("consistent hash ring has no nodes")
+	}
+
+	hashedKey := mix32(Hash(key))
+
+	idx := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].hash >= hashedKey
+	})
+	if idx == len(r.ring) {
+		idx = 0 // Note: wrap around.
+	}
+
+	return r.ring[idx].node
+}
+
+func (r *ConsistentHashRing) build() {
+	r.ring = make([]virtualNode, 0, len(r.nodes)*r.virtualNodes)
+
+	for _, node := range r.nodes {
+		for v := 0; v < r.virtualNodes; v++ {
+			h := mix32(Hash(strconv.FormatUint(uint64(node), 10) + "#" + strconv.Itoa(v)))
+			r.ring = append(r.ring, virtualNode{hash: h, node: node})
+		}
+	}
+
+	sort.Slice(r.ring, func(i, j int) bool {
+		if r.ring[i].hash == r.ring[j].hash {
+			return r.ring[i].node < r.ring[j].node
+		}
+		return r.ring[i].hash < r.ring[j].hash
+	})
+}
+
+// mix32 the murmur3 finalizer, fnv on short similar strings clusters a lot, so we spread the bits.
+func mix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,90 @@
+package hashing
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestConsistentHashRing_locateIsStable(t *testing.T) {
+
+	ring := ConsistentHashRingCreateNew(DefaultVirtualNodes, 0, 1, 2, 3)
+
+	for i := 0; i < 25; i++ {
+		if ring.Locate("10baeb6b-199f-4300-8db7-1acbe744e3fc") != ring.Locate("10baeb6b-199f-4300-8db7-1acbe744e3fc") {
+			t.FailNow()
+		}
+	}
+}
+
+func TestConsistentHashRing_addingNodeRemapsOnlyFewKeys(t *testing.T) {
+
+	// given
+	totalKeys := 10000
+	ring := ConsistentHashRingCreateNew(DefaultVirtualNodes, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	before := make([]uint32, totalKeys)
+	for i := 0; i < totalKeys; i++ {
+		before[i] = ring.Locate("user-" + strconv.Itoa(i))
+	}
+
+
+	// when
+	newRing := ring.Add(10)
+
+
+	// then
+	moved := 0
+	for i := 0; i < totalKeys; i++ {
+		after := newRing.Locate("user-" + strconv.Itoa(i))
+		if after != before[i] {
+			moved++
+			if after != 10 {
+				t.Fatalf("key should only move to the new node, moved to: %v", after)
+			}
+		}
+	}
+
+	// Note: ideally 1/11 of the keys (~909), allow some skew.
+	if moved == 0 || moved > totalKeys/5 {
+		t.Errorf("unexpected number of remapped keys: %v", moved)
+	}
+}
+
+func TestConsistentHashRing_removingNodeRemapsOnlyItsKeys(t *testing.T) {
+
+	// given
+	totalKeys := 10000
+	ring := ConsistentHashRingCreateNew(DefaultVirtualNodes, 0, 1, 2, 3, 4)
+
+
+	// when
+	newRing := ring.Remove(2)
+
+
+	// then
+	if newRing.Contains(2) || newRing.Size() != 4 {
+		t.Fatalf("node should have been removed, nodes: %v", newRing.Nodes())
+	}
+	for i := 0; i < totalKeys; i++ {
+		key := "user-" + strconv.Itoa(i)
+		if ring.Locate(key) != 2 && ring.Locate(key) != newRing.Locate(key) {
+			t.Fatalf("key: %v not owned by the removed node should not move", key)
+		}
+	}
+}
+
+func TestConsistentHashRing_distribution(t *testing.T) {
+
+	ring := ConsistentHashRingCreateNew(DefaultVirtualNodes, 0, 1, 2, 3, 4)
+
+	keysByNode := make(map[uint32]int)
+	for i := 0; i < 10000; i++ {
+		keysByNode[ring.Locate("user-"+strconv.Itoa(i))]++
+	}
+
+	for node, keys := range keysByNode {
+		// Note: ideally 2000 keys per node.
+		if keys < 1000 || keys > 3000 {
+			t.Errorf("node: %v owns %v keys, distribution is too skewed", node, keys)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package health
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+	Probes of the service (see admin /healthz and /readyz):
+
+	* readiness --> can the service do its job now? eg: connected to nats, subscribed, workers started
+	* liveness  --> is the service making progress? eg: no worker stuck on its mailbox, no producer blocked on publish,
+	                a failing liveness means the process should be restarted
+*/
+
+// HealthCheck returns nil when healthy, the error is reported as the reason otherwise.
+type HealthCheck func() error
+
+type HealthReport struct {
+	Healthy bool
+	Checks  map[string]string // Note: name --> "ok" or the reason
+}
+
+type HealthChecks struct {
+	mutex sync.RWMutex
+
+	readiness map[string]HealthCheck
+	liveness  map[string]HealthCheck
+}
+
+func HealthChecksCreateNew() *HealthChecks {
+	return &HealthChecks{
+		readiness: make(map[string]HealthCheck),
+		liveness:  make(map[string]HealthCheck),
+	}
+}
+
+func (h *HealthChecks) AddReadinessCheck(name string, check HealthCheck) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.readiness[name] = check
+}
+
+func (h *HealthChecks) AddLivenessCheck(name string, check HealthCheck) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.liveness[name] = check
+}
+
+func (h *HealthChecks) Readiness() HealthReport {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return run(h.readiness)
+}
+
+func (h *HealthChecks) Liveness() HealthReport {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return run(h.liveness)
+}
+
+func run(checks map[string]HealthCheck) HealthReport {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := HealthReport{Healthy: true, Checks: make(map[string]string, len(checks))}
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			report.Healthy = false
+			report.Checks[name] = err.Error()
+		} else {
+			report.Checks[name] = "ok"
+		}
+	}
+	return report
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	. "alarm/error"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the read-only resources of the admin api, see admin/
+var inspectPaths = map[string]string{
+	"workers": "/admin/workers",
+	"metrics": "/metrics",
+	"health":  "/healthz",
+	"ready":   "/readyz",
+}
+
+func inspectCommand(args []string) {
+
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	configFile, configOverrides := configFlags(flags)
+	adminUrl := flags.String("admin-url", "", "the admin api of the service (default: http://127.0.0.1:<adminHttpPort of the config>)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: alarm inspect [flags] workers|metrics|health|ready")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		panic(InvalidCommandError{Msg: "inspect expects exactly one resource"})
+	}
+	path, exists := inspectPaths[flags.Arg(0)]
+	if !exists {
+		flags.Usage()
+		panic(InvalidCommandError{Msg: "unknown resource to inspect: " + flags.Arg(0)})
+	}
+
+	if len(*adminUrl) == 0 {
+		props := loadClientConfig(*configFile, configOverrides)
+		port := props.FetchAsInt("adminHttpPort")
+		if port <= 0 {
+			panic(InvalidCommandError{Msg: "the admin api is disabled in the config (adminHttpPort), use --admin-url"})
+		}
+		*adminUrl = "http://127.0.0.1:" + strconv.Itoa(port)
+	}
+
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(*adminUrl + path)
+	if err != nil {
+		panic(CouldNotQueryAdminServerError{Msg: err.Error()})
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(CouldNotQueryAdminServerError{Msg: err.Error()})
+	}
+
+	// Note: json is indented for reading, the rest (eg: prometheus text format) is printed as is.
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	fmt.Println(string(bytes.TrimSpace(body)))
+
+	// Note: eg: not ready --> non zero exit code, so the command can be used in scripts.
+	if resp.StatusCode >= 300 {
+		panic(CouldNotQueryAdminServerError{Msg: path + " responded with " + resp.Status})
+	}
+}
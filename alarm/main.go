@@ -2,28 +2,71 @@ package main
 
 import (
 	. "alarm/error"
-	. "alarm/fileutil"
-	. "alarm/message"
-	log "github.com/sirupsen/logrus"
+	"fmt"
+	"os"
+	"strings"
 )
 
+/*
+	Usage: alarm <command> [flags], see: alarm <command> --help
+
+		serve          runs the service (the default command, eg: alarm --config config.properties)
+		emulate        publishes generated traffic to the input topics of a running service
+		verify         publishes scenarios to a running service and asserts on its AlarmDigest messages
+		record         records the input traffic of a service to a file
+		replay         republishes a recording, with its timing
+		inspect        queries the admin api of a running service (workers, metrics, health, ready)
+		config check   validates a config file and prints the effective config
+*/
+
+type command struct {
+	name        string
+	description string
+	run         func(args []string)
+}
+
+var commands = []command{
+	{name: "serve", description: "runs the service (default)", run: serveCommand},
+	{name: "emulate", description: "publishes generated traffic to a running service", run: emulateCommand},
+	{name: "verify", description: "publishes scenarios to a running service and asserts on its AlarmDigest messages", run: verifyCommand},
+	{name: "record", description: "records the input traffic of a service to a file", run: recordCommand},
+	{name: "replay", description: "republishes a recording, with its timing", run: replayCommand},
+	{name: "inspect", description: "queries the admin api of a running service", run: inspectCommand},
+	{name: "config", description: "config check: validates a config file and prints the effective config", run: configCommand},
+}
+
 func main() {
 
+	// Note: errors of the commands (eg: invalid configuration) are reported the same way as the ones of the service
+	defer GlobalErrorHandler()
 
-	// get the connection to nats server
-	serverConnection, err := ServerConnection()
-	if err != nil {
-		panic(CouldNotConnectToServerError{Msg: err.Error()})
+	args := os.Args[1:]
+
+	// Note: no command (or flags only) runs the service, as before the commands were introduced.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		serveCommand(args)
+		return
 	}
-	defer func() {
-		log.Debugf("[DEFER-CLEAR-RESOURCES] will close nats server connection now...")
-		serverConnection.Close()
-	}()
 
+	for _, c := range commands {
+		if c.name == args[0] {
+			c.run(args[1:])
+			return
+		}
+	}
 
-	// get properties
-	props := ReadPropertiesFile("config.properties")
-	props.PrintInfo()
+	printUsage()
+	if args[0] != "help" {
+		panic(InvalidCommandError{Msg: "unknown command: " + args[0]})
+	}
+}
 
-	BootstrapAlarmService(serverConnection, &props, false)
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: alarm <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10v %v\n", c.name, c.description)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run 'alarm <command> --help' for the flags of a command.")
 }
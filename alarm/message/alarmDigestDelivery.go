@@ -0,0 +1,340 @@
+package message
+
+import (
+	. "alarm/domain"
+	. "alarm/metrics"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Delivery of the digests:
+
+	* fire      --> the active alarms are flushed as soon as the digest is queued to the producers (default)
+	* confirm   --> the digest carries a DigestID and its alarms stay pending until an AlarmDigestDelivered message with
+	                that id arrives (see AlarmDigestDeliveredTopic)
+	* jetstream --> as confirm, but the digests are published to a JetStream stream and the ack of the consumer (of any
+	                durable consumer of the stream) confirms them, AlarmDigestDelivered messages are accepted as well
+
+	A confirmation clears the alarms of the digest which have not changed since (a changed one goes out with the next
+	digest). A user has at most one pending digest, the next digest includes its alarms anyway (they were not cleared)
+	and takes its place.
+
+	Unconfirmed digests, after the confirm timeout:
+
+	* resend --> the same digest (same DigestID) is published again, up to max resends, then merged
+	* merge  --> the digest is forgotten, its alarms stay active so the next digest of the user includes them
+
+	Pending digests do not move with the users on resharding and are not part of the snapshots, their alarms are, so
+	they get merged. A late confirmation of a forgotten digest is ignored.
+*/
+
+type DigestDeliveryMode string
+
+const (
+	DigestDeliveryFireAndForget DigestDeliveryMode = "fire"
+	DigestDeliveryConfirm       DigestDeliveryMode = "confirm"
+	DigestDeliveryJetStream     DigestDeliveryMode = "jetstream"
+)
+
+type UnconfirmedDigestPolicy string
+
+const (
+	ResendUnconfirmedDigests UnconfirmedDigestPolicy = "resend"
+	MergeUnconfirmedDigests  UnconfirmedDigestPolicy = "merge"
+)
+
+type AlarmDigestDeliveryOptions struct {
+	Mode           DigestDeliveryMode
+	ConfirmTimeout time.Duration
+	Unconfirmed    UnconfirmedDigestPolicy
+	MaxResends     int
+
+	// Note: only for the jetstream mode, the stream of the AlarmDigest topic.
+	StreamName string
+}
+
+const (
+	digestConfirmed = "confirmed"
+	digestResent    = "resent"
+	digestMerged    = "merged"
+	digestUnknown   = "unknown"
+)
+
+var digestDeliveriesCounter = CounterVecCreateNew("alarm_digest_deliveries_total", "Digests awaiting a delivery confirmation, by outcome.", "result")
+
+var ErrStreamNotSupported = errors.New("transport does not support streams (JetStream)")
+
+type pendingDigest struct {
+	digest  AlarmDigestMessage // Note: with its DigestId, published again as is
+	sentAt  time.Time
+	resends int
+}
+
+type digestDeliveredControlMessage struct {
+	userId   UserId
+	digestId string
+}
+
+type digestDeliveryCheckControlMessage struct{}
+
+func (o AlarmDigestDeliveryOptions) confirmsDelivery() bool {
+	return o.Mode == DigestDeliveryConfirm || o.Mode == DigestDeliveryJetStream
+}
+
+
+// ------------------- tracker -------------------
+
+type AlarmDigestDeliveryTracker struct {
+	workerPool *AlarmMessageWorkerPool
+	transport  Transport
+	options    AlarmDigestDeliveryOptions
+	tenants    *TenantRegistry // Note: nil when multi-tenancy is disabled
+
+	// Note: jetstream mode, the stream sequences of the published digests (written by the producers).
+	streamLock      sync.Mutex
+	streamSequences map[uint64]publishedDigest
+
+	subscriptions []TransportSubscription
+	stop          chan struct{}
+}
+
+type publishedDigest struct {
+	userId      string
+	digestId    string
+	publishedAt time.Time
+}
+
+func AlarmDigestDeliveryTrackerCreateNew(workerPool *AlarmMessageWorkerPool, transport Transport, tenants *TenantRegistry, options AlarmDigestDeliveryOptions) (*AlarmDigestDeliveryTracker, error) {
+	if options.Mode == DigestDeliveryJetStream {
+		streamTransport, supported := transport.(StreamTransport)
+		if !supported {
+			return nil, ErrStreamNotSupported
+		}
+		if err := streamTransport.EnsureStream(options.StreamName, tenants.Subjects(Topics().AlarmDigest)...); err != nil {
+			return nil, err
+		}
+	}
+
+	return &AlarmDigestDeliveryTracker{
+		workerPool:      workerPool,
+		transport:       transport,
+		tenants:         tenants,
+		options:         options,
+		streamSequences: make(map[uint64]publishedDigest),
+		stop:            make(chan struct{}),
+	}, nil
+}
+
+func (t *AlarmDigestDeliveryTracker) Start() {
+	if t.tenants == nil {
+		t.subscriptions = append(t.subscriptions, AsyncSubscribe(t.transport, Topics().AlarmDigestDelivered, func(msg *TransportMessage) {
+			t.onDelivered(msg, "")
+		}))
+	}
+	for _, name := range t.tenants.Names() {
+		tenant := name
+		t.subscriptions = append(t.subscriptions, AsyncSubscribe(t.transport, TenantSubject(tenant, Topics().AlarmDigestDelivered), func(msg *TransportMessage) {
+			t.onDelivered(msg, tenant)
+		}))
+	}
+	if t.options.Mode == DigestDeliveryJetStream {
+		t.subscriptions = append(t.subscriptions, AsyncSubscribe(t.transport, "$JS.ACK."+t.options.StreamName+".>", t.onStreamAck))
+	}
+
+	// Note: a digest is detected as unconfirmed at most a quarter of the timeout late.
+	checkInterval := t.options.ConfirmTimeout / 4
+	if checkInterval < 10*time.Millisecond {
+		checkInterval = 10 * time.Millisecond
+	}
+
+	go func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				t.Check()
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (t *AlarmDigestDeliveryTracker) Stop() {
+	close(t.stop)
+	for _, subscription := range t.subscriptions {
+		AsyncUnsubscribe(subscription, subscription.Subject())
+	}
+}
+
+func (t *AlarmDigestDeliveryTracker) Subscriptions() []TransportSubscription {
+	return t.subscriptions
+}
+
+// Confirm the digest has been delivered, to the worker which owns the user.
+func (t *AlarmDigestDeliveryTracker) Confirm(userId string, digestId string) {
+	t.workerPool.sendToOwner(userId, &digestDeliveredControlMessage{userId: UserId(userId), digestId: digestId}, nil)
+}
+
+// Check sends a check of the unconfirmed digests to the mailbox of every worker.
+func (t *AlarmDigestDeliveryTracker) Check() {
+	for _, worker := range t.workerPool.Workers() {
+		select {
+		case worker.controlMessages <- &digestDeliveryCheckControlMessage{}:
+		default:
+			log.Warnf("[%v] control mailbox is full, skipping digest delivery check\n", worker.workerName)
+		}
+	}
+
+	// Note: a resent digest gets a new sequence, the old one can still be acked a while.
+	expiredBefore := time.Now().Add(-time.Duration(t.options.MaxResends+2) * t.options.ConfirmTimeout)
+	t.streamLock.Lock()
+	for sequence, published := range t.streamSequences {
+		if published.publishedAt.Before(expiredBefore) {
+			delete(t.streamSequences, sequence)
+		}
+	}
+	t.streamLock.Unlock()
+}
+
+// onDelivered the confirmation of a consumer, of a user of the tenant (if any).
+func (t *AlarmDigestDeliveryTracker) onDelivered(msg *TransportMessage, tenant string) {
+	var delivered AlarmDigestDeliveredMessage
+	if err := json.Unmarshal(msg.Data, &delivered); err != nil || len(delivered.UserId) == 0 || len(delivered.DigestId) == 0 {
+		onBadFormattedMessage(t.transport, "alarmDigestDeliveryTracker", msg, errors.New("bad formatted message, UserID and DigestID are required"), true)
+		return
+	}
+	if len(tenant) > 0 {
+		delivered.UserId = TenantUserId(tenant, delivered.UserId)
+	}
+	t.Confirm(delivered.UserId, delivered.DigestId)
+}
+
+// usesStream true if the producers publish the digests to the stream.
+func (t *AlarmDigestDeliveryTracker) usesStream() bool {
+	return t != nil && t.options.Mode == DigestDeliveryJetStream
+}
+
+func (t *AlarmDigestDeliveryTracker) publishToStream(msg *TransportMessage, digest *AlarmDigestMessage) error {
+	sequence, err := t.transport.(StreamTransport).PublishToStream(msg)
+	if err != nil || len(digest.DigestId) == 0 {
+		return err
+	}
+
+	t.streamLock.Lock()
+	t.streamSequences[sequence] = publishedDigest{userId: digest.UserId, digestId: digest.DigestId, publishedAt: time.Now()}
+	t.streamLock.Unlock()
+	return nil
+}
+
+func (t *AlarmDigestDeliveryTracker) onStreamAck(msg *TransportMessage) {
+	// Note: a negative ack, in progress or terminated is not a delivery.
+	if len(msg.Data) > 0 && !strings.HasPrefix(string(msg.Data), "+ACK") && !strings.HasPrefix(string(msg.Data), "+NXT") {
+		return
+	}
+
+	sequence, valid := streamSequenceOfAck(msg.Subject)
+	if !valid {
+		log.Warnf("unexpected JetStream ack subject: %v\n", msg.Subject)
+		return
+	}
+
+	t.streamLock.Lock()
+	published, exists := t.streamSequences[sequence]
+	delete(t.streamSequences, sequence)
+	t.streamLock.Unlock()
+
+	if exists {
+		t.Confirm(published.userId, published.digestId)
+	}
+}
+
+// streamSequenceOfAck $JS.ACK.<stream>.<consumer>.<delivered>.<stream sequence>.<consumer sequence>.<timestamp>.<pending>
+func streamSequenceOfAck(subject string) (uint64, bool) {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) != 9 {
+		return 0, false
+	}
+
+	sequence, err := strconv.ParseUint(tokens[5], 10, 64)
+	return sequence, err == nil
+}
+
+
+// ------------------- worker -------------------
+
+// RequireDeliveryConfirmation the worker clears the alarms of a digest once it is delivered, to be called before it
+// starts consuming.
+func (w *AlarmMessageWorker) RequireDeliveryConfirmation(options AlarmDigestDeliveryOptions) {
+	w.deliveryOptions = options
+}
+
+func (w *AlarmMessageWorker) awaitDelivery(userId UserId, digest AlarmDigestMessage) {
+	w.pendingDigests[userId] = &pendingDigest{digest: digest, sentAt: w.now()}
+}
+
+func newDigestId() string {
+	return uuid.New().String()
+}
+
+func (w *AlarmMessageWorker) handleDigestDelivered(delivered *digestDeliveredControlMessage) {
+	pending, exists := w.pendingDigests[delivered.userId]
+	if !exists || pending.digest.DigestId != delivered.digestId {
+		digestDeliveriesCounter.WithLabelValues(digestUnknown).Inc()
+		log.Debugf("[%v] delivery of unknown digest: %v of user: %v\n", w.workerName, delivered.digestId, delivered.userId)
+		return
+	}
+	delete(w.pendingDigests, delivered.userId)
+
+	activeAlarms := w.activeAlarms[delivered.userId]
+	cleared := make([]string, 0, len(pending.digest.ActiveAlarms))
+	for _, sent := range pending.digest.ActiveAlarms {
+		alarm, active := activeAlarms[AlarmId(sent.AlarmId)]
+		if !active || AlarmStatusAsString(alarm.Status) != sent.Status || !alarmLatestChangedAt(alarm).Equal(sent.LatestChangedAt) ||
+			(alarm.EscalatedAfter > 0) != sent.Escalated {
+			continue // Note: changed (or escalated) since, it goes out with the next digest
+		}
+		delete(activeAlarms, AlarmId(sent.AlarmId))
+		cleared = append(cleared, sent.AlarmId)
+	}
+
+	if len(cleared) > 0 {
+		w.appendToWal(walEntry{Kind: walDigestConfirmed, UserId: string(delivered.userId), AlarmIds: cleared})
+	}
+	digestDeliveriesCounter.WithLabelValues(digestConfirmed).Inc()
+}
+
+func (w *AlarmMessageWorker) handleDigestDeliveryCheck() {
+	now := w.now()
+
+	for userId, pending := range w.pendingDigests {
+		if now.Sub(pending.sentAt) < w.deliveryOptions.ConfirmTimeout {
+			continue
+		}
+
+		if w.deliveryOptions.Unconfirmed == ResendUnconfirmedDigests && pending.resends < w.deliveryOptions.MaxResends {
+			if l := messageLog(pending.digest.CorrelationId, "worker", w.workerName); l != nil {
+				l.Debugf("worker will send again unconfirmed AlarmDigestMessage message: %v\n", pending.digest)
+			}
+			*w.alarmDigestMessages <- pending.digest
+
+			pending.sentAt = now
+			pending.resends++
+			digestDeliveriesCounter.WithLabelValues(digestResent).Inc()
+			continue
+		}
+
+		// Note: the alarms are still active, the next digest includes them.
+		delete(w.pendingDigests, userId)
+		digestDeliveriesCounter.WithLabelValues(digestMerged).Inc()
+	}
+}
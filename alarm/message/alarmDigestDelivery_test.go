@@ -0,0 +1,224 @@
+package message
+
+import (
+	. "alarm/domain"
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"testing"
+	"time"
+)
+
+func waitForPendingDigestAlarms(t *testing.T, transport Transport, userId string, expected int) {
+	for tries := 0; tries < 500; tries++ {
+		reply := queryOverTransport(t, transport, AlarmQueryStatsTopic, AlarmQueryMessage{UserId: userId})
+		if reply.Stats != nil && reply.Stats.PendingDigest == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("user: %v did not get %v alarms pending for the digest", userId, expected)
+}
+
+func TestAlarmMessageWorker_digestDelivery_confirmClearsOnlyUnchangedAlarms(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+	worker.RequireDeliveryConfirmation(AlarmDigestDeliveryOptions{Mode: DigestDeliveryConfirm, ConfirmTimeout: time.Minute})
+
+	changeAlarm(worker, "u1", "a1", CRITICAL, now)
+	changeAlarm(worker, "u1", "a2", WARNING, now)
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1"})
+	digest := <-*worker.alarmDigestMessages
+	changeAlarm(worker, "u1", "a2", CRITICAL, now.Add(time.Second))
+
+
+	// when
+	worker.handleDigestDelivered(&digestDeliveredControlMessage{userId: "u1", digestId: "other"})
+	unknownKeepsAlarms := len(worker.activeAlarms["u1"])
+	worker.handleDigestDelivered(&digestDeliveredControlMessage{userId: "u1", digestId: digest.DigestId})
+
+
+	// then
+	if len(digest.DigestId) == 0 || len(digest.ActiveAlarms) != 2 {
+		t.Fatalf("expected a digest with an id and 2 alarms, got: %v", digest)
+	}
+	if unknownKeepsAlarms != 2 {
+		t.Errorf("the confirmation of an unknown digest should not clear the alarms")
+	}
+	if _, pending := worker.activeAlarms["u1"]["a2"]; len(worker.activeAlarms["u1"]) != 1 || !pending {
+		t.Errorf("expected only the changed alarm to stay pending, got: %v", worker.activeAlarms["u1"])
+	}
+	if len(worker.pendingDigests) != 0 {
+		t.Errorf("expected the confirmed digest to be forgotten")
+	}
+}
+
+func TestAlarmMessageWorker_digestDelivery_resendsThenMergesUnconfirmedDigests(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+	worker.RequireDeliveryConfirmation(AlarmDigestDeliveryOptions{Mode: DigestDeliveryConfirm, ConfirmTimeout: time.Minute,
+		Unconfirmed: ResendUnconfirmedDigests, MaxResends: 1})
+
+	changeAlarm(worker, "u1", "a1", CRITICAL, now)
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1"})
+	digest := <-*worker.alarmDigestMessages
+
+
+	// when
+	now = now.Add(30 * time.Second)
+	worker.handleDigestDeliveryCheck()
+	early := len(*worker.alarmDigestMessages)
+
+	now = now.Add(30 * time.Second)
+	worker.handleDigestDeliveryCheck()
+
+
+	// then
+	if early != 0 {
+		t.Errorf("expected no resend before the confirm timeout")
+	}
+	if resent := <-*worker.alarmDigestMessages; resent.DigestId != digest.DigestId || len(resent.ActiveAlarms) != 1 {
+		t.Errorf("expected the same digest to be sent again, got: %v", resent)
+	}
+
+	now = now.Add(time.Minute)
+	worker.handleDigestDeliveryCheck()
+	if len(*worker.alarmDigestMessages) != 0 || len(worker.pendingDigests) != 0 {
+		t.Errorf("expected the digest to be merged after the max resends")
+	}
+
+	changeAlarm(worker, "u1", "a2", WARNING, now)
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1"})
+	if merged := <-*worker.alarmDigestMessages; len(merged.ActiveAlarms) != 2 || merged.DigestId == digest.DigestId {
+		t.Errorf("expected the next digest to include the unconfirmed alarms, got: %v", merged)
+	}
+}
+
+/*
+	Scenario:
+
+	* a user's alarm gets CRITICAL and a digest is requested, through the pool
+	* the consumer publishes AlarmDigestDelivered with the DigestID of the digest
+*/
+func TestAlarmDigestDeliveryTracker_confirmsOnTheDeliveredSubject(t *testing.T) {
+
+	// given
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	options := AlarmDigestDeliveryOptions{Mode: DigestDeliveryConfirm, ConfirmTimeout: time.Minute, Unconfirmed: MergeUnconfirmedDigests}
+	pool := testWorkerPool(2, &alarmDigestMessagesChan, func(worker *AlarmMessageWorker) {
+		worker.RequireDeliveryConfirmation(options)
+	})
+	transport := InMemoryTransportCreateNew()
+	subscriptions := RegisterAlarmQueryResponders("test", transport, pool, nil, time.Second)
+	defer func() {
+		for _, subscription := range subscriptions {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
+	}()
+
+	tracker, err := AlarmDigestDeliveryTrackerCreateNew(pool, transport, nil, options)
+	if err != nil {
+		t.Fatalf("could not create the tracker, error: %v", err)
+	}
+	tracker.Start()
+	defer tracker.Stop()
+
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CRITICAL", ChangedAt: time.Now()})
+	waitForProcessedMessages(t, pool, 1)
+	pool.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "u1"})
+	digest := <-alarmDigestMessagesChan
+	waitForPendingDigestAlarms(t, transport, "u1", 1)
+
+
+	// when
+	data, _ := json.Marshal(AlarmDigestDeliveredMessage{UserId: "u1", DigestId: digest.DigestId})
+	_ = transport.Publish(&TransportMessage{Subject: AlarmDigestDeliveredTopic, Data: data})
+
+
+	// then
+	waitForPendingDigestAlarms(t, transport, "u1", 0)
+}
+
+/*
+	Scenario:
+
+	* the digests are published to a JetStream stream by a producer
+	* a durable pull consumer fetches the digest and acks it
+*/
+func TestAlarmDigestDeliveryTracker_confirmsOnTheJetStreamAck(t *testing.T) {
+
+	// given
+	embeddedServer, err := StartEmbeddedServer(EmbeddedServerOptions{Port: EmbeddedServerRandomPort, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("could not start embedded server, error: %v", err)
+	}
+	defer StopEmbeddedServer(embeddedServer)
+
+	serverConnection, err := ServerConnectionTo(embeddedServer.ClientURL())
+	if err != nil {
+		t.Fatalf("could not connect to embedded server, error: %v", err)
+	}
+	defer serverConnection.Close()
+	transport := NatsTransportCreateNew(serverConnection)
+
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	options := AlarmDigestDeliveryOptions{Mode: DigestDeliveryJetStream, ConfirmTimeout: time.Minute, Unconfirmed: MergeUnconfirmedDigests, StreamName: "TEST_DIGESTS"}
+	pool := testWorkerPool(2, &alarmDigestMessagesChan, func(worker *AlarmMessageWorker) {
+		worker.RequireDeliveryConfirmation(options)
+	})
+	subscriptions := RegisterAlarmQueryResponders("test", transport, pool, nil, time.Second)
+	defer func() {
+		for _, subscription := range subscriptions {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
+	}()
+
+	tracker, err := AlarmDigestDeliveryTrackerCreateNew(pool, transport, nil, options)
+	if err != nil {
+		t.Fatalf("could not create the tracker, error: %v", err)
+	}
+	tracker.Start()
+	defer tracker.Stop()
+
+	producerName, producerId, topicName := "alarmDigestMessageProducer#0", 0, AlarmDigestTopic
+	producer := AlarmDigestMessageProducerCreateNew(&producerName, &producerId, &topicName, transport, &alarmDigestMessagesChan)
+	producer.TrackDeliveries(tracker)
+	go producer.Produce()
+	defer close(alarmDigestMessagesChan)
+
+	js, err := serverConnection.JetStream()
+	if err != nil {
+		t.Fatalf("could not get the JetStream context, error: %v", err)
+	}
+	consumer, err := js.PullSubscribe(AlarmDigestTopic, "digest-consumer")
+	if err != nil {
+		t.Fatalf("could not create the pull consumer, error: %v", err)
+	}
+
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CRITICAL", ChangedAt: time.Now()})
+	waitForProcessedMessages(t, pool, 1)
+	pool.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "u1"})
+	waitForPendingDigestAlarms(t, transport, "u1", 1)
+
+
+	// when
+	fetched, err := consumer.Fetch(1, nats.MaxWait(5*time.Second))
+	if err != nil || len(fetched) != 1 {
+		t.Fatalf("could not fetch the digest, error: %v", err)
+	}
+	var digest AlarmDigestMessage
+	_ = json.Unmarshal(fetched[0].Data, &digest)
+	if err := fetched[0].Ack(); err != nil {
+		t.Fatalf("could not ack the digest, error: %v", err)
+	}
+
+
+	// then
+	if len(digest.DigestId) == 0 || len(digest.ActiveAlarms) != 1 {
+		t.Errorf("expected a digest with an id, got: %v", digest)
+	}
+	waitForPendingDigestAlarms(t, transport, "u1", 0)
+}
@@ -0,0 +1,143 @@
+package message
+
+import (
+	. "alarm/domain"
+	. "alarm/metrics"
+	"strconv"
+	"time"
+)
+
+/*
+	Idempotent SendAlarmDigest: the first request flushes the active alarms, so a retry (the upstream did not see the
+	result) would get nothing. Every worker retains the latest digest it sent per user:
+
+	* request id window --> a request with the same RequestID as the latest digest of the user, within the window since it
+	                        was sent, gets that digest published again (with the correlation of the retry), nothing flushes. A request
+	                        answered without active alarms is retained as an empty digest, so its retry gets nothing again
+	* last digest ttl   --> how long the latest digest stays retrievable (AlarmQuery.LastDigest)
+
+	A digest is retained for the longer of the two, and moves with the user on resharding, is part of the snapshots and
+	gets rebuilt from the write-ahead log. Only the latest digest of a user is retained, so a retry after a newer request
+	does not get deduplicated. Requests without an id are never deduplicated.
+
+	0 disables both.
+*/
+
+type AlarmDigestReplayOptions struct {
+	RequestIdWindow time.Duration
+	LastDigestTtl   time.Duration
+}
+
+var digestsReplayedCounter = CounterVecCreateNew("alarm_digests_replayed_total", "Digests published again for a retried SendAlarmDigest request.", "worker")
+
+type retainedDigest struct {
+	requestId    string
+	sentAt       time.Time
+	activeAlarms []ActiveAlarm
+}
+
+type UserLastDigest struct {
+	UserId       string
+	RequestId    string
+	SentAt       time.Time
+	ActiveAlarms []ActiveAlarm
+}
+
+func (o AlarmDigestReplayOptions) retainFor() time.Duration {
+	if o.RequestIdWindow > o.LastDigestTtl {
+		return o.RequestIdWindow
+	}
+	return o.LastDigestTtl
+}
+
+
+// ------------------- worker -------------------
+
+// RetainDigests the worker keeps the latest digest of every user, to be called before it starts consuming.
+func (w *AlarmMessageWorker) RetainDigests(options AlarmDigestReplayOptions) {
+	w.digestReplayOptions = options
+}
+
+func (w *AlarmMessageWorker) retainDigest(userId UserId, requestId string, sentAt time.Time, activeAlarms []ActiveAlarm) {
+	// Note: an empty digest only matters to the retries of its request.
+	if w.digestReplayOptions.retainFor() <= 0 || (len(activeAlarms) == 0 && len(requestId) == 0) {
+		return
+	}
+	w.lastDigests[userId] = &retainedDigest{requestId: requestId, sentAt: sentAt, activeAlarms: activeAlarms}
+}
+
+// lastDigest the latest digest of the user, nil if none or expired (it gets forgotten on the next sweep).
+func (w *AlarmMessageWorker) lastDigest(userId UserId) *retainedDigest {
+	digest, exists := w.lastDigests[userId]
+	if !exists || w.now().Sub(digest.sentAt) > w.digestReplayOptions.retainFor() {
+		return nil
+	}
+	return digest
+}
+
+// retriedDigest the latest digest of the user if the request is its retry, nil otherwise.
+func (w *AlarmMessageWorker) retriedDigest(msg *SendAlarmDigestMessage) *retainedDigest {
+	if len(msg.RequestId) == 0 || w.digestReplayOptions.RequestIdWindow <= 0 {
+		return nil
+	}
+
+	digest := w.lastDigest(UserId(msg.UserId))
+	if digest == nil || digest.requestId != msg.RequestId || w.now().Sub(digest.sentAt) > w.digestReplayOptions.RequestIdWindow {
+		return nil
+	}
+	return digest
+}
+
+// replayDigest publishes the latest digest of the user again if the request is its retry, returns true if so.
+func (w *AlarmMessageWorker) replayDigest(msg *SendAlarmDigestMessage) bool {
+	digest := w.retriedDigest(msg)
+	if digest == nil {
+		return false
+	}
+
+	// Note: the request was answered without a digest, so is its retry.
+	if len(digest.activeAlarms) == 0 {
+		if l := messageLog(msg.CorrelationId, "worker", w.workerName); l != nil {
+			l.Debugf("worker will NOT send again AlarmDigestMessage message of request: %v - NO CRITICAL ALARMS at: %v\n", msg.RequestId, digest.sentAt)
+		}
+		return true
+	}
+
+	alarmDigestMessage := AlarmDigestMessage{
+		UserId:        msg.UserId,
+		ActiveAlarms:  append([]ActiveAlarm(nil), digest.activeAlarms...),
+		CorrelationId: msg.CorrelationId,
+		SpanContext:   msg.SpanContext,
+	}
+
+	if l := messageLog(msg.CorrelationId, "worker", w.workerName); l != nil {
+		l.Debugf("worker will send again AlarmDigestMessage message of request: %v, sent at: %v\n", msg.RequestId, digest.sentAt)
+	}
+	*w.alarmDigestMessages <- alarmDigestMessage
+
+	digestsReplayedCounter.WithLabelValues(strconv.Itoa(w.workerId)).Inc()
+	return true
+}
+
+// expireDigests forgets the digests retained for longer than needed, on every retention sweep.
+func (w *AlarmMessageWorker) expireDigests() {
+	for userId := range w.lastDigests {
+		if w.lastDigest(userId) == nil {
+			delete(w.lastDigests, userId)
+		}
+	}
+}
+
+func (w *AlarmMessageWorker) queriedLastDigest(userId UserId) *UserLastDigest {
+	digest := w.lastDigest(userId)
+	if digest == nil {
+		return nil
+	}
+
+	return &UserLastDigest{
+		UserId:       string(userId),
+		RequestId:    digest.requestId,
+		SentAt:       digest.sentAt,
+		ActiveAlarms: append([]ActiveAlarm(nil), digest.activeAlarms...),
+	}
+}
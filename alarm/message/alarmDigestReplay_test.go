@@ -0,0 +1,134 @@
+package message
+
+import (
+	. "alarm/domain"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAlarmMessageWorker_digestReplay_retriedRequestGetsTheSameDigest(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+	worker.RetainDigests(AlarmDigestReplayOptions{RequestIdWindow: 5 * time.Minute, LastDigestTtl: time.Hour})
+
+	changeAlarm(worker, "u1", "a1", CRITICAL, now)
+	changeAlarm(worker, "u1", "a2", WARNING, now.Add(time.Second))
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1", RequestId: "r1"})
+	first := <-*worker.alarmDigestMessages
+
+
+	// when
+	now = now.Add(time.Minute)
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1", RequestId: "r1", CorrelationId: "retry"})
+
+
+	// then
+	if len(*worker.alarmDigestMessages) != 1 {
+		t.Fatalf("expected the digest to be published again")
+	}
+	retried := <-*worker.alarmDigestMessages
+	if len(retried.ActiveAlarms) != 2 || retried.ActiveAlarms[0] != first.ActiveAlarms[0] || retried.ActiveAlarms[1] != first.ActiveAlarms[1] {
+		t.Errorf("expected the same digest: %v, got: %v", first.ActiveAlarms, retried.ActiveAlarms)
+	}
+	if retried.CorrelationId != "retry" {
+		t.Errorf("expected the correlation of the retry, got: %v", retried.CorrelationId)
+	}
+
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1", RequestId: "r2"})
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1"})
+	if len(*worker.alarmDigestMessages) != 0 {
+		t.Errorf("a new request should get an empty digest (nothing sent)")
+	}
+
+	// Note: the empty answer is retained as well, a retry gets nothing again even if an alarm got active meanwhile.
+	changeAlarm(worker, "u1", "a3", CRITICAL, now)
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1", RequestId: "r2"})
+	if len(*worker.alarmDigestMessages) != 0 {
+		t.Errorf("a retry of a request answered without alarms should get nothing again")
+	}
+
+	reply := make(chan *AlarmQueryReply, 1)
+	worker.handleAlarmQuery(&alarmQueryControlMessage{kind: lastDigestQuery, userId: "u1", reply: reply})
+	if lastDigest := (<-reply).LastDigest; lastDigest == nil || lastDigest.RequestId != "r2" || len(lastDigest.ActiveAlarms) != 0 {
+		t.Errorf("expected the empty last digest of the request to be retained, got: %v", lastDigest)
+	}
+
+	now = now.Add(5 * time.Minute)
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1", RequestId: "r1"})
+	if len(*worker.alarmDigestMessages) != 1 {
+		t.Fatalf("a retry after the window should get a new digest")
+	}
+	if fresh := <-*worker.alarmDigestMessages; len(fresh.ActiveAlarms) != 1 || fresh.ActiveAlarms[0].AlarmId != "a3" {
+		t.Errorf("expected the new digest of the retry after the window, got: %v", fresh.ActiveAlarms)
+	}
+
+	worker.handleAlarmQuery(&alarmQueryControlMessage{kind: lastDigestQuery, userId: "u1", reply: reply})
+	if lastDigest := (<-reply).LastDigest; lastDigest == nil || lastDigest.RequestId != "r1" || len(lastDigest.ActiveAlarms) != 1 {
+		t.Errorf("expected the last digest to be retrievable within its ttl, got: %v", lastDigest)
+	}
+
+	now = now.Add(time.Hour + time.Minute)
+	worker.handleRetentionSweep(&retentionSweepControlMessage{})
+	if len(worker.lastDigests) != 0 {
+		t.Errorf("expected the last digest to expire after its ttl")
+	}
+}
+
+func TestAlarmMessageWorker_digestReplay_survivesSnapshotAndWriteAheadLog(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	source := testRetentionWorker(&now)
+	source.RetainDigests(AlarmDigestReplayOptions{RequestIdWindow: 5 * time.Minute})
+
+	changeAlarm(source, "u1", "a1", CRITICAL, now)
+	source.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1", RequestId: "r1"})
+	<-*source.alarmDigestMessages
+	source.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u2", RequestId: "r2"}) // Note: nothing to send
+
+	snapshot := make(chan *workerSnapshot, 1)
+	source.handleSnapshot(&snapshotControlMessage{reply: snapshot})
+	users := map[UserId]*alarmUserState{}
+	for _, user := range (<-snapshot).users {
+		users[user.UserId] = user.state()
+	}
+
+
+	// when
+	restored := testRetentionWorker(&now)
+	restored.RetainDigests(AlarmDigestReplayOptions{RequestIdWindow: 5 * time.Minute})
+	restoredUsers := &sync.WaitGroup{}
+	restoredUsers.Add(1)
+	restored.handleRestore(&restoreControlMessage{users: users, restored: restoredUsers})
+
+	replayed := testRetentionWorker(&now)
+	replayed.RetainDigests(AlarmDigestReplayOptions{RequestIdWindow: 5 * time.Minute})
+	replayedEntries := &sync.WaitGroup{}
+	replayedEntries.Add(1)
+	replayed.handleWalReplay(&walReplayControlMessage{entries: []walEntry{
+		{Kind: walAlarmStatusChanged, UserId: "u1", AlarmId: "a1", Status: "CRITICAL", ChangedAt: now},
+		{Kind: walDigestFlushed, UserId: "u1", RequestId: "r1", ChangedAt: now},
+		{Kind: walDigestFlushed, UserId: "u2", RequestId: "r2", ChangedAt: now},
+	}, replayed: replayedEntries})
+
+
+	// then
+	for _, worker := range []*AlarmMessageWorker{restored, replayed} {
+		worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1", RequestId: "r1"})
+		if len(*worker.alarmDigestMessages) != 1 {
+			t.Fatalf("[%v] expected the digest to be published again", worker.workerName)
+		}
+		if digest := <-*worker.alarmDigestMessages; len(digest.ActiveAlarms) != 1 || digest.ActiveAlarms[0].AlarmId != "a1" {
+			t.Errorf("[%v] expected the same digest, got: %v", worker.workerName, digest)
+		}
+
+		changeAlarm(worker, "u2", "a2", CRITICAL, now)
+		worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u2", RequestId: "r2"})
+		if len(*worker.alarmDigestMessages) != 0 {
+			t.Errorf("[%v] expected the retry of the empty answer to get nothing again", worker.workerName)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package message
+
+import (
+	. "alarm/domain"
+	. "alarm/metrics"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Escalation of the alarms which stay active for too long in the same status, by rules like:
+
+	* WARNING>2h:escalate  --> a WARNING active for more than 2 hours is flagged as Escalated in the digests
+	* CRITICAL>30m:publish --> as escalate, and an AlarmEscalated message is published right away (see AlarmEscalatedTopic)
+
+	The escalator sends an evaluation control message to every worker periodically, so the worker evaluates the rules
+	from its own goroutine (no locks on the state). The duration in the status counts from the ChangedAt of the
+	transition into it, against the clock of the worker.
+
+	An escalated alarm goes out with the next digest of the user again (even if a digest has sent it already), flagged.
+	Of several rules of a status the one with the longest duration wins, so an alarm escalates once per rule; a change
+	of its status resets its escalation. The escalations travel with the alarms (resharding, snapshots), an alarm
+	restored from the write-ahead log only may escalate (and publish) again.
+*/
+
+type EscalationAction string
+
+const (
+	EscalateInDigest    EscalationAction = "escalate"
+	EscalateImmediately EscalationAction = "publish"
+)
+
+type EscalationRule struct {
+	Status    AlarmStatus
+	ActiveFor time.Duration
+	Action    EscalationAction
+}
+
+type AlarmEscalationOptions struct {
+	Rules              []EscalationRule
+	EvaluationInterval time.Duration
+}
+
+var escalationsCounter = CounterVecCreateNew("alarm_escalations_total", "Alarms escalated by the escalation rules.", "status", "action")
+
+type escalationEvaluationControlMessage struct{}
+
+// ParseEscalationRules parses rules like: WARNING>2h:escalate, CRITICAL>30m:publish
+func ParseEscalationRules(rules []string) ([]EscalationRule, error) {
+	parsed := make([]EscalationRule, 0, len(rules))
+
+	for _, rule := range rules {
+		statusAndRest := strings.SplitN(strings.TrimSpace(rule), ">", 2)
+		if len(statusAndRest) != 2 {
+			return nil, errors.New("invalid escalation rule: " + rule + ", expected eg: WARNING>2h:escalate")
+		}
+		durationAndAction := strings.SplitN(statusAndRest[1], ":", 2)
+		if len(durationAndAction) != 2 {
+			return nil, errors.New("invalid escalation rule: " + rule + ", expected eg: WARNING>2h:escalate")
+		}
+
+		status := ExtractAlarmStatus(statusAndRest[0])
+		if status != CRITICAL && status != WARNING {
+			return nil, errors.New("invalid escalation rule: " + rule + ", the status should be CRITICAL or WARNING")
+		}
+		activeFor, err := time.ParseDuration(durationAndAction[0])
+		if err != nil || activeFor <= 0 {
+			return nil, errors.New("invalid escalation rule: " + rule + ", the duration should be positive, eg: 30m")
+		}
+		action := EscalationAction(durationAndAction[1])
+		if action != EscalateInDigest && action != EscalateImmediately {
+			return nil, errors.New("invalid escalation rule: " + rule + ", the action should be escalate or publish")
+		}
+
+		parsed = append(parsed, EscalationRule{Status: status, ActiveFor: activeFor, Action: action})
+	}
+
+	// Note: the longest first, see ruleFor.
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return parsed[i].ActiveFor > parsed[j].ActiveFor
+	})
+	return parsed, nil
+}
+
+func (r EscalationRule) String() string {
+	activeFor := r.ActiveFor.String()
+	if strings.HasSuffix(activeFor, "m0s") {
+		activeFor = strings.TrimSuffix(activeFor, "0s")
+	}
+	if strings.HasSuffix(activeFor, "h0m") {
+		activeFor = strings.TrimSuffix(activeFor, "0m")
+	}
+	return string(r.Status) + ">" + activeFor + ":" + string(r.Action)
+}
+
+// ruleFor the rule of the status with the longest duration within the one of the alarm, false if none applies.
+func (o AlarmEscalationOptions) ruleFor(status AlarmStatus, activeFor time.Duration) (EscalationRule, bool) {
+	for _, rule := range o.Rules {
+		if rule.Status == status && rule.ActiveFor <= activeFor {
+			return rule, true
+		}
+	}
+	return EscalationRule{}, false
+}
+
+
+// ------------------- escalator -------------------
+
+type AlarmEscalator struct {
+	workerPool *AlarmMessageWorkerPool
+	transport  Transport
+	tenants    *TenantRegistry // Note: nil when multi-tenancy is disabled
+	options    AlarmEscalationOptions
+
+	alarmEscalatedMessages chan AlarmEscalatedMessage
+
+	stop chan struct{}
+}
+
+func AlarmEscalatorCreateNew(workerPool *AlarmMessageWorkerPool, transport Transport, tenants *TenantRegistry,
+							 alarmEscalatedMessages chan AlarmEscalatedMessage, options AlarmEscalationOptions) *AlarmEscalator {
+	return &AlarmEscalator{
+		workerPool:             workerPool,
+		transport:              transport,
+		tenants:                tenants,
+		options:                options,
+		alarmEscalatedMessages: alarmEscalatedMessages,
+		stop:                   make(chan struct{}),
+	}
+}
+
+func (e *AlarmEscalator) Start() {
+	go func() {
+		ticker := time.NewTicker(e.options.EvaluationInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.Evaluate()
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+
+	// Note: publishes until the channel gets closed.
+	go func() {
+		for escalated := range e.alarmEscalatedMessages {
+			e.publish(escalated)
+		}
+	}()
+}
+
+func (e *AlarmEscalator) Stop() {
+	close(e.stop)
+}
+
+// Evaluate sends an evaluation of the escalation rules to the mailbox of every worker.
+func (e *AlarmEscalator) Evaluate() {
+	for _, worker := range e.workerPool.Workers() {
+		select {
+		case worker.controlMessages <- &escalationEvaluationControlMessage{}:
+		default:
+			log.Warnf("[%v] control mailbox is full, skipping escalation evaluation\n", worker.workerName)
+		}
+	}
+}
+
+// publish the escalation, of a user of a tenant to the subject of the tenant, with the user id of the tenant.
+func (e *AlarmEscalator) publish(escalated AlarmEscalatedMessage) {
+	topicName := Topics().AlarmEscalated
+	if tenant, userId := e.tenants.split(UserId(escalated.UserId)); tenant != nil {
+		topicName = TenantSubject(tenant.Name, topicName)
+		escalated.UserId = userId
+	}
+
+	serializedInfo, err := json.Marshal(escalated)
+	if err != nil {
+		log.Error("error during json marshalling, error: ", err)
+		return
+	}
+
+	if err := PublishMessage(e.transport, topicName, serializedInfo); err != nil {
+		log.Warnf("could not publish AlarmEscalated of alarm: %v of user: %v, error: %v\n", escalated.AlarmId, escalated.UserId, err)
+	}
+}
+
+
+// ------------------- worker -------------------
+
+// EscalateAlarms the worker evaluates the escalation rules on every evaluation control message, the immediate
+// escalations go to the channel, to be called before it starts consuming.
+func (w *AlarmMessageWorker) EscalateAlarms(options AlarmEscalationOptions, alarmEscalatedMessages *chan AlarmEscalatedMessage) {
+	w.escalationOptions = options
+	w.alarmEscalatedMessages = alarmEscalatedMessages
+}
+
+func (w *AlarmMessageWorker) handleEscalationEvaluation() {
+	if len(w.escalationOptions.Rules) == 0 {
+		return
+	}
+	now := w.now()
+
+	for userId, alarms := range w.alarmsState {
+		for alarmId, alarm := range alarms {
+			if !IsActiveAlarm(alarm) {
+				continue
+			}
+
+			rule, applies := w.escalationOptions.ruleFor(alarm.Status, now.Sub(alarmStatusSince(alarm)))
+			if !applies || rule.ActiveFor <= alarm.EscalatedAfter {
+				continue
+			}
+			alarm.EscalatedAfter = rule.ActiveFor
+
+			// Note: pending again, so the next digest carries the escalation.
+			w.updateActiveAlarms(alarm, userId, alarmId)
+			escalationsCounter.WithLabelValues(string(rule.Status), string(rule.Action)).Inc()
+			log.Debugf("[%v] alarm: %v of user: %v escalated by rule: %v\n", w.workerName, alarmId, userId, rule)
+
+			if rule.Action == EscalateImmediately && w.alarmEscalatedMessages != nil {
+				*w.alarmEscalatedMessages <- AlarmEscalatedMessage{
+					UserId:      string(userId),
+					AlarmId:     string(alarmId),
+					Status:      AlarmStatusAsString(alarm.Status),
+					StatusSince: alarmStatusSince(alarm),
+					EscalatedAt: now,
+					Rule:        rule.String(),
+				}
+			}
+		}
+	}
+}
+
+// alarmStatusSince the alarms restored from a snapshot of an older version have no StatusSince.
+func alarmStatusSince(alarm *Alarm) time.Time {
+	if alarm.StatusSince.IsZero() {
+		return alarmLatestChangedAt(alarm)
+	}
+	return alarm.StatusSince
+}
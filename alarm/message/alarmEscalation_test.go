@@ -0,0 +1,139 @@
+package message
+
+import (
+	. "alarm/domain"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseEscalationRules(t *testing.T) {
+
+	// when
+	rules, err := ParseEscalationRules([]string{"WARNING>2h:escalate", " CRITICAL>30m:publish", "WARNING>6h:publish"})
+
+
+	// then
+	if err != nil {
+		t.Fatalf("expected valid rules, got: %v", err)
+	}
+	if len(rules) != 3 || rules[0].String() != "WARNING>6h:publish" || rules[2].String() != "CRITICAL>30m:publish" {
+		t.Errorf("expected the rules sorted longest first, got: %v", rules)
+	}
+
+	for _, invalid := range []string{"CLEARED>2h:escalate", "WARNING>0s:escalate", "WARNING>2h:notify", "WARNING:escalate", "WARNING>2h"} {
+		if _, err := ParseEscalationRules([]string{invalid}); err == nil {
+			t.Errorf("expected invalid rule: %v", invalid)
+		}
+	}
+}
+
+func TestAlarmMessageWorker_escalation_flagsInDigestAndPublishesImmediately(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+	rules, _ := ParseEscalationRules([]string{"WARNING>2h:escalate", "CRITICAL>30m:publish"})
+	alarmEscalatedMessages := make(chan AlarmEscalatedMessage, 10)
+	worker.EscalateAlarms(AlarmEscalationOptions{Rules: rules}, &alarmEscalatedMessages)
+
+	changeAlarm(worker, "u1", "a1", WARNING, now)
+	changeAlarm(worker, "u1", "a2", CRITICAL, now)
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1"})
+	<-*worker.alarmDigestMessages
+
+
+	// when
+	now = now.Add(31 * time.Minute)
+	changeAlarm(worker, "u1", "a1", WARNING, now) // Note: the same status, still counts from the first WARNING
+	worker.handleEscalationEvaluation()
+	worker.handleEscalationEvaluation()
+
+
+	// then
+	if len(alarmEscalatedMessages) != 1 {
+		t.Fatalf("expected a single AlarmEscalated message, got: %v", len(alarmEscalatedMessages))
+	}
+	if escalated := <-alarmEscalatedMessages; escalated.AlarmId != "a2" || escalated.Rule != "CRITICAL>30m:publish" || !escalated.StatusSince.Equal(now.Add(-31*time.Minute)) {
+		t.Errorf("invalid AlarmEscalated message: %+v", escalated)
+	}
+
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1"})
+	digest := <-*worker.alarmDigestMessages
+	if len(digest.ActiveAlarms) != 2 || digest.ActiveAlarms[0].AlarmId != "a2" || !digest.ActiveAlarms[0].Escalated || digest.ActiveAlarms[1].Escalated {
+		t.Errorf("expected the escalated alarm to be sent again flagged, got: %+v", digest.ActiveAlarms)
+	}
+
+	now = now.Add(90 * time.Minute)
+	worker.handleEscalationEvaluation()
+	if len(alarmEscalatedMessages) != 0 || worker.alarmsState["u1"]["a1"].EscalatedAfter != 2*time.Hour {
+		t.Errorf("expected the WARNING to be escalated in the digest only")
+	}
+
+	changeAlarm(worker, "u1", "a2", WARNING, now)
+	if worker.alarmsState["u1"]["a2"].EscalatedAfter != 0 {
+		t.Errorf("expected a change of the status to reset the escalation")
+	}
+}
+
+/*
+	Scenario:
+
+	* a CRITICAL alarm of a user of a tenant is active for an hour already
+	* the escalator evaluates the rules of the workers
+*/
+func TestAlarmEscalator_publishesToTheSubjectOfTheTenant(t *testing.T) {
+
+	// given
+	tenants := TenantRegistryCreateNew(map[string]TenantQuotas{"productA": {}})
+	rules, _ := ParseEscalationRules([]string{"CRITICAL>30m:publish"})
+	options := AlarmEscalationOptions{Rules: rules, EvaluationInterval: time.Hour}
+
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	alarmEscalatedMessagesChan := make(chan AlarmEscalatedMessage, 10)
+	defer close(alarmEscalatedMessagesChan)
+	pool := AlarmMessageWorkerPoolCreateNew(2, 50, func(i int) *AlarmMessageWorker {
+		alarmStatusChangedMessages := make(chan AlarmStatusChangedMessage, 75)
+		sendAlarmDigestMessages := make(chan SendAlarmDigestMessage, 75)
+
+		workerName := "alarmMessagesWorker#" + strconv.Itoa(i)
+		worker := AlarmMessageWorkerCreateNew(&workerName, &i, &alarmStatusChangedMessages, &sendAlarmDigestMessages, &alarmDigestMessagesChan)
+		worker.IsolateTenants(tenants)
+		worker.EscalateAlarms(options, &alarmEscalatedMessagesChan)
+		return worker
+	})
+
+	transport := InMemoryTransportCreateNew()
+	escalator := AlarmEscalatorCreateNew(pool, transport, tenants, alarmEscalatedMessagesChan, options)
+	escalator.Start()
+	defer escalator.Stop()
+
+	received := make(chan *TransportMessage, 10)
+	subject := TenantSubject("productA", AlarmEscalatedTopic)
+	subscription := AsyncSubscribe(transport, subject, func(msg *TransportMessage) {
+		received <- msg
+	})
+	defer AsyncUnsubscribe(subscription, subject)
+
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: TenantUserId("productA", "u1"),
+		Status: "CRITICAL", ChangedAt: time.Now().Add(-time.Hour)})
+	waitForProcessedMessages(t, pool, 1)
+
+
+	// when
+	escalator.Evaluate()
+
+
+	// then
+	select {
+	case msg := <-received:
+		var escalated AlarmEscalatedMessage
+		_ = json.Unmarshal(msg.Data, &escalated)
+		if escalated.UserId != "u1" || escalated.AlarmId != "a1" || escalated.Status != "CRITICAL" {
+			t.Errorf("invalid AlarmEscalated message: %+v", escalated)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the escalation was not published")
+	}
+}
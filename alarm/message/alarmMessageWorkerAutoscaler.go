@@ -0,0 +1,246 @@
+package message
+
+import (
+	. "alarm/metrics"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	The autoscaler samples the mailbox depth and the processing latency of every AlarmMessageWorker and grows or
+	shrinks the pool within the configured bounds.
+
+	Scaling goes through AlarmMessageWorkerPool.AddWorker/RemoveWorker, so the users get resharded with the same
+	protocol as the admin api (per user ordering is preserved).
+*/
+
+type AutoscalerOptions struct {
+	MinWorkers int
+	MaxWorkers int
+
+	SampleInterval time.Duration
+
+	// Note: utilization of the busiest mailbox (depth / capacity) in percent.
+	ScaleUpMailboxUtilizationPercent   int
+	ScaleDownMailboxUtilizationPercent int
+
+	// Note: if the average processing latency of the workers goes above it we scale up.
+	ScaleUpLatency time.Duration
+
+	// Note: how many consecutive idle samples are needed before scaling down (avoids flapping).
+	ScaleDownSamples int
+}
+
+type scalingDecision int
+
+const (
+	keepWorkers scalingDecision = iota
+	scaleUp
+	scaleDown
+)
+
+func (d scalingDecision) String() string {
+	switch d {
+	case scaleUp:
+		return "up"
+	case scaleDown:
+		return "down"
+	default:
+		return "keep"
+	}
+}
+
+var workersTotalGauge = GaugeVecCreateNew("alarm_workers_total", "Current number of alarm message workers.")
+var workerMailboxDepthGauge = GaugeVecCreateNew("alarm_worker_mailbox_depth", "Messages waiting in the mailboxes of the worker.", "worker")
+var workerProcessingLatencyGauge = GaugeVecCreateNew("alarm_worker_processing_latency_seconds", "Moving average of the message processing latency of the worker.", "worker")
+var autoscalerDecisionsCounter = CounterVecCreateNew("alarm_autoscaler_decisions_total", "Scaling decisions taken by the autoscaler.", "direction")
+
+// -------------------
+
+type AlarmMessageWorkerAutoscaler struct {
+	workerPool *AlarmMessageWorkerPool
+
+	optionsLock sync.Mutex
+	options     AutoscalerOptions
+
+	idleSamples    int
+	sampledWorkers map[string]bool
+
+	stop chan struct{}
+}
+
+func AlarmMessageWorkerAutoscalerCreateNew(workerPool *AlarmMessageWorkerPool, options AutoscalerOptions) *AlarmMessageWorkerAutoscaler {
+	return &AlarmMessageWorkerAutoscaler{
+		workerPool:     workerPool,
+		options:        options,
+		sampledWorkers: make(map[string]bool),
+		stop:           make(chan struct{}),
+	}
+}
+
+func (a *AlarmMessageWorkerAutoscaler) Start() {
+	sampleInterval := a.options.SampleInterval
+	go func() {
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				a.scale()
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (a *AlarmMessageWorkerAutoscaler) Stop() {
+	close(a.stop)
+}
+
+// SetOptions changes the thresholds at runtime (config reload), the sample interval needs a restart.
+func (a *AlarmMessageWorkerAutoscaler) SetOptions(options AutoscalerOptions) {
+	a.optionsLock.Lock()
+	defer a.optionsLock.Unlock()
+
+	options.SampleInterval = a.options.SampleInterval
+	a.options = options
+}
+
+func (a *AlarmMessageWorkerAutoscaler) scale() {
+
+	allSamples := a.workerPool.WorkersInfo()
+	a.recordSamples(allSamples)
+
+	// Note: the overflow worker (hot users) is not part of the ring, so it does not take part in the scaling.
+	samples := make([]AlarmMessageWorkerInfo, 0, len(allSamples))
+	for _, sample := range allSamples {
+		if !sample.Overflow {
+			samples = append(samples, sample)
+		}
+	}
+
+	decision := a.evaluate(samples)
+	if decision == keepWorkers {
+		return
+	}
+
+	autoscalerDecisionsCounter.WithLabelValues(decision.String()).Inc()
+
+	switch decision {
+	case scaleUp:
+		id, err := a.workerPool.AddWorker()
+		if err != nil {
+			log.Errorf("[autoscaler] could not add worker, error: %v\n", err)
+			return
+		}
+		log.Infof("[autoscaler] scaled up, added worker: %v, total workers: %v\n", id, len(samples)+1)
+
+	case scaleDown:
+		// Note: remove the most recently added worker.
+		id := samples[len(samples)-1].Id
+		if err := a.workerPool.RemoveWorker(id); err != nil {
+			log.Errorf("[autoscaler] could not remove worker: %v, error: %v\n", id, err)
+			return
+		}
+		log.Infof("[autoscaler] scaled down, removed worker: %v, total workers: %v\n", id, len(samples)-1)
+	}
+
+	workersTotalGauge.WithLabelValues().Set(float64(a.workerPool.Size()))
+}
+
+func (a *AlarmMessageWorkerAutoscaler) evaluate(samples []AlarmMessageWorkerInfo) scalingDecision {
+
+	totalWorkers := len(samples)
+	if totalWorkers == 0 {
+		return keepWorkers
+	}
+
+	a.optionsLock.Lock()
+	options := a.options
+	a.optionsLock.Unlock()
+
+	maxUtilizationPercent := 0
+	var totalLatency time.Duration
+	for _, sample := range samples {
+		if utilization := sample.MailboxUtilizationPercent(); utilization > maxUtilizationPercent {
+			maxUtilizationPercent = utilization
+		}
+		totalLatency += sample.ProcessingLatency
+	}
+	averageLatency := totalLatency / time.Duration(totalWorkers)
+
+	overloaded := maxUtilizationPercent >= options.ScaleUpMailboxUtilizationPercent ||
+		(options.ScaleUpLatency > 0 && averageLatency >= options.ScaleUpLatency)
+
+	if overloaded {
+		a.idleSamples = 0
+		if totalWorkers < options.MaxWorkers {
+			log.Infof("[autoscaler] overloaded --- max mailbox utilization: %v%% --- average latency: %v\n", maxUtilizationPercent, averageLatency)
+			return scaleUp
+		}
+		return keepWorkers
+	}
+
+	if maxUtilizationPercent <= options.ScaleDownMailboxUtilizationPercent {
+		a.idleSamples++
+	} else {
+		a.idleSamples = 0
+	}
+
+	if a.idleSamples >= options.ScaleDownSamples && totalWorkers > options.MinWorkers {
+		a.idleSamples = 0
+		log.Infof("[autoscaler] idle --- max mailbox utilization: %v%% --- average latency: %v\n", maxUtilizationPercent, averageLatency)
+		return scaleDown
+	}
+
+	return keepWorkers
+}
+
+func (a *AlarmMessageWorkerAutoscaler) recordSamples(samples []AlarmMessageWorkerInfo) {
+
+	current := make(map[string]bool, len(samples))
+	for _, sample := range samples {
+		worker := strconv.Itoa(int(sample.Id))
+		current[worker] = true
+
+		workerMailboxDepthGauge.WithLabelValues(worker).Set(float64(sample.AlarmStatusChangedMailboxDepth + sample.SendAlarmDigestMailboxDepth))
+		workerProcessingLatencyGauge.WithLabelValues(worker).Set(sample.ProcessingLatency.Seconds())
+	}
+
+	// Note: forget the workers which got removed.
+	for worker := range a.sampledWorkers {
+		if !current[worker] {
+			workerMailboxDepthGauge.Delete(worker)
+			workerProcessingLatencyGauge.Delete(worker)
+		}
+	}
+	a.sampledWorkers = current
+
+	workersTotalGauge.WithLabelValues().Set(float64(a.workerPool.Size()))
+}
+
+// -------------------
+
+// MailboxUtilizationPercent the utilization of the fullest mailbox of the worker.
+func (i AlarmMessageWorkerInfo) MailboxUtilizationPercent() int {
+	return maxInt(utilizationPercent(i.AlarmStatusChangedMailboxDepth, i.AlarmStatusChangedMailboxCapacity),
+		utilizationPercent(i.SendAlarmDigestMailboxDepth, i.SendAlarmDigestMailboxCapacity))
+}
+
+func utilizationPercent(depth int, capacity int) int {
+	if capacity == 0 {
+		return 0
+	}
+	return depth * 100 / capacity
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
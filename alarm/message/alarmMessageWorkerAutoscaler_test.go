@@ -0,0 +1,131 @@
+package message
+
+import (
+	"testing"
+	"time"
+)
+
+func testAutoscalerOptions() AutoscalerOptions {
+	return AutoscalerOptions{
+		MinWorkers:                         2,
+		MaxWorkers:                         4,
+		SampleInterval:                     time.Millisecond,
+		ScaleUpMailboxUtilizationPercent:   70,
+		ScaleDownMailboxUtilizationPercent: 5,
+		ScaleUpLatency:                     50 * time.Millisecond,
+		ScaleDownSamples:                   3,
+	}
+}
+
+func testWorkerInfo(id int, depth int, latency time.Duration) AlarmMessageWorkerInfo {
+	return AlarmMessageWorkerInfo{
+		Id:                                DistributionId(id),
+		AlarmStatusChangedMailboxDepth:    depth,
+		AlarmStatusChangedMailboxCapacity: 100,
+		SendAlarmDigestMailboxCapacity:    100,
+		ProcessingLatency:                 latency,
+	}
+}
+
+func TestAlarmMessageWorkerAutoscaler_evaluate_scalesUpOnFullMailbox(t *testing.T) {
+
+	autoscaler := AlarmMessageWorkerAutoscalerCreateNew(nil, testAutoscalerOptions())
+
+	decision := autoscaler.evaluate([]AlarmMessageWorkerInfo{testWorkerInfo(0, 0, 0), testWorkerInfo(1, 80, 0)})
+
+	if decision != scaleUp {
+		t.Errorf("expected scale up, got: %v", decision)
+	}
+}
+
+func TestAlarmMessageWorkerAutoscaler_evaluate_scalesUpOnLatency(t *testing.T) {
+
+	autoscaler := AlarmMessageWorkerAutoscalerCreateNew(nil, testAutoscalerOptions())
+
+	decision := autoscaler.evaluate([]AlarmMessageWorkerInfo{testWorkerInfo(0, 10, 60*time.Millisecond), testWorkerInfo(1, 10, 60*time.Millisecond)})
+
+	if decision != scaleUp {
+		t.Errorf("expected scale up, got: %v", decision)
+	}
+}
+
+func TestAlarmMessageWorkerAutoscaler_evaluate_respectsBounds(t *testing.T) {
+
+	autoscaler := AlarmMessageWorkerAutoscalerCreateNew(nil, testAutoscalerOptions())
+
+	full := []AlarmMessageWorkerInfo{testWorkerInfo(0, 90, 0), testWorkerInfo(1, 90, 0), testWorkerInfo(2, 90, 0), testWorkerInfo(3, 90, 0)}
+	if decision := autoscaler.evaluate(full); decision != keepWorkers {
+		t.Errorf("should not scale above max workers, got: %v", decision)
+	}
+
+	idle := []AlarmMessageWorkerInfo{testWorkerInfo(0, 0, 0), testWorkerInfo(1, 0, 0)}
+	for i := 0; i < 10; i++ {
+		if decision := autoscaler.evaluate(idle); decision != keepWorkers {
+			t.Errorf("should not scale below min workers, got: %v", decision)
+		}
+	}
+}
+
+func TestAlarmMessageWorkerAutoscaler_evaluate_scalesDownAfterConsecutiveIdleSamples(t *testing.T) {
+
+	autoscaler := AlarmMessageWorkerAutoscalerCreateNew(nil, testAutoscalerOptions())
+
+	idle := []AlarmMessageWorkerInfo{testWorkerInfo(0, 0, 0), testWorkerInfo(1, 0, 0), testWorkerInfo(2, 1, 0)}
+	busy := []AlarmMessageWorkerInfo{testWorkerInfo(0, 0, 0), testWorkerInfo(1, 30, 0), testWorkerInfo(2, 1, 0)}
+
+	decisions := []scalingDecision{
+		autoscaler.evaluate(idle),
+		autoscaler.evaluate(idle),
+		autoscaler.evaluate(busy), // Note: resets the idle samples.
+		autoscaler.evaluate(idle),
+		autoscaler.evaluate(idle),
+		autoscaler.evaluate(idle),
+	}
+
+	expected := []scalingDecision{keepWorkers, keepWorkers, keepWorkers, keepWorkers, keepWorkers, scaleDown}
+	for i := range expected {
+		if decisions[i] != expected[i] {
+			t.Errorf("sample: %v, expected: %v, got: %v", i, expected[i], decisions[i])
+		}
+	}
+}
+
+func TestAlarmMessageWorkerAutoscaler_scale_addsAndRemovesWorkers(t *testing.T) {
+
+	// given
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	pool := testWorkerPool(2, &alarmDigestMessagesChan)
+
+	options := testAutoscalerOptions()
+	options.ScaleUpLatency = 0
+	options.ScaleUpMailboxUtilizationPercent = 0 // Note: always overloaded.
+	autoscaler := AlarmMessageWorkerAutoscalerCreateNew(pool, options)
+
+
+	// when
+	autoscaler.scale()
+
+
+	// then
+	if pool.Size() != 3 {
+		t.Fatalf("expected 3 workers, got: %v", pool.Size())
+	}
+
+
+	// when
+	autoscaler.options.ScaleUpMailboxUtilizationPercent = 100
+	for i := 0; i < options.ScaleDownSamples; i++ {
+		autoscaler.scale()
+	}
+
+
+	// then
+	if pool.Size() != 2 {
+		t.Fatalf("expected 2 workers, got: %v", pool.Size())
+	}
+	for _, info := range pool.WorkersInfo() {
+		if info.Id == 2 {
+			t.Errorf("the most recently added worker should have been removed")
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package message
+
+import (
+	. "alarm/domain"
+	"errors"
+	"sort"
+	"time"
+)
+
+/*
+	History of the alarms, so support can answer "was alarm X active for user Y at 14:05?":
+
+	* every change applied by the worker appends a transition (the resulting status, ChangedAt, received at) to the alarm
+	* bounded by count --> above MaxTransitions the oldest transitions are dropped, on every change
+	* bounded by age   --> transitions received more than MaxAge ago are dropped, on every change and retention sweep
+	                       (the latest transition is always kept, it is the current status)
+
+	The history is part of the alarm, so it moves with the user on resharding, gets snapshotted and is forgotten with
+	the alarm by the retention policies.
+
+	Queries are control messages to the worker which owns the user, answered from the worker goroutine:
+
+	* timeline          --> the transitions of an alarm
+	* active set as of  --> the alarms of a user which were CRITICAL/WARNING at the time, as of their latest transition
+	                        which changed at or before it
+
+	Note: control messages have priority, so a query does not wait for the messages already in the mailbox of the worker.
+
+	MaxTransitions 0 disables the history, MaxAge 0 disables the age bound.
+*/
+
+type AlarmHistoryOptions struct {
+	MaxTransitions int
+	MaxAge         time.Duration
+}
+
+const historyQueryTimeout = 5 * time.Second
+
+var ErrAlarmNotFound = errors.New("alarm does not exist")
+var ErrHistoryQueryTimeout = errors.New("worker did not answer the query in time")
+
+type AlarmTransitionInfo struct {
+	Status     string
+	ChangedAt  time.Time
+	ReceivedAt time.Time
+}
+
+type AlarmTimeline struct {
+	UserId      string
+	AlarmId     string
+	Status      string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Transitions []AlarmTransitionInfo
+}
+
+type UserActiveAlarmsAt struct {
+	UserId       string
+	At           time.Time
+	ActiveAlarms []ActiveAlarm
+
+	// Note: some alarms existed at the time, but their retained history does not reach back that far.
+	Incomplete bool
+}
+
+type alarmTimelineControlMessage struct {
+	userId  UserId
+	alarmId AlarmId
+	reply   chan *AlarmTimeline // Note: nil if the worker does not know the alarm
+}
+
+type activeAlarmsAtControlMessage struct {
+	userId UserId
+	at     time.Time
+	reply  chan *UserActiveAlarmsAt
+}
+
+
+// ------------------- pool -------------------
+
+// AlarmTimeline the transitions of the alarm, from the worker which owns the user.
+func (p *AlarmMessageWorkerPool) AlarmTimeline(userId string, alarmId string) (*AlarmTimeline, error) {
+	deadline := time.After(historyQueryTimeout)
+	reply := make(chan *AlarmTimeline, 1)
+	if !p.sendToOwner(userId, &alarmTimelineControlMessage{userId: UserId(userId), alarmId: AlarmId(alarmId), reply: reply}, deadline) {
+		return nil, ErrHistoryQueryTimeout
+	}
+
+	select {
+	case timeline := <-reply:
+		if timeline == nil {
+			return nil, ErrAlarmNotFound
+		}
+		return timeline, nil
+	case <-deadline:
+		return nil, ErrHistoryQueryTimeout
+	}
+}
+
+// ActiveAlarmsAt the alarms of the user which were active at the time, from the worker which owns the user.
+func (p *AlarmMessageWorkerPool) ActiveAlarmsAt(userId string, at time.Time) (*UserActiveAlarmsAt, error) {
+	deadline := time.After(historyQueryTimeout)
+	reply := make(chan *UserActiveAlarmsAt, 1)
+	if !p.sendToOwner(userId, &activeAlarmsAtControlMessage{userId: UserId(userId), at: at, reply: reply}, deadline) {
+		return nil, ErrHistoryQueryTimeout
+	}
+
+	select {
+	case activeAlarms := <-reply:
+		return activeAlarms, nil
+	case <-deadline:
+		return nil, ErrHistoryQueryTimeout
+	}
+}
+
+// sendToOwner sends a control message to the worker which owns the user, false if its mailbox is still full at the
+// deadline (nil waits).
+func (p *AlarmMessageWorkerPool) sendToOwner(userId string, controlMessage workerControlMessage, deadline <-chan time.Time) bool {
+	// Note: a resharding holds the lock until the users are installed to their new owners, and a later one queues its
+	// handoff behind this message, so the owner has the state of the user when it handles it. The senders only read
+	// the routing, they share the lock.
+	p.reshardingLock.RLock()
+	defer p.reshardingLock.RUnlock()
+
+	p.routingLock.RLock()
+	worker := p.workers[p.routing.Locate(userId)]
+	p.routingLock.RUnlock()
+
+	select {
+	case worker.controlMessages <- controlMessage:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+
+// ------------------- worker -------------------
+
+// KeepHistory the worker records the transitions of the alarms, to be called before it starts consuming.
+func (w *AlarmMessageWorker) KeepHistory(options AlarmHistoryOptions) {
+	w.historyOptions = options
+}
+
+func (w *AlarmMessageWorker) recordTransition(alarm *Alarm, changedAt time.Time) {
+	if w.historyOptions.MaxTransitions <= 0 {
+		return
+	}
+
+	alarm.History = append(alarm.History, AlarmTransition{Status: alarm.Status, ChangedAt: changedAt, ReceivedAt: w.now()})
+	if dropped := len(alarm.History) - w.historyOptions.MaxTransitions; dropped > 0 {
+		alarm.History = append(alarm.History[:0:0], alarm.History[dropped:]...)
+	}
+	w.trimHistory(alarm)
+}
+
+// trimHistory drops the transitions older than the max age, but the latest one.
+func (w *AlarmMessageWorker) trimHistory(alarm *Alarm) {
+	maxAge := w.historyOptions.MaxAge
+	if maxAge <= 0 || len(alarm.History) == 0 {
+		return
+	}
+
+	now := w.now()
+	expired := 0
+	for expired < len(alarm.History)-1 && now.Sub(alarm.History[expired].ReceivedAt) > maxAge {
+		expired++
+	}
+	if expired > 0 {
+		alarm.History = append(alarm.History[:0:0], alarm.History[expired:]...)
+	}
+}
+
+func (w *AlarmMessageWorker) trimHistories() {
+	if w.historyOptions.MaxAge <= 0 {
+		return
+	}
+
+	for _, alarms := range w.alarmsState {
+		for _, alarm := range alarms {
+			w.trimHistory(alarm)
+		}
+	}
+}
+
+func (w *AlarmMessageWorker) handleAlarmTimeline(query *alarmTimelineControlMessage) {
+	alarm, exists := w.alarmsState[query.userId][query.alarmId]
+	if !exists {
+		query.reply <- nil
+		return
+	}
+
+	timeline := &AlarmTimeline{
+		UserId:      string(alarm.UserId),
+		AlarmId:     string(alarm.Id),
+		Status:      AlarmStatusAsString(alarm.Status),
+		CreatedAt:   alarm.CreatedAt,
+		UpdatedAt:   alarm.UpdatedAt,
+		Transitions: make([]AlarmTransitionInfo, 0, len(alarm.History)),
+	}
+	for _, transition := range alarm.History {
+		timeline.Transitions = append(timeline.Transitions, AlarmTransitionInfo{
+			Status:     AlarmStatusAsString(transition.Status),
+			ChangedAt:  transition.ChangedAt,
+			ReceivedAt: transition.ReceivedAt,
+		})
+	}
+	query.reply <- timeline
+}
+
+func (w *AlarmMessageWorker) handleActiveAlarmsAt(query *activeAlarmsAtControlMessage) {
+	result := &UserActiveAlarmsAt{UserId: string(query.userId), At: query.at, ActiveAlarms: make([]ActiveAlarm, 0)}
+
+	for alarmId, alarm := range w.alarmsState[query.userId] {
+		transition, known := StatusAt(alarm, query.at)
+		if !known {
+			// Note: the alarm was created (its first change) at or before the time, but its history is gone.
+			if !alarm.CreatedAt.After(query.at) {
+				result.Incomplete = true
+			}
+			continue
+		}
+
+		if IsActiveStatus(transition.Status) {
+			result.ActiveAlarms = append(result.ActiveAlarms, ActiveAlarm{
+				AlarmId:         string(alarmId),
+				Status:          AlarmStatusAsString(transition.Status),
+				LatestChangedAt: transition.ChangedAt,
+			})
+		}
+	}
+
+	sort.Slice(result.ActiveAlarms, func(i, j int) bool {
+		return result.ActiveAlarms[i].AlarmId < result.ActiveAlarms[j].AlarmId
+	})
+	query.reply <- result
+}
@@ -0,0 +1,142 @@
+package message
+
+import (
+	. "alarm/domain"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAlarmMessageWorker_history_boundedByCountAndAge(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+	worker.KeepHistory(AlarmHistoryOptions{MaxTransitions: 3, MaxAge: time.Hour})
+
+	for i, status := range []AlarmStatus{CRITICAL, WARNING, CLEARED, CRITICAL} {
+		changeAlarm(worker, "u1", "a1", status, now.Add(time.Duration(i)*time.Minute))
+	}
+	changeAlarm(worker, "u1", "a2", WARNING, now)
+
+
+	// when
+	now = now.Add(90 * time.Minute)
+	worker.handleRetentionSweep(&retentionSweepControlMessage{})
+
+
+	// then
+	a1 := worker.alarmsState["u1"]["a1"]
+	if len(a1.History) != 1 || a1.History[0].Status != CRITICAL || !a1.History[0].ChangedAt.Equal(now.Add(-87*time.Minute)) {
+		t.Errorf("expected only the latest transition to survive the age bound, got: %v", a1.History)
+	}
+
+	changeAlarm(worker, "u1", "a1", CLEARED, now)
+	changeAlarm(worker, "u1", "a1", WARNING, now.Add(time.Minute))
+	changeAlarm(worker, "u1", "a1", CRITICAL, now.Add(2*time.Minute))
+	if len(a1.History) != 3 || a1.History[0].Status != CLEARED || a1.History[2].Status != CRITICAL {
+		t.Errorf("expected the latest 3 transitions, got: %v", a1.History)
+	}
+	if a2 := worker.alarmsState["u1"]["a2"]; len(a2.History) != 1 {
+		t.Errorf("expected the latest transition of an old alarm to be kept, got: %v", a2.History)
+	}
+}
+
+func TestAlarmMessageWorker_history_activeAlarmsAt(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+	worker.KeepHistory(AlarmHistoryOptions{MaxTransitions: 2})
+
+	at := time.Date(2021, 8, 17, 14, 5, 0, 0, time.UTC)
+	changeAlarm(worker, "u1", "a1", CRITICAL, at.Add(-time.Hour))
+	changeAlarm(worker, "u1", "a1", CLEARED, at.Add(time.Minute))
+	changeAlarm(worker, "u1", "a2", CLEARED, at.Add(-time.Minute))
+	changeAlarm(worker, "u1", "a2", WARNING, at.Add(-2*time.Minute)) // Note: arrives out of order, a2 was CLEARED at 14:05
+	changeAlarm(worker, "u1", "a3", WARNING, at.Add(time.Minute))
+
+
+	// when
+	reply := make(chan *UserActiveAlarmsAt, 1)
+	worker.handleActiveAlarmsAt(&activeAlarmsAtControlMessage{userId: "u1", at: at, reply: reply})
+	result := <-reply
+
+
+	// then
+	if len(result.ActiveAlarms) != 1 || result.ActiveAlarms[0].AlarmId != "a1" || result.ActiveAlarms[0].Status != "CRITICAL" {
+		t.Errorf("expected only a1 to be active at %v, got: %v", at, result.ActiveAlarms)
+	}
+	if result.Incomplete {
+		t.Errorf("the whole history is kept, the result should be complete")
+	}
+
+	changeAlarm(worker, "u1", "a1", WARNING, at.Add(2*time.Minute)) // Note: drops the CRITICAL transition of 13:05
+	worker.handleActiveAlarmsAt(&activeAlarmsAtControlMessage{userId: "u1", at: at, reply: reply})
+	result = <-reply
+	if len(result.ActiveAlarms) != 0 || !result.Incomplete {
+		t.Errorf("expected an incomplete result once the history of a1 got dropped, got: %v", result)
+	}
+}
+
+/*
+	Scenario:
+
+	* a user's alarm gets CRITICAL then CLEARED, through the pool
+	* a worker gets added (the user may move to it)
+	* the timeline & the active set before the CLEARED are queried over request/reply
+*/
+func TestAlarmHistoryQueryResponder_answersTimelineAndActiveAlarms(t *testing.T) {
+
+	// given
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	pool := testWorkerPool(2, &alarmDigestMessagesChan, func(worker *AlarmMessageWorker) {
+		worker.KeepHistory(AlarmHistoryOptions{MaxTransitions: 10})
+	})
+	transport := InMemoryTransportCreateNew()
+	subscriptions := RegisterAlarmHistoryQueryResponder("test", transport, pool, nil)
+	defer func() {
+		for _, subscription := range subscriptions {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
+	}()
+
+	criticalAt := time.Date(2021, 8, 17, 14, 0, 0, 0, time.UTC)
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CRITICAL", ChangedAt: criticalAt})
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CLEARED", ChangedAt: criticalAt.Add(10 * time.Minute)})
+	waitForProcessedMessages(t, pool, 2)
+
+	if _, err := pool.AddWorker(); err != nil {
+		t.Fatalf("could not add worker, error: %v", err)
+	}
+
+
+	// when
+	query := func(q AlarmHistoryQueryMessage) AlarmHistoryQueryReply {
+		data, _ := json.Marshal(q)
+		msg, err := transport.Request(&TransportMessage{Subject: AlarmHistoryQueryTopic, Data: data}, time.Second)
+		if err != nil {
+			t.Fatalf("history query failed, error: %v", err)
+		}
+		var reply AlarmHistoryQueryReply
+		if err := json.Unmarshal(msg.Data, &reply); err != nil {
+			t.Fatalf("bad formatted reply: %v", string(msg.Data))
+		}
+		return reply
+	}
+	timeline := query(AlarmHistoryQueryMessage{UserId: "u1", AlarmId: "a1"})
+	activeAlarms := query(AlarmHistoryQueryMessage{UserId: "u1", At: criticalAt.Add(5 * time.Minute)})
+	missing := query(AlarmHistoryQueryMessage{UserId: "u1", AlarmId: "a2"})
+
+
+	// then
+	if timeline.Timeline == nil || len(timeline.Timeline.Transitions) != 2 || timeline.Timeline.Transitions[1].Status != "CLEARED" {
+		t.Errorf("invalid timeline: %v", timeline)
+	}
+	if activeAlarms.ActiveAlarms == nil || len(activeAlarms.ActiveAlarms.ActiveAlarms) != 1 || activeAlarms.ActiveAlarms.ActiveAlarms[0].AlarmId != "a1" {
+		t.Errorf("invalid active alarms: %v", activeAlarms)
+	}
+	if missing.Error == nil || missing.Error.Code != QueryErrorNotFound {
+		t.Errorf("expected alarm not found, got: %v", missing)
+	}
+}
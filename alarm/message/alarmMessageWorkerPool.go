@@ -0,0 +1,407 @@
+package message
+
+import (
+	. "alarm/hashing"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	The pool owns the AlarmMessageWorker actors and the routing table (consistent hash ring + pinned users) which maps
+	users to them.
+
+	Workers can be added or removed at runtime (eg: from the admin api), and single users can be pinned to a dedicated
+	overflow worker (eg: hot users), the affected users are migrated between the workers through their mailboxes
+	(see alarmMessageWorkerResharding.go).
+
+	Note: consumers hold the read lock of routingLock while they route and send a message to a worker mailbox, so when
+		  resharding takes the write lock we know that every message routed with the previous routing table is already
+		  in a mailbox.
+*/
+
+var ErrWorkerNotFound = errors.New("worker does not exist")
+var ErrLastWorker = errors.New("can not remove the last worker")
+var ErrOverflowWorker = errors.New("operation not supported for the overflow worker")
+var ErrNoOverflowWorker = errors.New("overflow worker is not enabled")
+
+type AlarmMessageWorkerFactory func(workerId int) *AlarmMessageWorker
+
+type AlarmMessageWorkerPool struct {
+	routingLock    sync.RWMutex
+	reshardingLock sync.RWMutex
+
+	routing *workerRoutingTable
+	workers map[DistributionId]*AlarmMessageWorker
+
+	overflowWorker *AlarmMessageWorker
+
+	nextWorkerId int
+	factory      AlarmMessageWorkerFactory
+
+	// Note: the running workers, see Stop.
+	running sync.WaitGroup
+}
+
+type AlarmMessageWorkerInfo struct {
+	Id       DistributionId
+	Name     string
+	Overflow bool
+
+	AlarmStatusChangedMailboxDepth    int
+	AlarmStatusChangedMailboxCapacity int
+	SendAlarmDigestMailboxDepth       int
+	SendAlarmDigestMailboxCapacity    int
+
+	ProcessingLatency time.Duration
+	ProcessedMessages int64
+
+	// Note: as of the latest retention sweep.
+	TrackedUsers        int64
+	TrackedAlarms       int64
+	EstimatedStateBytes int64
+	Evictions           int64
+}
+
+func AlarmMessageWorkerPoolCreateNew(totalWorkers int, virtualNodes int, factory AlarmMessageWorkerFactory) *AlarmMessageWorkerPool {
+
+	p := &AlarmMessageWorkerPool{
+		workers: make(map[DistributionId]*AlarmMessageWorker),
+		factory: factory,
+	}
+
+	nodes := make([]uint32, 0, totalWorkers)
+	for i := 0; i < totalWorkers; i++ {
+		worker := p.startWorker()
+		p.workers[worker.distributionId()] = worker
+		nodes = append(nodes, uint32(worker.distributionId()))
+	}
+	p.routing = &workerRoutingTable{ring: ConsistentHashRingCreateNew(virtualNodes, nodes...)}
+
+	return p
+}
+
+// EnableOverflowWorker starts the dedicated worker (not part of the ring) where pinned users get moved to.
+func (p *AlarmMessageWorkerPool) EnableOverflowWorker() DistributionId {
+	p.reshardingLock.Lock()
+	defer p.reshardingLock.Unlock()
+
+	if p.overflowWorker != nil {
+		return p.overflowWorker.distributionId()
+	}
+
+	worker := p.startWorker()
+
+	p.routingLock.Lock()
+	p.workers[worker.distributionId()] = worker
+	p.overflowWorker = worker
+	p.routingLock.Unlock()
+
+	log.Infof("overflow worker: %v enabled\n", worker.workerName)
+	return worker.distributionId()
+}
+
+// -------------------
+
+func (p *AlarmMessageWorkerPool) DispatchAlarmStatusChangedMessage(consumerId string, msg AlarmStatusChangedMessage) {
+	p.routingLock.RLock()
+	defer p.routingLock.RUnlock()
+
+	worker := p.route(&consumerId, &msg.UserId, msg.CorrelationId)
+	*worker.AlarmStatusChangedMessages <- msg
+}
+
+func (p *AlarmMessageWorkerPool) DispatchSendAlarmDigestMessage(consumerId string, msg SendAlarmDigestMessage) {
+	p.routingLock.RLock()
+	defer p.routingLock.RUnlock()
+
+	worker := p.route(&consumerId, &msg.UserId, msg.CorrelationId)
+	*worker.SendAlarmDigestMessages <- msg
+}
+
+func (p *AlarmMessageWorkerPool) route(consumerId *string, userId *string, correlationId string) *AlarmMessageWorker {
+	channelIdToSend := calculateDistributionId(consumerId, userId, correlationId, p.routing)
+
+	worker, found := p.workers[channelIdToSend]
+	if !found {
+		panic(errors.New("could not found a worker for distribution id: " + strconv.Itoa(int(channelIdToSend))))
+	}
+	return worker
+}
+
+// -------------------
+
+func (p *AlarmMessageWorkerPool) Size() int {
+	p.routingLock.RLock()
+	defer p.routingLock.RUnlock()
+
+	return p.routing.ring.Size()
+}
+
+// Workers all the workers, including the overflow worker.
+func (p *AlarmMessageWorkerPool) Workers() []*AlarmMessageWorker {
+	p.routingLock.RLock()
+	defer p.routingLock.RUnlock()
+
+	return p.sortedWorkers(false)
+}
+
+func (p *AlarmMessageWorkerPool) WorkersInfo() []AlarmMessageWorkerInfo {
+	workers := p.Workers()
+
+	infos := make([]AlarmMessageWorkerInfo, 0, len(workers))
+	for _, w := range workers {
+		infos = append(infos, AlarmMessageWorkerInfo{
+			Id:                                w.distributionId(),
+			Name:                              w.workerName,
+			Overflow:                          w == p.overflowWorker,
+			AlarmStatusChangedMailboxDepth:    len(*w.AlarmStatusChangedMessages),
+			AlarmStatusChangedMailboxCapacity: cap(*w.AlarmStatusChangedMessages),
+			SendAlarmDigestMailboxDepth:       len(*w.SendAlarmDigestMessages),
+			SendAlarmDigestMailboxCapacity:    cap(*w.SendAlarmDigestMessages),
+			ProcessingLatency:                 w.ProcessingLatency(),
+			ProcessedMessages:                 w.ProcessedMessages(),
+			TrackedUsers:                      w.TrackedUsers(),
+			TrackedAlarms:                     w.TrackedAlarms(),
+			EstimatedStateBytes:               w.EstimatedStateBytes(),
+			Evictions:                         w.Evictions(),
+		})
+	}
+	return infos
+}
+
+func (p *AlarmMessageWorkerPool) PinnedUsers() []string {
+	p.routingLock.RLock()
+	defer p.routingLock.RUnlock()
+
+	users := make([]string, 0, len(p.routing.pinnedUsers))
+	for userId := range p.routing.pinnedUsers {
+		users = append(users, userId)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// AddWorker starts a new worker and migrates to it the users it owns in the new ring.
+func (p *AlarmMessageWorkerPool) AddWorker() (DistributionId, error) {
+	p.reshardingLock.Lock()
+	defer p.reshardingLock.Unlock()
+
+	worker := p.startWorker()
+	id := worker.distributionId()
+
+	migration := &sync.WaitGroup{}
+
+	p.routingLock.Lock()
+	previousRouting := p.routing
+	sources := p.sortedWorkers(true)
+
+	migration.Add(len(sources))
+	for _, source := range sources {
+		worker.controlMessages <- &expectHandoffControlMessage{from: source.distributionId(), previousRouting: previousRouting, migration: migration}
+	}
+
+	p.routing = previousRouting.withRing(previousRouting.ring.Add(uint32(id)))
+	p.workers[id] = worker
+	newRouting := p.routing
+	p.routingLock.Unlock()
+
+	for _, source := range sources {
+		source.controlMessages <- &handoffControlMessage{routing: newRouting, targets: []*AlarmMessageWorker{worker}}
+	}
+
+	migration.Wait()
+
+	log.Infof("worker: %v added, total workers: %v\n", worker.workerName, newRouting.ring.Size())
+	return id, nil
+}
+
+// RemoveWorker migrates the users of the worker to the rest of the workers and stops it.
+func (p *AlarmMessageWorkerPool) RemoveWorker(id DistributionId) error {
+	p.reshardingLock.Lock()
+	defer p.reshardingLock.Unlock()
+
+	migration := &sync.WaitGroup{}
+
+	p.routingLock.Lock()
+	removed, exists := p.workers[id]
+	if !exists {
+		p.routingLock.Unlock()
+		return ErrWorkerNotFound
+	}
+	if removed == p.overflowWorker {
+		p.routingLock.Unlock()
+		return ErrOverflowWorker
+	}
+	if p.routing.ring.Size() == 1 {
+		p.routingLock.Unlock()
+		return ErrLastWorker
+	}
+
+	previousRouting := p.routing
+	delete(p.workers, id)
+	p.routing = previousRouting.withRing(previousRouting.ring.Remove(uint32(id)))
+	newRouting := p.routing
+	targets := p.sortedWorkers(true)
+
+	migration.Add(len(targets))
+	for _, target := range targets {
+		target.controlMessages <- &expectHandoffControlMessage{from: id, previousRouting: previousRouting, migration: migration}
+	}
+	p.routingLock.Unlock()
+
+	removed.controlMessages <- &handoffControlMessage{routing: newRouting, targets: targets, stop: true}
+
+	migration.Wait()
+
+	// Note: nobody routes to the removed worker anymore and it has stopped.
+	close(*removed.AlarmStatusChangedMessages)
+	close(*removed.SendAlarmDigestMessages)
+
+	log.Infof("worker: %v removed, total workers: %v\n", removed.workerName, newRouting.ring.Size())
+	return nil
+}
+
+// PinUser moves the user (and its state) to the overflow worker.
+func (p *AlarmMessageWorkerPool) PinUser(userId string) error {
+	p.reshardingLock.Lock()
+	defer p.reshardingLock.Unlock()
+
+	if p.overflowWorker == nil {
+		return ErrNoOverflowWorker
+	}
+
+	p.routingLock.Lock()
+	if _, pinned := p.routing.pinnedUsers[userId]; pinned {
+		p.routingLock.Unlock()
+		return nil
+	}
+	newRouting := p.routing.withPinnedUser(userId, p.overflowWorker.distributionId())
+	p.routingLock.Unlock()
+
+	p.moveUser(userId, newRouting)
+
+	log.Infof("user: %v pinned to overflow worker: %v\n", userId, p.overflowWorker.workerName)
+	return nil
+}
+
+// UnpinUser moves the user (and its state) back to its worker in the ring.
+func (p *AlarmMessageWorkerPool) UnpinUser(userId string) {
+	p.reshardingLock.Lock()
+	defer p.reshardingLock.Unlock()
+
+	p.routingLock.Lock()
+	if _, pinned := p.routing.pinnedUsers[userId]; !pinned {
+		p.routingLock.Unlock()
+		return
+	}
+	newRouting := p.routing.withoutPinnedUser(userId)
+	p.routingLock.Unlock()
+
+	p.moveUser(userId, newRouting)
+
+	log.Infof("user: %v unpinned from overflow worker\n", userId)
+}
+
+func (p *AlarmMessageWorkerPool) moveUser(userId string, newRouting *workerRoutingTable) {
+	migration := &sync.WaitGroup{}
+	migration.Add(1)
+
+	p.routingLock.Lock()
+	previousRouting := p.routing
+	source := p.workers[previousRouting.Locate(userId)]
+	target := p.workers[newRouting.Locate(userId)]
+
+	target.controlMessages <- &expectHandoffControlMessage{from: source.distributionId(), previousRouting: previousRouting, migration: migration}
+	p.routing = newRouting
+	p.routingLock.Unlock()
+
+	source.controlMessages <- &handoffControlMessage{routing: newRouting, targets: []*AlarmMessageWorker{target}}
+
+	migration.Wait()
+}
+
+// -------------------
+
+func (p *AlarmMessageWorkerPool) startWorker() *AlarmMessageWorker {
+	worker := p.factory(p.nextWorkerId)
+	p.nextWorkerId++
+
+	p.running.Add(1)
+	go func() {
+		defer p.running.Done()
+		worker.Consume()
+	}()
+
+	return worker
+}
+
+// Stop closes the mailboxes of the workers and waits for them to exit, nothing should dispatch to the pool anymore (the
+// messages still in the mailboxes may get dropped, see AlarmStateSnapshotter.Snapshot to drain them first).
+func (p *AlarmMessageWorkerPool) Stop() {
+	p.reshardingLock.Lock()
+	defer p.reshardingLock.Unlock()
+
+	for _, worker := range p.Workers() {
+		close(*worker.AlarmStatusChangedMessages)
+		close(*worker.SendAlarmDigestMessages)
+	}
+
+	p.running.Wait()
+	log.Infof("worker pool stopped\n")
+}
+
+func (p *AlarmMessageWorkerPool) sortedWorkers(onlyRingWorkers bool) []*AlarmMessageWorker {
+	workers := make([]*AlarmMessageWorker, 0, len(p.workers))
+	for _, w := range p.workers {
+		if onlyRingWorkers && w == p.overflowWorker {
+			continue
+		}
+		workers = append(workers, w)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].workerId < workers[j].workerId
+	})
+	return workers
+}
+
+// -------------------
+
+// workerRoutingTable immutable (copy-on-write), pinned users take precedence over the ring.
+type workerRoutingTable struct {
+	ring        *ConsistentHashRing
+	pinnedUsers map[string]DistributionId
+}
+
+func (t *workerRoutingTable) Locate(userId string) DistributionId {
+	if id, pinned := t.pinnedUsers[userId]; pinned {
+		return id
+	}
+	return DistributionId(t.ring.Locate(userId))
+}
+
+func (t *workerRoutingTable) withRing(ring *ConsistentHashRing) *workerRoutingTable {
+	return &workerRoutingTable{ring: ring, pinnedUsers: t.pinnedUsers}
+}
+
+func (t *workerRoutingTable) withPinnedUser(userId string, id DistributionId) *workerRoutingTable {
+	pinnedUsers := make(map[string]DistributionId, len(t.pinnedUsers)+1)
+	for u, w := range t.pinnedUsers {
+		pinnedUsers[u] = w
+	}
+	pinnedUsers[userId] = id
+	return &workerRoutingTable{ring: t.ring, pinnedUsers: pinnedUsers}
+}
+
+func (t *workerRoutingTable) withoutPinnedUser(userId string) *workerRoutingTable {
+	pinnedUsers := make(map[string]DistributionId, len(t.pinnedUsers))
+	for u, w := range t.pinnedUsers {
+		if u != userId {
+			pinnedUsers[u] = w
+		}
+	}
+	return &workerRoutingTable{ring: t.ring, pinnedUsers: pinnedUsers}
+}
@@ -0,0 +1,175 @@
+package message
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Note: the configurators enable the features of the workers (history, write-ahead log, ...) before they start consuming.
+func testWorkerPool(totalWorkers int, alarmDigestMessagesChan *chan AlarmDigestMessage, configurators ...func(*AlarmMessageWorker)) *AlarmMessageWorkerPool {
+	return AlarmMessageWorkerPoolCreateNew(totalWorkers, 50, func(i int) *AlarmMessageWorker {
+
+		alarmStatusChangedMessages := make(chan AlarmStatusChangedMessage, 75)
+		sendAlarmDigestMessages := make(chan SendAlarmDigestMessage, 75)
+
+		workerName := "alarmMessagesWorker#" + strconv.Itoa(i)
+		worker := AlarmMessageWorkerCreateNew(&workerName, &i, &alarmStatusChangedMessages, &sendAlarmDigestMessages, alarmDigestMessagesChan)
+		for _, configure := range configurators {
+			configure(worker)
+		}
+		return worker
+	})
+}
+
+/*
+	Scenario:
+
+	* Keep emitting AlarmStatusChanged messages for many users while workers get added and removed.
+	* Then request a digest for every user.
+	* Every user with active alarms should get exactly one digest with exactly its active alarms (no lost or
+	  duplicated events during the migration between workers).
+*/
+func TestAlarmMessageWorkerPool_reshardingDoesNotLoseState(t *testing.T) {
+
+	// given
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 5000)
+	pool := testWorkerPool(3, &alarmDigestMessagesChan)
+
+	statuses := []string{"CRITICAL", "WARNING", "CLEARED"}
+	random := rand.New(rand.NewSource(42))
+
+	totalUsers := 300
+	expectedStatus := make(map[string]map[string]string)
+
+	messages := make([]AlarmStatusChangedMessage, 0)
+	for i := 0; i < 20000; i++ {
+		userId := "user-" + strconv.Itoa(random.Intn(totalUsers))
+		alarmId := "alarm-" + strconv.Itoa(random.Intn(4))
+		status := statuses[random.Intn(len(statuses))]
+
+		messages = append(messages, AlarmStatusChangedMessage{AlarmId: alarmId, UserId: userId, Status: status, ChangedAt: time.Now()})
+
+		if _, exists := expectedStatus[userId]; !exists {
+			expectedStatus[userId] = make(map[string]string)
+		}
+		expectedStatus[userId][alarmId] = status
+	}
+
+
+	// when
+	sent := make(chan struct{})
+	go func() {
+		for _, msg := range messages {
+			pool.DispatchAlarmStatusChangedMessage("testConsumer", msg)
+		}
+		close(sent)
+	}()
+
+	id1, _ := pool.AddWorker()
+	id2, _ := pool.AddWorker()
+	if err := pool.RemoveWorker(0); err != nil {
+		t.Fatalf("could not remove worker, error: %v", err)
+	}
+	if err := pool.RemoveWorker(id1); err != nil {
+		t.Fatalf("could not remove worker, error: %v", err)
+	}
+	<-sent
+
+	// Note: status and digest mailboxes are different channels, so let the status changes get applied first.
+	waitForEmptyMailboxes(t, pool)
+
+	for userId := range expectedStatus {
+		pool.DispatchSendAlarmDigestMessage("testConsumer", SendAlarmDigestMessage{UserId: userId})
+	}
+
+
+	// then
+	if pool.Size() != 3 {
+		t.Errorf("expected 3 workers, got: %v", pool.Size())
+	}
+	if _, err := pool.AddWorker(); err != nil || id2 == 0 {
+		t.Errorf("pool should still accept workers")
+	}
+
+	expectedDigests := make(map[string][]string)
+	for userId, alarms := range expectedStatus {
+		var active []string
+		for alarmId, status := range alarms {
+			if status != "CLEARED" {
+				active = append(active, alarmId+"="+status)
+			}
+		}
+		if len(active) > 0 {
+			sort.Strings(active)
+			expectedDigests[userId] = active
+		}
+	}
+
+	received := make(map[string][]string)
+	timeout := time.After(5 * time.Second)
+	for len(received) < len(expectedDigests) {
+		select {
+		case digest := <-alarmDigestMessagesChan:
+			if _, duplicate := received[digest.UserId]; duplicate {
+				t.Fatalf("duplicated digest for user: %v", digest.UserId)
+			}
+			var active []string
+			for _, alarm := range digest.ActiveAlarms {
+				active = append(active, alarm.AlarmId+"="+alarm.Status)
+			}
+			sort.Strings(active)
+			received[digest.UserId] = active
+
+		case <-timeout:
+			t.Fatalf("expected %v digests, received: %v", len(expectedDigests), len(received))
+		}
+	}
+
+	for userId, expected := range expectedDigests {
+		if strings.Join(received[userId], ",") != strings.Join(expected, ",") {
+			t.Errorf("user: %v, expected: %v, received: %v", userId, expected, received[userId])
+		}
+	}
+
+	select {
+	case digest := <-alarmDigestMessagesChan:
+		t.Errorf("unexpected digest: %v", digest)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAlarmMessageWorkerPool_removeWorkerErrors(t *testing.T) {
+
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	pool := testWorkerPool(1, &alarmDigestMessagesChan)
+
+	if err := pool.RemoveWorker(7); err != ErrWorkerNotFound {
+		t.Errorf("expected worker not found error, got: %v", err)
+	}
+	if err := pool.RemoveWorker(0); err != ErrLastWorker {
+		t.Errorf("expected last worker error, got: %v", err)
+	}
+}
+
+func waitForEmptyMailboxes(t *testing.T, pool *AlarmMessageWorkerPool) {
+	for tries := 0; ; tries++ {
+		empty := true
+		for _, info := range pool.WorkersInfo() {
+			if info.AlarmStatusChangedMailboxDepth > 0 || info.SendAlarmDigestMailboxDepth > 0 {
+				empty = false
+			}
+		}
+		if empty {
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		if tries > 100 {
+			t.Fatalf("worker mailboxes did not drain")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,330 @@
+package message
+
+import (
+	. "alarm/domain"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+/*
+	Resharding protocol between AlarmMessageWorker actors (driven from AlarmMessageWorkerPool):
+
+	1. The pool announces to every worker that will receive users (target) from which workers (sources) to expect a
+	   handoff, together with the previous routing table (consistent hash ring + pinned users).
+	   Targets buffer any message of a user which previously belonged to a source still being waited for.
+
+	2. The pool swaps the routing table (while no consumer is in the middle of routing a message), so from now on the messages
+	   of the moved users are routed to their targets.
+
+	3. The pool sends a handoff to every source. The source first processes the messages which are already in its
+	   mailboxes (routed with the previous routing table), then extracts the state of the users it does not own anymore and
+	   sends it to their targets (every target gets a transfer, even an empty one).
+
+	4. The target installs the transferred state and replays the buffered messages of these users in order.
+
+	So every message is applied exactly once, and in the order it was routed.
+*/
+
+const controlMessagesCapacity = 64
+
+type workerControlMessage interface{}
+
+type expectHandoffControlMessage struct {
+	from            DistributionId
+	previousRouting *workerRoutingTable
+	migration       *sync.WaitGroup
+}
+
+type handoffControlMessage struct {
+	routing *workerRoutingTable
+	targets []*AlarmMessageWorker
+	stop    bool
+}
+
+type userStateTransferControlMessage struct {
+	from  DistributionId
+	users map[UserId]*alarmUserState
+}
+
+// alarmUserState the state of a single user which gets moved between workers.
+type alarmUserState struct {
+	alarms       map[AlarmId]*Alarm
+	activeAlarms map[AlarmId]*Alarm
+
+	// Note: the recency for the retention policies, see alarmMessageWorkerRetention.go
+	lastSeen  time.Time
+	changedAt map[AlarmId]time.Time
+
+	// Note: nil if none, see alarmDigestReplay.go
+	lastDigest *retainedDigest
+}
+
+type workerDataMessage struct {
+	userId string
+
+	alarmStatusChanged *AlarmStatusChangedMessage
+	sendAlarmDigest    *SendAlarmDigestMessage
+}
+
+type workerReshardingState struct {
+	previousRouting  *workerRoutingTable
+	awaitingHandoffs map[DistributionId]*sync.WaitGroup
+	bufferedMessages []*workerDataMessage
+}
+
+// -------------------
+
+func (w *AlarmMessageWorker) distributionId() DistributionId {
+	return DistributionId(w.workerId)
+}
+
+/*
+Control messages have priority over data messages, so before handling a data message we drain them.
+If a handoff shows up, the data message in hand (routed before the handoff was sent) is handled first.
+*/
+func (w *AlarmMessageWorker) processDataMessage(msg *workerDataMessage) {
+
+	for {
+		select {
+		case controlMessage := <-w.controlMessages:
+			if w.handleControlMessage(controlMessage, msg) {
+				msg = nil
+			}
+			continue
+		default:
+		}
+		break
+	}
+
+	if msg != nil {
+		w.handleDataMessage(msg)
+	}
+}
+
+// handleControlMessage returns true if the data message in hand has been handled.
+func (w *AlarmMessageWorker) handleControlMessage(controlMessage workerControlMessage, inHand *workerDataMessage) bool {
+
+	switch c := controlMessage.(type) {
+
+	case *expectHandoffControlMessage:
+		log.Infof("[%v] worker expects handoff from worker: %v\n", w.workerName, c.from)
+
+		if w.resharding.awaitingHandoffs == nil {
+			w.resharding.awaitingHandoffs = make(map[DistributionId]*sync.WaitGroup)
+		}
+		w.resharding.awaitingHandoffs[c.from] = c.migration
+		w.resharding.previousRouting = c.previousRouting
+
+	case *handoffControlMessage:
+		handled := false
+		if inHand != nil {
+			w.handleDataMessage(inHand)
+			handled = true
+		}
+		w.handleHandoff(c)
+		return handled
+
+	case *userStateTransferControlMessage:
+		w.handleUserStateTransfer(c)
+
+	case *retentionSweepControlMessage:
+		w.handleRetentionSweep(c)
+
+	case *snapshotControlMessage:
+		handled := false
+		if c.drain && inHand != nil {
+			w.handleDataMessage(inHand)
+			handled = true
+		}
+		w.handleSnapshot(c)
+		return handled
+
+	case *restoreControlMessage:
+		w.handleRestore(c)
+
+	case *walReplayControlMessage:
+		w.handleWalReplay(c)
+
+	case *alarmTimelineControlMessage:
+		w.handleAlarmTimeline(c)
+
+	case *activeAlarmsAtControlMessage:
+		w.handleActiveAlarmsAt(c)
+
+	case *alarmQueryControlMessage:
+		w.handleAlarmQuery(c)
+
+	case *digestDeliveredControlMessage:
+		w.handleDigestDelivered(c)
+
+	case *digestDeliveryCheckControlMessage:
+		w.handleDigestDeliveryCheck()
+
+	case *escalationEvaluationControlMessage:
+		w.handleEscalationEvaluation()
+
+	default:
+		log.Warnf("[%v] unknown control message: %v\n", w.workerName, controlMessage)
+	}
+
+	return false
+}
+
+func (w *AlarmMessageWorker) handleDataMessage(msg *workerDataMessage) {
+
+	if w.shouldBuffer(msg.userId) {
+		w.resharding.bufferedMessages = append(w.resharding.bufferedMessages, msg)
+		return
+	}
+
+	w.dispatchDataMessage(msg)
+}
+
+func (w *AlarmMessageWorker) shouldBuffer(userId string) bool {
+	if len(w.resharding.awaitingHandoffs) == 0 {
+		return false
+	}
+
+	previousOwner := w.resharding.previousRouting.Locate(userId)
+	if previousOwner == w.distributionId() {
+		return false
+	}
+
+	_, awaiting := w.resharding.awaitingHandoffs[previousOwner]
+	return awaiting
+}
+
+func (w *AlarmMessageWorker) handleHandoff(handoff *handoffControlMessage) {
+
+	// Note: first process the messages which got routed with the previous routing table.
+	w.processPendingMessages()
+
+	// Note: then extract the users which are not owned anymore.
+	transfers := make(map[DistributionId]map[UserId]*alarmUserState)
+	for _, target := range handoff.targets {
+		transfers[target.distributionId()] = make(map[UserId]*alarmUserState)
+	}
+
+	for _, userId := range w.ownedUsers() {
+		newOwner := handoff.routing.Locate(string(userId))
+		if newOwner == w.distributionId() {
+			continue
+		}
+
+		usersOfTarget, isTarget := transfers[newOwner]
+		if !isTarget {
+			log.Errorf("[%v] user: %v moves to worker: %v which does not expect a handoff, keeping it\n", w.workerName, userId, newOwner)
+			continue
+		}
+		usersOfTarget[userId] = w.extractUserState(userId)
+	}
+
+	for _, target := range handoff.targets {
+		users := transfers[target.distributionId()]
+		log.Infof("[%v] worker hands off %v users to worker: %v\n", w.workerName, len(users), target.workerName)
+
+		target.controlMessages <- &userStateTransferControlMessage{from: w.distributionId(), users: users}
+	}
+
+	if handoff.stop {
+		w.stopped = true
+		if w.wal != nil {
+			w.wal.close()
+		}
+	}
+}
+
+func (w *AlarmMessageWorker) handleUserStateTransfer(transfer *userStateTransferControlMessage) {
+
+	for userId, state := range transfer.users {
+		w.installUserState(userId, state)
+	}
+
+	migration, awaiting := w.resharding.awaitingHandoffs[transfer.from]
+	if !awaiting {
+		log.Errorf("[%v] worker received an unexpected handoff from worker: %v\n", w.workerName, transfer.from)
+		return
+	}
+	delete(w.resharding.awaitingHandoffs, transfer.from)
+
+	log.Infof("[%v] worker received %v users from worker: %v\n", w.workerName, len(transfer.users), transfer.from)
+
+	// Note: replay (in order) the buffered messages of the users which previously belonged to the source worker.
+	buffered := w.resharding.bufferedMessages
+	w.resharding.bufferedMessages = nil
+	for _, msg := range buffered {
+		w.handleDataMessage(msg)
+	}
+
+	if len(w.resharding.awaitingHandoffs) == 0 {
+		w.resharding.previousRouting = nil
+	}
+
+	migration.Done()
+}
+
+// processPendingMessages handles the messages which are already in the mailboxes (not the ones arriving meanwhile).
+func (w *AlarmMessageWorker) processPendingMessages() {
+	pendingAlarmStatusChangedMessages := len(*w.AlarmStatusChangedMessages)
+	for i := 0; i < pendingAlarmStatusChangedMessages; i++ {
+		msg := <-*w.AlarmStatusChangedMessages
+		w.handleDataMessage(&workerDataMessage{userId: msg.UserId, alarmStatusChanged: &msg})
+	}
+	pendingSendAlarmDigestMessages := len(*w.SendAlarmDigestMessages)
+	for i := 0; i < pendingSendAlarmDigestMessages; i++ {
+		msg := <-*w.SendAlarmDigestMessages
+		w.handleDataMessage(&workerDataMessage{userId: msg.UserId, sendAlarmDigest: &msg})
+	}
+}
+
+// -------------------
+
+func (w *AlarmMessageWorker) ownedUsers() []UserId {
+	users := make([]UserId, 0, len(w.alarmsState))
+	for userId := range w.alarmsState {
+		users = append(users, userId)
+	}
+	for userId := range w.activeAlarms {
+		if _, exists := w.alarmsState[userId]; !exists {
+			users = append(users, userId)
+		}
+	}
+	for userId := range w.lastDigests {
+		_, hasAlarms := w.alarmsState[userId]
+		_, hasActiveAlarms := w.activeAlarms[userId]
+		if !hasAlarms && !hasActiveAlarms {
+			users = append(users, userId)
+		}
+	}
+	return users
+}
+
+func (w *AlarmMessageWorker) extractUserState(userId UserId) *alarmUserState {
+	state := &alarmUserState{
+		alarms:       w.alarmsState[userId],
+		activeAlarms: w.activeAlarms[userId],
+	}
+	w.extractUserRetention(userId, state)
+	state.lastDigest = w.lastDigests[userId]
+
+	delete(w.alarmsState, userId)
+	delete(w.activeAlarms, userId)
+	delete(w.lastDigests, userId)
+	delete(w.pendingDigests, userId) // Note: its alarms move, the new owner merges them in the next digest
+
+	return state
+}
+
+func (w *AlarmMessageWorker) installUserState(userId UserId, state *alarmUserState) {
+	if state.alarms != nil {
+		w.alarmsState[userId] = state.alarms
+	}
+	if state.activeAlarms != nil {
+		w.activeAlarms[userId] = state.activeAlarms
+	}
+	w.installUserRetention(userId, state)
+	if state.lastDigest != nil {
+		w.lastDigests[userId] = state.lastDigest
+	}
+}
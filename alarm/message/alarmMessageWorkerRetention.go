@@ -0,0 +1,355 @@
+package message
+
+import (
+	. "alarm/domain"
+	. "alarm/metrics"
+	"container/list"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Retention of the state of the AlarmMessageWorker actors, so the memory stays bounded:
+
+	* cleared alarm ttl    --> a CLEARED alarm which has not changed for the ttl is forgotten
+	* idle user ttl        --> a user without any message (status change or digest request) for the ttl is forgotten,
+	                           including its active alarms which were never requested
+	* max alarms per worker --> above it, the least recently changed alarms of the worker are forgotten (LRU)
+
+	The sweeper sends a sweep control message to every worker periodically, so the worker evicts from its own goroutine
+	(no locks on the state). The ttls are checked on every sweep, the cap on every new alarm as well.
+	A forgotten alarm which changes again starts over as a new alarm.
+
+	0 disables a policy.
+*/
+
+type AlarmRetentionOptions struct {
+	ClearedAlarmTtl    time.Duration
+	IdleUserTtl        time.Duration
+	MaxAlarmsPerWorker int
+
+	SweepInterval time.Duration
+}
+
+const (
+	evictedClearedAlarm = "cleared_ttl"
+	evictedIdleUser     = "idle_user"
+	evictedCapacity     = "capacity"
+)
+
+// Note: a rough estimate of the memory of an alarm (the alarm, its entries in the state maps & the lru list) without its ids.
+const estimatedAlarmBytes = 256
+const estimatedTransitionBytes = 64
+
+var workerEvictionsCounter = CounterVecCreateNew("alarm_worker_evictions_total", "Alarms forgotten by the workers, by retention policy.", "reason")
+var workerTrackedAlarmsGauge = GaugeVecCreateNew("alarm_worker_tracked_alarms", "Alarms in the state of the worker (as of the latest sweep).", "worker")
+var workerStateBytesGauge = GaugeVecCreateNew("alarm_worker_state_bytes_estimate", "Estimated memory of the state of the worker (as of the latest sweep).", "worker")
+
+type retentionSweepControlMessage struct {
+	options AlarmRetentionOptions
+}
+
+// workerRetentionState the recency of the alarms & users of a worker, owned by the worker goroutine.
+type workerRetentionState struct {
+	options AlarmRetentionOptions
+
+	userLastSeen map[UserId]time.Time
+	lru          *list.List // Note: of *retainedAlarm, the most recently changed at the front
+	alarms       map[retainedAlarmKey]*list.Element
+
+	// Note: as of the latest sweep, read from other goroutines (eg: admin api) so accessed atomically.
+	trackedUsers       int64
+	trackedAlarms      int64
+	stateBytesEstimate int64
+	evictions          int64
+}
+
+type retainedAlarmKey struct {
+	userId  UserId
+	alarmId AlarmId
+}
+
+type retainedAlarm struct {
+	retainedAlarmKey
+	changedAt time.Time // Note: when the worker received its latest change, not the ChangedAt of the message
+}
+
+func newWorkerRetentionState() workerRetentionState {
+	return workerRetentionState{
+		userLastSeen: make(map[UserId]time.Time),
+		lru:          list.New(),
+		alarms:       make(map[retainedAlarmKey]*list.Element),
+	}
+}
+
+
+// ------------------- sweeper -------------------
+
+type AlarmRetentionSweeper struct {
+	workerPool *AlarmMessageWorkerPool
+
+	optionsLock sync.Mutex
+	options     AlarmRetentionOptions
+
+	stop chan struct{}
+}
+
+func AlarmRetentionSweeperCreateNew(workerPool *AlarmMessageWorkerPool, options AlarmRetentionOptions) *AlarmRetentionSweeper {
+	return &AlarmRetentionSweeper{
+		workerPool: workerPool,
+		options:    options,
+		stop:       make(chan struct{}),
+	}
+}
+
+func (s *AlarmRetentionSweeper) Start() {
+	sweepInterval := s.options.SweepInterval
+
+	// Note: the first sweep hands the options (eg: the cap) to the workers right away.
+	s.Sweep()
+
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.Sweep()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *AlarmRetentionSweeper) Stop() {
+	close(s.stop)
+}
+
+// SetOptions changes the policies at runtime (config reload), applied on the next sweep, the sweep interval needs a restart.
+func (s *AlarmRetentionSweeper) SetOptions(options AlarmRetentionOptions) {
+	s.optionsLock.Lock()
+	defer s.optionsLock.Unlock()
+
+	options.SweepInterval = s.options.SweepInterval
+	s.options = options
+}
+
+// Sweep sends a sweep to the mailbox of every worker.
+func (s *AlarmRetentionSweeper) Sweep() {
+	s.optionsLock.Lock()
+	options := s.options
+	s.optionsLock.Unlock()
+
+	for _, worker := range s.workerPool.Workers() {
+		select {
+		case worker.controlMessages <- &retentionSweepControlMessage{options: options}:
+		default:
+			// Note: eg: a worker in the middle of resharding, it gets the next one.
+			log.Warnf("[%v] control mailbox is full, skipping retention sweep\n", worker.workerName)
+		}
+	}
+}
+
+
+// ------------------- worker -------------------
+
+// touchAlarm records a change of the alarm, and evicts the least recently changed alarms above the cap.
+func (w *AlarmMessageWorker) touchAlarm(userId UserId, alarmId AlarmId) {
+	now := w.now()
+	w.retention.userLastSeen[userId] = now
+
+	key := retainedAlarmKey{userId: userId, alarmId: alarmId}
+	if element, exists := w.retention.alarms[key]; exists {
+		element.Value.(*retainedAlarm).changedAt = now
+		w.retention.lru.MoveToFront(element)
+		return
+	}
+	w.retention.alarms[key] = w.retention.lru.PushFront(&retainedAlarm{retainedAlarmKey: key, changedAt: now})
+
+	maxAlarms := w.retention.options.MaxAlarmsPerWorker
+	for maxAlarms > 0 && w.retention.lru.Len() > maxAlarms {
+		w.evictAlarm(w.retention.lru.Back().Value.(*retainedAlarm).retainedAlarmKey, evictedCapacity)
+	}
+}
+
+func (w *AlarmMessageWorker) touchUser(userId UserId) {
+	if _, exists := w.alarmsState[userId]; exists {
+		w.retention.userLastSeen[userId] = w.now()
+	}
+}
+
+func (w *AlarmMessageWorker) handleRetentionSweep(sweep *retentionSweepControlMessage) {
+	w.retention.options = sweep.options
+	now := w.now()
+	evictions := map[string]int{}
+
+	if ttl := sweep.options.ClearedAlarmTtl; ttl > 0 {
+		for element := w.retention.lru.Back(); element != nil; {
+			alarm := element.Value.(*retainedAlarm)
+			element = element.Prev()
+
+			if now.Sub(alarm.changedAt) < ttl {
+				break // Note: the rest changed more recently
+			}
+			if state := w.alarmsState[alarm.userId][alarm.alarmId]; state != nil && state.Status == CLEARED {
+				w.evictAlarm(alarm.retainedAlarmKey, evictedClearedAlarm)
+				evictions[evictedClearedAlarm]++
+			}
+		}
+	}
+
+	if ttl := sweep.options.IdleUserTtl; ttl > 0 {
+		for userId, lastSeen := range w.retention.userLastSeen {
+			if now.Sub(lastSeen) >= ttl {
+				evictions[evictedIdleUser] += w.evictUser(userId)
+			}
+		}
+	}
+
+	// Note: a lowered cap applies right away.
+	maxAlarms := sweep.options.MaxAlarmsPerWorker
+	for maxAlarms > 0 && w.retention.lru.Len() > maxAlarms {
+		w.evictAlarm(w.retention.lru.Back().Value.(*retainedAlarm).retainedAlarmKey, evictedCapacity)
+		evictions[evictedCapacity]++
+	}
+
+	w.trimHistories()
+	w.expireDigests()
+
+	w.recordStateSize()
+	if len(evictions) > 0 {
+		log.Infof("[%v] retention sweep evicted: %v --- tracked alarms: %v --- estimated state: %v bytes\n",
+			w.workerName, evictions, w.TrackedAlarms(), w.EstimatedStateBytes())
+	}
+}
+
+func (w *AlarmMessageWorker) evictAlarm(key retainedAlarmKey, reason string) {
+	if element, exists := w.retention.alarms[key]; exists {
+		w.retention.lru.Remove(element)
+		delete(w.retention.alarms, key)
+	}
+
+	alarms, userExisted := w.alarmsState[key.userId]
+	_, alarmExisted := alarms[key.alarmId]
+
+	delete(w.alarmsState[key.userId], key.alarmId)
+	delete(w.activeAlarms[key.userId], key.alarmId)
+	if len(w.alarmsState[key.userId]) == 0 {
+		delete(w.alarmsState, key.userId)
+		delete(w.activeAlarms, key.userId)
+		delete(w.pendingDigests, key.userId)
+		delete(w.retention.userLastSeen, key.userId)
+	}
+
+	if alarmExisted {
+		releasedUsers := 0
+		if _, userExists := w.alarmsState[key.userId]; userExisted && !userExists {
+			releasedUsers = 1
+		}
+		w.releaseTenantUsage(key.userId, releasedUsers, 1)
+	}
+
+	atomic.AddInt64(&w.retention.evictions, 1)
+	workerEvictionsCounter.WithLabelValues(reason).Inc()
+}
+
+// evictUser forgets all the alarms of the user, returns how many.
+func (w *AlarmMessageWorker) evictUser(userId UserId) int {
+	alarms := len(w.alarmsState[userId])
+	for alarmId := range w.alarmsState[userId] {
+		w.evictAlarm(retainedAlarmKey{userId: userId, alarmId: alarmId}, evictedIdleUser)
+	}
+
+	delete(w.alarmsState, userId)
+	delete(w.activeAlarms, userId)
+	delete(w.pendingDigests, userId)
+	delete(w.retention.userLastSeen, userId)
+	return alarms
+}
+
+func (w *AlarmMessageWorker) recordStateSize() {
+	var bytes int64
+	for userId, alarms := range w.alarmsState {
+		for alarmId, alarm := range alarms {
+			bytes += estimatedAlarmBytes + int64(len(userId)+len(alarmId)) + int64(len(alarm.History))*estimatedTransitionBytes
+		}
+	}
+
+	atomic.StoreInt64(&w.retention.trackedUsers, int64(len(w.alarmsState)))
+	atomic.StoreInt64(&w.retention.trackedAlarms, int64(w.retention.lru.Len()))
+	atomic.StoreInt64(&w.retention.stateBytesEstimate, bytes)
+
+	worker := strconv.Itoa(w.workerId)
+	workerTrackedAlarmsGauge.WithLabelValues(worker).Set(float64(w.retention.lru.Len()))
+	workerStateBytesGauge.WithLabelValues(worker).Set(float64(bytes))
+}
+
+func (w *AlarmMessageWorker) TrackedUsers() int64 {
+	return atomic.LoadInt64(&w.retention.trackedUsers)
+}
+
+func (w *AlarmMessageWorker) TrackedAlarms() int64 {
+	return atomic.LoadInt64(&w.retention.trackedAlarms)
+}
+
+func (w *AlarmMessageWorker) EstimatedStateBytes() int64 {
+	return atomic.LoadInt64(&w.retention.stateBytesEstimate)
+}
+
+func (w *AlarmMessageWorker) Evictions() int64 {
+	return atomic.LoadInt64(&w.retention.evictions)
+}
+
+// extractUserRetention removes the recency of the alarms of a user which moves to another worker.
+func (w *AlarmMessageWorker) extractUserRetention(userId UserId, state *alarmUserState) {
+	state.lastSeen = w.retention.userLastSeen[userId]
+	state.changedAt = make(map[AlarmId]time.Time, len(state.alarms))
+
+	for alarmId := range state.alarms {
+		key := retainedAlarmKey{userId: userId, alarmId: alarmId}
+		if element, exists := w.retention.alarms[key]; exists {
+			state.changedAt[alarmId] = element.Value.(*retainedAlarm).changedAt
+			w.retention.lru.Remove(element)
+			delete(w.retention.alarms, key)
+		}
+	}
+	delete(w.retention.userLastSeen, userId)
+}
+
+// installUserRetention the moved alarms join the lru at their recency, so the ttl sweep (from the back, stops at the first
+// recent one) and the cap see them in order with the alarms of the worker.
+func (w *AlarmMessageWorker) installUserRetention(userId UserId, state *alarmUserState) {
+	if len(state.alarms) == 0 {
+		return
+	}
+	w.retention.userLastSeen[userId] = state.lastSeen
+
+	alarms := make([]*retainedAlarm, 0, len(state.alarms))
+	for alarmId := range state.alarms {
+		alarms = append(alarms, &retainedAlarm{retainedAlarmKey: retainedAlarmKey{userId: userId, alarmId: alarmId}, changedAt: state.changedAt[alarmId]})
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		return alarms[i].changedAt.Before(alarms[j].changedAt)
+	})
+
+	// Note: the oldest first, so the walk from the back goes on from the previous one instead of starting over.
+	position := w.retention.lru.Back()
+	for _, alarm := range alarms {
+		for position != nil && position.Value.(*retainedAlarm).changedAt.Before(alarm.changedAt) {
+			position = position.Prev()
+		}
+
+		if position == nil {
+			position = w.retention.lru.PushFront(alarm)
+		} else {
+			position = w.retention.lru.InsertAfter(alarm, position)
+		}
+		w.retention.alarms[alarm.retainedAlarmKey] = position
+	}
+}
@@ -0,0 +1,197 @@
+package message
+
+import (
+	. "alarm/domain"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testRetentionWorker a worker with a manual clock, driven by calling its handlers directly.
+func testRetentionWorker(now *time.Time) *AlarmMessageWorker {
+	i := 0
+	alarmStatusChangedMessages := make(chan AlarmStatusChangedMessage, 75)
+	sendAlarmDigestMessages := make(chan SendAlarmDigestMessage, 75)
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 500)
+
+	workerName := "alarmMessagesWorker#" + strconv.Itoa(i)
+	worker := AlarmMessageWorkerCreateNew(&workerName, &i, &alarmStatusChangedMessages, &sendAlarmDigestMessages, &alarmDigestMessagesChan)
+	worker.now = func() time.Time {
+		return *now
+	}
+	return worker
+}
+
+func changeAlarm(worker *AlarmMessageWorker, userId string, alarmId string, status AlarmStatus, now time.Time) {
+	worker.handleAlarmStatusChangeMessage(&AlarmStatusChangedMessage{AlarmId: alarmId, UserId: userId, Status: string(status), ChangedAt: now})
+}
+
+func TestAlarmMessageWorker_retention_evictsExpiredClearedAlarms(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+
+	changeAlarm(worker, "u1", "a1", CRITICAL, now)
+	changeAlarm(worker, "u1", "a1", CLEARED, now)
+	changeAlarm(worker, "u1", "a2", CRITICAL, now)
+	now = now.Add(30 * time.Minute)
+	changeAlarm(worker, "u2", "a3", CLEARED, now)
+
+
+	// when
+	now = now.Add(31 * time.Minute)
+	worker.handleRetentionSweep(&retentionSweepControlMessage{options: AlarmRetentionOptions{ClearedAlarmTtl: time.Hour}})
+
+
+	// then
+	if _, exists := worker.alarmsState["u1"]["a1"]; exists {
+		t.Errorf("expired cleared alarm should be evicted")
+	}
+	if _, exists := worker.activeAlarms["u1"]["a2"]; !exists {
+		t.Errorf("active alarm should be kept")
+	}
+	if _, exists := worker.alarmsState["u2"]["a3"]; !exists {
+		t.Errorf("recently cleared alarm should be kept")
+	}
+	if worker.Evictions() != 1 || worker.TrackedAlarms() != 2 || worker.TrackedUsers() != 2 {
+		t.Errorf("unexpected evictions: %v, tracked alarms: %v, tracked users: %v", worker.Evictions(), worker.TrackedAlarms(), worker.TrackedUsers())
+	}
+	if worker.EstimatedStateBytes() <= 0 {
+		t.Errorf("expected an estimate of the state, got: %v", worker.EstimatedStateBytes())
+	}
+}
+
+func TestAlarmMessageWorker_retention_evictsIdleUsers(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+
+	changeAlarm(worker, "idle", "a1", CRITICAL, now)
+	changeAlarm(worker, "active", "a2", CRITICAL, now)
+	now = now.Add(50 * time.Minute)
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "active"})
+
+
+	// when
+	now = now.Add(20 * time.Minute)
+	worker.handleRetentionSweep(&retentionSweepControlMessage{options: AlarmRetentionOptions{IdleUserTtl: time.Hour}})
+
+
+	// then
+	if _, exists := worker.alarmsState["idle"]; exists {
+		t.Errorf("idle user should be evicted")
+	}
+	if _, exists := worker.activeAlarms["idle"]; exists {
+		t.Errorf("active alarms of the idle user should be evicted")
+	}
+	if _, exists := worker.alarmsState["active"]; !exists {
+		t.Errorf("user which requested a digest should be kept")
+	}
+	if _, exists := worker.retention.userLastSeen["idle"]; exists {
+		t.Errorf("idle user should not be tracked anymore")
+	}
+}
+
+func TestAlarmMessageWorker_retention_evictsLeastRecentlyChangedAboveCap(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+	worker.handleRetentionSweep(&retentionSweepControlMessage{options: AlarmRetentionOptions{MaxAlarmsPerWorker: 2}})
+
+	changeAlarm(worker, "u1", "a1", CRITICAL, now)
+	changeAlarm(worker, "u1", "a2", CRITICAL, now)
+	changeAlarm(worker, "u1", "a1", WARNING, now) // Note: a1 becomes the most recent
+
+
+	// when
+	changeAlarm(worker, "u2", "a3", CRITICAL, now)
+
+
+	// then
+	if _, exists := worker.alarmsState["u1"]["a2"]; exists {
+		t.Errorf("least recently changed alarm should be evicted")
+	}
+	if _, exists := worker.activeAlarms["u1"]["a1"]; !exists {
+		t.Errorf("recently changed alarm should be kept")
+	}
+	if _, exists := worker.activeAlarms["u2"]["a3"]; !exists {
+		t.Errorf("new alarm should be kept")
+	}
+	if worker.retention.lru.Len() != 2 || len(worker.retention.alarms) != 2 {
+		t.Errorf("expected 2 retained alarms, got: %v", worker.retention.lru.Len())
+	}
+}
+
+func TestAlarmMessageWorker_retention_survivesResharding(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	source := testRetentionWorker(&now)
+	target := testRetentionWorker(&now)
+
+	changeAlarm(source, "u1", "a1", CLEARED, now)
+	changeAlarm(source, "u1", "a2", CRITICAL, now.Add(time.Minute))
+
+
+	// when
+	state := source.extractUserState("u1")
+	target.installUserState("u1", state)
+	now = now.Add(61 * time.Minute)
+	target.handleRetentionSweep(&retentionSweepControlMessage{options: AlarmRetentionOptions{ClearedAlarmTtl: time.Hour}})
+
+
+	// then
+	if source.retention.lru.Len() != 0 || len(source.retention.userLastSeen) != 0 {
+		t.Errorf("source should not track the moved user anymore")
+	}
+	if _, exists := target.alarmsState["u1"]["a1"]; exists {
+		t.Errorf("moved cleared alarm should keep its age and be evicted")
+	}
+	if _, exists := target.activeAlarms["u1"]["a2"]; !exists {
+		t.Errorf("moved active alarm should be kept")
+	}
+}
+
+func TestAlarmMessageWorker_retention_installedAlarmsKeepTheirRecency(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	source := testRetentionWorker(&now)
+	changeAlarm(source, "u1", "a1", CLEARED, now)
+	changeAlarm(source, "u1", "a2", CRITICAL, now)
+
+	now = now.Add(2 * time.Hour)
+	target := testRetentionWorker(&now)
+	changeAlarm(target, "u2", "a3", CRITICAL, now)
+	changeAlarm(target, "u2", "a4", CLEARED, now)
+
+
+	// when
+	target.installUserState("u1", source.extractUserState("u1"))
+	target.handleRetentionSweep(&retentionSweepControlMessage{options: AlarmRetentionOptions{ClearedAlarmTtl: time.Hour}})
+
+
+	// then
+	if _, exists := target.alarmsState["u1"]["a1"]; exists {
+		t.Errorf("installed cleared alarm older than the ttl should be evicted")
+	}
+	if _, exists := target.alarmsState["u2"]["a4"]; !exists {
+		t.Errorf("recently cleared alarm should be kept")
+	}
+
+
+	// when
+	target.handleRetentionSweep(&retentionSweepControlMessage{options: AlarmRetentionOptions{MaxAlarmsPerWorker: 2}})
+
+
+	// then
+	if _, exists := target.alarmsState["u1"]["a2"]; exists {
+		t.Errorf("installed old alarm should be evicted above the cap before the recent ones")
+	}
+	if len(target.alarmsState["u2"]) != 2 {
+		t.Errorf("recently changed alarms of the worker should be kept, got: %v", target.alarmsState["u2"])
+	}
+}
@@ -0,0 +1,465 @@
+package message
+
+import (
+	. "alarm/domain"
+	. "alarm/metrics"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Snapshots of the state of the AlarmMessageWorker actors, so a restart does not lose the alarms:
+
+	* every snapshotIntervalMs and on graceful shutdown every worker serializes its users (from its own goroutine, through
+	  its control mailbox) to <snapshotDir>/worker-<id>.snapshot, the file is replaced atomically (temp file + rename)
+	* a round holds the resharding lock of the pool, so every user is in exactly one snapshot
+	* the final snapshot (shutdown) first processes the messages which are already in the mailboxes
+	* at startup all the snapshots are loaded and every user is installed to the worker which owns it now, so the
+	  number of workers may change between restarts (the snapshots of removed workers get deleted by the next round)
+
+	File format (json):
+
+		{"version":1,"worker":"alarmMessagesWorker#3","takenAt":"...","checksum":"<sha256 of state>","state":[...users...]}
+
+	A snapshot with an unknown version, a checksum mismatch or which can not be parsed is quarantined (renamed to
+	<file>.corrupt-<unix time>) and skipped, the service starts without the users of that worker.
+*/
+
+const snapshotFormatVersion = 1
+
+const snapshotFilePattern = "worker-*.snapshot"
+
+// Note: a worker which does not answer in time (eg: stuck) fails the round, the previous snapshots are kept.
+const snapshotReplyTimeout = 10 * time.Second
+
+var snapshotsCounter = CounterVecCreateNew("alarm_worker_snapshots_total", "Worker state snapshots, by result.", "result")
+
+type snapshotControlMessage struct {
+	drain bool
+	reply chan *workerSnapshot
+}
+
+type workerSnapshot struct {
+	users  []snapshotUser
+	walSeq int64 // Note: the latest write-ahead log entry the snapshot covers
+}
+
+type restoreControlMessage struct {
+	users    map[UserId]*alarmUserState
+	restored *sync.WaitGroup
+}
+
+type workerSnapshotFile struct {
+	Version  int             `json:"version"`
+	Worker   string          `json:"worker"`
+	TakenAt  time.Time       `json:"takenAt"`
+	Checksum string          `json:"checksum"`
+	State    json.RawMessage `json:"state"`
+}
+
+type snapshotUser struct {
+	UserId     UserId          `json:"user"`
+	LastSeen   time.Time       `json:"lastSeen"`
+	Alarms     []snapshotAlarm `json:"alarms"`
+	LastDigest *snapshotDigest `json:"lastDigest,omitempty"`
+}
+
+type snapshotDigest struct {
+	RequestId    string        `json:"request,omitempty"`
+	SentAt       time.Time     `json:"sentAt"`
+	ActiveAlarms []ActiveAlarm `json:"activeAlarms"`
+}
+
+type snapshotAlarm struct {
+	Id        AlarmId     `json:"id"`
+	Status    AlarmStatus `json:"status"`
+	CreatedAt time.Time   `json:"createdAt"`
+	UpdatedAt time.Time   `json:"updatedAt"`
+	Active    bool        `json:"active"`    // Note: not yet sent by a digest
+	ChangedAt time.Time   `json:"changedAt"` // Note: for the retention policies
+
+	StatusSince    time.Time     `json:"statusSince,omitempty"` // Note: for the escalation rules
+	EscalatedAfter time.Duration `json:"escalatedAfter,omitempty"`
+
+	History []AlarmTransition `json:"history,omitempty"`
+}
+
+
+// ------------------- snapshotter -------------------
+
+type AlarmStateSnapshotter struct {
+	workerPool *AlarmMessageWorkerPool
+	dir        string
+	interval   time.Duration
+
+	// Note: nil when disabled, compacted after every round
+	wal *WriteAheadLog
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// AlarmStateSnapshotterCreateNew interval 0 takes a snapshot only on Stop.
+func AlarmStateSnapshotterCreateNew(workerPool *AlarmMessageWorkerPool, dir string, interval time.Duration) *AlarmStateSnapshotter {
+	return &AlarmStateSnapshotter{
+		workerPool: workerPool,
+		dir:        dir,
+		interval:   interval,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// UseWriteAheadLog every round deletes the write-ahead log segments covered by the snapshots.
+func (s *AlarmStateSnapshotter) UseWriteAheadLog(wal *WriteAheadLog) {
+	s.wal = wal
+}
+
+func (s *AlarmStateSnapshotter) Start() {
+	go func() {
+		defer close(s.done)
+		if s.interval <= 0 {
+			<-s.stop
+			return
+		}
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Snapshot(false); err != nil {
+					log.Errorf("could not snapshot the worker state, error: %v\n", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic snapshots and takes the final one.
+func (s *AlarmStateSnapshotter) Stop() {
+	close(s.stop)
+	<-s.done
+
+	if err := s.Snapshot(true); err != nil {
+		log.Errorf("could not snapshot the worker state on shutdown, error: %v\n", err)
+	}
+}
+
+// Snapshot writes the state of every worker, drain processes the messages already in the mailboxes first.
+func (s *AlarmStateSnapshotter) Snapshot(drain bool) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		snapshotsCounter.WithLabelValues("failed").Inc()
+		return err
+	}
+
+	var roundStartSeq int64
+	if s.wal != nil {
+		roundStartSeq = s.wal.currentSequence()
+	}
+
+	snapshots, err := s.workerPool.snapshotWorkers(drain)
+	if err != nil {
+		snapshotsCounter.WithLabelValues("failed").Inc()
+		return err
+	}
+
+	written := make(map[string]bool)
+	for worker, snapshot := range snapshots {
+		filename, err := writeSnapshot(s.dir, worker, snapshot.users)
+		if err != nil {
+			snapshotsCounter.WithLabelValues("failed").Inc()
+			return fmt.Errorf("worker: %v, error: %w", worker.workerName, err)
+		}
+		written[filename] = true
+		snapshotsCounter.WithLabelValues("written").Inc()
+	}
+
+	// Note: the snapshots of the workers which do not exist anymore, their users are in the ones just written.
+	existing, _ := filepath.Glob(filepath.Join(s.dir, snapshotFilePattern))
+	for _, filename := range existing {
+		if !written[filename] {
+			if err := os.Remove(filename); err != nil {
+				log.Warnf("could not remove stale snapshot: %v, error: %v\n", filename, err)
+			}
+		}
+	}
+
+	if s.wal != nil {
+		covered := make(map[int]int64, len(snapshots))
+		for worker, snapshot := range snapshots {
+			covered[worker.workerId] = snapshot.walSeq
+		}
+		s.wal.compact(covered, roundStartSeq)
+	}
+
+	log.Debugf("snapshot of %v workers written to: %v\n", len(snapshots), s.dir)
+	return nil
+}
+
+// Restore loads the snapshots and installs their users to the workers which own them now, returns the number of users.
+func (s *AlarmStateSnapshotter) Restore() int {
+	filenames, err := filepath.Glob(filepath.Join(s.dir, snapshotFilePattern))
+	if err != nil {
+		log.Errorf("could not list the snapshots of: %v, error: %v\n", s.dir, err)
+		return 0
+	}
+
+	users := make(map[UserId]*alarmUserState)
+	for _, filename := range filenames {
+		snapshotUsers, err := readSnapshot(filename)
+		if err != nil {
+			quarantineSnapshot(filename, err)
+			continue
+		}
+
+		for _, user := range snapshotUsers {
+			// Note: should not happen (a round holds the resharding lock), the most recently seen wins.
+			if existing, exists := users[user.UserId]; exists && existing.lastSeen.After(user.LastSeen) {
+				continue
+			}
+			users[user.UserId] = user.state()
+		}
+		snapshotsCounter.WithLabelValues("restored").Inc()
+	}
+
+	s.workerPool.restoreUsers(users)
+
+	log.Infof("restored %v users from %v snapshots of: %v\n", len(users), len(filenames), s.dir)
+	return len(users)
+}
+
+
+// ------------------- files -------------------
+
+func snapshotFilename(dir string, worker *AlarmMessageWorker) string {
+	return filepath.Join(dir, "worker-"+strconv.Itoa(worker.workerId)+".snapshot")
+}
+
+func writeSnapshot(dir string, worker *AlarmMessageWorker, users []snapshotUser) (string, error) {
+	state, err := json.Marshal(users)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal(workerSnapshotFile{
+		Version:  snapshotFormatVersion,
+		Worker:   worker.workerName,
+		TakenAt:  time.Now().UTC(),
+		Checksum: snapshotChecksum(state),
+		State:    state,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	filename := snapshotFilename(dir, worker)
+	temporary := filename + ".tmp"
+
+	// Note: synced before the rename, since the write-ahead log segments it covers get deleted afterwards.
+	file, err := os.Create(temporary)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(content)
+	err = firstError(err, file.Sync())
+	err = firstError(err, file.Close())
+	if err != nil {
+		return "", err
+	}
+	return filename, os.Rename(temporary, filename)
+}
+
+func readSnapshot(filename string) ([]snapshotUser, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file workerSnapshotFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	if file.Version != snapshotFormatVersion {
+		return nil, fmt.Errorf("unsupported version: %v", file.Version)
+	}
+	if file.Checksum != snapshotChecksum(file.State) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	var users []snapshotUser
+	if err := json.Unmarshal(file.State, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func snapshotChecksum(state []byte) string {
+	sum := sha256.Sum256(state)
+	return hex.EncodeToString(sum[:])
+}
+
+func quarantineSnapshot(filename string, reason error) {
+	quarantined := filename + ".corrupt-" + strconv.FormatInt(time.Now().Unix(), 10)
+	if err := os.Rename(filename, quarantined); err != nil {
+		log.Errorf("could not quarantine snapshot: %v, error: %v\n", filename, err)
+	}
+
+	snapshotsCounter.WithLabelValues("quarantined").Inc()
+	log.Errorf("snapshot: %v is corrupt (%v), moved to: %v\n", filename, reason, quarantined)
+}
+
+func (user snapshotUser) state() *alarmUserState {
+	state := &alarmUserState{
+		alarms:       make(map[AlarmId]*Alarm, len(user.Alarms)),
+		activeAlarms: make(map[AlarmId]*Alarm),
+		lastSeen:     user.LastSeen,
+		changedAt:    make(map[AlarmId]time.Time, len(user.Alarms)),
+	}
+
+	for _, a := range user.Alarms {
+		alarm := &Alarm{Id: a.Id, UserId: user.UserId, Status: a.Status, CreatedAt: a.CreatedAt, UpdatedAt: a.UpdatedAt,
+			StatusSince: a.StatusSince, EscalatedAfter: a.EscalatedAfter, History: a.History}
+		state.alarms[a.Id] = alarm
+		if a.Active {
+			state.activeAlarms[a.Id] = alarm
+		}
+		state.changedAt[a.Id] = a.ChangedAt
+	}
+
+	if len(user.Alarms) == 0 {
+		// Note: a user with only a retained digest.
+		state.alarms, state.activeAlarms = nil, nil
+	}
+	if user.LastDigest != nil {
+		state.lastDigest = &retainedDigest{requestId: user.LastDigest.RequestId, sentAt: user.LastDigest.SentAt, activeAlarms: user.LastDigest.ActiveAlarms}
+	}
+	return state
+}
+
+
+// ------------------- pool -------------------
+
+func (p *AlarmMessageWorkerPool) snapshotWorkers(drain bool) (map[*AlarmMessageWorker]*workerSnapshot, error) {
+	p.reshardingLock.Lock()
+	defer p.reshardingLock.Unlock()
+
+	workers := p.Workers()
+	replies := make(map[*AlarmMessageWorker]chan *workerSnapshot, len(workers))
+	for _, worker := range workers {
+		replies[worker] = make(chan *workerSnapshot, 1)
+		worker.controlMessages <- &snapshotControlMessage{drain: drain, reply: replies[worker]}
+	}
+
+	deadline := time.After(snapshotReplyTimeout)
+	snapshots := make(map[*AlarmMessageWorker]*workerSnapshot, len(workers))
+	for worker, reply := range replies {
+		select {
+		case snapshot := <-reply:
+			snapshots[worker] = snapshot
+		case <-deadline:
+			return nil, errors.New("worker: " + worker.workerName + " did not answer the snapshot in time")
+		}
+	}
+	return snapshots, nil
+}
+
+// restoreUsers installs the users to their owners, meant for startup (before any message of these users).
+func (p *AlarmMessageWorkerPool) restoreUsers(users map[UserId]*alarmUserState) {
+	p.reshardingLock.Lock()
+	defer p.reshardingLock.Unlock()
+
+	p.routingLock.RLock()
+	byWorker := make(map[*AlarmMessageWorker]map[UserId]*alarmUserState)
+	for userId, state := range users {
+		worker := p.workers[p.routing.Locate(string(userId))]
+		if byWorker[worker] == nil {
+			byWorker[worker] = make(map[UserId]*alarmUserState)
+		}
+		byWorker[worker][userId] = state
+	}
+	p.routingLock.RUnlock()
+
+	restored := &sync.WaitGroup{}
+	restored.Add(len(byWorker))
+	for worker, workerUsers := range byWorker {
+		worker.controlMessages <- &restoreControlMessage{users: workerUsers, restored: restored}
+	}
+	restored.Wait()
+}
+
+
+// ------------------- worker -------------------
+
+func (w *AlarmMessageWorker) handleSnapshot(snapshot *snapshotControlMessage) {
+	if snapshot.drain {
+		w.processPendingMessages()
+	}
+
+	users := make([]snapshotUser, 0, len(w.alarmsState))
+	for userId, alarms := range w.alarmsState {
+		user := snapshotUser{UserId: userId, LastSeen: w.retention.userLastSeen[userId], Alarms: make([]snapshotAlarm, 0, len(alarms))}
+
+		for alarmId, alarm := range alarms {
+			_, active := w.activeAlarms[userId][alarmId]
+
+			var changedAt time.Time
+			if element, exists := w.retention.alarms[retainedAlarmKey{userId: userId, alarmId: alarmId}]; exists {
+				changedAt = element.Value.(*retainedAlarm).changedAt
+			}
+
+			user.Alarms = append(user.Alarms, snapshotAlarm{
+				Id:             alarm.Id,
+				Status:         alarm.Status,
+				CreatedAt:      alarm.CreatedAt,
+				UpdatedAt:      alarm.UpdatedAt,
+				Active:         active,
+				ChangedAt:      changedAt,
+				StatusSince:    alarm.StatusSince,
+				EscalatedAfter: alarm.EscalatedAfter,
+				History:        append([]AlarmTransition(nil), alarm.History...), // Note: gets written by another goroutine
+			})
+		}
+		if digest := w.lastDigest(userId); digest != nil {
+			user.LastDigest = &snapshotDigest{RequestId: digest.requestId, SentAt: digest.sentAt, ActiveAlarms: digest.activeAlarms}
+		}
+		users = append(users, user)
+	}
+	for userId, digest := range w.lastDigests {
+		if _, exists := w.alarmsState[userId]; exists || w.lastDigest(userId) == nil {
+			continue
+		}
+		users = append(users, snapshotUser{UserId: userId, Alarms: []snapshotAlarm{},
+			LastDigest: &snapshotDigest{RequestId: digest.requestId, SentAt: digest.sentAt, ActiveAlarms: digest.activeAlarms}})
+	}
+
+	// Note: the next entries go to a new segment, so the current ones can be deleted once the snapshot is written.
+	var walSeq int64
+	if w.wal != nil {
+		walSeq = w.wal.rotate()
+	}
+
+	snapshot.reply <- &workerSnapshot{users: users, walSeq: walSeq}
+}
+
+func (w *AlarmMessageWorker) handleRestore(restore *restoreControlMessage) {
+	for userId, state := range restore.users {
+		w.installUserState(userId, state)
+		w.trackTenantUsage(userId, len(state.alarms))
+	}
+
+	log.Infof("[%v] worker restored %v users\n", w.workerName, len(restore.users))
+	restore.restored.Done()
+}
@@ -0,0 +1,133 @@
+package message
+
+import (
+	. "alarm/domain"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlarmStateSnapshotter_restoresStateWithDifferentWorkerCount(t *testing.T) {
+
+	// given
+	dir := t.TempDir()
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 500)
+	pool := testWorkerPool(3, &alarmDigestMessagesChan)
+
+	changedAt := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		userId := "user-" + strconv.Itoa(i)
+		pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: userId, Status: "CRITICAL", ChangedAt: changedAt})
+		pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a2", UserId: userId, Status: "CLEARED", ChangedAt: changedAt})
+	}
+	if err := AlarmStateSnapshotterCreateNew(pool, dir, 0).Snapshot(true); err != nil {
+		t.Fatalf("could not snapshot, error: %v", err)
+	}
+
+
+	// when
+	restoredPool := testWorkerPool(2, &alarmDigestMessagesChan)
+	restored := AlarmStateSnapshotterCreateNew(restoredPool, dir, 0).Restore()
+
+
+	// then
+	if restored != 50 {
+		t.Errorf("expected 50 restored users, got: %v", restored)
+	}
+
+	for i := 0; i < 50; i++ {
+		restoredPool.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "user-" + strconv.Itoa(i)})
+	}
+	for i := 0; i < 50; i++ {
+		select {
+		case digest := <-alarmDigestMessagesChan:
+			if len(digest.ActiveAlarms) != 1 || digest.ActiveAlarms[0].AlarmId != "a1" || !digest.ActiveAlarms[0].LatestChangedAt.Equal(changedAt) {
+				t.Errorf("unexpected digest of user: %v, active alarms: %v", digest.UserId, digest.ActiveAlarms)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 50 digests, got: %v", i)
+		}
+	}
+
+	// Note: the next round removes the snapshot of the worker which does not exist anymore.
+	if err := AlarmStateSnapshotterCreateNew(restoredPool, dir, 0).Snapshot(false); err != nil {
+		t.Fatalf("could not snapshot, error: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, snapshotFilePattern)); len(files) != 2 {
+		t.Errorf("expected 2 snapshots, got: %v", files)
+	}
+}
+
+func TestAlarmStateSnapshotter_quarantinesCorruptSnapshots(t *testing.T) {
+
+	// given
+	dir := t.TempDir()
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 500)
+	pool := testWorkerPool(2, &alarmDigestMessagesChan)
+
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CRITICAL", ChangedAt: time.Now()})
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u2", Status: "CRITICAL", ChangedAt: time.Now()})
+	if err := AlarmStateSnapshotterCreateNew(pool, dir, 0).Snapshot(true); err != nil {
+		t.Fatalf("could not snapshot, error: %v", err)
+	}
+
+	// Note: one tampered (checksum mismatch), one truncated.
+	files, _ := filepath.Glob(filepath.Join(dir, snapshotFilePattern))
+	var tamperedFile, validFile string
+	for _, file := range files {
+		content, _ := os.ReadFile(file)
+		if len(tamperedFile) == 0 && strings.Contains(string(content), "CRITICAL") {
+			tamperedFile = file
+			_ = os.WriteFile(file, []byte(strings.Replace(string(content), "CRITICAL", "WARNING", 1)), 0644)
+		} else {
+			validFile = file
+		}
+	}
+	_ = os.WriteFile(filepath.Join(dir, "worker-7.snapshot"), []byte(`{"version":1,"state":[`), 0644)
+
+
+	// when
+	restored := AlarmStateSnapshotterCreateNew(testWorkerPool(2, &alarmDigestMessagesChan), dir, 0).Restore()
+
+
+	// then
+	quarantined, _ := filepath.Glob(filepath.Join(dir, "*.corrupt-*"))
+	if len(quarantined) != 2 {
+		t.Errorf("expected 2 quarantined snapshots, got: %v", quarantined)
+	}
+	if _, err := os.Stat(validFile); err != nil {
+		t.Errorf("valid snapshot should be kept, error: %v", err)
+	}
+	if restored > 1 {
+		t.Errorf("expected at most the users of the valid snapshot, got: %v", restored)
+	}
+}
+
+func TestReadSnapshot_rejectsUnknownVersion(t *testing.T) {
+
+	// given
+	filename := filepath.Join(t.TempDir(), "worker-0.snapshot")
+	state := `[{"user":"u1","alarms":[{"id":"a1","status":"CRITICAL","active":true}]}]`
+	content := `{"version":2,"checksum":"` + snapshotChecksum([]byte(state)) + `","state":` + state + `}`
+	_ = os.WriteFile(filename, []byte(content), 0644)
+
+
+	// when
+	_, err := readSnapshot(filename)
+
+
+	// then
+	if err == nil || !strings.Contains(err.Error(), "version") {
+		t.Errorf("expected an unsupported version error, got: %v", err)
+	}
+
+	// Note: same state with the supported version is valid.
+	_ = os.WriteFile(filename, []byte(strings.Replace(content, `"version":2`, `"version":1`, 1)), 0644)
+	users, err := readSnapshot(filename)
+	if err != nil || len(users) != 1 || users[0].state().activeAlarms["a1"].Status != CRITICAL {
+		t.Errorf("expected the snapshot to be valid, users: %v, error: %v", users, err)
+	}
+}
@@ -0,0 +1,266 @@
+package message
+
+import (
+	. "alarm/domain"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+/*
+	Read-only queries of the state of the workers (request/reply), so a service does not have to send SendAlarmDigest
+	(which flushes the active alarms) to see them:
+
+	* AlarmQuery.ActiveAlarms --> the alarms of the user which are CRITICAL/WARNING, and whether the next digest sends them
+	* AlarmQuery.Alarm        --> a single alarm of the user
+	* AlarmQuery.Stats        --> the counts of the state of the user, or of the whole pool without a user
+	* AlarmQuery.LastDigest   --> the latest digest sent to the user, while retained (see alarmDigestReplay.go)
+
+	A query is routed to the worker which owns the user (the same routing as its messages, pinned users included) as
+	a control message, and answered from the worker goroutine without changing its state (not even the retention recency).
+	Errors are replied with a code, see AlarmQueryError.
+
+	With multi-tenancy the queries are answered only on the subjects of the tenants (eg: productA.AlarmQuery.Stats), the
+	tenant of the subject scopes the user, so a client of a tenant can not query the users of another one (nor the stats
+	of the whole pool).
+
+	Note: control messages have priority, so a query does not wait for the messages already in the mailbox of the worker.
+*/
+
+const (
+	QueryErrorBadRequest = "BAD_REQUEST"
+	QueryErrorNotFound   = "NOT_FOUND"
+	QueryErrorTimeout    = "TIMEOUT"
+	QueryErrorInternal   = "INTERNAL"
+)
+
+type AlarmQueryError struct {
+	Code    string
+	Message string
+}
+
+func (e *AlarmQueryError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+type alarmQueryKind int
+
+const (
+	activeAlarmsQuery alarmQueryKind = iota
+	alarmQuery
+	statsQuery
+	lastDigestQuery
+)
+
+type QueriedAlarm struct {
+	AlarmId       string
+	Status        string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	PendingDigest bool // Note: not yet sent by a digest, the next one sends it
+}
+
+type UserActiveAlarms struct {
+	UserId       string
+	ActiveAlarms []QueriedAlarm
+}
+
+type UserAlarmStats struct {
+	UserId        string
+	Worker        string
+	Alarms        int
+	ActiveAlarms  int
+	PendingDigest int
+	ByStatus      map[string]int
+	LastSeen      time.Time // Note: the latest status change or digest request, zero if not tracked
+}
+
+type AlarmPoolStats struct {
+	Workers           int
+	TrackedUsers      int64 // Note: as of the latest retention sweep
+	TrackedAlarms     int64
+	ProcessedMessages int64
+	MailboxDepth      int
+}
+
+type alarmQueryControlMessage struct {
+	kind    alarmQueryKind
+	userId  UserId
+	alarmId AlarmId
+	reply   chan *AlarmQueryReply
+}
+
+
+// ------------------- responders -------------------
+
+// RegisterAlarmQueryResponders answers the AlarmQuery.* requests (of every tenant, if any), waiting for the owning worker
+// up to the timeout.
+func RegisterAlarmQueryResponders(listenerName string, transport Transport, workerPool *AlarmMessageWorkerPool, tenants *TenantRegistry,
+								  timeout time.Duration) []TransportSubscription {
+
+	respond := func(tenant string, topicName string, kind alarmQueryKind) TransportSubscription {
+		subject := tenantScopedSubject(tenant, topicName)
+		return AsyncSubscribe(transport, subject, func(msg *TransportMessage) {
+			if len(msg.Reply) == 0 {
+				log.Warnf("[%v] query without a reply inbox from topic: %v, data: %v\n", listenerName, subject, string(msg.Data))
+				return
+			}
+
+			var reply *AlarmQueryReply
+			var query AlarmQueryMessage
+			if err := json.Unmarshal(msg.Data, &query); err != nil {
+				log.Warnf("[%v] bad formatted query received from topic: %v, data: %v\n", listenerName, subject, string(msg.Data))
+				reply = &AlarmQueryReply{Error: &AlarmQueryError{Code: QueryErrorBadRequest, Message: "bad formatted query"}}
+			} else {
+				reply = workerPool.queryAlarms(kind, tenant, query, timeout)
+			}
+
+			data, err := json.Marshal(reply)
+			if err != nil {
+				data, _ = json.Marshal(&AlarmQueryReply{Error: &AlarmQueryError{Code: QueryErrorInternal, Message: err.Error()}})
+			}
+			if err := transport.Publish(&TransportMessage{Subject: msg.Reply, Data: data, Header: msg.Header}); err != nil {
+				log.Warnf("[%v] could not reply to query from topic: %v, error: %v\n", listenerName, subject, err)
+			}
+		})
+	}
+
+	topics := Topics()
+	var subscriptions []TransportSubscription
+	for _, tenant := range tenants.scopes() {
+		subscriptions = append(subscriptions,
+			respond(tenant, topics.AlarmQueryActiveAlarms, activeAlarmsQuery),
+			respond(tenant, topics.AlarmQueryAlarm, alarmQuery),
+			respond(tenant, topics.AlarmQueryStats, statsQuery),
+			respond(tenant, topics.AlarmQueryLastDigest, lastDigestQuery))
+	}
+	return subscriptions
+}
+
+
+// ------------------- pool -------------------
+
+// queryAlarms answers the query from the worker which owns the user of the tenant (the stats of the pool without a user
+// and a tenant).
+func (p *AlarmMessageWorkerPool) queryAlarms(kind alarmQueryKind, tenant string, query AlarmQueryMessage, timeout time.Duration) *AlarmQueryReply {
+	if kind == statsQuery && len(query.UserId) == 0 && len(tenant) == 0 {
+		return &AlarmQueryReply{PoolStats: p.poolStats()}
+	}
+	if len(query.UserId) == 0 {
+		return &AlarmQueryReply{Error: &AlarmQueryError{Code: QueryErrorBadRequest, Message: "UserID is required"}}
+	}
+	if kind == alarmQuery && len(query.AlarmId) == 0 {
+		return &AlarmQueryReply{Error: &AlarmQueryError{Code: QueryErrorBadRequest, Message: "AlarmID is required"}}
+	}
+
+	// Note: the timeout covers a full mailbox too, a late answer is dropped (a resharding in progress delays the send
+	// until the users are installed to their new owners).
+	deadline := time.After(timeout)
+	reply := make(chan *AlarmQueryReply, 1)
+	userId := scopedUserId(tenant, query.UserId)
+	if !p.sendToOwner(userId, &alarmQueryControlMessage{kind: kind, userId: UserId(userId), alarmId: AlarmId(query.AlarmId), reply: reply}, deadline) {
+		return &AlarmQueryReply{Error: &AlarmQueryError{Code: QueryErrorTimeout, Message: "worker mailbox still full after " + timeout.String()}}
+	}
+
+	select {
+	case r := <-reply:
+		return r.withUserId(query.UserId)
+	case <-deadline:
+		return &AlarmQueryReply{Error: &AlarmQueryError{Code: QueryErrorTimeout, Message: "worker did not answer the query in " + timeout.String()}}
+	}
+}
+
+// withUserId the reply carries the user id of the query, not the one scoped with the tenant.
+func (r *AlarmQueryReply) withUserId(userId string) *AlarmQueryReply {
+	if r.ActiveAlarms != nil {
+		r.ActiveAlarms.UserId = userId
+	}
+	if r.Stats != nil {
+		r.Stats.UserId = userId
+	}
+	if r.LastDigest != nil {
+		r.LastDigest.UserId = userId
+	}
+	return r
+}
+
+func (p *AlarmMessageWorkerPool) poolStats() *AlarmPoolStats {
+	stats := &AlarmPoolStats{}
+	for _, info := range p.WorkersInfo() {
+		stats.Workers++
+		stats.TrackedUsers += info.TrackedUsers
+		stats.TrackedAlarms += info.TrackedAlarms
+		stats.ProcessedMessages += info.ProcessedMessages
+		stats.MailboxDepth += info.AlarmStatusChangedMailboxDepth + info.SendAlarmDigestMailboxDepth
+	}
+	return stats
+}
+
+
+// ------------------- worker -------------------
+
+func (w *AlarmMessageWorker) handleAlarmQuery(query *alarmQueryControlMessage) {
+	alarms := w.alarmsState[query.userId]
+	pending := w.activeAlarms[query.userId]
+
+	queried := func(alarm *Alarm) QueriedAlarm {
+		_, pendingDigest := pending[alarm.Id]
+		return QueriedAlarm{
+			AlarmId:       string(alarm.Id),
+			Status:        AlarmStatusAsString(alarm.Status),
+			CreatedAt:     alarm.CreatedAt,
+			UpdatedAt:     alarm.UpdatedAt,
+			PendingDigest: pendingDigest,
+		}
+	}
+
+	switch query.kind {
+
+	case activeAlarmsQuery:
+		result := &UserActiveAlarms{UserId: string(query.userId), ActiveAlarms: make([]QueriedAlarm, 0)}
+		for _, alarm := range alarms {
+			if IsActiveAlarm(alarm) {
+				result.ActiveAlarms = append(result.ActiveAlarms, queried(alarm))
+			}
+		}
+		sort.Slice(result.ActiveAlarms, func(i, j int) bool {
+			return result.ActiveAlarms[i].AlarmId < result.ActiveAlarms[j].AlarmId
+		})
+		query.reply <- &AlarmQueryReply{ActiveAlarms: result}
+
+	case alarmQuery:
+		alarm, exists := alarms[query.alarmId]
+		if !exists {
+			query.reply <- &AlarmQueryReply{Error: &AlarmQueryError{Code: QueryErrorNotFound, Message: ErrAlarmNotFound.Error()}}
+			return
+		}
+		result := queried(alarm)
+		query.reply <- &AlarmQueryReply{Alarm: &result}
+
+	case statsQuery:
+		result := &UserAlarmStats{
+			UserId:        string(query.userId),
+			Worker:        w.workerName,
+			Alarms:        len(alarms),
+			PendingDigest: len(pending),
+			ByStatus:      make(map[string]int),
+			LastSeen:      w.retention.userLastSeen[query.userId],
+		}
+		for _, alarm := range alarms {
+			result.ByStatus[AlarmStatusAsString(alarm.Status)]++
+			if IsActiveAlarm(alarm) {
+				result.ActiveAlarms++
+			}
+		}
+		query.reply <- &AlarmQueryReply{Stats: result}
+
+	case lastDigestQuery:
+		result := w.queriedLastDigest(query.userId)
+		if result == nil {
+			query.reply <- &AlarmQueryReply{Error: &AlarmQueryError{Code: QueryErrorNotFound, Message: "no digest retained for the user"}}
+			return
+		}
+		query.reply <- &AlarmQueryReply{LastDigest: result}
+	}
+}
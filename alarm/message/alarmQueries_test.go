@@ -0,0 +1,203 @@
+package message
+
+import (
+	. "alarm/domain"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func queryOverTransport(t *testing.T, transport Transport, topicName string, query AlarmQueryMessage) AlarmQueryReply {
+	data, _ := json.Marshal(query)
+	msg, err := transport.Request(&TransportMessage{Subject: topicName, Data: data}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("query to topic: %v failed, error: %v", topicName, err)
+	}
+
+	var reply AlarmQueryReply
+	if err := json.Unmarshal(msg.Data, &reply); err != nil {
+		t.Fatalf("bad formatted reply: %v", string(msg.Data))
+	}
+	return reply
+}
+
+func TestAlarmMessageWorker_queries_doNotChangeTheState(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	worker := testRetentionWorker(&now)
+
+	changeAlarm(worker, "u1", "a1", CRITICAL, now)
+	worker.handleSendAlarmDigestMessage(&SendAlarmDigestMessage{UserId: "u1"})
+	changeAlarm(worker, "u1", "a2", WARNING, now)
+	changeAlarm(worker, "u1", "a3", CLEARED, now)
+	lastSeen := now
+	now = now.Add(time.Hour)
+
+
+	// when
+	reply := make(chan *AlarmQueryReply, 3)
+	worker.handleAlarmQuery(&alarmQueryControlMessage{kind: activeAlarmsQuery, userId: "u1", reply: reply})
+	worker.handleAlarmQuery(&alarmQueryControlMessage{kind: alarmQuery, userId: "u1", alarmId: "a3", reply: reply})
+	worker.handleAlarmQuery(&alarmQueryControlMessage{kind: statsQuery, userId: "u1", reply: reply})
+	activeAlarms, alarm, stats := <-reply, <-reply, <-reply
+
+
+	// then
+	expected := []QueriedAlarm{
+		{AlarmId: "a1", Status: "CRITICAL", CreatedAt: lastSeen, UpdatedAt: time.Time{}, PendingDigest: false},
+		{AlarmId: "a2", Status: "WARNING", CreatedAt: lastSeen, UpdatedAt: time.Time{}, PendingDigest: true},
+	}
+	if len(activeAlarms.ActiveAlarms.ActiveAlarms) != 2 || activeAlarms.ActiveAlarms.ActiveAlarms[0] != expected[0] || activeAlarms.ActiveAlarms.ActiveAlarms[1] != expected[1] {
+		t.Errorf("expected active alarms: %v, got: %v", expected, activeAlarms.ActiveAlarms)
+	}
+	if alarm.Alarm == nil || alarm.Alarm.Status != "CLEARED" {
+		t.Errorf("invalid alarm: %v", alarm)
+	}
+	if s := stats.Stats; s == nil || s.Alarms != 3 || s.ActiveAlarms != 2 || s.PendingDigest != 1 || s.ByStatus["CLEARED"] != 1 || !s.LastSeen.Equal(lastSeen) {
+		t.Errorf("invalid stats: %v", stats.Stats)
+	}
+
+	if len(worker.activeAlarms["u1"]) != 1 || !worker.retention.userLastSeen["u1"].Equal(lastSeen) {
+		t.Errorf("queries should not change the state of the worker")
+	}
+}
+
+/*
+	Scenario:
+
+	* a user gets 2 alarms through the pool, 1 active
+	* the queries are sent over request/reply (the pool stats, an unknown alarm, a bad formatted query as well)
+*/
+func TestAlarmQueryResponders_answerFromTheOwningWorker(t *testing.T) {
+
+	// given
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	pool := testWorkerPool(3, &alarmDigestMessagesChan)
+	transport := InMemoryTransportCreateNew()
+	subscriptions := RegisterAlarmQueryResponders("test", transport, pool, nil, time.Second)
+	defer func() {
+		for _, subscription := range subscriptions {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
+	}()
+
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CRITICAL", ChangedAt: time.Now()})
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a2", UserId: "u1", Status: "CLEARED", ChangedAt: time.Now()})
+	waitForProcessedMessages(t, pool, 2)
+
+
+	// when
+	activeAlarms := queryOverTransport(t, transport, AlarmQueryActiveAlarmsTopic, AlarmQueryMessage{UserId: "u1"})
+	alarm := queryOverTransport(t, transport, AlarmQueryAlarmTopic, AlarmQueryMessage{UserId: "u1", AlarmId: "a2"})
+	missing := queryOverTransport(t, transport, AlarmQueryAlarmTopic, AlarmQueryMessage{UserId: "u1", AlarmId: "a3"})
+	userStats := queryOverTransport(t, transport, AlarmQueryStatsTopic, AlarmQueryMessage{UserId: "u1"})
+	poolStats := queryOverTransport(t, transport, AlarmQueryStatsTopic, AlarmQueryMessage{})
+	noUser := queryOverTransport(t, transport, AlarmQueryActiveAlarmsTopic, AlarmQueryMessage{})
+
+	msg, _ := transport.Request(&TransportMessage{Subject: AlarmQueryAlarmTopic, Data: []byte("{")}, time.Second)
+	var badFormatted AlarmQueryReply
+	_ = json.Unmarshal(msg.Data, &badFormatted)
+
+
+	// then
+	if activeAlarms.ActiveAlarms == nil || len(activeAlarms.ActiveAlarms.ActiveAlarms) != 1 || !activeAlarms.ActiveAlarms.ActiveAlarms[0].PendingDigest {
+		t.Errorf("invalid active alarms: %v", activeAlarms)
+	}
+	if alarm.Alarm == nil || alarm.Alarm.AlarmId != "a2" || alarm.Alarm.Status != "CLEARED" {
+		t.Errorf("invalid alarm: %v", alarm)
+	}
+	if missing.Error == nil || missing.Error.Code != QueryErrorNotFound {
+		t.Errorf("expected not found, got: %v", missing)
+	}
+	owner := pool.workers[pool.routing.Locate("u1")]
+	if userStats.Stats == nil || userStats.Stats.Worker != owner.workerName || userStats.Stats.Alarms != 2 {
+		t.Errorf("invalid user stats: %v", userStats)
+	}
+	if poolStats.PoolStats == nil || poolStats.PoolStats.Workers != 3 || poolStats.PoolStats.ProcessedMessages != 2 {
+		t.Errorf("invalid pool stats: %v", poolStats)
+	}
+	if noUser.Error == nil || noUser.Error.Code != QueryErrorBadRequest {
+		t.Errorf("expected bad request without a user, got: %v", noUser)
+	}
+	if badFormatted.Error == nil || badFormatted.Error.Code != QueryErrorBadRequest {
+		t.Errorf("expected bad request for a bad formatted query, got: %v", badFormatted)
+	}
+}
+
+func TestAlarmQueryResponders_timeoutWhenTheWorkerIsBusy(t *testing.T) {
+
+	// given
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage) // Note: nobody reads it, so the digest blocks the worker
+	pool := testWorkerPool(2, &alarmDigestMessagesChan)
+	transport := InMemoryTransportCreateNew()
+	subscriptions := RegisterAlarmQueryResponders("test", transport, pool, nil, 100*time.Millisecond)
+	defer func() {
+		for _, subscription := range subscriptions {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
+	}()
+
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CRITICAL", ChangedAt: time.Now()})
+	waitForProcessedMessages(t, pool, 1)
+	pool.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "u1"})
+	owner := pool.workers[pool.routing.Locate("u1")]
+	for tries := 0; tries < 500 && (len(*owner.SendAlarmDigestMessages) > 0 || atomic.LoadInt32(&owner.busy) == 0); tries++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // Note: the worker is blocked in the digest by now
+
+
+	// when
+	reply := queryOverTransport(t, transport, AlarmQueryActiveAlarmsTopic, AlarmQueryMessage{UserId: "u1"})
+
+
+	// then
+	if reply.Error == nil || reply.Error.Code != QueryErrorTimeout {
+		t.Errorf("expected timeout, got: %v", reply)
+	}
+	<-alarmDigestMessagesChan
+}
+
+func TestAlarmQueryResponders_timeoutWhenTheControlMailboxIsFull(t *testing.T) {
+
+	// given
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage) // Note: nobody reads it, so the digest blocks the worker
+	pool := testWorkerPool(2, &alarmDigestMessagesChan)
+
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CRITICAL", ChangedAt: time.Now()})
+	waitForProcessedMessages(t, pool, 1)
+	pool.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "u1"})
+	owner := pool.workers[pool.routing.Locate("u1")]
+	for tries := 0; tries < 500 && (len(*owner.SendAlarmDigestMessages) > 0 || atomic.LoadInt32(&owner.busy) == 0); tries++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for len(owner.controlMessages) < cap(owner.controlMessages) {
+		owner.controlMessages <- &digestDeliveryCheckControlMessage{}
+	}
+
+	// Note: another reader of the routing (a concurrent query) does not block the query.
+	pool.reshardingLock.RLock()
+
+
+	// when
+	reply := pool.queryAlarms(activeAlarmsQuery, "", AlarmQueryMessage{UserId: "u1"}, 100*time.Millisecond)
+	pool.reshardingLock.RUnlock()
+
+
+	// then
+	if reply.Error == nil || reply.Error.Code != QueryErrorTimeout {
+		t.Errorf("expected timeout, got: %v", reply)
+	}
+
+	// Note: the query gave up the send, it does not land in the mailbox once the worker catches up.
+	<-alarmDigestMessagesChan
+	for tries := 0; tries < 500 && len(owner.controlMessages) > 0; tries++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(owner.controlMessages) != 0 {
+		t.Errorf("expected the control mailbox to be drained, got: %v", len(owner.controlMessages))
+	}
+}
@@ -0,0 +1,110 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	The checks of the health probes (see alarm/health):
+
+	* readiness --> the transport is connected, the subscriptions are active, the workers have started
+	* liveness  --> no worker has a mailbox which has not drained (or a message in process) for longer than the threshold,
+	                no producer is blocked on publish for longer than the threshold
+*/
+
+var ErrTransportDisconnected = errors.New("transport: disconnected")
+
+func CheckTransportConnected(transport Transport) error {
+	if !transport.IsConnected() {
+		return ErrTransportDisconnected
+	}
+	return nil
+}
+
+func CheckSubscriptionsActive(subscriptions []TransportSubscription) error {
+	var inactive []string
+	for _, subscription := range subscriptions {
+		if !subscription.IsValid() {
+			inactive = append(inactive, subscription.Subject())
+		}
+	}
+
+	if len(inactive) > 0 {
+		return fmt.Errorf("inactive subscriptions: %v", strings.Join(inactive, ", "))
+	}
+	return nil
+}
+
+func (p *AlarmMessageWorkerPool) CheckWorkersStarted() error {
+	var notStarted []string
+	for _, w := range p.Workers() {
+		if atomic.LoadInt32(&w.started) == 0 {
+			notStarted = append(notStarted, w.workerName)
+		}
+	}
+
+	if len(notStarted) > 0 {
+		return fmt.Errorf("workers not started: %v", strings.Join(notStarted, ", "))
+	}
+	return nil
+}
+
+// CheckWorkersProgress fails if a worker has not taken a message from its non-empty mailbox (or has not finished
+// processing one) for longer than the threshold.
+func (p *AlarmMessageWorkerPool) CheckWorkersProgress(threshold time.Duration) error {
+	var stuck []string
+	for _, w := range p.Workers() {
+		if stuckFor := w.stuckFor(); stuckFor > threshold {
+			stuck = append(stuck, fmt.Sprintf("%v (%v)", w.workerName, stuckFor.Round(time.Millisecond)))
+		}
+	}
+	sort.Strings(stuck)
+
+	if len(stuck) > 0 {
+		return fmt.Errorf("stuck workers: %v", strings.Join(stuck, ", "))
+	}
+	return nil
+}
+
+func (w *AlarmDigestMessageProducer) CheckNotBlocked(threshold time.Duration) error {
+	publishingSince := atomic.LoadInt64(&w.publishingSinceNanos)
+	if publishingSince == 0 {
+		return nil
+	}
+
+	if blockedFor := time.Since(time.Unix(0, publishingSince)); blockedFor > threshold {
+		return fmt.Errorf("%v blocked on publish for: %v", w.workerName, blockedFor.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// -------------------
+
+func (w *AlarmMessageWorker) recordProgress(busy bool) {
+	atomic.StoreInt64(&w.lastProgressNanos, time.Now().UnixNano())
+
+	if busy {
+		atomic.StoreInt32(&w.busy, 1)
+	} else {
+		atomic.StoreInt32(&w.busy, 0)
+	}
+}
+
+// stuckFor how long the worker has not made progress while it has work to do, 0 if it has nothing to do.
+func (w *AlarmMessageWorker) stuckFor() time.Duration {
+	if atomic.LoadInt32(&w.started) == 0 {
+		return 0
+	}
+
+	hasWork := atomic.LoadInt32(&w.busy) == 1 || len(*w.AlarmStatusChangedMessages) > 0 || len(*w.SendAlarmDigestMessages) > 0
+	if !hasWork {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, atomic.LoadInt64(&w.lastProgressNanos)))
+}
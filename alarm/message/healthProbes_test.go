@@ -0,0 +1,65 @@
+package message
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckWorkersProgress_detectsStuckWorker(t *testing.T) {
+
+	// given - nobody reads the digests, so the worker blocks on the digest of the user
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage)
+	pool := testWorkerPool(2, &alarmDigestMessagesChan)
+
+	for tries := 0; pool.CheckWorkersStarted() != nil; tries++ {
+		if tries > 100 {
+			t.Fatalf("workers should have been started: %v", pool.CheckWorkersStarted())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pool.DispatchAlarmStatusChangedMessage("test", statusChanged("u1", "a1", "CRITICAL", time.Now()))
+	waitForEmptyMailboxes(t, pool)
+
+	if err := pool.CheckWorkersProgress(50 * time.Millisecond); err != nil {
+		t.Fatalf("idle workers should not be stuck, got: %v", err)
+	}
+
+
+	// when
+	pool.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "u1"})
+	time.Sleep(100 * time.Millisecond)
+
+
+	// then
+	if err := pool.CheckWorkersProgress(50 * time.Millisecond); err == nil {
+		t.Errorf("the worker blocked on the digest should have been reported as stuck")
+	}
+
+	<-alarmDigestMessagesChan
+	for tries := 0; pool.CheckWorkersProgress(50*time.Millisecond) != nil; tries++ {
+		if tries > 100 {
+			t.Fatalf("the worker should have recovered: %v", pool.CheckWorkersProgress(50*time.Millisecond))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCheckSubscriptionsActive(t *testing.T) {
+
+	transport := InMemoryTransportCreateNew()
+	sub := AsyncSubscribe(transport, "AlarmStatusChanged", func(msg *TransportMessage) {})
+
+	if err := CheckSubscriptionsActive([]TransportSubscription{sub}); err != nil {
+		t.Errorf("subscription should have been active, got: %v", err)
+	}
+
+	_ = transport.Drain()
+
+	if err := CheckSubscriptionsActive([]TransportSubscription{sub}); err == nil {
+		t.Errorf("subscription should have been inactive after drain")
+	}
+	if err := CheckTransportConnected(transport); err == nil {
+		t.Errorf("transport should have been disconnected after drain")
+	}
+}
@@ -0,0 +1,397 @@
+package message
+
+import (
+	. "alarm/metrics"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	Hot user isolation: a single noisy user emitting thousands of AlarmStatusChanged messages per second should not
+	starve the rest of the users of the same worker.
+
+	Every user has a token bucket (rate per second + burst), when a user runs out of tokens:
+
+	* coalesce mode --> its messages are kept aside, only the latest status per alarm, and get forwarded to the worker
+						when tokens are available again (or right before a SendAlarmDigest of the user).
+
+	* overflow mode --> the user (and its state) is moved to the dedicated overflow worker, and moved back when it has
+						stayed under the limit for the cooldown period.
+*/
+
+type HotUserMode string
+
+const (
+	CoalesceHotUsers HotUserMode = "coalesce"
+	OverflowHotUsers HotUserMode = "overflow"
+)
+
+type HotUserThrottlerOptions struct {
+	RatePerSecond float64
+	Burst         int
+
+	Mode       HotUserMode
+	Exemptions []string
+
+	CoalesceFlushInterval time.Duration
+	OverflowCooldown      time.Duration
+}
+
+var hotUserThrottledCounter = CounterVecCreateNew("alarm_hot_user_throttled_total", "AlarmStatusChanged messages of users above their rate limit.", "mode")
+var hotUserCoalescedCounter = CounterVecCreateNew("alarm_hot_user_coalesced_total", "AlarmStatusChanged messages dropped because a newer status of the same alarm was coalesced.")
+var hotUsersPinnedGauge = GaugeVecCreateNew("alarm_hot_users_pinned", "Users currently moved to the overflow worker.")
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+type HotUserThrottler struct {
+	mutex sync.Mutex
+
+	options    HotUserThrottlerOptions
+	exemptions map[string]bool
+	workerPool *AlarmMessageWorkerPool
+	dispatcher MessageDispatcher // Note: the pool, or a test double
+
+	buckets map[string]*tokenBucket
+
+	// Note: coalesce mode, userId --> alarmId --> latest message.
+	coalesced map[string]map[string]AlarmStatusChangedMessage
+
+	// Note: coalesce mode, the users whose coalesced messages have been taken but not handed to the pool yet, the new
+	//		 messages of these wait behind them (coalesced) and their digests wait for them (flushed).
+	inFlight map[string]int
+	flushed  *sync.Cond
+
+	// Note: overflow mode, userId --> last time it was above the limit.
+	pinned map[string]time.Time
+
+	now  func() time.Time
+	stop chan struct{}
+	done chan struct{}
+}
+
+func HotUserThrottlerCreateNew(workerPool *AlarmMessageWorkerPool, options HotUserThrottlerOptions) *HotUserThrottler {
+
+	t := &HotUserThrottler{
+		options:    options,
+		exemptions: make(map[string]bool),
+		workerPool: workerPool,
+		dispatcher: workerPool,
+		buckets:    make(map[string]*tokenBucket),
+		coalesced:  make(map[string]map[string]AlarmStatusChangedMessage),
+		inFlight:   make(map[string]int),
+		pinned:     make(map[string]time.Time),
+		now:        time.Now,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	t.flushed = sync.NewCond(&t.mutex)
+
+	for _, userId := range options.Exemptions {
+		t.exemptions[userId] = true
+	}
+
+	switch options.Mode {
+	case CoalesceHotUsers:
+	case OverflowHotUsers:
+		workerPool.EnableOverflowWorker()
+	default:
+		panic(errors.New("unknown hot user mode: " + string(options.Mode)))
+	}
+
+	return t
+}
+
+func (t *HotUserThrottler) Start() {
+	go func() {
+		defer close(t.done)
+
+		ticker := time.NewTicker(t.options.CoalesceFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				t.tick()
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop forwards the coalesced messages to the workers regardless of the tokens, so they are not lost on shutdown (the
+// consumers should have stopped dispatching already).
+func (t *HotUserThrottler) Stop() {
+	close(t.stop)
+	<-t.done
+
+	t.mutex.Lock()
+	var pending []AlarmStatusChangedMessage
+	for userId := range t.coalesced {
+		pending = append(pending, t.takeCoalesced(userId, -1)...)
+	}
+	t.mutex.Unlock()
+
+	for _, msg := range pending {
+		t.dispatcher.DispatchAlarmStatusChangedMessage("hotUserThrottler", msg)
+	}
+}
+
+// SetLimits changes the limits at runtime (config reload), the mode and the flush interval need a restart.
+func (t *HotUserThrottler) SetLimits(ratePerSecond float64, burst int, exemptions []string, overflowCooldown time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.options.RatePerSecond = ratePerSecond
+	t.options.Burst = burst
+	t.options.Exemptions = exemptions
+	t.options.OverflowCooldown = overflowCooldown
+
+	t.exemptions = make(map[string]bool)
+	for _, userId := range exemptions {
+		t.exemptions[userId] = true
+	}
+
+	// Note: a smaller burst applies to the tokens already in the buckets.
+	for _, bucket := range t.buckets {
+		if bucket.tokens > float64(burst) {
+			bucket.tokens = float64(burst)
+		}
+	}
+}
+
+// -------------------
+
+func (t *HotUserThrottler) DispatchAlarmStatusChangedMessage(consumerId string, msg AlarmStatusChangedMessage) {
+
+	t.mutex.Lock()
+
+	if t.exemptions[msg.UserId] {
+		t.mutex.Unlock()
+		t.dispatcher.DispatchAlarmStatusChangedMessage(consumerId, msg)
+		return
+	}
+
+	switch t.options.Mode {
+
+	case CoalesceHotUsers:
+		// Note: if the user has coalesced messages (or some on their way to the pool), the new ones have to wait behind
+		//		 them (ordering).
+		if _, hasCoalesced := t.coalesced[msg.UserId]; !hasCoalesced && t.inFlight[msg.UserId] == 0 && t.takeToken(msg.UserId) {
+			t.mutex.Unlock()
+			t.dispatcher.DispatchAlarmStatusChangedMessage(consumerId, msg)
+			return
+		}
+		hotUserThrottledCounter.WithLabelValues(string(CoalesceHotUsers)).Inc()
+		t.coalesce(msg)
+		t.mutex.Unlock()
+
+	case OverflowHotUsers:
+		pin := false
+		if !t.takeToken(msg.UserId) {
+			hotUserThrottledCounter.WithLabelValues(string(OverflowHotUsers)).Inc()
+
+			_, alreadyPinned := t.pinned[msg.UserId]
+			t.pinned[msg.UserId] = t.now()
+			pin = !alreadyPinned
+		}
+		t.mutex.Unlock()
+
+		if pin {
+			log.Warnf("[%v] hot user: %v is above %v messages/sec, moving it to the overflow worker\n", consumerId, msg.UserId, t.options.RatePerSecond)
+			go t.pinUser(msg.UserId)
+		}
+		t.dispatcher.DispatchAlarmStatusChangedMessage(consumerId, msg)
+
+	default:
+		t.mutex.Unlock()
+		t.dispatcher.DispatchAlarmStatusChangedMessage(consumerId, msg)
+	}
+}
+
+// DispatchSendAlarmDigestMessage the coalesced messages of the user are flushed first, so the digest is up-to-date.
+func (t *HotUserThrottler) DispatchSendAlarmDigestMessage(consumerId string, msg SendAlarmDigestMessage) {
+
+	t.mutex.Lock()
+	// Note: the messages already on their way to the pool (eg: of a tick) go first.
+	for t.inFlight[msg.UserId] > 0 {
+		t.flushed.Wait()
+	}
+	pending := t.takeCoalesced(msg.UserId, -1)
+	t.markInFlight(msg.UserId, pending)
+	t.mutex.Unlock()
+
+	for _, m := range pending {
+		t.dispatcher.DispatchAlarmStatusChangedMessage(consumerId, m)
+	}
+	t.dispatcher.DispatchSendAlarmDigestMessage(consumerId, msg)
+
+	t.releaseInFlight(msg.UserId, pending)
+}
+
+// -------------------
+
+func (t *HotUserThrottler) tick() {
+
+	t.mutex.Lock()
+
+	now := t.now()
+
+	// Note: forward the coalesced messages as far as the tokens of each user allow.
+	var toDispatch []AlarmStatusChangedMessage
+	for userId := range t.coalesced {
+		if t.inFlight[userId] > 0 {
+			continue // Note: a digest of the user is flushing them.
+		}
+		t.refill(userId, now)
+		bucket := t.buckets[userId]
+
+		if available := int(bucket.tokens); available > 0 {
+			pending := t.takeCoalesced(userId, available)
+			bucket.tokens -= float64(len(pending))
+			t.markInFlight(userId, pending)
+			toDispatch = append(toDispatch, pending...)
+		}
+	}
+
+	// Note: users which stayed under the limit for the cooldown period leave the overflow worker.
+	var toUnpin []string
+	for userId, lastAboveLimit := range t.pinned {
+		if now.Sub(lastAboveLimit) >= t.options.OverflowCooldown {
+			delete(t.pinned, userId)
+			toUnpin = append(toUnpin, userId)
+		}
+	}
+	hotUsersPinnedGauge.WithLabelValues().Set(float64(len(t.pinned)))
+
+	// Note: full buckets are the same as missing buckets, forget them (bounded memory).
+	for userId, bucket := range t.buckets {
+		if _, hasCoalesced := t.coalesced[userId]; !hasCoalesced && bucket.tokens >= float64(t.options.Burst) {
+			delete(t.buckets, userId)
+		}
+	}
+
+	t.mutex.Unlock()
+
+	for _, msg := range toDispatch {
+		t.dispatcher.DispatchAlarmStatusChangedMessage("hotUserThrottler", msg)
+		t.releaseInFlight(msg.UserId, []AlarmStatusChangedMessage{msg})
+	}
+
+	for _, userId := range toUnpin {
+		log.Infof("[hotUserThrottler] hot user: %v cooled down, moving it back from the overflow worker\n", userId)
+		t.workerPool.UnpinUser(userId)
+	}
+}
+
+func (t *HotUserThrottler) pinUser(userId string) {
+	if err := t.workerPool.PinUser(userId); err != nil {
+		log.Errorf("[hotUserThrottler] could not move user: %v to the overflow worker, error: %v\n", userId, err)
+	}
+}
+
+// takeToken must be called holding the mutex.
+func (t *HotUserThrottler) takeToken(userId string) bool {
+	t.refill(userId, t.now())
+
+	bucket := t.buckets[userId]
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true
+	}
+	return false
+}
+
+func (t *HotUserThrottler) refill(userId string, now time.Time) {
+	bucket, exists := t.buckets[userId]
+	if !exists {
+		t.buckets[userId] = &tokenBucket{tokens: float64(t.options.Burst), lastRefill: now}
+		return
+	}
+
+	elapsed := now.Sub(bucket.lastRefill).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	bucket.tokens += elapsed * t.options.RatePerSecond
+	if bucket.tokens > float64(t.options.Burst) {
+		bucket.tokens = float64(t.options.Burst)
+	}
+	bucket.lastRefill = now
+}
+
+// coalesce keeps only the latest status per alarm, must be called holding the mutex.
+func (t *HotUserThrottler) coalesce(msg AlarmStatusChangedMessage) {
+	alarms, exists := t.coalesced[msg.UserId]
+	if !exists {
+		alarms = make(map[string]AlarmStatusChangedMessage)
+		t.coalesced[msg.UserId] = alarms
+	}
+
+	previous, hasPrevious := alarms[msg.AlarmId]
+	if hasPrevious {
+		hotUserCoalescedCounter.WithLabelValues().Inc()
+		if msg.ChangedAt.Before(previous.ChangedAt) {
+			return
+		}
+	}
+	alarms[msg.AlarmId] = msg
+}
+
+// markInFlight the messages are on their way to the pool, must be called holding the mutex.
+func (t *HotUserThrottler) markInFlight(userId string, messages []AlarmStatusChangedMessage) {
+	if len(messages) > 0 {
+		t.inFlight[userId] += len(messages)
+	}
+}
+
+// releaseInFlight the messages have been handed to the pool.
+func (t *HotUserThrottler) releaseInFlight(userId string, messages []AlarmStatusChangedMessage) {
+	if len(messages) == 0 {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.inFlight[userId] -= len(messages); t.inFlight[userId] <= 0 {
+		delete(t.inFlight, userId)
+		t.flushed.Broadcast()
+	}
+}
+
+// takeCoalesced removes up to max (-1 for all) coalesced messages of the user, oldest first, must be called holding the mutex.
+func (t *HotUserThrottler) takeCoalesced(userId string, max int) []AlarmStatusChangedMessage {
+	alarms, exists := t.coalesced[userId]
+	if !exists {
+		return nil
+	}
+
+	messages := make([]AlarmStatusChangedMessage, 0, len(alarms))
+	for _, m := range alarms {
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ChangedAt.Before(messages[j].ChangedAt)
+	})
+
+	if max >= 0 && max < len(messages) {
+		messages = messages[:max]
+	}
+
+	for _, m := range messages {
+		delete(alarms, m.AlarmId)
+	}
+	if len(alarms) == 0 {
+		delete(t.coalesced, userId)
+	}
+
+	return messages
+}
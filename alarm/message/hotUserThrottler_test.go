@@ -0,0 +1,265 @@
+package message
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func testHotUserThrottler(mode HotUserMode, exemptions ...string) (*HotUserThrottler, *AlarmMessageWorkerPool, chan AlarmDigestMessage, *testClock) {
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 100)
+	pool := testWorkerPool(2, &alarmDigestMessagesChan)
+
+	clock := &testClock{now: time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)}
+
+	throttler := HotUserThrottlerCreateNew(pool, HotUserThrottlerOptions{
+		RatePerSecond:         1,
+		Burst:                 2,
+		Mode:                  mode,
+		Exemptions:            exemptions,
+		CoalesceFlushInterval: time.Hour,
+		OverflowCooldown:      time.Minute,
+	})
+	throttler.now = func() time.Time {
+		return clock.now
+	}
+
+	return throttler, pool, alarmDigestMessagesChan, clock
+}
+
+func statusChanged(userId string, alarmId string, status string, changedAt time.Time) AlarmStatusChangedMessage {
+	return AlarmStatusChangedMessage{AlarmId: alarmId, UserId: userId, Status: status, ChangedAt: changedAt}
+}
+
+func TestHotUserThrottler_coalesceKeepsLatestStatusPerAlarm(t *testing.T) {
+
+	// given
+	throttler, pool, digests, clock := testHotUserThrottler(CoalesceHotUsers)
+	at := clock.now
+
+
+	// when
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a1", "CRITICAL", at))
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a2", "CRITICAL", at))
+
+	// Note: above the burst from now on.
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a1", "CLEARED", at.Add(1*time.Second)))
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a1", "WARNING", at.Add(2*time.Second)))
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a2", "CLEARED", at.Add(3*time.Second)))
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a3", "CRITICAL", at.Add(4*time.Second)))
+
+
+	// then
+	if len(throttler.coalesced["hot"]) != 3 {
+		t.Fatalf("expected 3 coalesced alarms, got: %v", throttler.coalesced["hot"])
+	}
+	if throttler.coalesced["hot"]["a1"].Status != "WARNING" {
+		t.Errorf("latest status should have been kept, got: %v", throttler.coalesced["hot"]["a1"])
+	}
+
+
+	// when - tokens for 2 messages are available again
+	clock.advance(2 * time.Second)
+	throttler.tick()
+
+
+	// then
+	if len(throttler.coalesced["hot"]) != 1 {
+		t.Fatalf("expected 1 coalesced alarm, got: %v", throttler.coalesced["hot"])
+	}
+
+
+	// when - the digest flushes the rest
+	waitForEmptyMailboxes(t, pool)
+	throttler.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "hot"})
+
+
+	// then
+	select {
+	case digest := <-digests:
+		if len(digest.ActiveAlarms) != 2 || digest.ActiveAlarms[0].AlarmId != "a1" || digest.ActiveAlarms[1].AlarmId != "a3" {
+			t.Errorf("unexpected digest: %v", digest)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("digest should have been produced")
+	}
+	if len(throttler.coalesced) != 0 {
+		t.Errorf("no coalesced messages should have been left, got: %v", throttler.coalesced)
+	}
+}
+
+// blockingDispatcher records the status changes in the order they reach the pool, the first one of the blocked
+// consumer waits until released.
+type blockingDispatcher struct {
+	mutex    sync.Mutex
+	statuses []string
+
+	blockedConsumer string
+	blockOnce       sync.Once
+	blocked         chan struct{}
+	release         chan struct{}
+}
+
+func (d *blockingDispatcher) DispatchAlarmStatusChangedMessage(consumerId string, msg AlarmStatusChangedMessage) {
+	if consumerId == d.blockedConsumer {
+		d.blockOnce.Do(func() {
+			close(d.blocked)
+			<-d.release
+		})
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.statuses = append(d.statuses, msg.Status)
+}
+
+func (d *blockingDispatcher) DispatchSendAlarmDigestMessage(consumerId string, msg SendAlarmDigestMessage) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.statuses = append(d.statuses, "DIGEST")
+}
+
+func TestHotUserThrottler_tickAndDirectDispatchKeepTheOrder(t *testing.T) {
+
+	// given
+	throttler, _, _, clock := testHotUserThrottler(CoalesceHotUsers)
+	dispatcher := &blockingDispatcher{blockedConsumer: "hotUserThrottler", blocked: make(chan struct{}), release: make(chan struct{})}
+	throttler.dispatcher = dispatcher
+	at := clock.now
+
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a1", "CRITICAL", at))
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a1", "WARNING", at.Add(time.Second)))
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a1", "CRITICAL", at.Add(2*time.Second))) // Note: coalesced
+	clock.advance(10 * time.Second)
+
+
+	// when - a tick hands the coalesced CRITICAL over while a newer CLEARED and a digest get dispatched
+	ticked := make(chan struct{})
+	go func() {
+		throttler.tick()
+		close(ticked)
+	}()
+	<-dispatcher.blocked
+
+	throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a1", "CLEARED", at.Add(3*time.Second)))
+	digested := make(chan struct{})
+	go func() {
+		throttler.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "hot"})
+		close(digested)
+	}()
+	time.Sleep(50 * time.Millisecond) // Note: the digest would be dispatched by now, if it did not wait
+
+	close(dispatcher.release)
+	<-ticked
+	<-digested
+
+
+	// then
+	expected := []string{"CRITICAL", "WARNING", "CRITICAL", "CLEARED", "DIGEST"}
+	if strings.Join(dispatcher.statuses, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the order: %v, got: %v", expected, dispatcher.statuses)
+	}
+	if len(throttler.coalesced) != 0 || len(throttler.inFlight) != 0 {
+		t.Errorf("nothing should have been left behind, coalesced: %v, in flight: %v", throttler.coalesced, throttler.inFlight)
+	}
+}
+
+func TestHotUserThrottler_stopForwardsCoalescedMessages(t *testing.T) {
+
+	// given
+	throttler, pool, digests, clock := testHotUserThrottler(CoalesceHotUsers)
+	throttler.Start()
+	for i, alarmId := range []string{"a1", "a2", "a3", "a4"} {
+		throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", alarmId, "CRITICAL", clock.now.Add(time.Duration(i)*time.Second)))
+	}
+
+
+	// when
+	throttler.Stop()
+
+
+	// then
+	if len(throttler.coalesced) != 0 {
+		t.Fatalf("no coalesced messages should have been left, got: %v", throttler.coalesced)
+	}
+
+	waitForEmptyMailboxes(t, pool)
+	pool.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "hot"})
+	select {
+	case digest := <-digests:
+		if len(digest.ActiveAlarms) != 4 {
+			t.Errorf("the coalesced alarms should have reached the worker, got: %v", digest)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("digest should have been produced")
+	}
+}
+
+func TestHotUserThrottler_exemptUsersAreNotThrottled(t *testing.T) {
+
+	throttler, _, _, clock := testHotUserThrottler(CoalesceHotUsers, "vip")
+
+	for i := 0; i < 10; i++ {
+		throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("vip", "a1", "CRITICAL", clock.now))
+	}
+
+	if len(throttler.coalesced) != 0 {
+		t.Errorf("exempt user should not have been throttled")
+	}
+}
+
+func TestHotUserThrottler_overflowMovesHotUserAndBack(t *testing.T) {
+
+	// given
+	throttler, pool, digests, clock := testHotUserThrottler(OverflowHotUsers)
+
+
+	// when
+	for i := 0; i < 5; i++ {
+		throttler.DispatchAlarmStatusChangedMessage("test", statusChanged("hot", "a1", "CRITICAL", clock.now))
+	}
+
+
+	// then
+	for tries := 0; len(pool.PinnedUsers()) == 0; tries++ {
+		if tries > 100 {
+			t.Fatalf("hot user should have been moved to the overflow worker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pool.Size() != 2 {
+		t.Errorf("overflow worker should not be part of the ring, size: %v", pool.Size())
+	}
+
+
+	// when - cooled down
+	clock.advance(2 * time.Minute)
+	throttler.tick()
+
+
+	// then
+	if len(pool.PinnedUsers()) != 0 {
+		t.Fatalf("hot user should have been moved back, pinned: %v", pool.PinnedUsers())
+	}
+
+	waitForEmptyMailboxes(t, pool)
+	throttler.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "hot"})
+
+	select {
+	case digest := <-digests:
+		if len(digest.ActiveAlarms) != 1 {
+			t.Errorf("state of the user should have survived the moves, digest: %v", digest)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("digest should have been produced")
+	}
+}
@@ -0,0 +1,324 @@
+package message
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	In-process implementation of the Transport, mainly used during tests so the whole pipeline can run without a
+	broker.
+
+	Delivery is deterministic: published messages are queued in publish order and delivered one by one from a
+	single dispatcher goroutine, subscribers of the same subject get the message in subscription order and queue
+	groups are served in round-robin fashion.
+
+	Note: handlers must not call Request or WaitIdle (they run on the dispatcher goroutine, so it would deadlock).
+*/
+
+const inMemoryInboxPrefix = "_INBOX."
+
+type InMemoryTransport struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	subscriptions      []*inMemoryTransportSubscription
+	queueGroupCounters map[string]uint64
+	inboxCounter       uint64
+
+	pending     []inMemoryDelivery
+	dispatching bool
+	closed      bool
+}
+
+type inMemoryDelivery struct {
+	subscription *inMemoryTransportSubscription
+	msg          *TransportMessage
+}
+
+func InMemoryTransportCreateNew() *InMemoryTransport {
+	t := &InMemoryTransport{
+		queueGroupCounters: make(map[string]uint64),
+	}
+	t.cond = sync.NewCond(&t.mutex)
+
+	go t.dispatch()
+
+	return t
+}
+
+func (t *InMemoryTransport) NumSubscriptions() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.subscriptions)
+}
+
+func (t *InMemoryTransport) Subscribe(subject string, handler func(msg *TransportMessage)) (TransportSubscription, error) {
+	return t.subscribe(subject, "", handler)
+}
+
+func (t *InMemoryTransport) QueueSubscribe(subject string, queue string, handler func(msg *TransportMessage)) (TransportSubscription, error) {
+	return t.subscribe(subject, queue, handler)
+}
+
+func (t *InMemoryTransport) Publish(msg *TransportMessage) error {
+	_, err := t.publish(msg)
+	return err
+}
+
+func (t *InMemoryTransport) Request(msg *TransportMessage, timeout time.Duration) (*TransportMessage, error) {
+
+	t.mutex.Lock()
+	t.inboxCounter++
+	inbox := inMemoryInboxPrefix + strconv.FormatUint(t.inboxCounter, 10)
+	t.mutex.Unlock()
+
+	replies := make(chan *TransportMessage, 1)
+	sub, err := t.Subscribe(inbox, func(reply *TransportMessage) {
+		select {
+		case replies <- reply:
+		default:
+			// Note: only the first reply matters.
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	request := *msg
+	request.Reply = inbox
+
+	delivered, err := t.publish(&request)
+	if err != nil {
+		return nil, err
+	}
+	if delivered == 0 {
+		return nil, ErrTransportNoResponders
+	}
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, ErrTransportTimeout
+	}
+}
+
+func (t *InMemoryTransport) Drain() error {
+	t.WaitIdle()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, subscription := range t.subscriptions {
+		subscription.active = false
+	}
+	t.subscriptions = nil
+	t.closed = true
+	t.cond.Broadcast()
+
+	return nil
+}
+
+func (t *InMemoryTransport) IsConnected() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return !t.closed
+}
+
+// WaitIdle blocks until all the published messages have been delivered.
+func (t *InMemoryTransport) WaitIdle() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for len(t.pending) > 0 || t.dispatching {
+		t.cond.Wait()
+	}
+}
+
+// -------------------
+
+func (t *InMemoryTransport) subscribe(subject string, queue string, handler func(msg *TransportMessage)) (TransportSubscription, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil, ErrTransportClosed
+	}
+
+	subscription := &inMemoryTransportSubscription{
+		transport: t,
+		subject:   subject,
+		queue:     queue,
+		handler:   handler,
+		active:    true,
+	}
+	t.subscriptions = append(t.subscriptions, subscription)
+
+	return subscription, nil
+}
+
+func (t *InMemoryTransport) unsubscribe(subscription *inMemoryTransportSubscription) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	subscription.active = false
+	for i, s := range t.subscriptions {
+		if s == subscription {
+			t.subscriptions = append(t.subscriptions[:i], t.subscriptions[i+1:]...)
+			break
+		}
+	}
+}
+
+func (t *InMemoryTransport) publish(msg *TransportMessage) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return 0, ErrTransportClosed
+	}
+
+	// Note: plain subscribers get every message, queue groups get it once (round-robin between their members).
+	queueGroupMembers := make(map[string][]*inMemoryTransportSubscription)
+	var queueGroupsInOrder []string
+	var receivers []*inMemoryTransportSubscription
+
+	for _, subscription := range t.subscriptions {
+		if !subjectMatches(subscription.subject, msg.Subject) {
+			continue
+		}
+
+		if len(subscription.queue) == 0 {
+			receivers = append(receivers, subscription)
+			continue
+		}
+
+		groupKey := subscription.subject + "|" + subscription.queue
+		if _, exists := queueGroupMembers[groupKey]; !exists {
+			queueGroupsInOrder = append(queueGroupsInOrder, groupKey)
+		}
+		queueGroupMembers[groupKey] = append(queueGroupMembers[groupKey], subscription)
+	}
+
+	for _, groupKey := range queueGroupsInOrder {
+		members := queueGroupMembers[groupKey]
+		counter := t.queueGroupCounters[groupKey]
+		t.queueGroupCounters[groupKey] = counter + 1
+
+		receivers = append(receivers, members[counter%uint64(len(members))])
+	}
+
+	for _, receiver := range receivers {
+		t.pending = append(t.pending, inMemoryDelivery{subscription: receiver, msg: copyTransportMessage(msg)})
+	}
+	if len(receivers) > 0 {
+		t.cond.Broadcast()
+	}
+
+	return len(receivers), nil
+}
+
+func (t *InMemoryTransport) dispatch() {
+	for {
+		t.mutex.Lock()
+		for len(t.pending) == 0 && !t.closed {
+			t.cond.Wait()
+		}
+		if len(t.pending) == 0 && t.closed {
+			t.mutex.Unlock()
+			return
+		}
+
+		delivery := t.pending[0]
+		t.pending = t.pending[1:]
+		t.dispatching = true
+		active := delivery.subscription.active
+		t.mutex.Unlock()
+
+		if active {
+			delivery.subscription.gate.handle(func() {
+				delivery.subscription.handler(delivery.msg)
+			})
+		}
+
+		t.mutex.Lock()
+		t.dispatching = false
+		t.cond.Broadcast()
+		t.mutex.Unlock()
+	}
+}
+
+// -------------------
+
+type inMemoryTransportSubscription struct {
+	transport *InMemoryTransport
+
+	subject string
+	queue   string
+	handler func(msg *TransportMessage)
+	gate    subscriptionGate
+
+	active bool
+}
+
+func (s *inMemoryTransportSubscription) Subject() string {
+	return s.subject
+}
+
+func (s *inMemoryTransportSubscription) Unsubscribe() error {
+	s.transport.unsubscribe(s)
+	s.gate.close()
+	return nil
+}
+
+func (s *inMemoryTransportSubscription) IsValid() bool {
+	s.transport.mutex.Lock()
+	defer s.transport.mutex.Unlock()
+
+	return s.active
+}
+
+// -------------------
+
+func copyTransportMessage(msg *TransportMessage) *TransportMessage {
+	c := &TransportMessage{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Data:    append([]byte(nil), msg.Data...),
+	}
+	if msg.Header != nil {
+		c.Header = make(TransportHeader, len(msg.Header))
+		for k, v := range msg.Header {
+			c.Header[k] = append([]string(nil), v...)
+		}
+	}
+	return c
+}
+
+// subjectMatches nats subject matching, where '*' matches a single token and '>' matches one or more tokens.
+func subjectMatches(pattern string, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+
+	for i, patternToken := range patternTokens {
+		if patternToken == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if patternToken != "*" && patternToken != subjectTokens[i] {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(subjectTokens)
+}
@@ -0,0 +1,163 @@
+package message
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInMemoryTransport_deliversInPublishOrder(t *testing.T) {
+
+	// given
+	transport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	var received []string
+	_ = AsyncSubscribe(transport, "AlarmStatusChanged.*", func(msg *TransportMessage) {
+		received = append(received, msg.Subject+"="+string(msg.Data))
+	})
+
+
+	// when
+	for i := 0; i < 10; i++ {
+		_ = PublishMessage(transport, "AlarmStatusChanged."+strconv.Itoa(i%3), []byte(strconv.Itoa(i)))
+	}
+	_ = PublishMessage(transport, "SendAlarmDigest.0", []byte("not-matching"))
+	transport.WaitIdle()
+
+
+	// then
+	if len(received) != 10 {
+		t.Fatalf("expected 10 messages, received: %v", received)
+	}
+	for i := 0; i < 10; i++ {
+		expected := "AlarmStatusChanged." + strconv.Itoa(i%3) + "=" + strconv.Itoa(i)
+		if received[i] != expected {
+			t.Errorf("expected: %v, received: %v", expected, received[i])
+		}
+	}
+}
+
+func TestInMemoryTransport_queueSubscribersRoundRobin(t *testing.T) {
+
+	// given
+	transport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	receivedBy := make(map[int]int)
+	for i := 0; i < 3; i++ {
+		subscriberId := i
+		_ = AsyncQueueSubscribe(transport, AlarmStatusChangedTopic, "workers", func(msg *TransportMessage) {
+			receivedBy[subscriberId]++
+		})
+	}
+
+	plainReceived := 0
+	_ = AsyncSubscribe(transport, AlarmStatusChangedTopic, func(msg *TransportMessage) {
+		plainReceived++
+	})
+
+
+	// when
+	for i := 0; i < 9; i++ {
+		_ = PublishMessage(transport, AlarmStatusChangedTopic, []byte("{}"))
+	}
+	transport.WaitIdle()
+
+
+	// then
+	for i := 0; i < 3; i++ {
+		if receivedBy[i] != 3 {
+			t.Errorf("queue subscriber %v should have received 3 messages, received: %v", i, receivedBy[i])
+		}
+	}
+	if plainReceived != 9 {
+		t.Errorf("plain subscriber should have received 9 messages, received: %v", plainReceived)
+	}
+}
+
+func TestInMemoryTransport_requestReply(t *testing.T) {
+
+	// given
+	transport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	_ = AsyncSubscribe(transport, "echo", func(msg *TransportMessage) {
+		_ = transport.Publish(&TransportMessage{Subject: msg.Reply, Data: append([]byte("echo:"), msg.Data...)})
+	})
+
+
+	// when
+	reply, err := transport.Request(&TransportMessage{Subject: "echo", Data: []byte("ping")}, time.Second)
+
+
+	// then
+	if err != nil {
+		t.Fatalf("request should have been answered, error: %v", err)
+	}
+	if string(reply.Data) != "echo:ping" {
+		t.Errorf("invalid reply: %v", string(reply.Data))
+	}
+
+	_, err = transport.Request(&TransportMessage{Subject: "nobody-listens"}, time.Second)
+	if err != ErrTransportNoResponders {
+		t.Errorf("expected no responders error, got: %v", err)
+	}
+}
+
+func TestInMemoryTransport_drainClosesTransport(t *testing.T) {
+
+	// given
+	transport := InMemoryTransportCreateNew()
+
+	received := 0
+	sub := AsyncSubscribe(transport, AlarmDigestTopic, func(msg *TransportMessage) {
+		received++
+	})
+	_ = PublishMessage(transport, AlarmDigestTopic, []byte("{}"))
+
+
+	// when
+	_ = transport.Drain()
+
+
+	// then
+	if received != 1 {
+		t.Errorf("pending message should have been delivered before closing")
+	}
+	if err := PublishMessage(transport, AlarmDigestTopic, []byte("{}")); err != ErrTransportClosed {
+		t.Errorf("expected closed error, got: %v", err)
+	}
+	if sub.Subject() != AlarmDigestTopic {
+		t.Errorf("invalid subscription subject: %v", sub.Subject())
+	}
+}
+
+func TestSubjectMatches(t *testing.T) {
+
+	cases := []struct {
+		pattern string
+		subject string
+		matches bool
+	}{
+		{"AlarmStatusChanged", "AlarmStatusChanged", true},
+		{"AlarmStatusChanged", "AlarmStatusChanged.1", false},
+		{"AlarmStatusChanged.*", "AlarmStatusChanged.1", true},
+		{"AlarmStatusChanged.*", "AlarmStatusChanged", false},
+		{"alerts.v1.>", "alerts.v1.status_changed.user", true},
+		{"alerts.v1.>", "alerts.v1", false},
+		{"*.AlarmDigest", "tenantA.AlarmDigest", true},
+	}
+
+	for _, c := range cases {
+		if subjectMatches(c.pattern, c.subject) != c.matches {
+			t.Errorf("pattern: %v, subject: %v, expected match: %v", c.pattern, c.subject, c.matches)
+		}
+	}
+}
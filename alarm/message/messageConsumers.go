@@ -1,10 +1,9 @@
 package message
 
 import (
-	. "alarm/hashing"
-	"errors"
 	log "github.com/sirupsen/logrus"
-	"strconv"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ------------------------------------------------------------------------------------------
@@ -14,15 +13,21 @@ type DistributionId uint32
 
 
 
-func calculateDistributionId(consumerId *string, userId *string, totalWorkers uint32) DistributionId {
-	hashedUserId := Hash(*userId)
-	channelIdToSend := DistributionId(hashedUserId % totalWorkers)
+func calculateDistributionId(consumerId *string, userId *string, correlationId string, routing *workerRoutingTable) DistributionId {
+	channelIdToSend := routing.Locate(*userId)
 
-	log.Infof("[%v] hashedUserId: %v --- channelIdToSend: %v\n", *consumerId, hashedUserId, channelIdToSend)
+	if l := messageLog(correlationId, "consumer", *consumerId); l != nil {
+		l.Debugf("userId: %v --- channelIdToSend: %v\n", *userId, channelIdToSend)
+	}
 
 	return channelIdToSend
 }
 
+// MessageDispatcher routes the consumed messages to the workers (eg: AlarmMessageWorkerPool, HotUserThrottler).
+type MessageDispatcher interface {
+	DispatchAlarmStatusChangedMessage(consumerId string, msg AlarmStatusChangedMessage)
+	DispatchSendAlarmDigestMessage(consumerId string, msg SendAlarmDigestMessage)
+}
 
 // ------------------------------------------------------------------------------------------
 
@@ -31,22 +36,20 @@ func calculateDistributionId(consumerId *string, userId *string, totalWorkers ui
 
 func AlarmStatusChangedMessagesConsumer(msgs <-chan AlarmStatusChangedMessage,
 										consumerId string,
-										alarmStatusChangedMessagesWorkersByDistributionId *map[DistributionId]*AlarmMessageWorker) {
-
-	var totalWorkers = uint32(len(*alarmStatusChangedMessagesWorkersByDistributionId))
+										dispatcher MessageDispatcher) {
 
 	for msg := range msgs {
 
-		log.Infof("[%v] AlarmStatusChangedMessage received: %v\n", consumerId, msg)
-
-		channelIdToSend := calculateDistributionId(&consumerId, &msg.UserId, totalWorkers)
-
-		worker, found := (*alarmStatusChangedMessagesWorkersByDistributionId)[channelIdToSend]
-		if !found {
-			panic(errors.New("could not found a worker for distribution id: " + strconv.Itoa(int(channelIdToSend))))
+		dequeue := startMessageSpan(msg.SpanContext, "AlarmStatusChanged dequeue", trace.SpanKindInternal, consumerAttributes(consumerId, msg.UserId)...)
+		if l := messageLog(msg.CorrelationId, "consumer", consumerId); l != nil {
+			l.Debugf("AlarmStatusChangedMessage received: %v\n", msg)
 		}
 
-		*worker.AlarmStatusChangedMessages <- msg
+		enqueue := startMessageSpan(dequeue.SpanContext(), "AlarmStatusChanged enqueue", trace.SpanKindProducer, consumerAttributes(consumerId, msg.UserId)...)
+		msg.SpanContext = enqueue.SpanContext()
+		dispatcher.DispatchAlarmStatusChangedMessage(consumerId, msg)
+		enqueue.End()
+		dequeue.End()
 	}
 
 	log.Printf("alarmStatusChangedConsumer with id: %v exiting...\n", consumerId)
@@ -56,26 +59,28 @@ func AlarmStatusChangedMessagesConsumer(msgs <-chan AlarmStatusChangedMessage,
 
 func SendAlarmDigestMessagesConsumer(msgs <-chan SendAlarmDigestMessage,
 	                                 consumerId string,
-	                                 alarmStatusChangedMessagesWorkersByDistributionId *map[DistributionId]*AlarmMessageWorker) {
-
-	var totalWorkers = uint32(len(*alarmStatusChangedMessagesWorkersByDistributionId))
+	                                 dispatcher MessageDispatcher) {
 
 	for msg := range msgs {
 
-		log.Infof("[%v] SendAlarmDigestMessage received: %v\n", consumerId, msg)
-
-		channelIdToSend := calculateDistributionId(&consumerId, &msg.UserId, totalWorkers)
-
-		worker, found := (*alarmStatusChangedMessagesWorkersByDistributionId)[channelIdToSend]
-		if !found {
-			panic(errors.New("could not found a worker for distribution id: " + strconv.Itoa(int(channelIdToSend))))
+		dequeue := startMessageSpan(msg.SpanContext, "SendAlarmDigest dequeue", trace.SpanKindInternal, consumerAttributes(consumerId, msg.UserId)...)
+		if l := messageLog(msg.CorrelationId, "consumer", consumerId); l != nil {
+			l.Debugf("SendAlarmDigestMessage received: %v\n", msg)
 		}
 
-		*worker.SendAlarmDigestMessages <- msg
+		enqueue := startMessageSpan(dequeue.SpanContext(), "SendAlarmDigest enqueue", trace.SpanKindProducer, consumerAttributes(consumerId, msg.UserId)...)
+		msg.SpanContext = enqueue.SpanContext()
+		dispatcher.DispatchSendAlarmDigestMessage(consumerId, msg)
+		enqueue.End()
+		dequeue.End()
 
 	}
 
 	log.Infof("sendAlarmDigestMessagesConsumer with id: %v exiting...\n", consumerId)
 }
 
+func consumerAttributes(consumerId string, userId string) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("alarm.consumer", consumerId), attribute.String("alarm.user_id", userId)}
+}
+
 
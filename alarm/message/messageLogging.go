@@ -0,0 +1,72 @@
+package message
+
+import (
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+/*
+	Every message gets a correlation id at the listener (the one of the CorrelationIdHeader if the publisher has set it,
+	a new one otherwise), which travels with the message: listener --> consumer --> worker --> producer --> AlarmDigest
+	topic (as header), so all the log lines of a message can be found with: correlationId=<id>.
+
+	The per message log lines are at debug level and sampled by correlation id, so when a message is sampled
+	all of its hops are logged.
+*/
+
+const CorrelationIdHeader = "Correlation-Id"
+
+// Note: log 1 out of messageLogSampling messages (1 logs all of them).
+var messageLogSampling uint64 = 1
+
+// SetMessageLogSampling sets how many messages share one logged message, eg: 100 --> 1% of the messages are logged.
+func SetMessageLogSampling(everyN int) {
+	if everyN < 1 {
+		everyN = 1
+	}
+	atomic.StoreUint64(&messageLogSampling, uint64(everyN))
+}
+
+func NewCorrelationId() string {
+	return uuid.NewString()
+}
+
+// correlationIdOf returns the correlation id of the transport message, or a new one.
+func correlationIdOf(msg *TransportMessage) string {
+	if correlationId := msg.Header.Get(CorrelationIdHeader); len(correlationId) > 0 {
+		return correlationId
+	}
+	return NewCorrelationId()
+}
+
+func correlationHeader(correlationId string) TransportHeader {
+	header := TransportHeader{}
+	header.Set(CorrelationIdHeader, correlationId)
+	return header
+}
+
+// messageLog returns the logger of a hop of the message, or nil if the message is not sampled (or debug is disabled).
+func messageLog(correlationId string, stage string, name string) *log.Entry {
+	if !log.IsLevelEnabled(log.DebugLevel) || !isSampled(correlationId) {
+		return nil
+	}
+
+	return log.WithFields(log.Fields{
+		"correlationId": correlationId,
+		"stage":         stage,
+		"name":          name,
+	})
+}
+
+func isSampled(correlationId string) bool {
+	sampling := atomic.LoadUint64(&messageLogSampling)
+	if sampling <= 1 {
+		return true
+	}
+
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(correlationId))
+	return hash.Sum64()%sampling == 0
+}
@@ -0,0 +1,145 @@
+package message
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"strconv"
+	"testing"
+)
+
+func TestAlarmStatusChangedListeners_assignCorrelationId(t *testing.T) {
+
+	// given
+	transport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	received := make(chan AlarmStatusChangedMessage, 10)
+	RegisterAlarmStatusChangedTopicListeners("testListener", 2, transport, received, true, true)
+
+	data := []byte(`{"AlarmId":"a1","UserId":"u1","Status":"CRITICAL","ChangedAt":"2021-08-17T15:00:00Z"}`)
+
+
+	// when
+	_ = PublishMessageWithCorrelationId(transport, AlarmStatusChangedTopic+".1", data, "from-publisher")
+	_ = PublishMessage(transport, AlarmStatusChangedTopic, data) // Note: through the delegator
+	transport.WaitIdle()
+
+
+	// then
+	first, second := <-received, <-received
+	if first.CorrelationId != "from-publisher" {
+		t.Errorf("correlation id of the header should have been kept, got: %v", first.CorrelationId)
+	}
+	if len(second.CorrelationId) == 0 || second.CorrelationId == first.CorrelationId {
+		t.Errorf("a new correlation id should have been generated, got: %v", second.CorrelationId)
+	}
+}
+
+func TestMessageLogSampling_isPerCorrelationId(t *testing.T) {
+
+	SetMessageLogSampling(10)
+	defer SetMessageLogSampling(1)
+
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		correlationId := "correlation-" + strconv.Itoa(i)
+		if isSampled(correlationId) {
+			sampled++
+		}
+		if isSampled(correlationId) != isSampled(correlationId) {
+			t.Fatalf("sampling of the same message should be stable")
+		}
+	}
+
+	if sampled < 50 || sampled > 150 {
+		t.Errorf("expected about 100 out of 1000 sampled messages, got: %v", sampled)
+	}
+}
+
+func TestTenantTopicListeners_logWithTheCorrelationIdOfTheMessage(t *testing.T) {
+
+	// given
+	logs := captureMessageLogs(t)
+	transport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	tenants := TenantRegistryCreateNew(map[string]TenantQuotas{"productA": {}})
+	received := make(chan AlarmStatusChangedMessage, 10)
+	RegisterTenantTopicListeners("testListener", transport, tenants, received, make(chan SendAlarmDigestMessage, 10), true)
+
+	data := []byte(`{"AlarmId":"a1","UserId":"u1","Status":"CRITICAL","ChangedAt":"2021-08-17T15:00:00Z"}`)
+
+
+	// when - no correlation id header
+	_ = PublishMessage(transport, "productA.AlarmStatusChanged", data)
+	transport.WaitIdle()
+
+
+	// then
+	msg := <-received
+	if logged := listenerCorrelationIds(logs, "testListener#productA.AlarmStatusChanged"); len(logged) != 1 || logged[0] != msg.CorrelationId {
+		t.Errorf("expected the listener to log the correlation id of the message: %v, got: %v", msg.CorrelationId, logged)
+	}
+}
+
+func TestWildcardTopicListeners_logWithTheCorrelationIdOfTheMessage(t *testing.T) {
+
+	// given
+	topics := DefaultTopicNames()
+	topics.AlarmStatusChanged = "alerts.v1.status_changed"
+	topics.AlarmStatusChangedWildcard = "alerts.v1.status_changed.>"
+	SetTopicNames(topics)
+	defer SetTopicNames(DefaultTopicNames())
+
+	logs := captureMessageLogs(t)
+	transport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	received := make(chan AlarmStatusChangedMessage, 10)
+	RegisterWildcardTopicListeners("testListener", 1, 1, transport, received, make(chan SendAlarmDigestMessage, 10), true)
+
+	data := []byte(`{"AlarmId":"a1","Status":"CRITICAL","ChangedAt":"2021-08-17T15:00:00Z"}`)
+
+
+	// when - no correlation id header
+	_ = PublishMessage(transport, "alerts.v1.status_changed.u1", data)
+	transport.WaitIdle()
+
+
+	// then
+	msg := <-received
+	if logged := listenerCorrelationIds(logs, "testListener#alerts.v1.status_changed.>"); len(logged) != 1 || logged[0] != msg.CorrelationId {
+		t.Errorf("expected the listener to log the correlation id of the message: %v, got: %v", msg.CorrelationId, logged)
+	}
+}
+
+// captureMessageLogs enables the debug logs of the messages until the end of the test.
+func captureMessageLogs(t *testing.T) *test.Hook {
+	level := log.GetLevel()
+	hooks := log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	log.SetLevel(log.DebugLevel)
+	t.Cleanup(func() {
+		log.SetLevel(level)
+		log.StandardLogger().ReplaceHooks(hooks)
+	})
+
+	hook := &test.Hook{}
+	log.AddHook(hook)
+	return hook
+}
+
+func listenerCorrelationIds(logs *test.Hook, listenerName string) []string {
+	var correlationIds []string
+	for _, entry := range logs.AllEntries() {
+		if entry.Data["stage"] == "listener" && entry.Data["name"] == listenerName {
+			correlationIds = append(correlationIds, entry.Data["correlationId"].(string))
+		}
+	}
+	return correlationIds
+}
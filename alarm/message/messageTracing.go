@@ -0,0 +1,62 @@
+package message
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+	The spans of a message (see alarm/tracing for the setup of the exporter):
+
+		<topic> receive            listener --> continues the trace of the publisher (W3C traceparent header) if any
+		<message> dequeue          consumer
+		  <message> enqueue        consumer --> dispatch to the mailbox of the worker (blocks when it is full)
+		<message> process          AlarmMessageWorker
+		AlarmDigest publish        AlarmDigestMessageProducer --> traceparent header of the AlarmDigest message
+
+	Like the correlation id, the span context travels with the message structs between the hops.
+*/
+
+const tracerName = "alarm/message"
+
+// Note: the global tracer provider is a no-op until tracing gets setup, so it is resolved on every use.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// startReceiveSpan starts the span of a received transport message, as child of the trace of the publisher if any.
+func startReceiveSpan(msg *TransportMessage, listenerName string, correlationId string) trace.Span {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), msg.Header)
+
+	_, span := tracer().Start(ctx, msg.Subject+" receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination", msg.Subject),
+			attribute.String("alarm.listener", listenerName),
+			attribute.String("alarm.correlation_id", correlationId),
+		))
+	return span
+}
+
+// startMessageSpan starts a span as child of the span of the previous hop (or a new trace if there is none).
+func startMessageSpan(parent trace.SpanContext, name string, kind trace.SpanKind, attributes ...attribute.KeyValue) trace.Span {
+	ctx := trace.ContextWithSpanContext(context.Background(), parent)
+
+	_, span := tracer().Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attributes...))
+	return span
+}
+
+// spanContextOf returns the span context of the publisher of the transport message, if any.
+func spanContextOf(msg *TransportMessage) trace.SpanContext {
+	return trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), msg.Header))
+}
+
+// messageHeader the headers of a published message: correlation id & trace context.
+func messageHeader(correlationId string, spanContext trace.SpanContext) TransportHeader {
+	header := correlationHeader(correlationId)
+	otel.GetTextMapPropagator().Inject(trace.ContextWithSpanContext(context.Background(), spanContext), header)
+	return header
+}
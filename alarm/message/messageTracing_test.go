@@ -0,0 +1,93 @@
+package message
+
+import (
+	. "alarm/tracing"
+	"context"
+	"go.opentelemetry.io/otel"
+	"testing"
+	"time"
+)
+
+func TestTracing_sendAlarmDigestOfUpstreamTraceLinksToAlarmDigest(t *testing.T) {
+
+	// given
+	exporter := SetupInMemoryTracing()
+
+	transport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = transport.Drain()
+	}()
+
+	alarmStatusChangedMessagesChan := make(chan AlarmStatusChangedMessage, 10)
+	sendAlarmDigestMessagesChan := make(chan SendAlarmDigestMessage, 10)
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	defer close(alarmStatusChangedMessagesChan)
+	defer close(sendAlarmDigestMessagesChan)
+
+	RegisterAlarmStatusChangedTopicListeners("testListener", 1, transport, alarmStatusChangedMessagesChan, false, true)
+	RegisterSendAlarmDigestTopicListeners("testListener", 1, transport, sendAlarmDigestMessagesChan, false, true)
+
+	pool := testWorkerPool(1, &alarmDigestMessagesChan)
+	go AlarmStatusChangedMessagesConsumer(alarmStatusChangedMessagesChan, "testConsumer", pool)
+	go SendAlarmDigestMessagesConsumer(sendAlarmDigestMessagesChan, "testConsumer", pool)
+
+	producerName, producerId, topicName := "testProducer", 0, AlarmDigestTopic
+	go AlarmDigestMessageProducerCreateNew(&producerName, &producerId, &topicName, transport, &alarmDigestMessagesChan).Produce()
+
+	digests := make(chan AlarmDigestMessage, 1)
+	RegisterAlarmDigestTopicListener("testDigestListener", transport, AlarmDigestTopic, true, func(message AlarmDigestMessage) {
+		digests <- message
+	})
+
+	_ = PublishMessage(transport, AlarmStatusChangedTopic+".0",
+		[]byte(`{"AlarmId":"a1","UserId":"u1","Status":"CRITICAL","ChangedAt":"2021-08-17T15:00:00Z"}`))
+	transport.WaitIdle()
+	waitForEmptyMailboxes(t, pool)
+
+
+	// when - an upstream traced service asks for the digest
+	ctx, upstream := otel.Tracer("upstream").Start(context.Background(), "upstream")
+	header := TransportHeader{}
+	otel.GetTextMapPropagator().Inject(ctx, header)
+	_ = PublishMessageWithHeader(transport, SendAlarmDigestTopic+".0", []byte(`{"UserId":"u1"}`), header)
+	upstream.End()
+
+
+	// then
+	var digest AlarmDigestMessage
+	select {
+	case digest = <-digests:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("digest should have been produced")
+	}
+
+	traceId := upstream.SpanContext().TraceID()
+	if digest.SpanContext.TraceID() != traceId {
+		t.Errorf("AlarmDigest should continue the upstream trace: %v, got: %v", traceId, digest.SpanContext.TraceID())
+	}
+
+	// Note: the publish span ends right after the AlarmDigest message has been published.
+	expected := []string{"SendAlarmDigest.0 receive", "SendAlarmDigest dequeue", "SendAlarmDigest enqueue", "SendAlarmDigest process", "AlarmDigest publish"}
+	for tries := 0; ; tries++ {
+		spans := make(map[string]bool)
+		for _, span := range exporter.GetSpans() {
+			if span.SpanContext.TraceID() == traceId {
+				spans[span.Name] = true
+			}
+		}
+
+		missing := 0
+		for _, name := range expected {
+			if !spans[name] {
+				missing++
+			}
+		}
+		if missing == 0 {
+			return
+		}
+		if tries > 100 {
+			t.Fatalf("spans: %v of the upstream trace are expected, got: %v", expected, spans)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
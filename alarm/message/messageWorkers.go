@@ -3,9 +3,11 @@ package message
 import (
 	. "alarm/domain"
 	"encoding/json"
-	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sort"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +20,14 @@ type Worker struct {
 	workerName string
 }
 
+func (w *Worker) WorkerId() int {
+	return w.workerId
+}
+
+func (w *Worker) WorkerName() string {
+	return w.workerName
+}
+
 
 // -------------------
 
@@ -27,16 +37,25 @@ type AlarmDigestMessageProducer struct {
 
 	topicName *string
 
-	serverConnection * nats.Conn
+	transport Transport
 
 	alarmDigestMessages *chan AlarmDigestMessage
+
+	// Note: for the liveness probe (see healthProbes.go), accessed atomically, 0 when not publishing.
+	publishingSinceNanos int64
+
+	// Note: nil unless the digests get confirmed through a JetStream stream, see alarmDigestDelivery.go
+	deliveryTracker *AlarmDigestDeliveryTracker
+
+	// Note: nil when multi-tenancy is disabled, see tenants.go
+	tenants *TenantRegistry
 }
 
 
 func AlarmDigestMessageProducerCreateNew(workerName *string,
 	workerId *int,
 	topicName *string,
-	serverConnection * nats.Conn,
+	transport Transport,
 	alarmDigestMessages *chan AlarmDigestMessage) *AlarmDigestMessageProducer {
 
 
@@ -46,31 +65,73 @@ func AlarmDigestMessageProducerCreateNew(workerName *string,
 			workerName: *workerName,
 		},
 		topicName: topicName,
-		serverConnection: serverConnection,
+		transport: transport,
 		alarmDigestMessages: alarmDigestMessages,
 	}
 
 	return w
 }
 
+// TrackDeliveries the producer publishes the digests to the stream of the tracker (jetstream mode), to be called before
+// it starts producing.
+func (w *AlarmDigestMessageProducer) TrackDeliveries(tracker *AlarmDigestDeliveryTracker) {
+	w.deliveryTracker = tracker
+}
+
+// IsolateTenants the producer publishes the digests of the users of a tenant to its subject, to be called before it
+// starts producing.
+func (w *AlarmDigestMessageProducer) IsolateTenants(tenants *TenantRegistry) {
+	w.tenants = tenants
+}
+
 func (w *AlarmDigestMessageProducer) Produce() {
 
 	for {
 
 		select {
-		case alarmDigestMessage := <-*w.alarmDigestMessages:
-			log.Infof("[%v] worker received AlarmDigestMessage message: %v\n", w.workerName, alarmDigestMessage)
+		case alarmDigestMessage, ok := <-*w.alarmDigestMessages:
+			if !ok {
+				log.Infof("[%v] producer exiting...\n", w.workerName)
+				return
+			}
+			span := startMessageSpan(alarmDigestMessage.SpanContext, *w.topicName+" publish", trace.SpanKindProducer,
+				attribute.String("messaging.system", "nats"),
+				attribute.String("messaging.destination", *w.topicName),
+				attribute.String("alarm.user_id", alarmDigestMessage.UserId))
 
-			serializedInfo, serializationError := json.Marshal(alarmDigestMessage)
+			if l := messageLog(alarmDigestMessage.CorrelationId, "producer", w.workerName); l != nil {
+				l.Debugf("worker received AlarmDigestMessage message: %v\n", alarmDigestMessage)
+			}
+
+			// Note: the digest of a user of a tenant goes to the subject of the tenant, with the user id of the tenant.
+			topicName := *w.topicName
+			published := alarmDigestMessage
+			if tenant, userId := w.tenants.split(UserId(alarmDigestMessage.UserId)); tenant != nil {
+				topicName = TenantSubject(tenant.Name, topicName)
+				published.UserId = userId
+				tenantDigestsCounter.WithLabelValues(tenant.Name).Inc()
+			}
+
+			serializedInfo, serializationError := json.Marshal(published)
 			if serializationError != nil {
 				log.Infoln("error during json marshalling, error: ", serializationError)
 				panic(serializationError)
 			}
 
-			err := PublishMessage(w.serverConnection, *w.topicName, serializedInfo)
+			atomic.StoreInt64(&w.publishingSinceNanos, time.Now().UnixNano())
+			var err error
+			if w.deliveryTracker.usesStream() {
+				err = w.deliveryTracker.publishToStream(&TransportMessage{Subject: topicName, Data: serializedInfo,
+					Header: messageHeader(alarmDigestMessage.CorrelationId, span.SpanContext())}, &alarmDigestMessage)
+			} else {
+				err = PublishMessageWithHeader(w.transport, topicName, serializedInfo, messageHeader(alarmDigestMessage.CorrelationId, span.SpanContext()))
+			}
+			atomic.StoreInt64(&w.publishingSinceNanos, 0)
 			if err != nil {
-				log.Errorf("could not publish alarm digest message, err: %v\n", err)
+				log.WithField("correlationId", alarmDigestMessage.CorrelationId).Errorf("could not publish alarm digest message, err: %v\n", err)
+				span.RecordError(err)
 			}
+			span.End()
 		}
 
 	}
@@ -80,6 +141,8 @@ func (w *AlarmDigestMessageProducer) Produce() {
 
 const printDebugMessageOfWorkerState = false
 
+const processingLatencySmoothing = 8
+
 type AlarmMessageWorker struct {
 	Worker
 
@@ -88,6 +151,47 @@ type AlarmMessageWorker struct {
 
 	alarmDigestMessages *chan AlarmDigestMessage
 
+	// Note: control messages (eg: resharding) have priority over the above mailboxes, see alarmMessageWorkerResharding.go
+	controlMessages chan workerControlMessage
+	resharding      workerReshardingState
+	stopped         bool
+
+	// Note: exponentially weighted moving average, read from other goroutines (eg: autoscaler) so accessed atomically.
+	processingLatencyNanos int64
+
+	// Note: the data messages applied to the state (not the buffered ones during resharding), accessed atomically.
+	processedMessages int64
+
+	// Note: for the liveness probe (see healthProbes.go), accessed atomically.
+	started           int32
+	busy              int32
+	lastProgressNanos int64
+
+	// Note: eviction of cleared, idle and least recently changed alarms, see alarmMessageWorkerRetention.go
+	retention workerRetentionState
+	now       func() time.Time
+
+	// Note: nil when disabled, see writeAheadLog.go
+	wal *workerLog
+
+	// Note: the transitions kept on the alarms (disabled by default), see alarmMessageWorkerHistory.go
+	historyOptions AlarmHistoryOptions
+
+	// Note: the latest digest of every user, for the retried requests and the queries, see alarmDigestReplay.go
+	digestReplayOptions AlarmDigestReplayOptions
+	lastDigests         map[UserId]*retainedDigest
+
+	// Note: the digests awaiting a delivery confirmation (disabled by default), see alarmDigestDelivery.go
+	deliveryOptions AlarmDigestDeliveryOptions
+	pendingDigests  map[UserId]*pendingDigest
+
+	// Note: nil when multi-tenancy is disabled, the quotas of the tenants are shared by all the workers, see tenants.go
+	tenants *TenantRegistry
+
+	// Note: no rules by default, see alarmEscalation.go
+	escalationOptions      AlarmEscalationOptions
+	alarmEscalatedMessages *chan AlarmEscalatedMessage
+
 	alarmsState map[UserId]map[AlarmId]*Alarm
 	// Note: we hold here the active alarms so during SendAlarmDigest message to calculate it more efficient in terms of time complexity.
 	activeAlarms map[UserId]map[AlarmId]*Alarm
@@ -108,107 +212,232 @@ func AlarmMessageWorkerCreateNew(workerName *string,
 	w.SendAlarmDigestMessages = sendAlarmDigestMessages
 	w.alarmDigestMessages = alarmDigestMessages
 
+	w.controlMessages = make(chan workerControlMessage, controlMessagesCapacity)
+
 	w.alarmsState = make(map[UserId]map[AlarmId]*Alarm)
 	w.activeAlarms = make(map[UserId]map[AlarmId]*Alarm)
 
+	w.retention = newWorkerRetentionState()
+	w.lastDigests = make(map[UserId]*retainedDigest)
+	w.pendingDigests = make(map[UserId]*pendingDigest)
+	w.now = time.Now
+
 	return w
 }
 
 func (w *AlarmMessageWorker) Consume() {
 
-	for {
+	w.recordProgress(false)
+	atomic.StoreInt32(&w.started, 1)
+
+	for !w.stopped {
 
 		select {
-		case alarmStatusChangeMessage := <-*w.AlarmStatusChangedMessages:
-			log.Infof("[%v] WORKER RECEIVED AlarmStatusChangedMessages message: %v\n", w.workerName, alarmStatusChangeMessage)
+		case controlMessage := <-w.controlMessages:
+			w.handleControlMessage(controlMessage, nil)
 
-			w.handleAlarmStatusChangeMessage(&alarmStatusChangeMessage)
+		case alarmStatusChangeMessage, ok := <-*w.AlarmStatusChangedMessages:
+			if !ok {
+				return
+			}
+			w.recordProgress(true)
+			w.processDataMessage(&workerDataMessage{userId: alarmStatusChangeMessage.UserId, alarmStatusChanged: &alarmStatusChangeMessage})
+			w.recordProgress(false)
 
-			if printDebugMessageOfWorkerState {
-				log.Debugf("[%v] alarmsState: %v\n", w.alarmsState, alarmStatusChangeMessage)
-				log.Debugf("[%v] activeAlarms: %v\n", w.activeAlarms, alarmStatusChangeMessage)
+		case sendAlarmDigestMessage, ok := <-*w.SendAlarmDigestMessages:
+			if !ok {
+				return
 			}
+			w.recordProgress(true)
+			w.processDataMessage(&workerDataMessage{userId: sendAlarmDigestMessage.UserId, sendAlarmDigest: &sendAlarmDigestMessage})
+			w.recordProgress(false)
+		}
+	}
+
+	log.Infof("[%v] worker exiting...\n", w.workerName)
+}
+
+func (w *AlarmMessageWorker) dispatchDataMessage(msg *workerDataMessage) {
+
+	startedAt := time.Now()
+	defer func() {
+		w.recordProcessingLatency(time.Since(startedAt))
+		atomic.AddInt64(&w.processedMessages, 1)
+	}()
+
+	if msg.alarmStatusChanged != nil {
+		span := startMessageSpan(msg.alarmStatusChanged.SpanContext, "AlarmStatusChanged process", trace.SpanKindConsumer, w.spanAttributes(msg.alarmStatusChanged.UserId)...)
+		defer span.End()
+
+		if l := messageLog(msg.alarmStatusChanged.CorrelationId, "worker", w.workerName); l != nil {
+			l.Debugf("WORKER RECEIVED AlarmStatusChangedMessages message: %v\n", *msg.alarmStatusChanged)
+		}
+
+		if w.handleAlarmStatusChangeMessage(msg.alarmStatusChanged) {
+			w.appendToWal(walEntry{Kind: walAlarmStatusChanged, UserId: msg.alarmStatusChanged.UserId, AlarmId: msg.alarmStatusChanged.AlarmId,
+				Status: msg.alarmStatusChanged.Status, ChangedAt: msg.alarmStatusChanged.ChangedAt})
+		}
+
+		if printDebugMessageOfWorkerState {
+			log.Debugf("[%v] alarmsState: %v\n", w.alarmsState, *msg.alarmStatusChanged)
+			log.Debugf("[%v] activeAlarms: %v\n", w.activeAlarms, *msg.alarmStatusChanged)
+		}
 
-		case sendAlarmDigestMessage := <-*w.SendAlarmDigestMessages:
-			log.Infof("[%v] WORKER RECEIVED SendAlarmDigestMessage message: %v\n", w.workerName, sendAlarmDigestMessage)
+	} else if msg.sendAlarmDigest != nil {
+		span := startMessageSpan(msg.sendAlarmDigest.SpanContext, "SendAlarmDigest process", trace.SpanKindConsumer, w.spanAttributes(msg.sendAlarmDigest.UserId)...)
+		defer span.End()
+
+		// Note: the AlarmDigest message continues the trace from this span.
+		msg.sendAlarmDigest.SpanContext = span.SpanContext()
+
+		if l := messageLog(msg.sendAlarmDigest.CorrelationId, "worker", w.workerName); l != nil {
+			l.Debugf("WORKER RECEIVED SendAlarmDigestMessage message: %v\n", *msg.sendAlarmDigest)
+		}
 
-			w.handleSendAlarmDigestMessage(&sendAlarmDigestMessage)
+		flushes := !w.deliveryOptions.confirmsDelivery() && len(w.activeAlarms[UserId(msg.sendAlarmDigest.UserId)]) > 0
+		// Note: the empty answer of a request is logged too (retained for its retries), and a retry changes nothing.
+		flushes = flushes || len(w.activeAlarms[UserId(msg.sendAlarmDigest.UserId)]) == 0 && len(msg.sendAlarmDigest.RequestId) > 0
+		flushes = flushes && w.retriedDigest(msg.sendAlarmDigest) == nil
+		w.handleSendAlarmDigestMessage(msg.sendAlarmDigest)
+		if flushes {
+			w.appendToWal(walEntry{Kind: walDigestFlushed, UserId: msg.sendAlarmDigest.UserId, RequestId: msg.sendAlarmDigest.RequestId, ChangedAt: w.now()})
 		}
 	}
 }
 
+func (w *AlarmMessageWorker) spanAttributes(userId string) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("alarm.worker", w.workerName), attribute.String("alarm.user_id", userId)}
+}
+
+func (w *AlarmMessageWorker) recordProcessingLatency(latency time.Duration) {
+	previous := atomic.LoadInt64(&w.processingLatencyNanos)
+	if previous == 0 {
+		atomic.StoreInt64(&w.processingLatencyNanos, int64(latency))
+		return
+	}
+	atomic.StoreInt64(&w.processingLatencyNanos, previous+(int64(latency)-previous)/processingLatencySmoothing)
+}
+
+func (w *AlarmMessageWorker) ProcessingLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&w.processingLatencyNanos))
+}
+
+func (w *AlarmMessageWorker) ProcessedMessages() int64 {
+	return atomic.LoadInt64(&w.processedMessages)
+}
+
 func (w *AlarmMessageWorker) handleSendAlarmDigestMessage(msg *SendAlarmDigestMessage) {
 
 	userId := UserId(msg.UserId)
+	w.touchUser(userId)
+
+	// Note: a retried request gets the digest it already produced, see alarmDigestReplay.go
+	if w.replayDigest(msg) {
+		return
+	}
 
 	activeAlarms, activeAlarmsExistForUser := w.activeAlarms[userId]
 	if activeAlarmsExistForUser && len(activeAlarms) != 0 {
 
 		// Note: collect them.
-		alarms := make([]ActiveAlarm, 0, len(activeAlarms))
+		alarms := w.collectActiveAlarms(userId)
 
-		for _, alarm := range activeAlarms {
 
-			var timestamp time.Time
-			if alarm.UpdatedAt.IsZero() {
-				timestamp = alarm.CreatedAt
-			} else {
-				timestamp = alarm.UpdatedAt
-			}
+		// Note: send them
+		alarmDigestMessage := AlarmDigestMessage{
+			UserId:        msg.UserId,
+			ActiveAlarms:  alarms,
+			CorrelationId: msg.CorrelationId,
+			SpanContext:   msg.SpanContext,
+		}
+		if w.deliveryOptions.confirmsDelivery() {
+			alarmDigestMessage.DigestId = newDigestId()
+		}
 
-			activeAlarm := ActiveAlarm{
-				AlarmId:         string(alarm.Id),
-				Status:          AlarmStatusAsString(alarm.Status),
-				LatestChangedAt: timestamp,
-			}
+		if l := messageLog(msg.CorrelationId, "worker", w.workerName); l != nil {
+			l.Debugf("worker will send AlarmDigestMessage message: %v\n", alarmDigestMessage)
+		}
+		*w.alarmDigestMessages <- alarmDigestMessage
+		w.retainDigest(userId, msg.RequestId, w.now(), alarms)
 
-			alarms = append(alarms, activeAlarm)
+
+		// Note: delete sent active alarms for user so that to not received them twice (once delivered if confirmed).
+		if w.deliveryOptions.confirmsDelivery() {
+			w.awaitDelivery(userId, alarmDigestMessage)
+		} else {
+			w.flushActiveAlarms(userId)
 		}
 
+	} else {
+		if l := messageLog(msg.CorrelationId, "worker", w.workerName); l != nil {
+			l.Debugf("worker will NOT send AlarmDigestMessage message - NO CRITICAL ALARMS\n")
+		}
+		w.retainDigest(userId, msg.RequestId, w.now(), nil)
+	}
 
-		// Note: sort them (oldest to newest)
-		sort.Slice(alarms, func(i, j int) bool {
-			return alarms[i].LatestChangedAt.Before(alarms[j].LatestChangedAt)
-		})
+}
 
+// collectActiveAlarms the active alarms of the user which were not sent yet, sorted oldest to newest.
+func (w *AlarmMessageWorker) collectActiveAlarms(userId UserId) []ActiveAlarm {
+	activeAlarms := w.activeAlarms[userId]
+	alarms := make([]ActiveAlarm, 0, len(activeAlarms))
 
-		// Note: send them
-		alarmDigestMessage := AlarmDigestMessage{
-			UserId:       msg.UserId,
-			ActiveAlarms: alarms,
+	for _, alarm := range activeAlarms {
+
+		activeAlarm := ActiveAlarm{
+			AlarmId:         string(alarm.Id),
+			Status:          AlarmStatusAsString(alarm.Status),
+			LatestChangedAt: alarmLatestChangedAt(alarm),
+			Escalated:       alarm.EscalatedAfter > 0,
 		}
 
-		log.Infof("[%v] worker will send AlarmDigestMessage message: %v\n", w.workerName, alarmDigestMessage)
-		*w.alarmDigestMessages <- alarmDigestMessage
+		alarms = append(alarms, activeAlarm)
+	}
 
+	sort.Slice(alarms, func(i, j int) bool {
+		return alarms[i].LatestChangedAt.Before(alarms[j].LatestChangedAt)
+	})
+	return alarms
+}
 
-		// Note: delete sent active alarms for user so that to not received them twice.
-		for k, _ := range activeAlarms {
-			delete(activeAlarms, k)
-		}
 
-	} else {
-		log.Infof("[%v] worker will NOT send AlarmDigestMessage message - NO CRITICAL ALARMS\n", w.workerName)
+func alarmLatestChangedAt(alarm *Alarm) time.Time {
+	if alarm.UpdatedAt.IsZero() {
+		return alarm.CreatedAt
 	}
+	return alarm.UpdatedAt
+}
 
+func (w *AlarmMessageWorker) flushActiveAlarms(userId UserId) {
+	activeAlarms := w.activeAlarms[userId]
+	for k, _ := range activeAlarms {
+		delete(activeAlarms, k)
+	}
 }
 
 
-func (w *AlarmMessageWorker) handleAlarmStatusChangeMessage(msg *AlarmStatusChangedMessage) {
+// handleAlarmStatusChangeMessage returns false if the message got dropped (the tenant is above a quota).
+func (w *AlarmMessageWorker) handleAlarmStatusChangeMessage(msg *AlarmStatusChangedMessage) bool {
 
 	userId := UserId(msg.UserId)
 	alarmId := AlarmId(msg.AlarmId)
 	newAlarmStatus := ExtractAlarmStatus(msg.Status)
 	changedAt := msg.ChangedAt
 
+	if !w.admitAlarm(userId, alarmId) {
+		return false
+	}
+
 	alarms, alarmsExistsForSelectedUser := w.alarmsState[userId]
 	if alarmsExistsForSelectedUser {
 
 		selectedAlarmState, selectedAlarmExist := alarms[alarmId]
 		if selectedAlarmExist {
 
-			if newAlarmStatus != UNKNOWN {
+			if newAlarmStatus != UNKNOWN && newAlarmStatus != selectedAlarmState.Status {
 				selectedAlarmState.Status = newAlarmStatus
+				selectedAlarmState.StatusSince = changedAt
+				selectedAlarmState.EscalatedAfter = 0
 			}
 			selectedAlarmState.UpdatedAt = changedAt
 
@@ -231,6 +460,10 @@ func (w *AlarmMessageWorker) handleAlarmStatusChangeMessage(msg *AlarmStatusChan
 
 		w.updateActiveAlarms(alarm, userId, alarmId)
 	}
+
+	w.recordTransition(w.alarmsState[userId][alarmId], changedAt)
+	w.touchAlarm(userId, alarmId)
+	return true
 }
 
 func (w *AlarmMessageWorker) updateActiveAlarms(alarm *Alarm, userId UserId, alarmId AlarmId) {
@@ -270,8 +503,9 @@ func (w *AlarmMessageWorker) constructNewAlarm(alarmId AlarmId, userId UserId, n
 	alarm := &Alarm{
 		Id:        alarmId,
 		UserId:    userId,
-		Status:    newAlarmStatus,
-		CreatedAt: timestamp,
+		Status:      newAlarmStatus,
+		CreatedAt:   timestamp,
+		StatusSince: timestamp,
 	}
 	return alarm
 }
@@ -1,6 +1,9 @@
 package message
 
-import "time"
+import (
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
 
 // --- consuming ---
 
@@ -9,11 +12,18 @@ type AlarmStatusChangedMessage struct {
 	UserId string
 	Status string
 	ChangedAt time.Time
+
+	CorrelationId string `json:"-"` // Note: travels as transport header, see CorrelationIdHeader
+	SpanContext trace.SpanContext `json:"-"` // Note: the span of the previous hop, see messageTracing.go
 }
 
 
 type SendAlarmDigestMessage struct {
 	UserId string
+	RequestId string // Note: optional, a retried request with the same id gets the same digest again
+
+	CorrelationId string `json:"-"`
+	SpanContext trace.SpanContext `json:"-"`
 }
 
 
@@ -24,11 +34,63 @@ type SendAlarmDigestMessage struct {
 type AlarmDigestMessage struct {
 	UserId string
 	ActiveAlarms []ActiveAlarm
+	DigestId string `json:",omitempty"` // Note: only when the delivery gets confirmed, see alarmDigestDelivery.go
+
+	CorrelationId string `json:"-"` // Note: the one of the SendAlarmDigest message which triggered it
+	SpanContext trace.SpanContext `json:"-"`
 }
 
 type ActiveAlarm struct {
 	AlarmId string
 	Status string
 	LatestChangedAt time.Time
+	Escalated bool `json:",omitempty"` // Note: active for longer than an escalation rule allows, see alarmEscalation.go
+}
+
+
+type AlarmDigestDeliveredMessage struct {
+	UserId string
+	DigestId string
+}
+
+
+type AlarmEscalatedMessage struct {
+	UserId string
+	AlarmId string
+	Status string
+	StatusSince time.Time
+	EscalatedAt time.Time
+	Rule string // Note: eg: CRITICAL>30m:publish
 }
 
+
+
+
+
+// --- queries ---
+
+type AlarmHistoryQueryMessage struct {
+	UserId  string
+	AlarmId string    // Note: the timeline of the alarm if set, otherwise the active alarms of the user
+	At      time.Time // Note: for the active alarms, now if zero
+}
+
+type AlarmHistoryQueryReply struct {
+	Timeline     *AlarmTimeline      `json:",omitempty"`
+	ActiveAlarms *UserActiveAlarmsAt `json:",omitempty"`
+	Error        *AlarmQueryError    `json:",omitempty"`
+}
+
+type AlarmQueryMessage struct {
+	UserId  string // Note: optional for the stats, the stats of the whole pool then
+	AlarmId string // Note: only for a single alarm
+}
+
+type AlarmQueryReply struct {
+	ActiveAlarms *UserActiveAlarms `json:",omitempty"`
+	Alarm        *QueriedAlarm     `json:",omitempty"`
+	Stats        *UserAlarmStats   `json:",omitempty"`
+	PoolStats    *AlarmPoolStats   `json:",omitempty"`
+	LastDigest   *UserLastDigest   `json:",omitempty"`
+	Error        *AlarmQueryError  `json:",omitempty"`
+}
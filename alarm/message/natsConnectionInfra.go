@@ -2,15 +2,23 @@ package message
 
 import (
 	. "alarm/error"
+	. "alarm/metrics"
 	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
 	"time"
 )
 
 
+var natsConnectedGauge = GaugeVecCreateNew("alarm_nats_connected", "1 while connected to the nats server.")
+var natsReconnectsCounter = CounterVecCreateNew("alarm_nats_reconnects_total", "Reconnections to the nats server.")
+
 func ServerConnection() (*nats.Conn, error) {
+	return ServerConnectionTo(nats.DefaultURL)
+}
+
+func ServerConnectionTo(serverUrl string) (*nats.Conn, error) {
 
-	nc, err := nats.Connect(nats.DefaultURL,
+	nc, err := nats.Connect(serverUrl,
 
 		nats.Name("Alarm Digest Service"),
 		nats.Timeout(4*time.Second),
@@ -27,19 +35,24 @@ func ServerConnection() (*nats.Conn, error) {
 			}
 		}),
 
+		// Note: while disconnected the readiness probe fails (see CheckTransportConnected).
 		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
 			// handle disconnect error event
 			log.Warnf("disconnected from the server id: %v --- error: %v\n", nc.ConnectedServerId(), err)
+			natsConnectedGauge.WithLabelValues().Set(0)
 		}),
 		nats.ReconnectHandler(func(nc *nats.Conn) {
 			// handle reconnect event
 			log.Warnf("reconnected to server id: %v\n", nc.ConnectedServerId())
+			natsConnectedGauge.WithLabelValues().Set(1)
+			natsReconnectsCounter.WithLabelValues().Inc()
 		}))
 
 	if err != nil {
 		return nil, err
 	}
 
+	natsConnectedGauge.WithLabelValues().Set(1)
 	log.Infof("connected to server: %v --- addr: %v --- serverId: %v\n",
 		nc.ConnectedServerName(),
 		nc.ConnectedAddr(),
@@ -51,11 +64,11 @@ func ServerConnection() (*nats.Conn, error) {
 	return nc, nil
 }
 
-func AsyncSubscribe(conn *nats.Conn, topicName string, consumer func(msg *nats.Msg)) *nats.Subscription {
+func AsyncSubscribe(transport Transport, topicName string, consumer func(msg *TransportMessage)) TransportSubscription {
 
 	defer GlobalErrorHandler()
 
-	sub, err := conn.Subscribe(topicName, func(m *nats.Msg) {
+	sub, err := transport.Subscribe(topicName, func(m *TransportMessage) {
 		consumer(m)
 	})
 
@@ -67,7 +80,24 @@ func AsyncSubscribe(conn *nats.Conn, topicName string, consumer func(msg *nats.M
 }
 
 
-func AsyncUnsubscribe(sub *nats.Subscription, topicName string) {
+func AsyncQueueSubscribe(transport Transport, topicName string, queueName string, consumer func(msg *TransportMessage)) TransportSubscription {
+
+	defer GlobalErrorHandler()
+
+	sub, err := transport.QueueSubscribe(topicName, queueName, func(m *TransportMessage) {
+		consumer(m)
+	})
+
+	if err != nil {
+		panic(CouldNotSubscribeToTopicError{Msg: "topic-name --> " + topicName + ", queue-name --> " + queueName})
+	}
+
+	return sub
+}
+
+
+// AsyncUnsubscribe returns once the consumer of the subscription is not running anymore (see TransportSubscription).
+func AsyncUnsubscribe(sub TransportSubscription, topicName string) {
 	defer GlobalErrorHandler()
 
 	if err := sub.Unsubscribe(); err != nil {
@@ -76,7 +106,14 @@ func AsyncUnsubscribe(sub *nats.Subscription, topicName string) {
 }
 
 
-func PublishMessage(conn *nats.Conn, topicName string, msg []byte) error {
-	return conn.Publish(topicName, msg)
+func PublishMessage(transport Transport, topicName string, msg []byte) error {
+	return transport.Publish(&TransportMessage{Subject: topicName, Data: msg})
+}
+
+func PublishMessageWithCorrelationId(transport Transport, topicName string, msg []byte, correlationId string) error {
+	return PublishMessageWithHeader(transport, topicName, msg, correlationHeader(correlationId))
 }
 
+func PublishMessageWithHeader(transport Transport, topicName string, msg []byte, header TransportHeader) error {
+	return transport.Publish(&TransportMessage{Subject: topicName, Data: msg, Header: header})
+}
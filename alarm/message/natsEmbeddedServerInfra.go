@@ -0,0 +1,69 @@
+package message
+
+import (
+	"errors"
+	"github.com/nats-io/nats-server/v2/server"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+/*
+	The purpose of this file is to provide an in-process nats server, so the alarm service can be shipped as a single
+	binary (no external nats-server needed) and the integration tests/benchmarks can run hermetic.
+
+	Note: the embedded server listens on a real tcp port, so external clients (eg: the be-challenge verify tool)
+		  can still connect to it.
+*/
+
+const EmbeddedServerRandomPort = server.RANDOM_PORT
+
+const embeddedServerReadyTimeout = 5 * time.Second
+
+type EmbeddedServerOptions struct {
+	Host string
+	Port int
+
+	JetStream bool
+	// Note: if empty and JetStream is enabled, nats server will use a temp directory.
+	StoreDir string
+}
+
+func StartEmbeddedServer(options EmbeddedServerOptions) (*server.Server, error) {
+
+	host := options.Host
+	if len(host) == 0 {
+		host = "127.0.0.1"
+	}
+
+	opts := &server.Options{
+		ServerName: "alarm-digest-embedded-nats",
+		Host:       host,
+		Port:       options.Port,
+		NoLog:      true,
+		NoSigs:     true,
+		JetStream:  options.JetStream,
+		StoreDir:   options.StoreDir,
+	}
+
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go ns.Start()
+
+	if !ns.ReadyForConnections(embeddedServerReadyTimeout) {
+		ns.Shutdown()
+		return nil, errors.New("embedded nats server not ready for connections after " + embeddedServerReadyTimeout.String())
+	}
+
+	log.Infof("embedded nats server started --- clientUrl: %v --- jetStream: %v\n", ns.ClientURL(), ns.JetStreamEnabled())
+
+	return ns, nil
+}
+
+func StopEmbeddedServer(ns *server.Server) {
+	log.Debugf("will shutdown embedded nats server: %v\n", ns.ClientURL())
+	ns.Shutdown()
+	ns.WaitForShutdown()
+}
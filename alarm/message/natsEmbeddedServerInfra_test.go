@@ -0,0 +1,38 @@
+package message
+
+import (
+	"testing"
+)
+
+func TestStartEmbeddedServer_randomPortWithJetStream(t *testing.T) {
+
+	// given
+	storeDir := t.TempDir()
+
+	// when
+	embeddedServer, err := StartEmbeddedServer(EmbeddedServerOptions{
+		Port:      EmbeddedServerRandomPort,
+		JetStream: true,
+		StoreDir:  storeDir,
+	})
+	if err != nil {
+		t.Fatalf("could not start embedded server, error: %v", err)
+	}
+	defer StopEmbeddedServer(embeddedServer)
+
+
+	// then
+	if !embeddedServer.JetStreamEnabled() {
+		t.Errorf("jet stream should have been enabled")
+	}
+
+	serverConnection, err := ServerConnectionTo(embeddedServer.ClientURL())
+	if err != nil {
+		t.Fatalf("could not connect to embedded server, error: %v", err)
+	}
+	defer serverConnection.Close()
+
+	if !serverConnection.IsConnected() {
+		t.Errorf("connection to embedded server should have been established")
+	}
+}
@@ -0,0 +1,155 @@
+package message
+
+import (
+	"github.com/nats-io/nats.go"
+	"time"
+)
+
+// -------------------
+
+type NatsTransport struct {
+	serverConnection *nats.Conn
+}
+
+func NatsTransportCreateNew(serverConnection *nats.Conn) *NatsTransport {
+	return &NatsTransport{serverConnection: serverConnection}
+}
+
+func (t *NatsTransport) Connection() *nats.Conn {
+	return t.serverConnection
+}
+
+func (t *NatsTransport) NumSubscriptions() int {
+	return t.serverConnection.NumSubscriptions()
+}
+
+func (t *NatsTransport) Subscribe(subject string, handler func(msg *TransportMessage)) (TransportSubscription, error) {
+	subscription := &natsTransportSubscription{}
+	sub, err := t.serverConnection.Subscribe(subject, func(m *nats.Msg) {
+		subscription.gate.handle(func() {
+			handler(fromNatsMsg(m))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	subscription.sub = sub
+	return subscription, nil
+}
+
+func (t *NatsTransport) QueueSubscribe(subject string, queue string, handler func(msg *TransportMessage)) (TransportSubscription, error) {
+	subscription := &natsTransportSubscription{}
+	sub, err := t.serverConnection.QueueSubscribe(subject, queue, func(m *nats.Msg) {
+		subscription.gate.handle(func() {
+			handler(fromNatsMsg(m))
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	subscription.sub = sub
+	return subscription, nil
+}
+
+func (t *NatsTransport) Publish(msg *TransportMessage) error {
+	return t.serverConnection.PublishMsg(toNatsMsg(msg))
+}
+
+func (t *NatsTransport) Request(msg *TransportMessage, timeout time.Duration) (*TransportMessage, error) {
+	reply, err := t.serverConnection.RequestMsg(toNatsMsg(msg), timeout)
+
+	switch err {
+	case nil:
+		return fromNatsMsg(reply), nil
+	case nats.ErrNoResponders:
+		return nil, ErrTransportNoResponders
+	case nats.ErrTimeout:
+		return nil, ErrTransportTimeout
+	default:
+		return nil, err
+	}
+}
+
+func (t *NatsTransport) EnsureStream(name string, subjects ...string) error {
+	js, err := t.serverConnection.JetStream()
+	if err != nil {
+		return err
+	}
+
+	// Note: an existing stream is kept as is (eg: created with other limits by the operator).
+	if _, err := js.StreamInfo(name); err == nil {
+		return nil
+	}
+	_, err = js.AddStream(&nats.StreamConfig{Name: name, Subjects: subjects})
+	return err
+}
+
+func (t *NatsTransport) PublishToStream(msg *TransportMessage) (uint64, error) {
+	js, err := t.serverConnection.JetStream()
+	if err != nil {
+		return 0, err
+	}
+
+	ack, err := js.PublishMsg(toNatsMsg(msg))
+	if err != nil {
+		return 0, err
+	}
+	return ack.Sequence, nil
+}
+
+func (t *NatsTransport) Drain() error {
+	return t.serverConnection.Drain()
+}
+
+func (t *NatsTransport) IsConnected() bool {
+	return t.serverConnection.IsConnected()
+}
+
+// -------------------
+
+type natsTransportSubscription struct {
+	sub  *nats.Subscription
+	gate subscriptionGate
+}
+
+func (s *natsTransportSubscription) Subject() string {
+	return s.sub.Subject
+}
+
+func (s *natsTransportSubscription) Unsubscribe() error {
+	err := s.sub.Unsubscribe()
+
+	// Note: nats may still be running the handler of a message received before the unsubscribe.
+	s.gate.close()
+	return err
+}
+
+func (s *natsTransportSubscription) IsValid() bool {
+	return s.sub.IsValid()
+}
+
+// -------------------
+
+func fromNatsMsg(m *nats.Msg) *TransportMessage {
+	msg := &TransportMessage{
+		Subject: m.Subject,
+		Reply:   m.Reply,
+		Data:    m.Data,
+	}
+	if len(m.Header) > 0 {
+		msg.Header = TransportHeader(m.Header)
+	}
+	return msg
+}
+
+func toNatsMsg(msg *TransportMessage) *nats.Msg {
+	m := &nats.Msg{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Data:    msg.Data,
+	}
+	if len(msg.Header) > 0 {
+		m.Header = nats.Header(msg.Header)
+	}
+	return m
+}
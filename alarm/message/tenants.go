@@ -0,0 +1,360 @@
+package message
+
+import (
+	. "alarm/domain"
+	. "alarm/metrics"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Multi-tenancy (disabled when no tenant is configured): every tenant gets its own subjects, the topics prefixed
+	with the tenant, eg: productA.AlarmStatusChanged, productA.SendAlarmDigest --> productA.AlarmDigest, and the
+	unprefixed subjects are not subscribed anymore.
+
+	Inside the service the user ids are scoped with the tenant (<tenant>/<userId>), so the state of the users of
+	different tenants never mixes: routing, resharding, snapshots and the write-ahead log work on the scoped ids, the
+	producers publish the digests with the user id of the tenant again.
+
+	Quotas per tenant (0 means unlimited):
+
+	* max users  --> users with state (in all the workers), a message of a new user above it is rejected
+	* max alarms --> alarms with state (in all the workers), a message of a new alarm above it is rejected
+	* rate       --> AlarmStatusChanged + SendAlarmDigest messages per second (burst of a second), rejected in the listeners
+
+	The rejected messages are dropped (counted in alarm_tenant_quota_rejections_total), the alarms and the users which
+	get evicted by the retention free their quota.
+*/
+
+const tenantUserIdSeparator = "/"
+
+const (
+	quotaUsers  = "users"
+	quotaAlarms = "alarms"
+	quotaRate   = "rate"
+)
+
+var tenantMessagesCounter = CounterVecCreateNew("alarm_tenant_messages_total", "Messages received on the subjects of the tenant.", "tenant", "topic")
+var tenantQuotaRejectionsCounter = CounterVecCreateNew("alarm_tenant_quota_rejections_total", "Messages dropped because the tenant was above a quota.", "tenant", "quota")
+var tenantDigestsCounter = CounterVecCreateNew("alarm_tenant_digests_total", "AlarmDigest messages published to the tenant.", "tenant")
+var tenantUsersGauge = GaugeVecCreateNew("alarm_tenant_users", "Users with state, per tenant.", "tenant")
+var tenantAlarmsGauge = GaugeVecCreateNew("alarm_tenant_alarms", "Alarms with state, per tenant.", "tenant")
+
+type TenantQuotas struct {
+	MaxUsers           int
+	MaxAlarms          int
+	RateLimitPerSecond float64
+}
+
+type Tenant struct {
+	Name   string
+	Quotas TenantQuotas
+
+	mutex  sync.Mutex
+	users  int
+	alarms int
+	bucket tokenBucket
+	now    func() time.Time
+}
+
+type TenantUsage struct {
+	Tenant string
+	Users  int
+	Alarms int
+	TenantQuotas
+}
+
+type TenantRegistry struct {
+	tenants map[string]*Tenant
+	names   []string
+}
+
+func TenantRegistryCreateNew(quotas map[string]TenantQuotas) *TenantRegistry {
+	r := &TenantRegistry{tenants: make(map[string]*Tenant)}
+
+	for name, tenantQuotas := range quotas {
+		r.tenants[name] = &Tenant{Name: name, Quotas: tenantQuotas, bucket: tokenBucket{tokens: tenantQuotas.RateLimitPerSecond}, now: time.Now}
+		r.names = append(r.names, name)
+	}
+	sort.Strings(r.names)
+
+	return r
+}
+
+// TenantSubject the subject of the topic for the tenant, eg: productA.AlarmStatusChanged
+func TenantSubject(tenant string, topicName string) string {
+	return tenant + "." + topicName
+}
+
+// TenantUserId the id of the user of the tenant inside the service, eg: productA/e859dab9-...
+func TenantUserId(tenant string, userId string) string {
+	return tenant + tenantUserIdSeparator + userId
+}
+
+// scopedUserId the user id inside the service of a user of the tenant (if any), for the queries.
+func scopedUserId(tenant string, userId string) string {
+	if len(tenant) == 0 {
+		return userId
+	}
+	return TenantUserId(tenant, userId)
+}
+
+// tenantScopedSubject the subject of the topic for the tenant (if any), for the queries.
+func tenantScopedSubject(tenant string, topicName string) string {
+	if len(tenant) == 0 {
+		return topicName
+	}
+	return TenantSubject(tenant, topicName)
+}
+
+// Names the sorted names of the tenants, none if multi-tenancy is disabled (nil).
+func (r *TenantRegistry) Names() []string {
+	if r == nil {
+		return nil
+	}
+	return r.names
+}
+
+// scopes the tenants the queries are answered for, the unscoped "" only if multi-tenancy is disabled (nil).
+func (r *TenantRegistry) scopes() []string {
+	if r == nil {
+		return []string{""}
+	}
+	return r.names
+}
+
+func (r *TenantRegistry) Tenant(name string) *Tenant {
+	return r.tenants[name]
+}
+
+// Subjects the subjects of the topic for every tenant, only the topic itself if multi-tenancy is disabled (nil).
+func (r *TenantRegistry) Subjects(topicName string) []string {
+	if r == nil {
+		return []string{topicName}
+	}
+
+	subjects := make([]string, 0, len(r.names))
+	for _, name := range r.names {
+		subjects = append(subjects, TenantSubject(name, topicName))
+	}
+	return subjects
+}
+
+func (r *TenantRegistry) Usage() []TenantUsage {
+	usage := make([]TenantUsage, 0, len(r.names))
+	for _, name := range r.names {
+		usage = append(usage, r.tenants[name].usage())
+	}
+	return usage
+}
+
+// split the tenant and the user id of the tenant of a scoped user id, nil tenant if not scoped (or disabled).
+func (r *TenantRegistry) split(userId UserId) (*Tenant, string) {
+	if r == nil {
+		return nil, string(userId)
+	}
+
+	separator := strings.Index(string(userId), tenantUserIdSeparator)
+	if separator < 0 {
+		return nil, string(userId)
+	}
+	tenant, exists := r.tenants[string(userId)[:separator]]
+	if !exists {
+		return nil, string(userId)
+	}
+	return tenant, string(userId)[separator+1:]
+}
+
+func (t *Tenant) usage() TenantUsage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return TenantUsage{Tenant: t.Name, Users: t.users, Alarms: t.alarms, TenantQuotas: t.Quotas}
+}
+
+// admit reserves a new alarm (and a new user), returns the quota it is above of, empty if admitted.
+func (t *Tenant) admit(newUser bool) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if newUser && t.Quotas.MaxUsers > 0 && t.users >= t.Quotas.MaxUsers {
+		return quotaUsers
+	}
+	if t.Quotas.MaxAlarms > 0 && t.alarms >= t.Quotas.MaxAlarms {
+		return quotaAlarms
+	}
+
+	if newUser {
+		t.users++
+	}
+	t.alarms++
+	t.recordUsage()
+	return ""
+}
+
+// track counts state which is already there (restored), regardless of the quotas.
+func (t *Tenant) track(users int, alarms int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.users += users
+	t.alarms += alarms
+	t.recordUsage()
+}
+
+func (t *Tenant) release(users int, alarms int) {
+	t.track(-users, -alarms)
+}
+
+func (t *Tenant) recordUsage() {
+	tenantUsersGauge.WithLabelValues(t.Name).Set(float64(t.users))
+	tenantAlarmsGauge.WithLabelValues(t.Name).Set(float64(t.alarms))
+}
+
+// allowMessage takes a token of the rate limit, false if the tenant is above it.
+func (t *Tenant) allowMessage() bool {
+	if t.Quotas.RateLimitPerSecond <= 0 {
+		return true
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	if !t.bucket.lastRefill.IsZero() {
+		t.bucket.tokens += now.Sub(t.bucket.lastRefill).Seconds() * t.Quotas.RateLimitPerSecond
+		if t.bucket.tokens > t.Quotas.RateLimitPerSecond {
+			t.bucket.tokens = t.Quotas.RateLimitPerSecond
+		}
+	}
+	t.bucket.lastRefill = now
+
+	if t.bucket.tokens < 1 {
+		return false
+	}
+	t.bucket.tokens--
+	return true
+}
+
+
+// ------------------- listeners -------------------
+
+// RegisterTenantTopicListeners subscribes to the AlarmStatusChanged and SendAlarmDigest subjects of every tenant, the
+// messages get the scoped user id.
+func RegisterTenantTopicListeners(listenerNamePrefix string, transport Transport, tenants *TenantRegistry,
+								   alarmStatusChangedMessagesChan chan AlarmStatusChangedMessage, sendAlarmDigestMessagesChan chan SendAlarmDigestMessage,
+								   ignoreBadFormattedMessages bool) ([]TransportSubscription, []TransportSubscription) {
+
+	alarmStatusChangedTopicSubscriptions := make([]TransportSubscription, 0, len(tenants.Names()))
+	sendAlarmDigestTopicSubscriptions := make([]TransportSubscription, 0, len(tenants.Names()))
+
+	for _, name := range tenants.Names() {
+		tenant := tenants.Tenant(name)
+
+		alarmStatusChangedTopicSubscriptions = append(alarmStatusChangedTopicSubscriptions,
+			registerTenantTopicListener(listenerNamePrefix, transport, tenant, Topics().AlarmStatusChanged, ignoreBadFormattedMessages, func(msg *TransportMessage, listenerName string, correlationId string) bool {
+				var dat AlarmStatusChangedMessage
+				if err := json.Unmarshal(msg.Data, &dat); err != nil {
+					return false
+				}
+
+				dat.UserId = TenantUserId(tenant.Name, dat.UserId)
+				dat.CorrelationId = correlationId
+				span := startReceiveSpan(msg, listenerName, dat.CorrelationId)
+				dat.SpanContext = span.SpanContext()
+				alarmStatusChangedMessagesChan <- dat
+				span.End()
+				return true
+			}))
+
+		sendAlarmDigestTopicSubscriptions = append(sendAlarmDigestTopicSubscriptions,
+			registerTenantTopicListener(listenerNamePrefix, transport, tenant, Topics().SendAlarmDigest, ignoreBadFormattedMessages, func(msg *TransportMessage, listenerName string, correlationId string) bool {
+				var dat SendAlarmDigestMessage
+				if err := json.Unmarshal(msg.Data, &dat); err != nil {
+					return false
+				}
+
+				dat.UserId = TenantUserId(tenant.Name, dat.UserId)
+				dat.CorrelationId = correlationId
+				span := startReceiveSpan(msg, listenerName, dat.CorrelationId)
+				dat.SpanContext = span.SpanContext()
+				sendAlarmDigestMessagesChan <- dat
+				span.End()
+				return true
+			}))
+	}
+
+	return alarmStatusChangedTopicSubscriptions, sendAlarmDigestTopicSubscriptions
+}
+
+// registerTenantTopicListener applies the rate limit of the tenant, the handler returns false for a bad formatted message.
+// Note: the correlation id is derived once, a message without the header would get a new one on every call.
+func registerTenantTopicListener(listenerNamePrefix string, transport Transport, tenant *Tenant, topicName string,
+								  ignoreBadFormattedMessages bool, handler func(msg *TransportMessage, listenerName string, correlationId string) bool) TransportSubscription {
+
+	subject := TenantSubject(tenant.Name, topicName)
+	listenerName := listenerNamePrefix + "#" + subject
+
+	return AsyncSubscribe(transport, subject, func(msg *TransportMessage) {
+		tenantMessagesCounter.WithLabelValues(tenant.Name, topicName).Inc()
+
+		if !tenant.allowMessage() {
+			tenantQuotaRejectionsCounter.WithLabelValues(tenant.Name, quotaRate).Inc()
+			log.Debugf("[%v] tenant: %v is above its rate limit, message dropped\n", listenerName, tenant.Name)
+			return
+		}
+
+		correlationId := correlationIdOf(msg)
+		if l := messageLog(correlationId, "listener", listenerName); l != nil {
+			l.Debugf("message received from topic: %v, data: %v\n", subject, string(msg.Data))
+		}
+
+		if !handler(msg, listenerName, correlationId) {
+			onBadFormattedMessage(transport, listenerName, msg, errors.New("bad formatted message received from topic: "+subject), ignoreBadFormattedMessages)
+		}
+	})
+}
+
+
+// ------------------- worker -------------------
+
+// IsolateTenants the worker enforces the user and alarm quotas of the tenants, to be called before it starts consuming.
+func (w *AlarmMessageWorker) IsolateTenants(tenants *TenantRegistry) {
+	w.tenants = tenants
+}
+
+// admitAlarm true if the alarm has state already or the quotas of its tenant allow a new one.
+func (w *AlarmMessageWorker) admitAlarm(userId UserId, alarmId AlarmId) bool {
+	tenant, _ := w.tenants.split(userId)
+	if tenant == nil {
+		return true
+	}
+
+	alarms, userExists := w.alarmsState[userId]
+	if _, alarmExists := alarms[alarmId]; alarmExists {
+		return true
+	}
+
+	if quota := tenant.admit(!userExists); len(quota) > 0 {
+		tenantQuotaRejectionsCounter.WithLabelValues(tenant.Name, quota).Inc()
+		log.Debugf("[%v] tenant: %v is above its %v quota, alarm: %v of user: %v dropped\n", w.workerName, tenant.Name, quota, alarmId, userId)
+		return false
+	}
+	return true
+}
+
+func (w *AlarmMessageWorker) trackTenantUsage(userId UserId, alarms int) {
+	if tenant, _ := w.tenants.split(userId); tenant != nil && alarms > 0 {
+		tenant.track(1, alarms)
+	}
+}
+
+func (w *AlarmMessageWorker) releaseTenantUsage(userId UserId, users int, alarms int) {
+	if tenant, _ := w.tenants.split(userId); tenant != nil {
+		tenant.release(users, alarms)
+	}
+}
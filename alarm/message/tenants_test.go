@@ -0,0 +1,230 @@
+package message
+
+import (
+	. "alarm/domain"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func publishJson(t *testing.T, transport Transport, subject string, message interface{}) {
+	data, _ := json.Marshal(message)
+	if err := transport.Publish(&TransportMessage{Subject: subject, Data: data}); err != nil {
+		t.Fatalf("could not publish to: %v, error: %v", subject, err)
+	}
+}
+
+func TestAlarmMessageWorker_tenants_quotasOnUsersAndAlarms(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	tenants := TenantRegistryCreateNew(map[string]TenantQuotas{"productA": {MaxUsers: 1, MaxAlarms: 2}})
+	worker := testRetentionWorker(&now)
+	worker.IsolateTenants(tenants)
+
+	changeAlarm(worker, "productA/u1", "a1", CRITICAL, now)
+	changeAlarm(worker, "productA/u1", "a2", CRITICAL, now)
+
+
+	// when
+	changeAlarm(worker, "productA/u1", "a3", CRITICAL, now)
+	changeAlarm(worker, "productA/u2", "a1", CRITICAL, now)
+	changeAlarm(worker, "productA/u1", "a1", CLEARED, now)
+	changeAlarm(worker, "u3", "a1", CRITICAL, now) // Note: not of a tenant, no quotas
+
+
+	// then
+	if len(worker.alarmsState["productA/u1"]) != 2 || worker.alarmsState["productA/u2"] != nil || worker.alarmsState["u3"] == nil {
+		t.Errorf("expected the new alarm and the new user above the quotas to be dropped, got: %v", worker.alarmsState)
+	}
+	if worker.alarmsState["productA/u1"]["a1"].Status != CLEARED {
+		t.Errorf("the alarms already tracked should still change")
+	}
+	if usage := tenants.Usage()[0]; usage.Users != 1 || usage.Alarms != 2 {
+		t.Errorf("invalid usage: %+v", usage)
+	}
+
+	worker.evictUser("productA/u1")
+	changeAlarm(worker, "productA/u2", "a1", CRITICAL, now)
+	if usage := tenants.Usage()[0]; worker.alarmsState["productA/u2"] == nil || usage.Users != 1 || usage.Alarms != 1 {
+		t.Errorf("expected the evicted user to free the quotas, got: %+v", usage)
+	}
+}
+
+func TestTenant_rateLimit(t *testing.T) {
+
+	// given
+	now := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	tenant := TenantRegistryCreateNew(map[string]TenantQuotas{"productA": {RateLimitPerSecond: 2}}).Tenant("productA")
+	tenant.now = func() time.Time {
+		return now
+	}
+
+
+	// when
+	allowed := []bool{tenant.allowMessage(), tenant.allowMessage(), tenant.allowMessage()}
+	now = now.Add(500 * time.Millisecond)
+	allowed = append(allowed, tenant.allowMessage(), tenant.allowMessage())
+
+
+	// then
+	expected := []bool{true, true, false, true, false}
+	for i := range expected {
+		if allowed[i] != expected[i] {
+			t.Errorf("expected: %v, got: %v", expected, allowed)
+			break
+		}
+	}
+}
+
+/*
+	Scenario:
+
+	* the same user id gets an alarm on the subjects of 2 tenants, productB with a single user quota
+	* a second user of productB is rejected
+	* both users of the same id request a digest
+*/
+func TestRegisterTenantTopicListeners_isolateTheTenants(t *testing.T) {
+
+	// given
+	tenants := TenantRegistryCreateNew(map[string]TenantQuotas{"productA": {}, "productB": {MaxUsers: 1}})
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	pool := testWorkerPool(2, &alarmDigestMessagesChan, func(worker *AlarmMessageWorker) {
+		worker.IsolateTenants(tenants)
+	})
+	transport := InMemoryTransportCreateNew()
+
+	alarmStatusChangedMessagesChan := make(chan AlarmStatusChangedMessage, 10)
+	sendAlarmDigestMessagesChan := make(chan SendAlarmDigestMessage, 10)
+	alarmStatusChangedSubscriptions, sendAlarmDigestSubscriptions := RegisterTenantTopicListeners("test", transport, tenants,
+		alarmStatusChangedMessagesChan, sendAlarmDigestMessagesChan, true)
+	defer func() {
+		for _, subscription := range append(alarmStatusChangedSubscriptions, sendAlarmDigestSubscriptions...) {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
+	}()
+	go AlarmStatusChangedMessagesConsumer(alarmStatusChangedMessagesChan, "test", pool)
+	go SendAlarmDigestMessagesConsumer(sendAlarmDigestMessagesChan, "test", pool)
+	defer close(alarmStatusChangedMessagesChan)
+	defer close(sendAlarmDigestMessagesChan)
+
+	producerName, producerId, topicName := "alarmDigestMessageProducer#0", 0, AlarmDigestTopic
+	producer := AlarmDigestMessageProducerCreateNew(&producerName, &producerId, &topicName, transport, &alarmDigestMessagesChan)
+	producer.IsolateTenants(tenants)
+	go producer.Produce()
+	defer close(alarmDigestMessagesChan)
+
+	digests := make(chan *TransportMessage, 10)
+	for _, subject := range []string{"productA.AlarmDigest", "productB.AlarmDigest", AlarmDigestTopic} {
+		subscription := AsyncSubscribe(transport, subject, func(msg *TransportMessage) {
+			digests <- msg
+		})
+		defer AsyncUnsubscribe(subscription, subject)
+	}
+
+	publishJson(t, transport, "productA.AlarmStatusChanged", AlarmStatusChangedMessage{AlarmId: "a1", UserId: "u1", Status: "CRITICAL", ChangedAt: time.Now()})
+	publishJson(t, transport, "productB.AlarmStatusChanged", AlarmStatusChangedMessage{AlarmId: "a2", UserId: "u1", Status: "WARNING", ChangedAt: time.Now()})
+	publishJson(t, transport, "productB.AlarmStatusChanged", AlarmStatusChangedMessage{AlarmId: "a3", UserId: "u2", Status: "WARNING", ChangedAt: time.Now()})
+	waitForProcessedMessages(t, pool, 3)
+
+
+	// when
+	publishJson(t, transport, "productA.SendAlarmDigest", SendAlarmDigestMessage{UserId: "u1"})
+	publishJson(t, transport, "productB.SendAlarmDigest", SendAlarmDigestMessage{UserId: "u1"})
+
+
+	// then
+	received := map[string]AlarmDigestMessage{}
+	for len(received) < 2 {
+		select {
+		case msg := <-digests:
+			var digest AlarmDigestMessage
+			_ = json.Unmarshal(msg.Data, &digest)
+			received[msg.Subject] = digest
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a digest per tenant, got: %v", received)
+		}
+	}
+
+	if digest := received["productA.AlarmDigest"]; digest.UserId != "u1" || len(digest.ActiveAlarms) != 1 || digest.ActiveAlarms[0].AlarmId != "a1" {
+		t.Errorf("invalid digest of productA: %v", digest)
+	}
+	if digest := received["productB.AlarmDigest"]; digest.UserId != "u1" || len(digest.ActiveAlarms) != 1 || digest.ActiveAlarms[0].AlarmId != "a2" {
+		t.Errorf("invalid digest of productB: %v", digest)
+	}
+	if usage := tenants.Usage(); usage[1].Users != 1 || usage[1].Alarms != 1 {
+		t.Errorf("expected the second user of productB to be rejected, got: %+v", usage)
+	}
+}
+
+/*
+	Scenario:
+
+	* the same user id gets an alarm in 2 tenants
+	* the user of productB queries its alarms, also asking (in the payload) for the tenant productA
+	* the unprefixed query subjects and the stats of the whole pool are queried
+*/
+func TestRegisterAlarmQueryResponders_isolateTheTenants(t *testing.T) {
+
+	// given
+	tenants := TenantRegistryCreateNew(map[string]TenantQuotas{"productA": {}, "productB": {}})
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 10)
+	pool := testWorkerPool(2, &alarmDigestMessagesChan, func(worker *AlarmMessageWorker) {
+		worker.IsolateTenants(tenants)
+	})
+	transport := InMemoryTransportCreateNew()
+
+	querySubscriptions := RegisterAlarmQueryResponders("test", transport, pool, tenants, time.Second)
+	historySubscriptions := RegisterAlarmHistoryQueryResponder("test", transport, pool, tenants)
+	defer func() {
+		for _, subscription := range append(querySubscriptions, historySubscriptions...) {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
+	}()
+
+	changedAt := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a1", UserId: TenantUserId("productA", "u1"), Status: "CRITICAL", ChangedAt: changedAt})
+	pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: "a2", UserId: TenantUserId("productB", "u1"), Status: "WARNING", ChangedAt: changedAt})
+	waitForProcessedMessages(t, pool, 2)
+
+
+	// when
+	crossTenant := []byte(`{"UserId":"u1","AlarmId":"a1","Tenant":"productA"}`)
+	request := func(subject string, data []byte) (*TransportMessage, error) {
+		return transport.Request(&TransportMessage{Subject: subject, Data: data}, time.Second)
+	}
+	activeAlarmsMsg, activeAlarmsErr := request("productB."+AlarmQueryActiveAlarmsTopic, crossTenant)
+	alarmMsg, alarmErr := request("productB."+AlarmQueryAlarmTopic, crossTenant)
+	historyMsg, historyErr := request("productB."+AlarmHistoryQueryTopic, crossTenant)
+	_, unprefixedErr := request(AlarmQueryActiveAlarmsTopic, crossTenant)
+	poolStats := queryOverTransport(t, transport, "productB."+AlarmQueryStatsTopic, AlarmQueryMessage{})
+
+
+	// then
+	if activeAlarmsErr != nil || alarmErr != nil || historyErr != nil {
+		t.Fatalf("the queries of productB failed, errors: %v, %v, %v", activeAlarmsErr, alarmErr, historyErr)
+	}
+
+	var activeAlarms, alarm AlarmQueryReply
+	var history AlarmHistoryQueryReply
+	_ = json.Unmarshal(activeAlarmsMsg.Data, &activeAlarms)
+	_ = json.Unmarshal(alarmMsg.Data, &alarm)
+	_ = json.Unmarshal(historyMsg.Data, &history)
+
+	if activeAlarms.ActiveAlarms == nil || activeAlarms.ActiveAlarms.UserId != "u1" || len(activeAlarms.ActiveAlarms.ActiveAlarms) != 1 ||
+		activeAlarms.ActiveAlarms.ActiveAlarms[0].AlarmId != "a2" {
+		t.Errorf("expected only the alarms of the user of productB, got: %+v", activeAlarms.ActiveAlarms)
+	}
+	if alarm.Error == nil || alarm.Error.Code != QueryErrorNotFound {
+		t.Errorf("expected the alarm of productA not to be found from productB, got: %+v", alarm)
+	}
+	if history.Error == nil || history.Error.Code != QueryErrorNotFound {
+		t.Errorf("expected the history of productA not to be found from productB, got: %+v", history)
+	}
+	if unprefixedErr != ErrTransportNoResponders {
+		t.Errorf("expected no responder on the unprefixed query subject, got: %v", unprefixedErr)
+	}
+	if poolStats.Error == nil || poolStats.Error.Code != QueryErrorBadRequest || poolStats.PoolStats != nil {
+		t.Errorf("expected the stats of the pool to be rejected for a tenant, got: %+v", poolStats)
+	}
+}
@@ -1,31 +1,33 @@
 package message
 
 import (
+	. "alarm/metrics"
 	"encoding/json"
-	"github.com/nats-io/nats.go"
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"math"
 	"strconv"
 	"sync/atomic"
+	"time"
 )
 
-func RegisterAlarmDigestTopicListener(listenerName string, serverConnection *nats.Conn,
+func RegisterAlarmDigestTopicListener(listenerName string, transport Transport,
 									topicName string, ignoreBadFormattedMessages bool,
-									messageConsumer func(message AlarmDigestMessage)) *nats.Subscription {
+									messageConsumer func(message AlarmDigestMessage)) TransportSubscription {
 
-	topicSubscription := AsyncSubscribe(serverConnection, topicName, func(msg *nats.Msg) {
+	topicSubscription := AsyncSubscribe(transport, topicName, func(msg *TransportMessage) {
 
 		var dat AlarmDigestMessage
 		if err := json.Unmarshal(msg.Data, &dat); err != nil {
-
-			if ignoreBadFormattedMessages {
-				log.Warnf("[%v] bad formatted message received from topic: %v, data: %v\n", listenerName, topicName, string(msg.Data))
-			} else {
-				panic(err)
-			}
+			onBadFormattedMessage(transport, listenerName, msg, err, ignoreBadFormattedMessages)
+			return
 		}
 
-		log.Debugf("[%v] !!!!!!!!!!!!!!!!!!!!!!!! SendAlarmDigestMessage received from topic: %v, data: %v\n", listenerName, topicName, dat)
+		dat.CorrelationId = correlationIdOf(msg)
+		dat.SpanContext = spanContextOf(msg)
+		if l := messageLog(dat.CorrelationId, "listener", listenerName); l != nil {
+			l.Debugf("AlarmDigestMessage received from topic: %v, data: %v\n", topicName, dat)
+		}
 
 
 		if messageConsumer != nil {
@@ -38,29 +40,32 @@ func RegisterAlarmDigestTopicListener(listenerName string, serverConnection *nat
 
 
 func RegisterSendAlarmDigestTopicListeners(listenerNamePrefix string, sendAlarmDigestListeners int,
-											serverConnection *nats.Conn, sendAlarmDigestMessagesChan chan SendAlarmDigestMessage,
-											registerDelegator bool, ignoreBadFormattedMessages bool) []*nats.Subscription {
+											transport Transport, sendAlarmDigestMessagesChan chan SendAlarmDigestMessage,
+											registerDelegator bool, ignoreBadFormattedMessages bool) []TransportSubscription {
 
-	var sendAlarmDigestTopicSubscriptions = make([]*nats.Subscription, sendAlarmDigestListeners)
+	var sendAlarmDigestTopicSubscriptions = make([]TransportSubscription, 0, sendAlarmDigestListeners+1)
 	for i := 0; i < sendAlarmDigestListeners; i++ {
 
-		topicName := SendAlarmDigestTopic + "." + strconv.Itoa(i)
+		topicName := Topics().Shard(Topics().SendAlarmDigest, i)
 
 		listenerName := listenerNamePrefix + "#" + strconv.Itoa(i)
 
-		sendAlarmDigestTopicSubscription := AsyncSubscribe(serverConnection, topicName, func(msg *nats.Msg) {
+		sendAlarmDigestTopicSubscription := AsyncSubscribe(transport, topicName, func(msg *TransportMessage) {
 
 			var dat SendAlarmDigestMessage
 			if err := json.Unmarshal(msg.Data, &dat); err != nil {
-				if ignoreBadFormattedMessages {
-					log.Warnf("[%v] bad formatted message received from topic: %v, data: %v\n", listenerName, topicName, string(msg.Data))
-				} else {
-					panic(err)
-				}
+				onBadFormattedMessage(transport, listenerName, msg, err, ignoreBadFormattedMessages)
+				return
 			}
 
-			log.Infof("[%v] message received from topic: %v, data: %v\n", listenerName, topicName, dat)
+			dat.CorrelationId = correlationIdOf(msg)
+			span := startReceiveSpan(msg, listenerName, dat.CorrelationId)
+			dat.SpanContext = span.SpanContext()
+			if l := messageLog(dat.CorrelationId, "listener", listenerName); l != nil {
+				l.Debugf("message received from topic: %v, data: %v\n", topicName, dat)
+			}
 			sendAlarmDigestMessagesChan <- dat
+			span.End()
 
 		})
 
@@ -70,7 +75,7 @@ func RegisterSendAlarmDigestTopicListeners(listenerNamePrefix string, sendAlarmD
 
 	/*
 		Note: because the provided test emits message to SendAlarmDigest topic, and I have implemented a solution
-			  to scale listeners, so each one listens to .<id> suffix, so: SendAlarmDigest.<id> we will need to have
+			  to scale listeners, so each one listens to .<id> suffix (see TopicNames.ShardPattern), so: SendAlarmDigest.<id> we will need to have
 	          a listener which will listen on SendAlarmDigest topic as is, and delegate the messages to other listeners,
 	          in our case with round-robin fashion.
 	 */
@@ -78,28 +83,40 @@ func RegisterSendAlarmDigestTopicListeners(listenerNamePrefix string, sendAlarmD
 
 		var currentCounter uint64 = 0
 
-		subscription := AsyncSubscribe(serverConnection, SendAlarmDigestTopic, func(msg *nats.Msg) {
+		topicName := Topics().SendAlarmDigest
+		listenerName := topicName + "#Delegator"
+
+		subscription := AsyncSubscribe(transport, topicName, func(msg *TransportMessage) {
 			var dat SendAlarmDigestMessage
 			if err := json.Unmarshal(msg.Data, &dat); err != nil {
-				panic(err)
+				onBadFormattedMessage(transport, listenerName, msg, err, ignoreBadFormattedMessages)
+				return
 			}
 
-			topicName := SendAlarmDigestTopic
-			listenerName := SendAlarmDigestTopic + "#Delegator"
-			log.Infof("[%v] message received from topic: %v, data: %v\n", listenerName, topicName, dat)
+			// Note: the correlation id is assigned here, so the delegated message keeps it.
+			correlationId := correlationIdOf(msg)
+			span := startReceiveSpan(msg, listenerName, correlationId)
+			defer span.End()
+
+			l := messageLog(correlationId, "listener", listenerName)
+			if l != nil {
+				l.Debugf("message received from topic: %v, data: %v\n", topicName, dat)
+			}
 
 
 			listenerIdToDelegate := atomic.LoadUint64(&currentCounter) % uint64(sendAlarmDigestListeners)
 			if listenerIdToDelegate < 0 || listenerIdToDelegate >= uint64(sendAlarmDigestListeners) {
 				panic("error occurred during calculation of listener id to delegate")
 			}
-			topicNameOfListenerToDelegate := SendAlarmDigestTopic + "." + strconv.FormatUint(listenerIdToDelegate, 10)
+			topicNameOfListenerToDelegate := Topics().Shard(topicName, int(listenerIdToDelegate))
 
 
-			log.Infof("[%v] will delegate now to topic: %v\n", listenerName, topicNameOfListenerToDelegate)
+			if l != nil {
+				l.Debugf("will delegate now to topic: %v\n", topicNameOfListenerToDelegate)
+			}
 
 
-			err := PublishMessage(serverConnection, topicNameOfListenerToDelegate, msg.Data)
+			err := PublishMessageWithHeader(transport, topicNameOfListenerToDelegate, msg.Data, messageHeader(correlationId, span.SpanContext()))
 			if err != nil {
 				if ignoreBadFormattedMessages {
 					log.Warnf("[%v] bad formatted message received from topic: %v, data: %v\n", listenerName, topicName, string(msg.Data))
@@ -125,30 +142,33 @@ func RegisterSendAlarmDigestTopicListeners(listenerNamePrefix string, sendAlarmD
 }
 
 func RegisterAlarmStatusChangedTopicListeners(listenerNamePrefix string, alarmStatusChangedListeners int,
-												serverConnection *nats.Conn, alarmStatusChangedMessagesChan chan AlarmStatusChangedMessage,
-												registerDelegator bool, ignoreBadFormattedMessages bool) []*nats.Subscription {
+												transport Transport, alarmStatusChangedMessagesChan chan AlarmStatusChangedMessage,
+												registerDelegator bool, ignoreBadFormattedMessages bool) []TransportSubscription {
 
 
-	var alarmStatusChangedTopicSubscriptions = make([]*nats.Subscription, alarmStatusChangedListeners)
+	var alarmStatusChangedTopicSubscriptions = make([]TransportSubscription, 0, alarmStatusChangedListeners+1)
 	for i := 0; i < alarmStatusChangedListeners; i++ {
 
-		topicName := AlarmStatusChangedTopic + "." + strconv.Itoa(i)
+		topicName := Topics().Shard(Topics().AlarmStatusChanged, i)
 
 		listenerName := listenerNamePrefix + "#" + strconv.Itoa(i)
 
-		alarmStatusChangedTopicSubscription := AsyncSubscribe(serverConnection, topicName, func(msg *nats.Msg) {
+		alarmStatusChangedTopicSubscription := AsyncSubscribe(transport, topicName, func(msg *TransportMessage) {
 
 			var dat AlarmStatusChangedMessage
 			if err := json.Unmarshal(msg.Data, &dat); err != nil {
-				if ignoreBadFormattedMessages {
-					log.Warnf("[%v] bad formatted message received from topic: %v, data: %v\n", listenerName, topicName, string(msg.Data))
-				} else {
-					panic(err)
-				}
+				onBadFormattedMessage(transport, listenerName, msg, err, ignoreBadFormattedMessages)
+				return
 			}
 
-			log.Infof("[%v] message received from topic: %v, data: %v\n", listenerName, topicName, dat)
+			dat.CorrelationId = correlationIdOf(msg)
+			span := startReceiveSpan(msg, listenerName, dat.CorrelationId)
+			dat.SpanContext = span.SpanContext()
+			if l := messageLog(dat.CorrelationId, "listener", listenerName); l != nil {
+				l.Debugf("message received from topic: %v, data: %v\n", topicName, dat)
+			}
 			alarmStatusChangedMessagesChan <- dat
+			span.End()
 
 		})
 
@@ -158,7 +178,7 @@ func RegisterAlarmStatusChangedTopicListeners(listenerNamePrefix string, alarmSt
 
 	/*
 		Note: because the provided test emits message to AlarmStatusChangedTopic topic, and I have implemented a solution
-			  to scale listeners, so each one listens to .<id> suffix, so: AlarmStatusChangedTopic.<id> we will need to have
+			  to scale listeners, so each one listens to .<id> suffix (see TopicNames.ShardPattern), so: AlarmStatusChangedTopic.<id> we will need to have
 			  a listener which will listen on SendAlarmDigest topic as is, and delegate the messages to other listeners,
 			  in our case with round-robin fashion.
 	*/
@@ -167,28 +187,40 @@ func RegisterAlarmStatusChangedTopicListeners(listenerNamePrefix string, alarmSt
 
 		var currentCounter uint64 = 0
 
-		subscription := AsyncSubscribe(serverConnection, AlarmStatusChangedTopic, func(msg *nats.Msg) {
+		topicName := Topics().AlarmStatusChanged
+		listenerName := topicName + "#Delegator"
+
+		subscription := AsyncSubscribe(transport, topicName, func(msg *TransportMessage) {
 			var dat AlarmStatusChangedMessage
 			if err := json.Unmarshal(msg.Data, &dat); err != nil {
-				panic(err)
+				onBadFormattedMessage(transport, listenerName, msg, err, ignoreBadFormattedMessages)
+				return
 			}
 
-			topicName := AlarmStatusChangedTopic
-			listenerName := AlarmStatusChangedTopic + "#Delegator"
-			log.Infof("[%v] message received from topic: %v, data: %v\n", listenerName, topicName, dat)
+			// Note: the correlation id is assigned here, so the delegated message keeps it.
+			correlationId := correlationIdOf(msg)
+			span := startReceiveSpan(msg, listenerName, correlationId)
+			defer span.End()
+
+			l := messageLog(correlationId, "listener", listenerName)
+			if l != nil {
+				l.Debugf("message received from topic: %v, data: %v\n", topicName, dat)
+			}
 
 
 			listenerIdToDelegate := atomic.LoadUint64(&currentCounter) % uint64(alarmStatusChangedListeners)
 			if listenerIdToDelegate < 0 || listenerIdToDelegate >= uint64(alarmStatusChangedListeners) {
 				panic("error occurred during calculation of listener id to delegate")
 			}
-			topicNameOfListenerToDelegate := AlarmStatusChangedTopic + "." + strconv.FormatUint(listenerIdToDelegate, 10)
+			topicNameOfListenerToDelegate := Topics().Shard(topicName, int(listenerIdToDelegate))
 
 
-			log.Infof("[%v] will delegate now to topic: %v\n", listenerName, topicNameOfListenerToDelegate)
+			if l != nil {
+				l.Debugf("will delegate now to topic: %v\n", topicNameOfListenerToDelegate)
+			}
 
 
-			err := PublishMessage(serverConnection, topicNameOfListenerToDelegate, msg.Data)
+			err := PublishMessageWithHeader(transport, topicNameOfListenerToDelegate, msg.Data, messageHeader(correlationId, span.SpanContext()))
 			if err != nil {
 				if ignoreBadFormattedMessages {
 					log.Warnf("[%v] bad formatted message received from topic: %v, data: %v\n", listenerName, topicName, string(msg.Data))
@@ -212,3 +244,202 @@ func RegisterAlarmStatusChangedTopicListeners(listenerNamePrefix string, alarmSt
 }
 
 
+/*
+	The wildcard subscriptions of Topics() (if any), eg: alerts.v1.status_changed.> , so the producers can publish per
+	user (alerts.v1.status_changed.<user id>) without the UserID in the payload, the user id of the subject is used then.
+
+	Note: the subjects of the shards the wildcards match (eg: alerts.v1.status_changed.0 with the {subject}.{shard}
+		  pattern) are skipped, the listeners of the shards (alarmStatusChangedListeners, sendAlarmDigestListeners)
+		  receive them.
+*/
+func RegisterWildcardTopicListeners(listenerNamePrefix string, alarmStatusChangedListeners int, sendAlarmDigestListeners int, transport Transport,
+									alarmStatusChangedMessagesChan chan AlarmStatusChangedMessage, sendAlarmDigestMessagesChan chan SendAlarmDigestMessage,
+									ignoreBadFormattedMessages bool) ([]TransportSubscription, []TransportSubscription) {
+
+	topics := Topics()
+	shardSubjects := topics.ShardSubjects(alarmStatusChangedListeners, sendAlarmDigestListeners)
+	var alarmStatusChangedTopicSubscriptions, sendAlarmDigestTopicSubscriptions []TransportSubscription
+
+	if len(topics.AlarmStatusChangedWildcard) > 0 {
+		alarmStatusChangedTopicSubscriptions = append(alarmStatusChangedTopicSubscriptions,
+			registerWildcardTopicListener(listenerNamePrefix, transport, topics.AlarmStatusChangedWildcard, shardSubjects, ignoreBadFormattedMessages, func(msg *TransportMessage, listenerName string, correlationId string) error {
+				var dat AlarmStatusChangedMessage
+				if err := json.Unmarshal(msg.Data, &dat); err != nil {
+					return err
+				}
+				if len(dat.UserId) == 0 {
+					dat.UserId = topics.UserIdOf(msg.Subject)
+				}
+				if len(dat.UserId) == 0 {
+					return ErrUserIdNotInSubject
+				}
+
+				dat.CorrelationId = correlationId
+				span := startReceiveSpan(msg, listenerName, dat.CorrelationId)
+				dat.SpanContext = span.SpanContext()
+				alarmStatusChangedMessagesChan <- dat
+				span.End()
+				return nil
+			}))
+	}
+
+	if len(topics.SendAlarmDigestWildcard) > 0 {
+		sendAlarmDigestTopicSubscriptions = append(sendAlarmDigestTopicSubscriptions,
+			registerWildcardTopicListener(listenerNamePrefix, transport, topics.SendAlarmDigestWildcard, shardSubjects, ignoreBadFormattedMessages, func(msg *TransportMessage, listenerName string, correlationId string) error {
+				var dat SendAlarmDigestMessage
+				if err := json.Unmarshal(msg.Data, &dat); err != nil {
+					return err
+				}
+				if len(dat.UserId) == 0 {
+					dat.UserId = topics.UserIdOf(msg.Subject)
+				}
+				if len(dat.UserId) == 0 {
+					return ErrUserIdNotInSubject
+				}
+
+				dat.CorrelationId = correlationId
+				span := startReceiveSpan(msg, listenerName, dat.CorrelationId)
+				dat.SpanContext = span.SpanContext()
+				sendAlarmDigestMessagesChan <- dat
+				span.End()
+				return nil
+			}))
+	}
+
+	return alarmStatusChangedTopicSubscriptions, sendAlarmDigestTopicSubscriptions
+}
+
+var ErrUserIdNotInSubject = errors.New("the message has no UserID and its subject has no user id token")
+
+func registerWildcardTopicListener(listenerNamePrefix string, transport Transport, wildcard string, shardSubjects map[string]bool,
+									ignoreBadFormattedMessages bool, handler func(msg *TransportMessage, listenerName string, correlationId string) error) TransportSubscription {
+
+	listenerName := listenerNamePrefix + "#" + wildcard
+
+	return AsyncSubscribe(transport, wildcard, func(msg *TransportMessage) {
+		if shardSubjects[msg.Subject] {
+			return
+		}
+
+		// Note: the handler gets the same id, so the later hops log the message under the id of this line.
+		correlationId := correlationIdOf(msg)
+		if l := messageLog(correlationId, "listener", listenerName); l != nil {
+			l.Debugf("message received from topic: %v, data: %v\n", msg.Subject, string(msg.Data))
+		}
+
+		if err := handler(msg, listenerName, correlationId); err != nil {
+			onBadFormattedMessage(transport, listenerName, msg, err, ignoreBadFormattedMessages)
+		}
+	})
+}
+
+
+// RegisterAlarmHistoryQueryResponder answers the history queries (request/reply) of every tenant (if any), the tenant of
+// the subject scopes the user, see AlarmHistoryQueryTopic.
+func RegisterAlarmHistoryQueryResponder(listenerName string, transport Transport, workerPool *AlarmMessageWorkerPool,
+										tenants *TenantRegistry) []TransportSubscription {
+
+	var subscriptions []TransportSubscription
+	for _, tenant := range tenants.scopes() {
+		subscriptions = append(subscriptions, registerAlarmHistoryQueryResponder(listenerName, transport, workerPool, tenant))
+	}
+	return subscriptions
+}
+
+func registerAlarmHistoryQueryResponder(listenerName string, transport Transport, workerPool *AlarmMessageWorkerPool,
+										tenant string) TransportSubscription {
+
+	return AsyncSubscribe(transport, tenantScopedSubject(tenant, Topics().AlarmHistoryQuery), func(msg *TransportMessage) {
+		if len(msg.Reply) == 0 {
+			log.Warnf("[%v] history query without a reply inbox, data: %v\n", listenerName, string(msg.Data))
+			return
+		}
+
+		var reply AlarmHistoryQueryReply
+		var query AlarmHistoryQueryMessage
+		if err := json.Unmarshal(msg.Data, &query); err != nil || len(query.UserId) == 0 {
+			log.Warnf("[%v] bad formatted history query, data: %v\n", listenerName, string(msg.Data))
+			reply.Error = &AlarmQueryError{Code: QueryErrorBadRequest, Message: "bad formatted query, UserID is required"}
+
+		} else if len(query.AlarmId) > 0 {
+			timeline, err := workerPool.AlarmTimeline(scopedUserId(tenant, query.UserId), query.AlarmId)
+			if err != nil {
+				reply.Error = historyQueryError(err)
+			}
+			if timeline != nil {
+				timeline.UserId = query.UserId
+			}
+			reply.Timeline = timeline
+
+		} else {
+			at := query.At
+			if at.IsZero() {
+				at = time.Now()
+			}
+			activeAlarms, err := workerPool.ActiveAlarmsAt(scopedUserId(tenant, query.UserId), at)
+			if err != nil {
+				reply.Error = historyQueryError(err)
+			}
+			if activeAlarms != nil {
+				activeAlarms.UserId = query.UserId
+			}
+			reply.ActiveAlarms = activeAlarms
+		}
+
+		data, _ := json.Marshal(reply)
+		if err := transport.Publish(&TransportMessage{Subject: msg.Reply, Data: data, Header: msg.Header}); err != nil {
+			log.Warnf("[%v] could not reply to history query, error: %v\n", listenerName, err)
+		}
+	})
+}
+
+func historyQueryError(err error) *AlarmQueryError {
+	switch err {
+	case ErrAlarmNotFound:
+		return &AlarmQueryError{Code: QueryErrorNotFound, Message: err.Error()}
+	case ErrHistoryQueryTimeout:
+		return &AlarmQueryError{Code: QueryErrorTimeout, Message: err.Error()}
+	default:
+		return &AlarmQueryError{Code: QueryErrorInternal, Message: err.Error()}
+	}
+}
+
+
+
+// ------------------- dead letter -------------------
+
+const DeadLetterSubjectHeader = "Dead-Letter-Subject"
+const DeadLetterReasonHeader = "Dead-Letter-Reason"
+
+var deadLettersCounter = CounterVecCreateNew("alarm_dead_letters_total", "Bad formatted messages published to the dead-letter subject.", "listener")
+
+// onBadFormattedMessage logs the message and publishes it to the dead-letter subject, or panics if they are not ignored.
+func onBadFormattedMessage(transport Transport, listenerName string, msg *TransportMessage, err error, ignoreBadFormattedMessages bool) {
+	if !ignoreBadFormattedMessages {
+		panic(err)
+	}
+
+	log.Warnf("[%v] bad formatted message received from topic: %v, data: %v\n", listenerName, msg.Subject, string(msg.Data))
+	deadLetter(transport, listenerName, msg, err.Error())
+}
+
+// deadLetter publishes the message as it was received, with its subject and the reason as headers.
+func deadLetter(transport Transport, listenerName string, msg *TransportMessage, reason string) {
+	subject := Topics().DeadLetter
+	if len(subject) == 0 {
+		return
+	}
+
+	header := TransportHeader{}
+	for k, v := range msg.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	header.Set(DeadLetterSubjectHeader, msg.Subject)
+	header.Set(DeadLetterReasonHeader, reason)
+
+	if err := transport.Publish(&TransportMessage{Subject: subject, Data: msg.Data, Header: header}); err != nil {
+		log.Warnf("[%v] could not publish to the dead-letter subject: %v, error: %v\n", listenerName, subject, err)
+		return
+	}
+	deadLettersCounter.WithLabelValues(listenerName).Inc()
+}
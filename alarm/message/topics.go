@@ -1,5 +1,16 @@
 package message
 
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	The constants below are the default subjects, the service uses the ones of Topics() which are read from the
+	configuration at startup (see SetTopicNames), eg: alarmStatusChangedSubject=alerts.v1.status_changed
+*/
 
 /*
 	JSON example payload:
@@ -16,9 +27,10 @@ const AlarmStatusChangedTopic = "AlarmStatusChanged"
 
 
 /*
-	JSON example payload:
+	JSON example payload (RequestID is optional, a retry with the same one gets the same digest again):
 		{
 			UserID: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+			RequestID: "7d1b5e0c-3f0a-4c55-9a55-0c4b3a1f8d21"
 		}
 */
 const SendAlarmDigestTopic = "SendAlarmDigest"
@@ -42,3 +54,361 @@ const SendAlarmDigestTopic = "SendAlarmDigest"
 		}
 */
 const AlarmDigestTopic = "AlarmDigest"
+
+
+
+
+/*
+	The consumer of the AlarmDigest confirms it processed a digest (which carries a DigestID only when confirmations are
+	required, see alarmDigestDelivery.go).
+
+	JSON example payload:
+		{
+			UserID: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+			DigestID: "0b6c7e52-5a8e-4b8e-9f0e-2d7a1cfb3c11"
+		}
+*/
+const AlarmDigestDeliveredTopic = "AlarmDigestDelivered"
+
+
+
+/*
+	An alarm escalated by a rule with the publish action (see alarmEscalation.go), right away.
+
+	JSON example payload:
+		{
+			UserID: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+			AlarmID: "e36a6c22-ece6-46eb-9016-9303273edbfe",
+			Status: "CRITICAL",
+			StatusSince: "2021-06-07T20:40:15.598765212Z",
+			EscalatedAt: "2021-06-07T21:10:16.000182411Z",
+			Rule: "CRITICAL>30m:publish"
+		}
+*/
+const AlarmEscalatedTopic = "AlarmEscalated"
+
+
+
+/*
+	Request/reply, the reply goes to the inbox of the request.
+
+	JSON example payload (timeline of the alarm):
+		{
+			UserID: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+			AlarmID: "e36a6c22-ece6-46eb-9016-9303273edbfe"
+		}
+
+	JSON example payload (active alarms of the user as of the time, now if omitted):
+		{
+			UserID: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+			At: "2021-06-07T14:05:00Z"
+		}
+
+	JSON example reply:
+		{
+			Timeline: {
+				UserId: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+				AlarmId: "e36a6c22-ece6-46eb-9016-9303273edbfe",
+				Status: "CLEARED",
+				CreatedAt: "2021-06-07T13:40:15.598765212Z",
+				UpdatedAt: "2021-06-07T14:20:01.828161292Z",
+				Transitions: [{
+						Status: "CRITICAL",
+						ChangedAt: "2021-06-07T13:40:15.598765212Z",
+						ReceivedAt: "2021-06-07T13:40:15.601223541Z"
+					}, {
+						Status: "CLEARED",
+						ChangedAt: "2021-06-07T14:20:01.828161292Z",
+						ReceivedAt: "2021-06-07T14:20:01.830014388Z"
+				}]
+			}
+		}
+
+		{
+			ActiveAlarms: {
+				UserId: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+				At: "2021-06-07T14:05:00Z",
+				ActiveAlarms: [{
+					AlarmID: "e36a6c22-ece6-46eb-9016-9303273edbfe",
+					Status: "CRITICAL",
+					LatestChangedAt: "2021-06-07T13:40:15.598765212Z"
+				}],
+				Incomplete: false
+			}
+		}
+
+		{
+			Error: {
+				Code: "NOT_FOUND",
+				Message: "alarm does not exist"
+			}
+		}
+*/
+const AlarmHistoryQueryTopic = "AlarmHistoryQuery"
+
+
+
+
+/*
+	Read-only queries of the state of the workers (request/reply), the reply goes to the inbox of the request.
+	An error reply carries a code: BAD_REQUEST, NOT_FOUND, TIMEOUT or INTERNAL.
+
+	JSON example payload:
+		{
+			UserID: "e859dab9-66d4-4bf4-a578-113d223b94f0"
+		}
+
+	JSON example reply:
+		{
+			ActiveAlarms: {
+				UserId: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+				ActiveAlarms: [{
+					AlarmId: "e36a6c22-ece6-46eb-9016-9303273edbfe",
+					Status: "WARNING",
+					CreatedAt: "2021-06-07T20:40:15.598765212Z",
+					UpdatedAt: "2021-06-07T20:40:15.598765212Z",
+					PendingDigest: true
+				}]
+			}
+		}
+*/
+const AlarmQueryActiveAlarmsTopic = "AlarmQuery.ActiveAlarms"
+
+
+/*
+	JSON example payload:
+		{
+			UserID: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+			AlarmID: "e36a6c22-ece6-46eb-9016-9303273edbfe"
+		}
+
+	JSON example reply:
+		{
+			Alarm: {
+				AlarmId: "e36a6c22-ece6-46eb-9016-9303273edbfe",
+				Status: "WARNING",
+				CreatedAt: "2021-06-07T20:40:15.598765212Z",
+				UpdatedAt: "2021-06-07T20:40:15.598765212Z",
+				PendingDigest: false
+			}
+		}
+
+		{
+			Error: {
+				Code: "NOT_FOUND",
+				Message: "alarm does not exist"
+			}
+		}
+*/
+const AlarmQueryAlarmTopic = "AlarmQuery.Alarm"
+
+
+/*
+	JSON example payload (the stats of the user, the stats of the whole pool without UserID):
+		{
+			UserID: "e859dab9-66d4-4bf4-a578-113d223b94f0"
+		}
+
+	JSON example reply:
+		{
+			Stats: {
+				UserId: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+				Worker: "alarmMessagesWorker#3",
+				Alarms: 3,
+				ActiveAlarms: 2,
+				PendingDigest: 1,
+				ByStatus: {"CLEARED": 1, "CRITICAL": 1, "WARNING": 1},
+				LastSeen: "2021-06-07T20:40:15.601223541Z"
+			}
+		}
+
+		{
+			PoolStats: {
+				Workers: 4,
+				TrackedUsers: 400,
+				TrackedAlarms: 1200,
+				ProcessedMessages: 52000,
+				MailboxDepth: 12
+			}
+		}
+*/
+const AlarmQueryStatsTopic = "AlarmQuery.Stats"
+
+
+
+/*
+	JSON example payload:
+		{
+			UserID: "e859dab9-66d4-4bf4-a578-113d223b94f0"
+		}
+
+	JSON example reply (NOT_FOUND error if no digest is retained for the user):
+		{
+			LastDigest: {
+				UserId: "e859dab9-66d4-4bf4-a578-113d223b94f0",
+				RequestId: "7d1b5e0c-3f0a-4c55-9a55-0c4b3a1f8d21",
+				SentAt: "2021-06-07T21:30:00.113261412Z",
+				ActiveAlarms: [{
+					AlarmID: "e36a6c22-ece6-46eb-9016-9303273edbfe",
+					Status: "WARNING",
+					LatestChangedAt: "2021-06-07T20:40:15.598765212Z"
+				}]
+			}
+		}
+*/
+const AlarmQueryLastDigestTopic = "AlarmQuery.LastDigest"
+
+
+
+// ------------------- topic names -------------------
+
+// TopicNames the subjects of the service.
+type TopicNames struct {
+	AlarmStatusChanged   string
+	SendAlarmDigest      string
+	AlarmDigest          string
+	AlarmDigestDelivered string
+	AlarmEscalated       string
+
+	// Note: request/reply, see alarmQueries.go and alarmMessageWorkerHistory.go
+	AlarmHistoryQuery      string
+	AlarmQueryActiveAlarms string
+	AlarmQueryAlarm        string
+	AlarmQueryStats        string
+	AlarmQueryLastDigest   string
+
+	// Note: the subject of the listener of a shard, eg: {subject}.{shard} --> AlarmStatusChanged.3
+	ShardPattern string
+
+	// Note: the bad formatted messages are published there as they were received (empty only logs them).
+	DeadLetter string
+
+	// Note: optional subscriptions, eg: alerts.v1.status_changed.> , a message without UserID gets the one of the
+	//		 UserIdToken of its subject (negative counts from the end, -1 is the last token). The subjects of the shards
+	//		 they match (eg: alerts.v1.status_changed.0) are skipped, the listeners of the shards receive them.
+	AlarmStatusChangedWildcard string
+	SendAlarmDigestWildcard    string
+	UserIdToken                int
+}
+
+const ShardPlaceholder = "{shard}"
+const SubjectPlaceholder = "{subject}"
+
+func DefaultTopicNames() TopicNames {
+	return TopicNames{
+		AlarmStatusChanged:     AlarmStatusChangedTopic,
+		SendAlarmDigest:        SendAlarmDigestTopic,
+		AlarmDigest:            AlarmDigestTopic,
+		AlarmDigestDelivered:   AlarmDigestDeliveredTopic,
+		AlarmEscalated:         AlarmEscalatedTopic,
+		AlarmHistoryQuery:      AlarmHistoryQueryTopic,
+		AlarmQueryActiveAlarms: AlarmQueryActiveAlarmsTopic,
+		AlarmQueryAlarm:        AlarmQueryAlarmTopic,
+		AlarmQueryStats:        AlarmQueryStatsTopic,
+		AlarmQueryLastDigest:   AlarmQueryLastDigestTopic,
+		ShardPattern:           SubjectPlaceholder + "." + ShardPlaceholder,
+		UserIdToken:            -1,
+	}
+}
+
+var topicNames atomic.Value
+
+// SetTopicNames sets the subjects used by the listeners, producers and emulators, to be called before they start.
+func SetTopicNames(names TopicNames) {
+	topicNames.Store(names)
+}
+
+// Topics the subjects set by SetTopicNames, or the default ones.
+func Topics() TopicNames {
+	if names, ok := topicNames.Load().(TopicNames); ok {
+		return names
+	}
+	return DefaultTopicNames()
+}
+
+// Shard the subject of the listener of the shard.
+func (n TopicNames) Shard(subject string, shard int) string {
+	return strings.ReplaceAll(strings.ReplaceAll(n.ShardPattern, SubjectPlaceholder, subject), ShardPlaceholder, strconv.Itoa(shard))
+}
+
+// UserIdOf the UserIdToken of the subject, empty if the subject does not have it.
+func (n TopicNames) UserIdOf(subject string) string {
+	tokens := strings.Split(subject, ".")
+
+	i := n.UserIdToken
+	if i < 0 {
+		i += len(tokens)
+	}
+	if i < 0 || i >= len(tokens) {
+		return ""
+	}
+	return tokens[i]
+}
+
+// ShardSubjects the subjects of the listeners of the shards of AlarmStatusChanged and SendAlarmDigest.
+func (n TopicNames) ShardSubjects(alarmStatusChangedShards int, sendAlarmDigestShards int) map[string]bool {
+	subjects := make(map[string]bool)
+	for shard := 0; shard < alarmStatusChangedShards; shard++ {
+		subjects[n.Shard(n.AlarmStatusChanged, shard)] = true
+	}
+	for shard := 0; shard < sendAlarmDigestShards; shard++ {
+		subjects[n.Shard(n.SendAlarmDigest, shard)] = true
+	}
+	return subjects
+}
+
+// Validate the subjects are set and distinct, and the wildcards do not receive the messages of the other listeners
+// (which would process them twice), except the ones of the shards which the wildcard listeners skip.
+func (n TopicNames) Validate(shards int) error {
+	subjects := map[string]string{
+		"AlarmStatusChanged":     n.AlarmStatusChanged,
+		"SendAlarmDigest":        n.SendAlarmDigest,
+		"AlarmDigest":            n.AlarmDigest,
+		"AlarmDigestDelivered":   n.AlarmDigestDelivered,
+		"AlarmEscalated":         n.AlarmEscalated,
+		"AlarmHistoryQuery":      n.AlarmHistoryQuery,
+		"AlarmQueryActiveAlarms": n.AlarmQueryActiveAlarms,
+		"AlarmQueryAlarm":        n.AlarmQueryAlarm,
+		"AlarmQueryStats":        n.AlarmQueryStats,
+		"AlarmQueryLastDigest":   n.AlarmQueryLastDigest,
+	}
+	if len(n.DeadLetter) > 0 {
+		subjects["DeadLetter"] = n.DeadLetter
+	}
+
+	names := make(map[string]string)
+	for name, subject := range subjects {
+		if len(subject) == 0 || strings.ContainsAny(subject, "*> ") {
+			return errors.New("the subject of " + name + " should be a non empty subject without wildcards: " + subject)
+		}
+		if other, exists := names[subject]; exists {
+			return errors.New("the subjects of " + name + " and " + other + " should be distinct: " + subject)
+		}
+		names[subject] = name
+	}
+	if !strings.Contains(n.ShardPattern, ShardPlaceholder) || !strings.Contains(n.ShardPattern, SubjectPlaceholder) {
+		return errors.New("the shard subject pattern should contain " + SubjectPlaceholder + " and " + ShardPlaceholder + ": " + n.ShardPattern)
+	}
+	for shardSubject := range n.ShardSubjects(shards, shards) {
+		if name, exists := names[shardSubject]; exists {
+			return errors.New("the subject of " + name + " is the subject of a shard: " + shardSubject)
+		}
+	}
+
+	for _, wildcard := range []string{n.AlarmStatusChangedWildcard, n.SendAlarmDigestWildcard} {
+		if len(wildcard) == 0 {
+			continue
+		}
+		for subject := range names {
+			if subjectMatches(wildcard, subject) {
+				return errors.New("the wildcard subject " + wildcard + " overlaps the subject: " + subject)
+			}
+		}
+	}
+	if len(n.AlarmStatusChangedWildcard) > 0 && len(n.SendAlarmDigestWildcard) > 0 &&
+		(subjectMatches(n.AlarmStatusChangedWildcard, n.SendAlarmDigestWildcard) || subjectMatches(n.SendAlarmDigestWildcard, n.AlarmStatusChangedWildcard)) {
+		return errors.New("the wildcard subjects overlap: " + n.AlarmStatusChangedWildcard + ", " + n.SendAlarmDigestWildcard)
+	}
+
+	return nil
+}
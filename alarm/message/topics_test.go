@@ -0,0 +1,172 @@
+package message
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTopicNames_shardAndUserIdOfTheSubject(t *testing.T) {
+
+	// given
+	topics := DefaultTopicNames()
+	topics.ShardPattern = "{subject}_shard.{shard}"
+
+
+	// when
+	shard := topics.Shard("alerts.v1.status_changed", 3)
+	last := topics.UserIdOf("alerts.v1.status_changed.u1")
+	topics.UserIdToken = 3
+	fourth := topics.UserIdOf("alerts.v1.status_changed.u2.critical")
+	missing := topics.UserIdOf("alerts.v1")
+
+
+	// then
+	if shard != "alerts.v1.status_changed_shard.3" {
+		t.Errorf("invalid shard subject: %v", shard)
+	}
+	if last != "u1" || fourth != "u2" || missing != "" {
+		t.Errorf("invalid user ids of the subjects: %v, %v, %q", last, fourth, missing)
+	}
+}
+
+func TestTopicNames_validate(t *testing.T) {
+
+	valid := DefaultTopicNames()
+	valid.AlarmStatusChanged = "alerts.v1.status_changed"
+	valid.ShardPattern = "{subject}_shard.{shard}"
+	valid.AlarmStatusChangedWildcard = "alerts.v1.status_changed.>"
+	if err := valid.Validate(2); err != nil {
+		t.Errorf("expected valid subjects, got: %v", err)
+	}
+
+	overlapping := valid
+	overlapping.DeadLetter = "alerts.v1.status_changed.dead_letter"
+	if err := overlapping.Validate(2); err == nil {
+		t.Errorf("expected the wildcard to overlap the dead-letter subject")
+	}
+
+	noShard := valid
+	noShard.ShardPattern = "{subject}"
+	if err := noShard.Validate(2); err == nil {
+		t.Errorf("expected the shard pattern without {shard} to be invalid")
+	}
+
+	wildcardSubject := valid
+	wildcardSubject.AlarmDigest = "alerts.v1.*"
+	if err := wildcardSubject.Validate(2); err == nil {
+		t.Errorf("expected a subject with a wildcard to be invalid")
+	}
+
+	sameSubject := valid
+	sameSubject.AlarmQueryStats = sameSubject.AlarmHistoryQuery
+	if err := sameSubject.Validate(2); err == nil {
+		t.Errorf("expected the same subject of two topics to be invalid")
+	}
+
+	shardSubject := valid
+	shardSubject.AlarmDigest = "alerts.v1.status_changed_shard.1"
+	if err := shardSubject.Validate(2); err == nil {
+		t.Errorf("expected the subject of a shard to be invalid for another topic")
+	}
+}
+
+// Note: the example of the README and config.properties, with the shipped defaults.
+func TestTopicNames_validateDefaultsAcceptTheWildcardExample(t *testing.T) {
+
+	// given
+	topics := DefaultTopicNames()
+	topics.AlarmStatusChanged = "alerts.v1.status_changed"
+	topics.AlarmStatusChangedWildcard = "alerts.v1.status_changed.>"
+
+
+	// when
+	err := topics.Validate(4)
+
+
+	// then
+	if err != nil {
+		t.Errorf("expected the wildcard example to be valid with the default shard pattern, got: %v", err)
+	}
+}
+
+/*
+	Scenario:
+
+	* the subjects are configured, with a wildcard subscription for AlarmStatusChanged and a dead-letter subject
+	* a message without UserID is published to the subject of a user
+	* a bad formatted message is published to a shard
+*/
+func TestRegisterWildcardTopicListeners_userIdOfTheSubjectAndDeadLetter(t *testing.T) {
+
+	// given
+	topics := DefaultTopicNames()
+	topics.AlarmStatusChanged = "alerts.v1.status_changed"
+	topics.AlarmStatusChangedWildcard = "alerts.v1.status_changed.>"
+	topics.DeadLetter = "alerts.v1.dead_letter"
+	SetTopicNames(topics)
+	defer SetTopicNames(DefaultTopicNames())
+
+	transport := InMemoryTransportCreateNew()
+	alarmStatusChangedMessagesChan := make(chan AlarmStatusChangedMessage, 10)
+	sendAlarmDigestMessagesChan := make(chan SendAlarmDigestMessage, 10)
+
+	shardSubscriptions := RegisterAlarmStatusChangedTopicListeners("test", 1, transport, alarmStatusChangedMessagesChan, false, true)
+	alarmStatusChangedSubscriptions, sendAlarmDigestSubscriptions := RegisterWildcardTopicListeners("test", 1, 1, transport,
+		alarmStatusChangedMessagesChan, sendAlarmDigestMessagesChan, true)
+	defer func() {
+		for _, subscription := range append(append(shardSubscriptions, alarmStatusChangedSubscriptions...), sendAlarmDigestSubscriptions...) {
+			AsyncUnsubscribe(subscription, subscription.Subject())
+		}
+	}()
+
+	deadLetters := make(chan *TransportMessage, 10)
+	deadLetterSubscription := AsyncSubscribe(transport, topics.DeadLetter, func(msg *TransportMessage) {
+		deadLetters <- msg
+	})
+	defer AsyncUnsubscribe(deadLetterSubscription, topics.DeadLetter)
+
+
+	// when
+	publishJson(t, transport, "alerts.v1.status_changed.u1", AlarmStatusChangedMessage{AlarmId: "a1", Status: "CRITICAL", ChangedAt: time.Now()})
+	publishJson(t, transport, "alerts.v1.status_changed.0", AlarmStatusChangedMessage{UserId: "u2", AlarmId: "a2", Status: "CRITICAL", ChangedAt: time.Now()})
+	_ = transport.Publish(&TransportMessage{Subject: "alerts.v1.status_changed.0", Data: []byte("{not json")})
+	transport.WaitIdle()
+
+
+	// then
+	if len(alarmStatusChangedSubscriptions) != 1 || len(sendAlarmDigestSubscriptions) != 0 {
+		t.Fatalf("expected only the AlarmStatusChanged wildcard to be subscribed")
+	}
+
+	select {
+	case msg := <-alarmStatusChangedMessagesChan:
+		if msg.UserId != "u1" || msg.AlarmId != "a1" {
+			t.Errorf("expected the user id of the subject, got: %v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the message of the wildcard subject was not received")
+	}
+
+	// Note: the message of the shard is received once, by the listener of the shard and not by the wildcard.
+	select {
+	case msg := <-alarmStatusChangedMessagesChan:
+		if msg.UserId != "u2" || msg.AlarmId != "a2" {
+			t.Errorf("expected the message of the shard, got: %v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the message of the shard was not received")
+	}
+
+	select {
+	case msg := <-deadLetters:
+		if msg.Header.Get(DeadLetterSubjectHeader) != "alerts.v1.status_changed.0" || len(msg.Header.Get(DeadLetterReasonHeader)) == 0 || string(msg.Data) != "{not json" {
+			t.Errorf("invalid dead letter: %v, header: %v", string(msg.Data), msg.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the bad formatted message was not published to the dead-letter subject")
+	}
+
+	if len(alarmStatusChangedMessagesChan) != 0 || len(deadLetters) != 0 {
+		t.Errorf("the messages of the shard should be received only by the listener of the shard")
+	}
+}
@@ -3,11 +3,14 @@ package message
 import (
 	"alarm/domain"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
-	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
 	"math/rand"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,70 +27,195 @@ import (
 
 */
 
-func EmulateTraffic(shots int, serverConnection *nats.Conn, alarmStatusChangedListeners int, sendAlarmDigestListeners int, bursts int, waitTimeInMs int64) {
+func EmulateTraffic(shots int, transport Transport, alarmStatusChangedListeners int, sendAlarmDigestListeners int, bursts int, waitTimeInMs int64) {
+	EmulateTrafficWith(transport, EmulationOptions{
+		Shots:                       shots,
+		Bursts:                      bursts,
+		WaitTimeInMs:                waitTimeInMs,
+		StatusMix:                   map[domain.AlarmStatus]int{domain.CRITICAL: 1},
+		DigestPercent:               100,
+		AlarmStatusChangedListeners: alarmStatusChangedListeners,
+		SendAlarmDigestListeners:    sendAlarmDigestListeners,
+	})
+}
+
+
+type EmulationOptions struct {
+	Shots        int   // Note: -1 runs forever
+	Bursts       int   // the alarm status changes of every shot
+	WaitTimeInMs int64 // the pause between two shots
+
+	// Note: 0 picks a new user (and alarm) per status change, otherwise the status changes are spread over a fixed pool
+	//		 of users with AlarmsPerUser alarms each, so the same alarms get repeated updates (eg: CRITICAL --> CLEARED).
+	Users         int
+	AlarmsPerUser int
+
+	StatusMix     map[domain.AlarmStatus]int // the weights of the statuses, eg: CRITICAL=60, WARNING=30, CLEARED=10
+	DigestPercent int                        // the percent of the status changes which are followed by a digest request
+
+	AlarmStatusChangedListeners int
+	SendAlarmDigestListeners    int
+}
+
+func EmulateTrafficWith(transport Transport, options EmulationOptions) {
+
+	users := newEmulatedUsers(options.Users, options.AlarmsPerUser)
+	pickStatus := statusPicker(options.StatusMix)
+
+	// Note: a finite emulation returns once all of its messages have been published.
+	var bursts sync.WaitGroup
+	defer bursts.Wait()
 
 	currentShot := 0
 
 	for {
 
-		if shots < 0 {
+		if options.Shots < 0 {
 			// we run forever
 		} else {
-			if currentShot >= shots {
+			if currentShot >= options.Shots {
 				break
 			}
 			currentShot++
 		}
 
-		for i:=0; i<bursts; i++ {
+		for i:=0; i<options.Bursts; i++ {
+			bursts.Add(1)
 			go func() {
+				defer bursts.Done()
 
-				alarmId, _ := uuid.NewUUID()
-				userId, _ := uuid.NewUUID()
+				userId, alarmId := users.pick()
 
-				_, _ = EmulateAlarmStatusChangedMessage(serverConnection, &domain.Alarm{
-					Id:        domain.AlarmId(alarmId.String()),
-					UserId:    domain.UserId(userId.String()),
-					Status:    domain.CRITICAL,
+				_, _ = EmulateAlarmStatusChangedMessage(transport, &domain.Alarm{
+					Id:        domain.AlarmId(alarmId),
+					UserId:    domain.UserId(userId),
+					Status:    pickStatus(),
 					CreatedAt: time.Now(),
-				}, time.Now(), alarmStatusChangedListeners)
+				}, time.Now(), options.AlarmStatusChangedListeners)
 
-				_, _ = EmulateSendAlarmDigestMessage(serverConnection, userId.String(), sendAlarmDigestListeners)
+				if rand.Intn(100) < options.DigestPercent {
+					_, _ = EmulateSendAlarmDigestMessage(transport, userId, options.SendAlarmDigestListeners)
+				}
 
 			}()
 		}
 
-		time.Sleep(time.Millisecond * time.Duration(waitTimeInMs))
+		time.Sleep(time.Millisecond * time.Duration(options.WaitTimeInMs))
 	}
 }
 
+// ParseStatusMix parses the weights of the statuses, eg: CRITICAL=60,WARNING=30,CLEARED=10
+func ParseStatusMix(value string) (map[domain.AlarmStatus]int, error) {
+	mix := make(map[domain.AlarmStatus]int)
+	total := 0
 
-func EmulateAlarmStatusChangedMessage(conn *nats.Conn, alarm *domain.Alarm, changedAt time.Time, totalListeners int) ([]byte, error) {
+	for _, entry := range strings.Split(value, ",") {
+		statusAndWeight := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(statusAndWeight) != 2 {
+			return nil, fmt.Errorf("status mix: %q is not in status=weight form", entry)
+		}
 
-	dataToSerialize := map[string]interface{}{}
+		status := domain.ExtractAlarmStatus(strings.ToUpper(strings.TrimSpace(statusAndWeight[0])))
+		if status == domain.UNKNOWN {
+			return nil, fmt.Errorf("status mix: unknown status %q", statusAndWeight[0])
+		}
 
-	dataToSerialize["AlarmID"] = alarm.Id
-	dataToSerialize["UserID"] = alarm.UserId
-	dataToSerialize["Status"] = alarm.Status
-	dataToSerialize["ChangedAt"] = changedAt.Format(time.RFC3339)
+		weight, err := strconv.Atoi(strings.TrimSpace(statusAndWeight[1]))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("status mix: invalid weight %q", statusAndWeight[1])
+		}
+
+		mix[status] = weight
+		total += weight
+	}
+
+	if total == 0 {
+		return nil, errors.New("status mix: at least one status needs a positive weight")
+	}
+	return mix, nil
+}
+
+func statusPicker(mix map[domain.AlarmStatus]int) func() domain.AlarmStatus {
+
+	// Note: fixed order, so the same mix always maps the random numbers to the same statuses.
+	statuses := make([]domain.AlarmStatus, 0, len(mix))
+	total := 0
+	for _, status := range []domain.AlarmStatus{domain.CRITICAL, domain.WARNING, domain.CLEARED} {
+		if mix[status] > 0 {
+			statuses = append(statuses, status)
+			total += mix[status]
+		}
+	}
+
+	if total == 0 {
+		return func() domain.AlarmStatus { return domain.CRITICAL }
+	}
+
+	return func() domain.AlarmStatus {
+		n := rand.Intn(total)
+		for _, status := range statuses {
+			if n < mix[status] {
+				return status
+			}
+			n -= mix[status]
+		}
+		return statuses[len(statuses)-1]
+	}
+}
+
+type emulatedUsers struct {
+	userIds  []string
+	alarmIds [][]string
+}
 
-	serializedInfo, err := json.Marshal(dataToSerialize)
+func newEmulatedUsers(users int, alarmsPerUser int) *emulatedUsers {
+	if alarmsPerUser < 1 {
+		alarmsPerUser = 1
+	}
+
+	pool := &emulatedUsers{}
+	for i := 0; i < users; i++ {
+		alarmIds := make([]string, 0, alarmsPerUser)
+		for j := 0; j < alarmsPerUser; j++ {
+			alarmIds = append(alarmIds, uuid.NewString())
+		}
+
+		pool.userIds = append(pool.userIds, uuid.NewString())
+		pool.alarmIds = append(pool.alarmIds, alarmIds)
+	}
+	return pool
+}
+
+// pick returns a user and one of its alarms, a new user and alarm when there is no pool.
+func (u *emulatedUsers) pick() (string, string) {
+	if len(u.userIds) == 0 {
+		return uuid.NewString(), uuid.NewString()
+	}
+
+	i := rand.Intn(len(u.userIds))
+	return u.userIds[i], u.alarmIds[i][rand.Intn(len(u.alarmIds[i]))]
+}
+
+
+func EmulateAlarmStatusChangedMessage(transport Transport, alarm *domain.Alarm, changedAt time.Time, totalListeners int) ([]byte, error) {
+
+	serializedInfo, err := alarmStatusChangedPayload(alarm, changedAt)
 	if err != nil {
 		log.Error("error during json marshalling, error: ", err)
 		return nil, err
 	}
 
 	listenerId := rand.Intn(totalListeners)
-	topicName := AlarmStatusChangedTopic + "." + strconv.Itoa(listenerId)
+	topicName := Topics().Shard(Topics().AlarmStatusChanged, listenerId)
 
-	pubErr := PublishMessage(conn, topicName, serializedInfo)
+	pubErr := PublishMessage(transport, topicName, serializedInfo)
 	if pubErr != nil {
 		log.Error("error during publish message, error: ", pubErr)
 		return nil, pubErr
 	}
 
 
-	pubErr2 := PublishMessage(conn, AlarmStatusChangedTopic, serializedInfo)
+	pubErr2 := PublishMessage(transport, Topics().AlarmStatusChanged, serializedInfo)
 	if pubErr2 != nil {
 		log.Error("error during publish message, error: ", pubErr)
 		return nil, pubErr2
@@ -96,28 +224,25 @@ func EmulateAlarmStatusChangedMessage(conn *nats.Conn, alarm *domain.Alarm, chan
 	return serializedInfo, nil
 }
 
-func EmulateSendAlarmDigestMessage(conn *nats.Conn, userId string, totalListeners int) ([]byte, error) {
+func EmulateSendAlarmDigestMessage(transport Transport, userId string, totalListeners int) ([]byte, error) {
 
-	dataToSerialize := map[string]interface{}{}
-	dataToSerialize["UserID"] = userId
-
-	serializedInfo, err := json.Marshal(dataToSerialize)
+	serializedInfo, err := sendAlarmDigestPayload(userId)
 	if err != nil {
 		log.Error("error during json marshalling, error: ", err)
 		return nil, err
 	}
 
 	listenerId := rand.Intn(totalListeners)
-	topicName := SendAlarmDigestTopic + "." + strconv.Itoa(listenerId)
+	topicName := Topics().Shard(Topics().SendAlarmDigest, listenerId)
 
-	pubErr := PublishMessage(conn, topicName, serializedInfo)
+	pubErr := PublishMessage(transport, topicName, serializedInfo)
 	if pubErr != nil {
 		log.Error("error during publish message, error: ", pubErr)
 		return nil, pubErr
 	}
 
 
-	pubErr2 := PublishMessage(conn, SendAlarmDigestTopic, serializedInfo)
+	pubErr2 := PublishMessage(transport, Topics().SendAlarmDigest, serializedInfo)
 	if pubErr2 != nil {
 		log.Error("error during publish message, error: ", pubErr)
 		return nil, pubErr2
@@ -127,5 +252,36 @@ func EmulateSendAlarmDigestMessage(conn *nats.Conn, userId string, totalListener
 	return serializedInfo, nil
 }
 
+// EmulateRecordedMessage publishes a message as it was recorded (see trafficRecorders.go), to its original topic.
+func EmulateRecordedMessage(transport Transport, topicName string, payload []byte, correlationId string) error {
 
+	var pubErr error
+	if len(correlationId) > 0 {
+		pubErr = PublishMessageWithCorrelationId(transport, topicName, payload, correlationId)
+	} else {
+		pubErr = PublishMessage(transport, topicName, payload)
+	}
 
+	if pubErr != nil {
+		log.Error("error during publish message, error: ", pubErr)
+	}
+	return pubErr
+}
+
+func alarmStatusChangedPayload(alarm *domain.Alarm, changedAt time.Time) ([]byte, error) {
+	dataToSerialize := map[string]interface{}{}
+
+	dataToSerialize["AlarmID"] = alarm.Id
+	dataToSerialize["UserID"] = alarm.UserId
+	dataToSerialize["Status"] = alarm.Status
+	dataToSerialize["ChangedAt"] = changedAt.Format(time.RFC3339)
+
+	return json.Marshal(dataToSerialize)
+}
+
+func sendAlarmDigestPayload(userId string) ([]byte, error) {
+	dataToSerialize := map[string]interface{}{}
+	dataToSerialize["UserID"] = userId
+
+	return json.Marshal(dataToSerialize)
+}
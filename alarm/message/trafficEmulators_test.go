@@ -0,0 +1,34 @@
+package message
+
+import (
+	"alarm/domain"
+	"testing"
+)
+
+func TestParseStatusMix(t *testing.T) {
+
+	mix, err := ParseStatusMix("critical=60, WARNING=30,CLEARED=10")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mix[domain.CRITICAL] != 60 || mix[domain.WARNING] != 30 || mix[domain.CLEARED] != 10 {
+		t.Errorf("unexpected mix: %v", mix)
+	}
+
+	for _, invalid := range []string{"CRITICAL", "UNKNOWN=1", "CRITICAL=-1", "CRITICAL=0"} {
+		if _, err := ParseStatusMix(invalid); err == nil {
+			t.Errorf("%q should have been rejected", invalid)
+		}
+	}
+}
+
+func TestStatusPicker_followsTheWeights(t *testing.T) {
+
+	pick := statusPicker(map[domain.AlarmStatus]int{domain.WARNING: 1})
+
+	for i := 0; i < 100; i++ {
+		if status := pick(); status != domain.WARNING {
+			t.Fatalf("only warnings should have been picked, got: %v", status)
+		}
+	}
+}
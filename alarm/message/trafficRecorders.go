@@ -0,0 +1,259 @@
+package message
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Record & replay of the input traffic of the service, to reproduce issues seen in production.
+
+	The recorder subscribes to the input topics (AlarmStatusChanged, SendAlarmDigest) and appends every message as a
+	json line (gzip compressed when the file ends with .gz):
+
+		{"t":1520,"s":"AlarmStatusChanged","c":"<correlation id>","d":{"AlarmID":"...","UserID":"...",...}}
+
+		t --> microseconds since the start of the recording
+		s --> the subject
+		c --> the Correlation-Id header (if any)
+		d --> the payload, as is when it is json, otherwise r --> the payload base64 encoded
+
+	The replayer republishes the messages (see EmulateRecordedMessage) preserving their relative
+	timing divided by the speed, optionally with the user ids anonymized: every user id is replaced by a
+	uuid derived from it and a salt, so the messages of a user still end up together (same worker, same digest).
+*/
+
+type TrafficRecord struct {
+	At            int64           `json:"t"`
+	Subject       string          `json:"s"`
+	CorrelationId string          `json:"c,omitempty"`
+	Data          json.RawMessage `json:"d,omitempty"`
+	Raw           []byte          `json:"r,omitempty"` // Note: payloads which are not json
+}
+
+func (r *TrafficRecord) payload() []byte {
+	if len(r.Data) > 0 {
+		return r.Data
+	}
+	return r.Raw
+}
+
+type TrafficRecorder struct {
+	mutex sync.Mutex
+
+	transport Transport
+	subjects  []string
+
+	file       *os.File
+	compressor *gzip.Writer
+	writer     *bufio.Writer
+
+	startedAt     time.Time
+	subscriptions []TransportSubscription
+	recorded      int64
+}
+
+func TrafficRecorderCreateNew(transport Transport, filename string, subjects []string) (*TrafficRecorder, error) {
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &TrafficRecorder{transport: transport, subjects: subjects, file: file}
+
+	if strings.HasSuffix(filename, ".gz") {
+		recorder.compressor = gzip.NewWriter(file)
+		recorder.writer = bufio.NewWriter(recorder.compressor)
+	} else {
+		recorder.writer = bufio.NewWriter(file)
+	}
+
+	return recorder, nil
+}
+
+func (r *TrafficRecorder) Start() {
+	r.startedAt = time.Now()
+
+	for _, subject := range r.subjects {
+		r.subscriptions = append(r.subscriptions, AsyncSubscribe(r.transport, subject, r.record))
+	}
+	log.Infof("recording traffic of: %v\n", r.subjects)
+}
+
+// Stop unsubscribes and flushes the recording to the file.
+func (r *TrafficRecorder) Stop() error {
+	for _, sub := range r.subscriptions {
+		AsyncUnsubscribe(sub, sub.Subject())
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err := r.writer.Flush()
+	if r.compressor != nil {
+		err = firstError(err, r.compressor.Close())
+	}
+	return firstError(err, r.file.Close())
+}
+
+// Recorded the number of the recorded messages
+func (r *TrafficRecorder) Recorded() int64 {
+	return atomic.LoadInt64(&r.recorded)
+}
+
+func (r *TrafficRecorder) record(msg *TransportMessage) {
+
+	record := TrafficRecord{
+		At:            time.Since(r.startedAt).Microseconds(),
+		Subject:       msg.Subject,
+		CorrelationId: msg.Header.Get(CorrelationIdHeader),
+	}
+	if json.Valid(msg.Data) {
+		record.Data = msg.Data
+	} else {
+		record.Raw = msg.Data
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Error("could not record message, error: ", err)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.writer.Write(append(line, '\n')); err != nil {
+		log.Error("could not record message, error: ", err)
+		return
+	}
+	atomic.AddInt64(&r.recorded, 1)
+}
+
+func firstError(err error, other error) error {
+	if err != nil {
+		return err
+	}
+	return other
+}
+
+
+// ------------------- replay -------------------
+
+type TrafficReplayOptions struct {
+	Speed          float64 // Note: 1 replays in real time, 2 twice as fast, 0 without pauses
+	AnonymizeUsers bool
+	AnonymizeSalt  string // Note: the same salt maps a user id to the same anonymous id
+}
+
+// ReplayTraffic republishes a recording, returns the number of the replayed messages.
+func ReplayTraffic(transport Transport, filename string, options TrafficReplayOptions) (int, error) {
+
+	reader, closeReader, err := openRecording(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer closeReader()
+
+	startedAt := time.Now()
+	replayed := 0
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+
+		var record TrafficRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return replayed, fmt.Errorf("recording: %v, line: %v, error: %w", filename, line, err)
+		}
+
+		if options.Speed > 0 {
+			due := startedAt.Add(time.Duration(float64(time.Duration(record.At)*time.Microsecond) / options.Speed))
+			time.Sleep(time.Until(due))
+		}
+
+		payload := record.payload()
+		if options.AnonymizeUsers {
+			payload = anonymizeUser(payload, options.AnonymizeSalt)
+		}
+
+		if err := EmulateRecordedMessage(transport, record.Subject, payload, record.CorrelationId); err != nil {
+			return replayed, fmt.Errorf("recording: %v, line: %v, could not publish, error: %w", filename, line, err)
+		}
+		replayed++
+	}
+
+	return replayed, scanner.Err()
+}
+
+// openRecording opens a plain or a gzip compressed recording (detected by its content, not its name).
+func openRecording(filename string) (io.Reader, func(), error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	magic, _ := buffered.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		decompressor, err := gzip.NewReader(buffered)
+		if err != nil {
+			_ = file.Close()
+			return nil, nil, errors.New("recording: " + filename + " is not a valid gzip file, error: " + err.Error())
+		}
+		return decompressor, func() {
+			_ = decompressor.Close()
+			_ = file.Close()
+		}, nil
+	}
+
+	return buffered, func() {
+		_ = file.Close()
+	}, nil
+}
+
+var anonymousUserNamespace = uuid.MustParse("6f0c4a3e-8d7e-4c59-9f39-5d6f1b1a2c10")
+
+// anonymizeUser replaces the UserID of a json payload, the rest of the payload is kept as is.
+func anonymizeUser(payload []byte, salt string) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+
+	for key, value := range fields {
+		if !strings.EqualFold(key, "UserID") {
+			continue
+		}
+
+		var userId string
+		if err := json.Unmarshal(value, &userId); err != nil {
+			continue
+		}
+		fields[key], _ = json.Marshal(AnonymousUserId(userId, salt))
+	}
+
+	anonymized, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return anonymized
+}
+
+// AnonymousUserId the anonymous id of a user id, the same for the same user id & salt.
+func AnonymousUserId(userId string, salt string) string {
+	return uuid.NewSHA1(anonymousUserNamespace, []byte(salt+userId)).String()
+}
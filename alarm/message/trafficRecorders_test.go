@@ -0,0 +1,83 @@
+package message
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficRecorder_recordAndReplay(t *testing.T) {
+
+	// given - a recording of a status change (with correlation id), a digest request and a non json message
+	recordedTransport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = recordedTransport.Drain()
+	}()
+
+	filename := filepath.Join(t.TempDir(), "traffic.jsonl.gz")
+	recorder, err := TrafficRecorderCreateNew(recordedTransport, filename, []string{AlarmStatusChangedTopic, SendAlarmDigestTopic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Start()
+
+	_ = PublishMessageWithCorrelationId(recordedTransport, AlarmStatusChangedTopic,
+		[]byte(`{"AlarmID":"a1","UserID":"u1","Status":"CRITICAL","ChangedAt":"2021-06-07T20:40:15.598765212Z"}`), "c1")
+	time.Sleep(20 * time.Millisecond)
+	_ = PublishMessage(recordedTransport, SendAlarmDigestTopic, []byte(`{"UserID":"u1"}`))
+	_ = PublishMessage(recordedTransport, SendAlarmDigestTopic, []byte(`not json`))
+	recordedTransport.WaitIdle()
+
+	if err := recorder.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Recorded() != 3 {
+		t.Fatalf("expected 3 recorded messages, got: %v", recorder.Recorded())
+	}
+
+
+	// when
+	replayTransport := InMemoryTransportCreateNew()
+	defer func() {
+		_ = replayTransport.Drain()
+	}()
+
+	var replayedMessages []*TransportMessage
+	AsyncSubscribe(replayTransport, ">", func(msg *TransportMessage) {
+		replayedMessages = append(replayedMessages, msg)
+	})
+
+	startedAt := time.Now()
+	replayed, err := ReplayTraffic(replayTransport, filename, TrafficReplayOptions{Speed: 2, AnonymizeUsers: true, AnonymizeSalt: "salt"})
+	replayTransport.WaitIdle()
+
+
+	// then
+	if err != nil || replayed != 3 || len(replayedMessages) != 3 {
+		t.Fatalf("expected 3 replayed messages, got: %v (%v), error: %v", replayed, len(replayedMessages), err)
+	}
+	if time.Since(startedAt) < 10*time.Millisecond {
+		t.Errorf("the relative timing (20ms at 2x) should have been preserved, took: %v", time.Since(startedAt))
+	}
+
+	statusChanged := replayedMessages[0]
+	if statusChanged.Subject != AlarmStatusChangedTopic || statusChanged.Header.Get(CorrelationIdHeader) != "c1" {
+		t.Errorf("unexpected message: %+v", statusChanged)
+	}
+
+	var statusChangedData, digestRequestData map[string]string
+	_ = json.Unmarshal(statusChanged.Data, &statusChangedData)
+	_ = json.Unmarshal(replayedMessages[1].Data, &digestRequestData)
+
+	anonymousUserId := AnonymousUserId("u1", "salt")
+	if statusChangedData["UserID"] != anonymousUserId || digestRequestData["UserID"] != anonymousUserId {
+		t.Errorf("the user should have been anonymized (the same way), got: %v, %v", statusChangedData, digestRequestData)
+	}
+	if statusChangedData["ChangedAt"] != "2021-06-07T20:40:15.598765212Z" || statusChangedData["AlarmID"] != "a1" {
+		t.Errorf("the rest of the payload should have been kept, got: %v", statusChangedData)
+	}
+	if string(replayedMessages[2].Data) != "not json" {
+		t.Errorf("non json payloads should have been replayed as is, got: %v", string(replayedMessages[2].Data))
+	}
+}
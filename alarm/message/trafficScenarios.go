@@ -0,0 +1,280 @@
+package message
+
+import (
+	"alarm/domain"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+	"os"
+	"time"
+)
+
+/*
+	A scenario is a timeline of alarm status changes and digest requests of a few users, plus the digests the service
+	should produce for them. The scenario files are YAML (or JSON, which is valid YAML):
+
+		scenarios:
+		  - name: latest status wins, oldest change first
+		    steps:
+		      - {user: U, alarm: a1, status: WARNING}
+		      - {user: U, alarm: a2, status: CRITICAL, after: 1m}   # 1 minute after the previous step
+		      - {after: 30s}                                         # a pause
+		      - {user: U, alarm: a1, status: CRITICAL}
+		      - {user: U, digest: true}
+		    expected:
+		      - user: U
+		        alarms:
+		          - {alarm: a2, status: CRITICAL}
+		          - {alarm: a1, status: CRITICAL}
+
+	* users & alarms are symbolic (eg: "U", "a1"), they get fresh ids on every replay, so the scenarios do not interfere
+	  with each other (or with other traffic) and can be repeated against the same service
+	* after     --> the scenario time since the previous step (default: 1s), the ChangedAt of every status change is
+	                start + scenario time (second precision, as it travels as RFC3339)
+	* expected  --> the digests in the order they should be received, the users of the steps which are not listed
+	                should receive no digest (eg: all of their alarms got cleared)
+
+	Replay speed: the real pause before every step is after / speed (1 --> real time, 60 --> a minute per second,
+	0 --> no pauses), but never less than the step delay, so the service applies the steps in order.
+*/
+
+const defaultStepAfter = time.Second
+
+type VerificationStep struct {
+	User   string             `yaml:"user"`
+	Alarm  string             `yaml:"alarm"`  // Note: a status change of the alarm
+	Status domain.AlarmStatus `yaml:"status"`
+	Digest bool               `yaml:"digest"` // Note: a digest request of the user
+	After  *time.Duration     `yaml:"after"`  // Note: a step without alarm and digest is just a pause
+}
+
+type ExpectedAlarm struct {
+	Alarm  string             `yaml:"alarm"`
+	Status domain.AlarmStatus `yaml:"status"`
+}
+
+type ExpectedDigest struct {
+	User   string          `yaml:"user"`
+	Alarms []ExpectedAlarm `yaml:"alarms"`
+}
+
+type VerificationScenario struct {
+	Name     string             `yaml:"name"`
+	Steps    []VerificationStep `yaml:"steps"`
+	Expected []ExpectedDigest   `yaml:"expected"`
+}
+
+type ReplayOptions struct {
+	Speed     float64       // Note: 1 replays in real time, 0 without pauses
+	StepDelay time.Duration // the minimum pause between the steps
+}
+
+func AlarmChange(user string, alarm string, status domain.AlarmStatus) VerificationStep {
+	return VerificationStep{User: user, Alarm: alarm, Status: status}
+}
+
+func DigestRequest(user string) VerificationStep {
+	return VerificationStep{User: user, Digest: true}
+}
+
+func Pause(after time.Duration) VerificationStep {
+	return VerificationStep{After: &after}
+}
+
+func (step VerificationStep) after() time.Duration {
+	if step.After == nil {
+		return defaultStepAfter
+	}
+	return *step.After
+}
+
+
+// ------------------- scenario files -------------------
+
+type scenarioFile struct {
+	Scenarios []VerificationScenario `yaml:"scenarios"`
+}
+
+// LoadScenarios reads and validates the scenarios of a YAML or JSON file.
+func LoadScenarios(filename string) ([]VerificationScenario, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file scenarioFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("scenario file: %v, error: %w", filename, err)
+	}
+	if len(file.Scenarios) == 0 {
+		return nil, errors.New("scenario file: " + filename + " has no scenarios")
+	}
+
+	for i, scenario := range file.Scenarios {
+		if err := scenario.Validate(); err != nil {
+			return nil, fmt.Errorf("scenario file: %v, scenario #%v, error: %w", filename, i, err)
+		}
+	}
+	return file.Scenarios, nil
+}
+
+// Validate checks that the steps are complete and the expected digests refer to users & alarms of the steps.
+func (scenario VerificationScenario) Validate() error {
+	if len(scenario.Name) == 0 {
+		return errors.New("name is required")
+	}
+
+	alarms := make(map[string]bool) // Note: by user + alarm
+	users := make(map[string]bool)
+
+	for i, step := range scenario.Steps {
+		if step.After != nil && *step.After < 0 {
+			return fmt.Errorf("%v: step %v: negative after", scenario.Name, i)
+		}
+
+		switch {
+		case len(step.Alarm) > 0 && step.Digest:
+			return fmt.Errorf("%v: step %v: either an alarm status change or a digest request", scenario.Name, i)
+
+		case len(step.Alarm) > 0:
+			if domain.ExtractAlarmStatus(string(step.Status)) == domain.UNKNOWN {
+				return fmt.Errorf("%v: step %v: unknown status %q", scenario.Name, i, step.Status)
+			}
+			alarms[step.User+"/"+step.Alarm] = true
+
+		case !step.Digest:
+			if len(step.User) > 0 || len(step.Status) > 0 {
+				return fmt.Errorf("%v: step %v: user or status without an alarm or a digest", scenario.Name, i)
+			}
+			continue
+		}
+
+		if len(step.User) == 0 {
+			return fmt.Errorf("%v: step %v: user is required", scenario.Name, i)
+		}
+		users[step.User] = true
+	}
+
+	for _, expected := range scenario.Expected {
+		if !users[expected.User] {
+			return fmt.Errorf("%v: expected digest of unknown user %q", scenario.Name, expected.User)
+		}
+		for _, alarm := range expected.Alarms {
+			if !alarms[expected.User+"/"+alarm.Alarm] {
+				return fmt.Errorf("%v: expected unknown alarm %q of user %q", scenario.Name, alarm.Alarm, expected.User)
+			}
+		}
+	}
+	return nil
+}
+
+
+// ------------------- replay -------------------
+
+// ReplayScenario publishes the steps of the scenario to the input topics of the service, without assertions.
+func ReplayScenario(transport Transport, scenario VerificationScenario, options ReplayOptions) error {
+	_, err := replayScenario(transport, scenario, options)
+	return err
+}
+
+// scenarioRun maps the symbols of a replayed scenario to the ids and timestamps that were published.
+type scenarioRun struct {
+	users           map[string]string    // Note: symbol --> user id
+	alarms          map[string]string    // Note: user/alarm symbol --> alarm id
+	latestChangedAt map[string]time.Time // Note: user/alarm symbol --> ChangedAt of its latest status change
+}
+
+func replayScenario(transport Transport, scenario VerificationScenario, options ReplayOptions) (*scenarioRun, error) {
+
+	run := &scenarioRun{
+		users:           make(map[string]string),
+		alarms:          make(map[string]string),
+		latestChangedAt: make(map[string]time.Time),
+	}
+
+	// Note: second precision, since ChangedAt travels as RFC3339.
+	start := time.Now().UTC().Truncate(time.Second)
+	scenarioTime := time.Duration(0)
+
+	for i, step := range scenario.Steps {
+
+		scenarioTime += step.after()
+		if i > 0 {
+			time.Sleep(options.pause(step.after()))
+		}
+
+		var payload []byte
+		var topic string
+		var err error
+
+		switch {
+		case step.Digest:
+			topic = Topics().SendAlarmDigest
+			payload, err = sendAlarmDigestPayload(run.userId(step.User))
+
+		case len(step.Alarm) > 0:
+			changedAt := start.Add(scenarioTime)
+			run.latestChangedAt[step.User+"/"+step.Alarm] = changedAt
+
+			topic = Topics().AlarmStatusChanged
+			payload, err = alarmStatusChangedPayload(&domain.Alarm{
+				Id:     domain.AlarmId(run.alarmId(step.User, step.Alarm)),
+				UserId: domain.UserId(run.userId(step.User)),
+				Status: step.Status,
+			}, changedAt)
+
+		default:
+			continue // Note: a pause
+		}
+
+		if err == nil {
+			err = PublishMessage(transport, topic, payload)
+		}
+		if err != nil {
+			return run, fmt.Errorf("step %v: could not publish, error: %w", i, err)
+		}
+	}
+
+	// Note: the last step gets processed before the digests are awaited.
+	time.Sleep(options.StepDelay)
+	return run, nil
+}
+
+func (options ReplayOptions) pause(after time.Duration) time.Duration {
+	pause := time.Duration(0)
+	if options.Speed > 0 {
+		pause = time.Duration(float64(after) / options.Speed)
+	}
+
+	if pause < options.StepDelay {
+		return options.StepDelay
+	}
+	return pause
+}
+
+func (run *scenarioRun) userId(user string) string {
+	if _, exists := run.users[user]; !exists {
+		run.users[user] = uuid.NewString()
+	}
+	return run.users[user]
+}
+
+func (run *scenarioRun) alarmId(user string, alarm string) string {
+	key := user + "/" + alarm
+	if _, exists := run.alarms[key]; !exists {
+		run.alarms[key] = uuid.NewString()
+	}
+	return run.alarms[key]
+}
+
+// userIds the ids of the users of the scenario, by symbol
+func (run *scenarioRun) userIds() map[string]string {
+	return run.users
+}
+
+// alarm returns the id and the latest ChangedAt of an alarm of the scenario.
+func (run *scenarioRun) alarm(user string, alarm string) (string, time.Time) {
+	key := user + "/" + alarm
+	return run.alarms[key], run.latestChangedAt[key]
+}
@@ -0,0 +1,102 @@
+package message
+
+import (
+	"alarm/domain"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testScenarioFile(t *testing.T, name string, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadScenarios_yamlAndJson(t *testing.T) {
+
+	// given
+	yamlFile := testScenarioFile(t, "s.yaml", `
+scenarios:
+  - name: escalation
+    steps:
+      - {user: U, alarm: a1, status: WARNING}
+      - {after: 30s}
+      - {user: U, alarm: a1, status: CRITICAL, after: 1m}
+      - {user: U, digest: true}
+    expected:
+      - user: U
+        alarms: [{alarm: a1, status: CRITICAL}]
+`)
+	jsonFile := testScenarioFile(t, "s.json", `{"scenarios": [{"name": "json", "steps": [{"user": "U", "digest": true}]}]}`)
+
+
+	// when
+	yamlScenarios, yamlErr := LoadScenarios(yamlFile)
+	jsonScenarios, jsonErr := LoadScenarios(jsonFile)
+
+
+	// then
+	if yamlErr != nil || jsonErr != nil {
+		t.Fatalf("unexpected errors: %v, %v", yamlErr, jsonErr)
+	}
+
+	steps := yamlScenarios[0].Steps
+	if len(steps) != 4 || steps[1].after() != 30*time.Second || steps[2].after() != time.Minute || steps[0].after() != defaultStepAfter {
+		t.Errorf("unexpected steps: %+v", steps)
+	}
+	if steps[2].Status != domain.CRITICAL || !steps[3].Digest {
+		t.Errorf("unexpected steps: %+v", steps)
+	}
+	if len(jsonScenarios) != 1 || jsonScenarios[0].Name != "json" {
+		t.Errorf("unexpected scenarios: %+v", jsonScenarios)
+	}
+}
+
+func TestLoadScenarios_rejectsInvalidScenarios(t *testing.T) {
+
+	invalid := map[string]string{
+		"unknown status":   `{user: U, alarm: a1, status: BROKEN}`,
+		"alarm and digest": `{user: U, alarm: a1, status: CRITICAL, digest: true}`,
+		"missing user":     `{alarm: a1, status: CRITICAL}`,
+		"negative after":   `{user: U, digest: true, after: -1s}`,
+	}
+
+	for reason, step := range invalid {
+		filename := testScenarioFile(t, "s.yaml", "scenarios:\n  - name: invalid\n    steps:\n      - "+step+"\n")
+
+		if _, err := LoadScenarios(filename); err == nil {
+			t.Errorf("%v should have been rejected", reason)
+		}
+	}
+
+	unknownAlarm := testScenarioFile(t, "s.yaml", `
+scenarios:
+  - name: invalid
+    steps:
+      - {user: U, alarm: a1, status: CRITICAL}
+    expected:
+      - {user: U, alarms: [{alarm: a2, status: CRITICAL}]}
+`)
+	if _, err := LoadScenarios(unknownAlarm); err == nil || !strings.Contains(err.Error(), "a2") {
+		t.Errorf("expected unknown alarm error, got: %v", err)
+	}
+}
+
+func TestReplayOptions_pause(t *testing.T) {
+
+	options := ReplayOptions{Speed: 60, StepDelay: 10 * time.Millisecond}
+	if pause := options.pause(time.Minute); pause != time.Second {
+		t.Errorf("a minute at 60x should take a second, got: %v", pause)
+	}
+	if pause := options.pause(0); pause != 10*time.Millisecond {
+		t.Errorf("the step delay is the minimum pause, got: %v", pause)
+	}
+	if pause := (ReplayOptions{}).pause(time.Hour); pause != 0 {
+		t.Errorf("speed 0 should not pause, got: %v", pause)
+	}
+}
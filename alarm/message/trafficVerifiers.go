@@ -0,0 +1,217 @@
+package message
+
+import (
+	"alarm/domain"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+/*
+	A local counterpart of the be-challenge verify tool: it publishes scenarios to the input topics of a running service
+	(the plain AlarmStatusChanged and SendAlarmDigest topics, the same as the real publishers) and asserts on the
+	AlarmDigest messages the service produces.
+
+	The scenarios are replayed by trafficScenarios.go (fresh ids per run, known ChangedAt), so the expected digests,
+	the order of their alarms (oldest to newest) and their LatestChangedAt are known up front.
+*/
+
+type VerificationOptions struct {
+	ReplayOptions
+	Timeout time.Duration // waiting for the expected digests
+	Grace   time.Duration // keep listening after the expected digests, to catch unexpected ones
+}
+
+type VerificationResult struct {
+	Scenario string
+	Passed   bool
+	Failures []string
+	Elapsed  time.Duration
+}
+
+
+// DefaultVerificationScenarios covers the specification of the service (the smoke test of the be-challenge verify tool and more).
+func DefaultVerificationScenarios() []VerificationScenario {
+	return []VerificationScenario{
+		{
+			Name: "smoke",
+			Steps: []VerificationStep{
+				AlarmChange("X", "a1", domain.CRITICAL),
+				AlarmChange("Y", "a2", domain.WARNING),
+				DigestRequest("X"),
+				DigestRequest("Y"),
+			},
+			Expected: []ExpectedDigest{
+				{User: "X", Alarms: []ExpectedAlarm{{"a1", domain.CRITICAL}}},
+				{User: "Y", Alarms: []ExpectedAlarm{{"a2", domain.WARNING}}},
+			},
+		},
+		{
+			Name: "cleared alarms are not sent",
+			Steps: []VerificationStep{
+				AlarmChange("Z", "a1", domain.CRITICAL),
+				AlarmChange("Z", "a1", domain.CLEARED),
+				DigestRequest("Z"),
+			},
+		},
+		{
+			Name: "latest status wins, oldest change first",
+			Steps: []VerificationStep{
+				AlarmChange("U", "a1", domain.WARNING),
+				AlarmChange("U", "a2", domain.CRITICAL),
+				AlarmChange("U", "a1", domain.CRITICAL),
+				DigestRequest("U"),
+			},
+			Expected: []ExpectedDigest{
+				{User: "U", Alarms: []ExpectedAlarm{{"a2", domain.CRITICAL}, {"a1", domain.CRITICAL}}},
+			},
+		},
+		{
+			Name: "alarms are sent once",
+			Steps: []VerificationStep{
+				AlarmChange("V", "a1", domain.CRITICAL),
+				DigestRequest("V"),
+				DigestRequest("V"),
+			},
+			Expected: []ExpectedDigest{
+				{User: "V", Alarms: []ExpectedAlarm{{"a1", domain.CRITICAL}}},
+			},
+		},
+		{
+			Name: "no active alarms, no digest",
+			Steps: []VerificationStep{
+				DigestRequest("W"),
+			},
+		},
+	}
+}
+
+
+// VerifyScenarios runs the scenarios one after the other against the service behind the transport.
+func VerifyScenarios(transport Transport, scenarios []VerificationScenario, options VerificationOptions) []VerificationResult {
+
+	collector := &digestCollector{received: make(map[string][]AlarmDigestMessage)}
+
+	sub := RegisterAlarmDigestTopicListener("verify", transport, Topics().AlarmDigest, true, collector.collect)
+	defer func() {
+		AsyncUnsubscribe(sub, sub.Subject())
+	}()
+
+	results := make([]VerificationResult, 0, len(scenarios))
+	for _, scenario := range scenarios {
+		results = append(results, verifyScenario(transport, collector, scenario, options))
+	}
+	return results
+}
+
+func verifyScenario(transport Transport, collector *digestCollector, scenario VerificationScenario, options VerificationOptions) VerificationResult {
+
+	startedAt := time.Now()
+	result := VerificationResult{Scenario: scenario.Name}
+
+	run, err := replayScenario(transport, scenario, options.ReplayOptions)
+	if err != nil {
+		result.Failures = append(result.Failures, err.Error())
+		result.Elapsed = time.Since(startedAt)
+		return result
+	}
+
+
+	// wait for the digests
+	expectedDigests := len(scenario.Expected)
+	deadline := time.Now().Add(options.Timeout)
+	for collector.count(run.userIds()) < expectedDigests && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(options.Grace)
+
+
+	// compare them
+	expectedByUser := make(map[string][]ExpectedDigest)
+	for _, expected := range scenario.Expected {
+		expectedByUser[expected.User] = append(expectedByUser[expected.User], expected)
+	}
+
+	for user, userId := range run.userIds() {
+		received := collector.take(userId)
+		expected := expectedByUser[user]
+
+		if len(received) != len(expected) {
+			result.Failures = append(result.Failures,
+				fmt.Sprintf("user %v: expected %v digest(s), received %v: %v", user, len(expected), len(received), received))
+			continue
+		}
+
+		for i := range expected {
+			result.Failures = append(result.Failures, compareDigest(user, expected[i], received[i], run)...)
+		}
+	}
+
+	result.Passed = len(result.Failures) == 0
+	result.Elapsed = time.Since(startedAt)
+
+	log.Debugf("verification scenario: %v, passed: %v, failures: %v\n", result.Scenario, result.Passed, result.Failures)
+	return result
+}
+
+func compareDigest(user string, expected ExpectedDigest, received AlarmDigestMessage, run *scenarioRun) []string {
+
+	if len(expected.Alarms) != len(received.ActiveAlarms) {
+		return []string{fmt.Sprintf("user %v: expected %v active alarm(s), received %v: %v",
+			user, len(expected.Alarms), len(received.ActiveAlarms), received.ActiveAlarms)}
+	}
+
+	var failures []string
+	for i, expectedAlarm := range expected.Alarms {
+		receivedAlarm := received.ActiveAlarms[i]
+		alarmId, changedAt := run.alarm(user, expectedAlarm.Alarm)
+
+		if receivedAlarm.AlarmId != alarmId {
+			failures = append(failures, fmt.Sprintf("user %v: expected alarm %v at position %v, received: %v", user, expectedAlarm.Alarm, i, receivedAlarm.AlarmId))
+			continue
+		}
+		if receivedAlarm.Status != string(expectedAlarm.Status) {
+			failures = append(failures, fmt.Sprintf("user %v: alarm %v expected status %v, received: %v", user, expectedAlarm.Alarm, expectedAlarm.Status, receivedAlarm.Status))
+		}
+		if !receivedAlarm.LatestChangedAt.Equal(changedAt) {
+			failures = append(failures, fmt.Sprintf("user %v: alarm %v expected latest change at %v, received: %v", user, expectedAlarm.Alarm, changedAt, receivedAlarm.LatestChangedAt))
+		}
+	}
+	return failures
+}
+
+
+// ------------------- digest collector -------------------
+
+type digestCollector struct {
+	mutex    sync.Mutex
+	received map[string][]AlarmDigestMessage // Note: by user id
+}
+
+func (c *digestCollector) collect(message AlarmDigestMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.received[message.UserId] = append(c.received[message.UserId], message)
+}
+
+func (c *digestCollector) count(userIds map[string]string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	total := 0
+	for _, userId := range userIds {
+		total += len(c.received[userId])
+	}
+	return total
+}
+
+func (c *digestCollector) take(userId string) []AlarmDigestMessage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	received := c.received[userId]
+	delete(c.received, userId)
+	return received
+}
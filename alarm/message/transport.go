@@ -0,0 +1,108 @@
+package message
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+	The purpose of this file is to abstract the messaging infrastructure (nats, in-memory, etc.) from the components
+	(listeners, producers, emulators), so the whole pipeline can run on something other than core nats, eg: fully
+	in-process during tests.
+*/
+
+var ErrTransportNoResponders = errors.New("transport: no responders available for request")
+var ErrTransportTimeout = errors.New("transport: timeout")
+var ErrTransportClosed = errors.New("transport: closed")
+
+// TransportHeader the optional headers of a message (eg: correlation id, trace context, etc.)
+type TransportHeader map[string][]string
+
+func (h TransportHeader) Get(key string) string {
+	if values := h[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (h TransportHeader) Set(key string, value string) {
+	h[key] = []string{value}
+}
+
+// Keys with Get & Set make the headers a carrier of the trace context (see messageTracing.go).
+func (h TransportHeader) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+type TransportMessage struct {
+	Subject string
+	Reply   string
+	Data    []byte
+	Header  TransportHeader
+}
+
+type TransportSubscription interface {
+	Subject() string
+
+	// Unsubscribe returns once the handler is not running anymore, no message gets handled after it (so the handler
+	// must not unsubscribe its own subscription).
+	Unsubscribe() error
+
+	// IsValid false once unsubscribed (or the connection is closed).
+	IsValid() bool
+}
+
+type Transport interface {
+	Subscribe(subject string, handler func(msg *TransportMessage)) (TransportSubscription, error)
+
+	// QueueSubscribe every message is delivered to only one of the subscribers of the same queue group.
+	QueueSubscribe(subject string, queue string, handler func(msg *TransportMessage)) (TransportSubscription, error)
+
+	Publish(msg *TransportMessage) error
+
+	Request(msg *TransportMessage, timeout time.Duration) (*TransportMessage, error)
+
+	// Drain delivers the pending messages, unsubscribes everything and closes the transport.
+	Drain() error
+
+	// IsConnected false while disconnected (eg: nats reconnecting) or after Drain.
+	IsConnected() bool
+}
+
+// StreamTransport a transport which can also publish to a persisted stream (nats JetStream), optional.
+type StreamTransport interface {
+	// EnsureStream creates the stream of the subjects if it does not exist.
+	EnsureStream(name string, subjects ...string) error
+
+	// PublishToStream returns the sequence of the stored message in the stream.
+	PublishToStream(msg *TransportMessage) (uint64, error)
+}
+
+// -------------------
+
+// subscriptionGate makes Unsubscribe synchronous: it waits for the running handler, and the late deliveries are skipped.
+type subscriptionGate struct {
+	mutex  sync.Mutex
+	closed bool
+}
+
+func (g *subscriptionGate) handle(handler func()) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.closed {
+		handler()
+	}
+}
+
+func (g *subscriptionGate) close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.closed = true
+}
@@ -0,0 +1,749 @@
+package message
+
+import (
+	"alarm/domain"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	Seeded simulation of the listeners --> consumers --> workers pipeline (on the in-memory transport) against a
+	reference model of the specification:
+
+	* a seed generates a plan: random alarm status changes & digest requests of a few users (so alarms get cleared,
+	  re-raised, updated many times), workers added & removed in the middle of the traffic, the listener topics the
+	  messages go through and where the batches end
+	* the ChangedAt of the messages come from a virtual clock (which sometimes goes back, eg: a late upstream message)
+	* a scheduler, driven by the same seed, picks which actor steps next: a listener topic delivers its next message,
+	  a consumer hands its next message over to the pool, or the resharder adds/removes a worker (and waits for the
+	  migration). Every step completes before the next one, so the order of the deliveries, of the hand overs to the
+	  workers and of the reshardings between them is the same for every run of a seed.
+	* at the end of a batch the scheduler waits until every message has been applied by the workers (see
+	  ProcessedMessages), so lost or duplicated messages show up as well. A batch never mixes the status changes and
+	  the digest requests of the same user (they travel through different consumers, so their order is not defined).
+	* the digests of every user are compared against the reference model (fed in the order of the deliveries), a
+	  failing plan is shrunk (events removed while it still fails) and reported with its seed
+
+	Only the workers run freely: when they pick their mailboxes up with respect to a handoff is left to the go runtime,
+	the protocol of the pool has to hold for any of these interleavings.
+
+	Run more seeds with: ALARM_SIMULATION_SEEDS=1000 go test ./message -run TestSimulation
+	Run a single seed with: ALARM_SIMULATION_SEED=42 go test ./message -run TestSimulation -v
+*/
+
+const (
+	simulationSeedsEnv = "ALARM_SIMULATION_SEEDS"
+	simulationSeedEnv  = "ALARM_SIMULATION_SEED"
+)
+
+type simulationEventKind int
+
+const (
+	simulatedStatusChange simulationEventKind = iota
+	simulatedDigestRequest
+	simulatedAddWorker
+	simulatedRemoveWorker
+)
+
+type simulationEvent struct {
+	kind     simulationEventKind
+	user     string
+	alarm    string
+	status   domain.AlarmStatus
+	at       time.Time // Note: virtual clock
+	listener int       // Note: the listener topic (when not through the delegator)
+	worker   int       // Note: the index of the worker to remove
+	endBatch bool
+}
+
+type simulationPlan struct {
+	seed         int64
+	viaDelegator bool // Note: all the messages through the plain topics, or all through the listener topics
+	events       []simulationEvent
+}
+
+const (
+	simulationUsers          = 3
+	simulationAlarmsPerUser  = 3
+	simulationListeners      = 2
+	simulationWorkers        = 3
+	simulationEventsMin      = 20
+	simulationEventsMax      = 80
+	simulationBarrierTimeout = 5 * time.Second
+)
+
+var simulationEpoch = time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+
+func generateSimulationPlan(seed int64) simulationPlan {
+	random := rand.New(rand.NewSource(seed))
+
+	plan := simulationPlan{seed: seed, viaDelegator: random.Intn(2) == 0}
+	clock := simulationEpoch
+
+	total := simulationEventsMin + random.Intn(simulationEventsMax-simulationEventsMin)
+	for i := 0; i < total; i++ {
+
+		event := simulationEvent{
+			user:     "u" + strconv.Itoa(random.Intn(simulationUsers)),
+			listener: random.Intn(simulationListeners),
+			endBatch: random.Intn(100) < 30,
+		}
+
+		switch n := random.Intn(100); {
+		case n < 70:
+			event.kind = simulatedStatusChange
+			event.alarm = "a" + strconv.Itoa(random.Intn(simulationAlarmsPerUser))
+			event.status = []domain.AlarmStatus{domain.CRITICAL, domain.WARNING, domain.CLEARED}[random.Intn(3)]
+
+			clock = clock.Add(time.Duration(1+random.Intn(10)) * time.Second)
+			event.at = clock
+			if random.Intn(100) < 10 {
+				event.at = clock.Add(-time.Duration(1+random.Intn(30)) * time.Second) // Note: a late message
+			}
+
+		case n < 92:
+			event.kind = simulatedDigestRequest
+
+		case n < 96:
+			event.kind = simulatedAddWorker
+
+		default:
+			event.kind = simulatedRemoveWorker
+			event.worker = random.Intn(simulationWorkers * 2)
+		}
+
+		plan.events = append(plan.events, event)
+	}
+
+	return plan
+}
+
+func (plan simulationPlan) String() string {
+	lines := []string{fmt.Sprintf("seed: %v, via delegator: %v, events: %v", plan.seed, plan.viaDelegator, len(plan.events))}
+
+	for _, event := range plan.events {
+		line := event.String()
+		if event.endBatch {
+			line += " |"
+		}
+		lines = append(lines, "  "+line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (event simulationEvent) String() string {
+	switch event.kind {
+	case simulatedStatusChange:
+		return fmt.Sprintf("%v %v %v at %v", event.user, event.alarm, event.status, event.at.Sub(simulationEpoch))
+	case simulatedDigestRequest:
+		return fmt.Sprintf("%v digest", event.user)
+	case simulatedAddWorker:
+		return "add worker"
+	default:
+		return fmt.Sprintf("remove worker #%v", event.worker)
+	}
+}
+
+
+// ------------------- reference model -------------------
+
+type modelAlarm struct {
+	status    domain.AlarmStatus
+	changedAt time.Time
+}
+
+// simulationModel the specification: the latest received status of an alarm wins, a digest sends the active
+// (CRITICAL, WARNING) alarms which changed since the previous digest, oldest change first.
+type simulationModel struct {
+	alarms  map[string]map[string]*modelAlarm
+	active  map[string]map[string]bool
+	digests map[string][][]ActiveAlarm
+}
+
+// runSimulationModel applies the messages in the order they were delivered.
+func runSimulationModel(delivered []simulationEvent) map[string][][]ActiveAlarm {
+	model := simulationModel{
+		alarms:  make(map[string]map[string]*modelAlarm),
+		active:  make(map[string]map[string]bool),
+		digests: make(map[string][][]ActiveAlarm),
+	}
+
+	for _, event := range delivered {
+		switch event.kind {
+
+		case simulatedStatusChange:
+			if model.alarms[event.user] == nil {
+				model.alarms[event.user] = make(map[string]*modelAlarm)
+				model.active[event.user] = make(map[string]bool)
+			}
+			model.alarms[event.user][event.alarm] = &modelAlarm{status: event.status, changedAt: event.at}
+
+			if event.status == domain.CRITICAL || event.status == domain.WARNING {
+				model.active[event.user][event.alarm] = true
+			} else {
+				delete(model.active[event.user], event.alarm)
+			}
+
+		case simulatedDigestRequest:
+			if len(model.active[event.user]) == 0 {
+				continue
+			}
+
+			digest := make([]ActiveAlarm, 0, len(model.active[event.user]))
+			for alarm := range model.active[event.user] {
+				state := model.alarms[event.user][alarm]
+				digest = append(digest, ActiveAlarm{AlarmId: alarm, Status: string(state.status), LatestChangedAt: state.changedAt})
+			}
+			model.digests[event.user] = append(model.digests[event.user], sortedAlarms(digest))
+			model.active[event.user] = make(map[string]bool)
+		}
+	}
+
+	return model.digests
+}
+
+// sortedAlarms oldest change first, the alarm id breaks the ties (the service does not define their order).
+func sortedAlarms(alarms []ActiveAlarm) []ActiveAlarm {
+	sorted := append([]ActiveAlarm(nil), alarms...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].LatestChangedAt.Equal(sorted[j].LatestChangedAt) {
+			return sorted[i].LatestChangedAt.Before(sorted[j].LatestChangedAt)
+		}
+		return sorted[i].AlarmId < sorted[j].AlarmId
+	})
+	return sorted
+}
+
+
+// ------------------- simulation -------------------
+
+// simulationDispatcher holds what the consumers hand over to the pool, until the scheduler dispatches it.
+type simulationDispatcher struct {
+	lock               sync.Mutex
+	alarmStatusChanged []AlarmStatusChangedMessage
+	sendAlarmDigest    []SendAlarmDigestMessage
+	received           int64
+}
+
+func (d *simulationDispatcher) DispatchAlarmStatusChangedMessage(consumerId string, msg AlarmStatusChangedMessage) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.alarmStatusChanged = append(d.alarmStatusChanged, msg)
+	d.received++
+}
+
+func (d *simulationDispatcher) DispatchSendAlarmDigestMessage(consumerId string, msg SendAlarmDigestMessage) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.sendAlarmDigest = append(d.sendAlarmDigest, msg)
+	d.received++
+}
+
+func (d *simulationDispatcher) pending() (alarmStatusChanged int, sendAlarmDigest int, received int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return len(d.alarmStatusChanged), len(d.sendAlarmDigest), d.received
+}
+
+// dispatchAlarmStatusChanged hands the oldest status change over to the pool, the user id of the message if any.
+func (d *simulationDispatcher) dispatchAlarmStatusChanged(pool *AlarmMessageWorkerPool) string {
+	d.lock.Lock()
+	if len(d.alarmStatusChanged) == 0 {
+		d.lock.Unlock()
+		return ""
+	}
+	msg := d.alarmStatusChanged[0]
+	d.alarmStatusChanged = d.alarmStatusChanged[1:]
+	d.lock.Unlock()
+
+	pool.DispatchAlarmStatusChangedMessage("simulationConsumer", msg)
+	return msg.UserId
+}
+
+// dispatchSendAlarmDigest hands the oldest digest request over to the pool, the user id of the message if any.
+func (d *simulationDispatcher) dispatchSendAlarmDigest(pool *AlarmMessageWorkerPool) string {
+	d.lock.Lock()
+	if len(d.sendAlarmDigest) == 0 {
+		d.lock.Unlock()
+		return ""
+	}
+	msg := d.sendAlarmDigest[0]
+	d.sendAlarmDigest = d.sendAlarmDigest[1:]
+	d.lock.Unlock()
+
+	pool.DispatchSendAlarmDigestMessage("simulationConsumer", msg)
+	return msg.UserId
+}
+
+type simulation struct {
+	transport  *InMemoryTransport
+	pool       *AlarmMessageWorkerPool
+	dispatcher *simulationDispatcher
+
+	workersLock sync.Mutex
+	workers     []*AlarmMessageWorker // Note: all the workers ever started, including the removed ones
+
+	alarmStatusChangedMessages chan AlarmStatusChangedMessage
+	sendAlarmDigestMessages    chan SendAlarmDigestMessage
+	alarmDigestMessages        chan AlarmDigestMessage
+}
+
+func simulationCreateNew(plan simulationPlan) *simulation {
+	s := &simulation{
+		transport:                  InMemoryTransportCreateNew(),
+		dispatcher:                 &simulationDispatcher{},
+		alarmStatusChangedMessages: make(chan AlarmStatusChangedMessage, 100),
+		sendAlarmDigestMessages:    make(chan SendAlarmDigestMessage, 100),
+		alarmDigestMessages:        make(chan AlarmDigestMessage, len(plan.events)+1),
+	}
+
+	RegisterAlarmStatusChangedTopicListeners("simulation", simulationListeners, s.transport, s.alarmStatusChangedMessages, true, false)
+	RegisterSendAlarmDigestTopicListeners("simulation", simulationListeners, s.transport, s.sendAlarmDigestMessages, true, false)
+
+	s.pool = AlarmMessageWorkerPoolCreateNew(simulationWorkers, 10, func(i int) *AlarmMessageWorker {
+		alarmStatusChangedMessages := make(chan AlarmStatusChangedMessage, 75)
+		sendAlarmDigestMessages := make(chan SendAlarmDigestMessage, 75)
+
+		workerName := "simulationWorker#" + strconv.Itoa(i)
+		worker := AlarmMessageWorkerCreateNew(&workerName, &i, &alarmStatusChangedMessages, &sendAlarmDigestMessages, &s.alarmDigestMessages)
+
+		s.workersLock.Lock()
+		s.workers = append(s.workers, worker)
+		s.workersLock.Unlock()
+		return worker
+	})
+
+	go AlarmStatusChangedMessagesConsumer(s.alarmStatusChangedMessages, "simulationConsumer", s.dispatcher)
+	go SendAlarmDigestMessagesConsumer(s.sendAlarmDigestMessages, "simulationConsumer", s.dispatcher)
+
+	return s
+}
+
+func (s *simulation) close() {
+	_ = s.transport.Drain()
+	close(s.alarmStatusChangedMessages)
+	close(s.sendAlarmDigestMessages)
+
+	// Note: the removed workers have already exited.
+	for _, worker := range s.pool.Workers() {
+		close(*worker.AlarmStatusChangedMessages)
+		close(*worker.SendAlarmDigestMessages)
+	}
+}
+
+func (s *simulation) processedMessages() int64 {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	var processed int64
+	for _, worker := range s.workers {
+		processed += worker.ProcessedMessages()
+	}
+	return processed
+}
+
+// the actors of the scheduler, after the listener topics (one per index)
+const (
+	simulationResharder = simulationListeners + iota
+	simulationAlarmStatusChangedConsumer
+	simulationSendAlarmDigestConsumer
+)
+
+type simulationRun struct {
+	digests   map[string][][]ActiveAlarm
+	delivered []simulationEvent // Note: the messages in the order they were delivered
+	steps     []string          // Note: which actor stepped, in order
+}
+
+// run executes the plan, in the order the scheduler picks, and returns the digests of every user, or an error if
+// messages got lost or duplicated.
+func (s *simulation) run(plan simulationPlan) (*simulationRun, error) {
+
+	random := rand.New(rand.NewSource(plan.seed))
+	result := &simulationRun{}
+
+	// Note: the events of every actor keep the order of the plan.
+	queues := make([][]simulationEvent, simulationResharder+1)
+	for _, event := range plan.events {
+		actor := event.listener
+		if event.kind == simulatedAddWorker || event.kind == simulatedRemoveWorker {
+			actor = simulationResharder
+		}
+		queues[actor] = append(queues[actor], event)
+	}
+
+	var published int64
+	batch := make(map[string]simulationEventKind) // Note: the kind of the messages of every user in the current batch
+
+	// Note: the consumers have handed over every delivered message, so what the scheduler picks next does not depend
+	//		 on the timing of their goroutines.
+	waitForConsumers := func() error {
+		deadline := time.Now().Add(simulationBarrierTimeout)
+		for {
+			_, _, received := s.dispatcher.pending()
+			if received == published {
+				return nil
+			}
+			if received > published || time.Now().After(deadline) {
+				return fmt.Errorf("%v messages published, %v received by the consumers", published, received)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	barrier := func() error {
+		// Note: the consumers hand over what they hold (the batch has a single kind of message per user).
+		for userId := s.dispatcher.dispatchAlarmStatusChanged(s.pool); len(userId) > 0; userId = s.dispatcher.dispatchAlarmStatusChanged(s.pool) {
+			result.steps = append(result.steps, "dispatch status change of "+userId)
+		}
+		for userId := s.dispatcher.dispatchSendAlarmDigest(s.pool); len(userId) > 0; userId = s.dispatcher.dispatchSendAlarmDigest(s.pool) {
+			result.steps = append(result.steps, "dispatch digest request of "+userId)
+		}
+		batch = make(map[string]simulationEventKind)
+		result.steps = append(result.steps, "barrier")
+
+		deadline := time.Now().Add(simulationBarrierTimeout)
+		for {
+			processed := s.processedMessages()
+			if processed == published {
+				return nil
+			}
+			if processed > published || time.Now().After(deadline) {
+				return fmt.Errorf("%v messages published, %v processed", published, processed)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for {
+		var actors []int
+		for actor, queue := range queues {
+			if len(queue) > 0 {
+				actors = append(actors, actor)
+			}
+		}
+		if alarmStatusChanged, sendAlarmDigest, _ := s.dispatcher.pending(); alarmStatusChanged > 0 {
+			actors = append(actors, simulationAlarmStatusChangedConsumer)
+			if sendAlarmDigest > 0 {
+				actors = append(actors, simulationSendAlarmDigestConsumer)
+			}
+		} else if sendAlarmDigest > 0 {
+			actors = append(actors, simulationSendAlarmDigestConsumer)
+		}
+		if len(actors) == 0 {
+			break
+		}
+
+		switch actor := actors[random.Intn(len(actors))]; actor {
+		case simulationAlarmStatusChangedConsumer:
+			result.steps = append(result.steps, "dispatch status change of "+s.dispatcher.dispatchAlarmStatusChanged(s.pool))
+
+		case simulationSendAlarmDigestConsumer:
+			result.steps = append(result.steps, "dispatch digest request of "+s.dispatcher.dispatchSendAlarmDigest(s.pool))
+
+		default:
+			event := queues[actor][0]
+			queues[actor] = queues[actor][1:]
+
+			switch event.kind {
+			case simulatedAddWorker:
+				_, _ = s.pool.AddWorker()
+
+			case simulatedRemoveWorker:
+				workers := s.pool.Workers()
+				_ = s.pool.RemoveWorker(workers[event.worker%len(workers)].distributionId()) // Note: eg: the last worker can not be removed
+
+			default:
+				if kind, exists := batch[event.user]; exists && kind != event.kind {
+					if err := barrier(); err != nil {
+						return nil, err
+					}
+				}
+				batch[event.user] = event.kind
+
+				if err := s.publish(plan, event); err != nil {
+					return nil, err
+				}
+				s.transport.WaitIdle()
+				published++
+				if err := waitForConsumers(); err != nil {
+					return nil, err
+				}
+				result.delivered = append(result.delivered, event)
+			}
+			result.steps = append(result.steps, fmt.Sprintf("actor #%v: %v", actor, event))
+
+			if event.endBatch {
+				if err := barrier(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if err := barrier(); err != nil {
+		return nil, err
+	}
+
+	result.digests = make(map[string][][]ActiveAlarm)
+	for len(s.alarmDigestMessages) > 0 {
+		digest := <-s.alarmDigestMessages
+		result.digests[digest.UserId] = append(result.digests[digest.UserId], digest.ActiveAlarms)
+	}
+	return result, nil
+}
+
+func (s *simulation) publish(plan simulationPlan, event simulationEvent) error {
+	var topic string
+	var payload []byte
+	var err error
+
+	if event.kind == simulatedStatusChange {
+		topic = AlarmStatusChangedTopic
+		payload, err = alarmStatusChangedPayload(&domain.Alarm{
+			Id:     domain.AlarmId(event.alarm),
+			UserId: domain.UserId(event.user),
+			Status: event.status,
+		}, event.at)
+	} else {
+		topic = SendAlarmDigestTopic
+		payload, err = sendAlarmDigestPayload(event.user)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !plan.viaDelegator {
+		topic += "." + strconv.Itoa(event.listener)
+	}
+	return PublishMessage(s.transport, topic, payload)
+}
+
+
+// ------------------- checking & shrinking -------------------
+
+// checkSimulationPlan runs the plan and returns what differs from the reference model, nil if nothing.
+func checkSimulationPlan(plan simulationPlan) []string {
+	s := simulationCreateNew(plan)
+	defer s.close()
+
+	run, err := s.run(plan)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	actual, expected := run.digests, runSimulationModel(run.delivered)
+
+	var differences []string
+	for user := 0; user < simulationUsers; user++ {
+		userId := "u" + strconv.Itoa(user)
+
+		expectedDigests, actualDigests := expected[userId], actual[userId]
+		if len(expectedDigests) != len(actualDigests) {
+			differences = append(differences, fmt.Sprintf("%v: expected %v digests, got %v: %v", userId, len(expectedDigests), len(actualDigests), actualDigests))
+			continue
+		}
+
+		for i := range expectedDigests {
+			if !sameAlarms(expectedDigests[i], actualDigests[i]) {
+				differences = append(differences, fmt.Sprintf("%v: digest #%v expected: %v, got: %v", userId, i, expectedDigests[i], actualDigests[i]))
+			}
+		}
+	}
+	return differences
+}
+
+func sameAlarms(expected []ActiveAlarm, actual []ActiveAlarm) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+
+	// Note: the service sends the oldest first, the order of the alarms with the same LatestChangedAt is not defined.
+	for i := 1; i < len(actual); i++ {
+		if actual[i].LatestChangedAt.Before(actual[i-1].LatestChangedAt) {
+			return false
+		}
+	}
+
+	sortedActual := sortedAlarms(actual)
+	for i := range expected {
+		if expected[i].AlarmId != sortedActual[i].AlarmId || expected[i].Status != sortedActual[i].Status ||
+			!expected[i].LatestChangedAt.Equal(sortedActual[i].LatestChangedAt) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	shrinkSimulationPlan removes events from a failing plan while it keeps failing (first chunks, then single events),
+	so the reported reproduction is minimal. A candidate counts as failing if any of its attempts fails, since the
+	workers are still scheduled by the go runtime.
+*/
+func shrinkSimulationPlan(plan simulationPlan, fails func(simulationPlan) bool, attempts int) simulationPlan {
+
+	failsInAnyAttempt := func(candidate simulationPlan) bool {
+		for i := 0; i < attempts; i++ {
+			if fails(candidate) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for chunk := len(plan.events) / 2; chunk >= 1; {
+		shrunk := false
+
+		for start := 0; start+chunk <= len(plan.events); {
+			candidate := plan
+			candidate.events = append(append([]simulationEvent(nil), plan.events[:start]...), plan.events[start+chunk:]...)
+
+			if failsInAnyAttempt(candidate) {
+				plan = candidate
+				shrunk = true
+			} else {
+				start += chunk
+			}
+		}
+
+		if !shrunk {
+			chunk /= 2
+		}
+	}
+	return plan
+}
+
+func simulationSeeds(t *testing.T) []int64 {
+	if seed := os.Getenv(simulationSeedEnv); len(seed) > 0 {
+		value, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid %v: %v", simulationSeedEnv, seed)
+		}
+		return []int64{value}
+	}
+
+	total := 20
+	if seeds := os.Getenv(simulationSeedsEnv); len(seeds) > 0 {
+		value, err := strconv.Atoi(seeds)
+		if err != nil {
+			t.Fatalf("invalid %v: %v", simulationSeedsEnv, seeds)
+		}
+		total = value
+	}
+
+	seeds := make([]int64, 0, total)
+	for i := 1; i <= total; i++ {
+		seeds = append(seeds, int64(i))
+	}
+	return seeds
+}
+
+
+// -------------------
+
+func TestSimulation_pipelineMatchesReferenceModel(t *testing.T) {
+
+	var failed int32
+	for _, seed := range simulationSeeds(t) {
+
+		// given
+		plan := generateSimulationPlan(seed)
+
+		// when
+		differences := checkSimulationPlan(plan)
+
+		// then
+		if len(differences) == 0 {
+			continue
+		}
+
+		if atomic.AddInt32(&failed, 1) > 1 {
+			t.Errorf("seed: %v failed as well: %v", seed, differences)
+			continue
+		}
+
+		minimal := shrinkSimulationPlan(plan, func(candidate simulationPlan) bool {
+			return len(checkSimulationPlan(candidate)) > 0
+		}, 3)
+		t.Errorf("seed: %v does not match the reference model: %v\nminimal reproduction:\n%v\ndifferences: %v",
+			seed, differences, minimal, checkSimulationPlan(minimal))
+	}
+}
+
+func TestSimulation_planIsDeterminedBySeed(t *testing.T) {
+	if generateSimulationPlan(7).String() != generateSimulationPlan(7).String() {
+		t.Errorf("the same seed should generate the same plan")
+	}
+	if generateSimulationPlan(7).String() == generateSimulationPlan(8).String() {
+		t.Errorf("different seeds should generate different plans")
+	}
+}
+
+func TestSimulation_scheduleIsDeterminedBySeed(t *testing.T) {
+
+	// given
+	schedule := func(seed int64) []string {
+		plan := generateSimulationPlan(seed)
+		s := simulationCreateNew(plan)
+		defer s.close()
+
+		run, err := s.run(plan)
+		if err != nil {
+			t.Fatalf("seed: %v failed: %v", seed, err)
+		}
+		return run.steps
+	}
+
+
+	// when
+	first, second, other := schedule(7), schedule(7), schedule(8)
+
+
+	// then
+	if strings.Join(first, "\n") != strings.Join(second, "\n") {
+		t.Errorf("the same seed should step the actors in the same order:\n%v\n---\n%v", strings.Join(first, "\n"), strings.Join(second, "\n"))
+	}
+	if strings.Join(first, "\n") == strings.Join(other, "\n") {
+		t.Errorf("different seeds should step the actors in different orders")
+	}
+}
+
+func TestShrinkSimulationPlan_findsMinimalReproduction(t *testing.T) {
+
+	// given - a (made up) bug: a cleared alarm which was critical before
+	plan := generateSimulationPlan(3)
+	fails := func(candidate simulationPlan) bool {
+		critical := make(map[string]bool)
+		for _, event := range candidate.events {
+			key := event.user + "/" + event.alarm
+			if event.kind == simulatedStatusChange && event.status == domain.CLEARED && critical[key] {
+				return true
+			}
+			critical[key] = critical[key] || (event.kind == simulatedStatusChange && event.status == domain.CRITICAL)
+		}
+		return false
+	}
+	if !fails(plan) {
+		t.Fatalf("the plan should fail to begin with:\n%v", plan)
+	}
+
+
+	// when
+	minimal := shrinkSimulationPlan(plan, fails, 1)
+
+
+	// then
+	if len(minimal.events) != 2 || minimal.events[0].status != domain.CRITICAL || minimal.events[1].status != domain.CLEARED {
+		t.Errorf("expected a critical and a clear of the same alarm, got:\n%v", minimal)
+	}
+}
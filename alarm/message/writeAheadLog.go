@@ -0,0 +1,468 @@
+package message
+
+import (
+	. "alarm/domain"
+	. "alarm/metrics"
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Write-ahead log of the events the workers applied to their state, so a crash loses nothing since the latest snapshot:
+
+	* every worker appends (from its own goroutine) the AlarmStatusChanged messages it applied and the digests it
+	  flushed to its own segments: <walDir>/worker-<id>/<first sequence>.wal
+	* every entry gets a sequence from a counter shared by all the workers (and continued across restarts), so the
+	  entries of a user which moved between workers can be merged back in the order they got applied
+	* a segment is closed when it grows above walSegmentBytes, or when its worker takes a snapshot
+
+	Record: | length (4 bytes) | crc32 of the payload (4 bytes) | payload (json entry) |
+	A crash in the middle of an append leaves a torn record at the end of a segment, the replay stops there.
+
+	Fsync policy: always (after every entry), interval (every walFsyncIntervalMs, the latest entries may be lost by a
+	crash of the machine, not of the process) or never (left to the OS).
+
+	Recovery: the snapshots get restored first, then the entries are replayed in sequence order, each one on the worker
+	which owns its user now. A flushed digest is not sent again, only its alarms are marked as sent.
+
+	Compaction: after a snapshot round every segment whose entries are covered by the snapshots gets deleted. If the
+	service crashes in between, the covered entries are replayed on top of the snapshots, which ends up in the same state.
+*/
+
+type WalFsyncPolicy string
+
+const (
+	WalFsyncAlways   WalFsyncPolicy = "always"
+	WalFsyncInterval WalFsyncPolicy = "interval"
+	WalFsyncNever    WalFsyncPolicy = "never"
+)
+
+const (
+	walAlarmStatusChanged = "change"
+	walDigestFlushed      = "flush"
+	walDigestConfirmed    = "confirm"
+)
+
+const walSegmentExtension = ".wal"
+
+var walRecordsCounter = CounterVecCreateNew("alarm_wal_records_total", "Write-ahead log records, by result.", "result")
+
+type WriteAheadLogOptions struct {
+	Dir           string
+	SegmentBytes  int64
+	Fsync         WalFsyncPolicy
+	FsyncInterval time.Duration
+}
+
+type walEntry struct {
+	Seq       int64     `json:"seq"`
+	Kind      string    `json:"kind"`
+	UserId    string    `json:"user"`
+	AlarmId   string    `json:"alarm,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	ChangedAt time.Time `json:"changedAt"` // Note: for a flush, when the digest was sent
+	RequestId string    `json:"request,omitempty"`
+	AlarmIds  []string  `json:"alarms,omitempty"` // Note: for a confirmed digest, the cleared alarms
+}
+
+type walReplayControlMessage struct {
+	entries  []walEntry
+	replayed *sync.WaitGroup
+}
+
+
+// -------------------
+
+type WriteAheadLog struct {
+	options WriteAheadLogOptions
+
+	// Note: the latest assigned sequence, accessed atomically.
+	sequence int64
+
+	logsLock sync.Mutex
+	logs     map[int]*workerLog // Note: by worker id
+
+	recovered []walEntry
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// WriteAheadLogCreateNew reads the existing segments (kept for Replay) and continues their sequence.
+func WriteAheadLogCreateNew(options WriteAheadLogOptions) (*WriteAheadLog, error) {
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &WriteAheadLog{
+		options: options,
+		logs:    make(map[int]*workerLog),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		entries, err := readWalSegment(segment.filename)
+		if err != nil {
+			log.Warnf("write-ahead log segment: %v, replaying up to: %v\n", segment.filename, err)
+			walRecordsCounter.WithLabelValues("torn").Inc()
+		}
+		l.recovered = append(l.recovered, entries...)
+	}
+
+	sort.SliceStable(l.recovered, func(i, j int) bool {
+		return l.recovered[i].Seq < l.recovered[j].Seq
+	})
+	if len(l.recovered) > 0 {
+		l.sequence = l.recovered[len(l.recovered)-1].Seq
+	}
+
+	log.Infof("write-ahead log: %v, %v segments, %v entries to replay\n", options.Dir, len(segments), len(l.recovered))
+	return l, nil
+}
+
+func (l *WriteAheadLog) Start() {
+	go func() {
+		defer close(l.done)
+		if l.options.Fsync != WalFsyncInterval {
+			<-l.stop
+			return
+		}
+
+		ticker := time.NewTicker(l.options.FsyncInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.syncAll()
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop syncs and closes the segments, meant after the workers have stopped appending.
+func (l *WriteAheadLog) Stop() {
+	close(l.stop)
+	<-l.done
+
+	l.logsLock.Lock()
+	defer l.logsLock.Unlock()
+
+	for _, workerLog := range l.logs {
+		workerLog.close()
+	}
+}
+
+// Replay applies the recovered entries to the workers which own their users now, returns the number of entries.
+func (l *WriteAheadLog) Replay(workerPool *AlarmMessageWorkerPool) int {
+	workerPool.replayWal(l.recovered)
+
+	replayed := len(l.recovered)
+	walRecordsCounter.WithLabelValues("replayed").Add(float64(replayed))
+	l.recovered = nil
+
+	log.Infof("replayed %v write-ahead log entries\n", replayed)
+	return replayed
+}
+
+func (l *WriteAheadLog) workerLog(workerId int) *workerLog {
+	l.logsLock.Lock()
+	defer l.logsLock.Unlock()
+
+	if _, exists := l.logs[workerId]; !exists {
+		l.logs[workerId] = &workerLog{wal: l, dir: filepath.Join(l.options.Dir, "worker-"+strconv.Itoa(workerId))}
+	}
+	return l.logs[workerId]
+}
+
+func (l *WriteAheadLog) syncAll() {
+	l.logsLock.Lock()
+	defer l.logsLock.Unlock()
+
+	for _, workerLog := range l.logs {
+		workerLog.sync()
+	}
+}
+
+/*
+compact deletes the segments covered by a snapshot round:
+
+* roundStartSeq the sequence before the round started, the segments which start up to it were closed before the round
+  (at the latest by the snapshot of their worker), so their entries are in the snapshots (eg: of removed workers, or of
+  a previous run, which got replayed)
+* covered the latest sequence every worker had appended when it took its snapshot (its segment got closed then)
+*/
+func (l *WriteAheadLog) compact(covered map[int]int64, roundStartSeq int64) {
+	segments, err := l.segments()
+	if err != nil {
+		log.Errorf("could not list the write-ahead log segments, error: %v\n", err)
+		return
+	}
+
+	deleted := 0
+	for _, segment := range segments {
+		if segment.firstSeq > roundStartSeq && segment.firstSeq > covered[segment.workerId] {
+			continue
+		}
+
+		if err := os.Remove(segment.filename); err != nil {
+			log.Warnf("could not delete write-ahead log segment: %v, error: %v\n", segment.filename, err)
+			continue
+		}
+		deleted++
+	}
+	log.Debugf("write-ahead log compaction deleted %v segments\n", deleted)
+}
+
+// currentSequence the latest assigned sequence
+func (l *WriteAheadLog) currentSequence() int64 {
+	return atomic.LoadInt64(&l.sequence)
+}
+
+type walSegment struct {
+	filename string
+	workerId int
+	firstSeq int64
+}
+
+func (l *WriteAheadLog) segments() ([]walSegment, error) {
+	filenames, err := filepath.Glob(filepath.Join(l.options.Dir, "worker-*", "*"+walSegmentExtension))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]walSegment, 0, len(filenames))
+	for _, filename := range filenames {
+		workerId, err1 := strconv.Atoi(strings.TrimPrefix(filepath.Base(filepath.Dir(filename)), "worker-"))
+		firstSeq, err2 := strconv.ParseInt(strings.TrimSuffix(filepath.Base(filename), walSegmentExtension), 10, 64)
+		if err1 != nil || err2 != nil {
+			log.Warnf("skipping unknown file in the write-ahead log: %v\n", filename)
+			continue
+		}
+		segments = append(segments, walSegment{filename: filename, workerId: workerId, firstSeq: firstSeq})
+	}
+	return segments, nil
+}
+
+
+// ------------------- worker log -------------------
+
+// workerLog the segments of a single worker, appended from the worker goroutine (the lock is for the fsync & close).
+type workerLog struct {
+	mutex sync.Mutex
+
+	wal *WriteAheadLog
+	dir string
+
+	file    *os.File
+	written int64
+	lastSeq int64
+}
+
+func (w *workerLog) append(entry walEntry) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	entry.Seq = atomic.AddInt64(&w.wal.sequence, 1)
+
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[8:], payload)
+
+	if w.file == nil {
+		if err := os.MkdirAll(w.dir, 0755); err != nil {
+			return err
+		}
+		// Note: named after its first sequence, see compact
+		w.file, err = os.OpenFile(filepath.Join(w.dir, fmt.Sprintf("%020d%v", entry.Seq, walSegmentExtension)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		w.written = 0
+	}
+
+	if _, err := w.file.Write(record); err != nil {
+		return err
+	}
+	w.written += int64(len(record))
+	w.lastSeq = entry.Seq
+
+	if w.wal.options.Fsync == WalFsyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if w.written >= w.wal.options.SegmentBytes {
+		w.closeSegment()
+	}
+	return nil
+}
+
+// rotate closes the current segment, returns the latest appended sequence.
+func (w *workerLog) rotate() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.closeSegment()
+	return w.lastSeq
+}
+
+func (w *workerLog) sync() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file != nil {
+		if err := w.file.Sync(); err != nil {
+			log.Errorf("could not fsync write-ahead log segment: %v, error: %v\n", w.file.Name(), err)
+		}
+	}
+}
+
+func (w *workerLog) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.closeSegment()
+}
+
+func (w *workerLog) closeSegment() {
+	if w.file == nil {
+		return
+	}
+	if w.wal.options.Fsync != WalFsyncNever {
+		_ = w.file.Sync()
+	}
+	if err := w.file.Close(); err != nil {
+		log.Errorf("could not close write-ahead log segment: %v, error: %v\n", w.file.Name(), err)
+	}
+	w.file = nil
+}
+
+// readWalSegment returns the entries up to the end of the segment, or up to a torn or corrupt record (with an error).
+func readWalSegment(filename string) ([]walEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, 8)
+
+	var entries []walEntry
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return entries, nil
+			}
+			return entries, errors.New("torn record header")
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return entries, errors.New("torn record")
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return entries, errors.New("record checksum mismatch")
+		}
+
+		var entry walEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+
+// ------------------- pool -------------------
+
+// replayWal sends the entries (in sequence order) to the workers which own their users, meant for startup.
+func (p *AlarmMessageWorkerPool) replayWal(entries []walEntry) {
+	p.reshardingLock.Lock()
+	defer p.reshardingLock.Unlock()
+
+	p.routingLock.RLock()
+	byWorker := make(map[*AlarmMessageWorker][]walEntry)
+	for _, entry := range entries {
+		worker := p.workers[p.routing.Locate(entry.UserId)]
+		byWorker[worker] = append(byWorker[worker], entry)
+	}
+	p.routingLock.RUnlock()
+
+	replayed := &sync.WaitGroup{}
+	replayed.Add(len(byWorker))
+	for worker, workerEntries := range byWorker {
+		worker.controlMessages <- &walReplayControlMessage{entries: workerEntries, replayed: replayed}
+	}
+	replayed.Wait()
+}
+
+
+// ------------------- worker -------------------
+
+// EnableWriteAheadLog the worker appends the events it applies, to be called before it starts consuming.
+func (w *AlarmMessageWorker) EnableWriteAheadLog(wal *WriteAheadLog) {
+	w.wal = wal.workerLog(w.workerId)
+}
+
+func (w *AlarmMessageWorker) appendToWal(entry walEntry) {
+	if w.wal == nil {
+		return
+	}
+
+	if err := w.wal.append(entry); err != nil {
+		walRecordsCounter.WithLabelValues("failed").Inc()
+		log.Errorf("[%v] could not append to the write-ahead log, error: %v\n", w.workerName, err)
+		return
+	}
+	walRecordsCounter.WithLabelValues("appended").Inc()
+}
+
+func (w *AlarmMessageWorker) handleWalReplay(replay *walReplayControlMessage) {
+	for _, entry := range replay.entries {
+		switch entry.Kind {
+		case walAlarmStatusChanged:
+			w.handleAlarmStatusChangeMessage(&AlarmStatusChangedMessage{AlarmId: entry.AlarmId, UserId: entry.UserId, Status: entry.Status, ChangedAt: entry.ChangedAt})
+		case walDigestFlushed:
+			// Note: the flushed alarms are the digest which was sent, retained again for the retried requests.
+			w.retainDigest(UserId(entry.UserId), entry.RequestId, entry.ChangedAt, w.collectActiveAlarms(UserId(entry.UserId)))
+			w.flushActiveAlarms(UserId(entry.UserId))
+		case walDigestConfirmed:
+			for _, alarmId := range entry.AlarmIds {
+				delete(w.activeAlarms[UserId(entry.UserId)], AlarmId(alarmId))
+			}
+		default:
+			log.Warnf("[%v] unknown write-ahead log entry: %v\n", w.workerName, entry)
+		}
+	}
+
+	log.Infof("[%v] worker replayed %v write-ahead log entries\n", w.workerName, len(replay.entries))
+	replay.replayed.Done()
+}
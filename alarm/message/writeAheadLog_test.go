@@ -0,0 +1,218 @@
+package message
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testWal(t *testing.T, dir string) *WriteAheadLog {
+	wal, err := WriteAheadLogCreateNew(WriteAheadLogOptions{Dir: dir, SegmentBytes: 4096, Fsync: WalFsyncAlways})
+	if err != nil {
+		t.Fatalf("could not open write-ahead log, error: %v", err)
+	}
+	wal.Start()
+	return wal
+}
+
+func waitForProcessedMessages(t *testing.T, pool *AlarmMessageWorkerPool, expected int64) {
+	for tries := 0; tries < 500; tries++ {
+		var processed int64
+		for _, worker := range pool.Workers() {
+			processed += worker.ProcessedMessages()
+		}
+		if processed == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("workers did not process %v messages", expected)
+}
+
+func walSegments(t *testing.T, dir string) []string {
+	segments, err := filepath.Glob(filepath.Join(dir, "worker-*", "*"+walSegmentExtension))
+	if err != nil {
+		t.Fatalf("could not list segments, error: %v", err)
+	}
+	return segments
+}
+
+/*
+	Scenario:
+
+	* 20 users get 2 alarms each, the first 10 request a digest, then a snapshot is taken.
+	* Then more changes and a digest, and the service crashes (no final snapshot).
+	* A service with a different number of workers restores the snapshots and replays the log: every user should
+	  get the digest it would have got without the crash.
+*/
+func TestWriteAheadLog_recoversTheChangesSinceTheLatestSnapshot(t *testing.T) {
+
+	// given
+	snapshotDir := t.TempDir()
+	walDir := t.TempDir()
+	alarmDigestMessagesChan := make(chan AlarmDigestMessage, 1000)
+
+	wal := testWal(t, walDir)
+	pool := testWorkerPool(3, &alarmDigestMessagesChan, func(worker *AlarmMessageWorker) {
+		worker.EnableWriteAheadLog(wal)
+	})
+	snapshotter := AlarmStateSnapshotterCreateNew(pool, snapshotDir, 0)
+	snapshotter.UseWriteAheadLog(wal)
+
+	changedAt := time.Date(2021, 8, 17, 15, 0, 0, 0, time.UTC)
+	change := func(pool *AlarmMessageWorkerPool, user int, alarmId string, status string) {
+		pool.DispatchAlarmStatusChangedMessage("test", AlarmStatusChangedMessage{AlarmId: alarmId, UserId: "user-" + strconv.Itoa(user), Status: status, ChangedAt: changedAt})
+	}
+	digest := func(pool *AlarmMessageWorkerPool, user int) {
+		pool.DispatchSendAlarmDigestMessage("test", SendAlarmDigestMessage{UserId: "user-" + strconv.Itoa(user)})
+	}
+
+	for user := 0; user < 20; user++ {
+		change(pool, user, "a1", "CRITICAL")
+		change(pool, user, "a2", "WARNING")
+	}
+	// Note: the changes and the digests of a user go through different mailboxes, so they get applied in order only across a barrier.
+	waitForProcessedMessages(t, pool, 40)
+	for user := 0; user < 10; user++ {
+		digest(pool, user)
+	}
+	waitForProcessedMessages(t, pool, 50)
+
+	if err := snapshotter.Snapshot(false); err != nil {
+		t.Fatalf("could not snapshot, error: %v", err)
+	}
+	if segments := walSegments(t, walDir); len(segments) != 0 {
+		t.Errorf("expected the snapshot to compact the log, segments: %v", segments)
+	}
+
+	for user := 10; user < 20; user++ {
+		change(pool, user, "a1", "CLEARED")
+	}
+	for user := 0; user < 5; user++ {
+		change(pool, user, "a3", "CRITICAL")
+	}
+	waitForProcessedMessages(t, pool, 65)
+	digest(pool, 19)
+	waitForProcessedMessages(t, pool, 66)
+
+	for len(alarmDigestMessagesChan) > 0 {
+		<-alarmDigestMessagesChan
+	}
+
+
+	// when
+	recoveredWal := testWal(t, walDir)
+	recoveredPool := testWorkerPool(2, &alarmDigestMessagesChan, func(worker *AlarmMessageWorker) {
+		worker.EnableWriteAheadLog(recoveredWal)
+	})
+	AlarmStateSnapshotterCreateNew(recoveredPool, snapshotDir, 0).Restore()
+	replayed := recoveredWal.Replay(recoveredPool)
+
+
+	// then
+	if replayed != 16 {
+		t.Errorf("expected 16 replayed entries, got: %v", replayed)
+	}
+
+	expected := make(map[string][]string)
+	for user := 0; user < 5; user++ {
+		expected["user-"+strconv.Itoa(user)] = []string{"a3"}
+	}
+	for user := 10; user < 19; user++ {
+		expected["user-"+strconv.Itoa(user)] = []string{"a2"}
+	}
+
+	for user := 0; user < 20; user++ {
+		digest(recoveredPool, user)
+	}
+	waitForProcessedMessages(t, recoveredPool, 20)
+
+	received := make(map[string][]string)
+	for len(alarmDigestMessagesChan) > 0 {
+		message := <-alarmDigestMessagesChan
+		for _, alarm := range message.ActiveAlarms {
+			received[message.UserId] = append(received[message.UserId], alarm.AlarmId)
+		}
+		sort.Strings(received[message.UserId])
+	}
+
+	if len(received) != len(expected) {
+		t.Errorf("expected digests of %v users, got: %v", len(expected), received)
+	}
+	for userId, alarms := range expected {
+		if len(received[userId]) != 1 || received[userId][0] != alarms[0] {
+			t.Errorf("user: %v, expected active alarms: %v, got: %v", userId, alarms, received[userId])
+		}
+	}
+}
+
+func TestWriteAheadLog_replaysUpToATornRecord(t *testing.T) {
+
+	// given
+	dir := t.TempDir()
+	wal := testWal(t, dir)
+	workerLog := wal.workerLog(0)
+	for i := 0; i < 3; i++ {
+		if err := workerLog.append(walEntry{Kind: walAlarmStatusChanged, UserId: "u1", AlarmId: "a" + strconv.Itoa(i), Status: "CRITICAL"}); err != nil {
+			t.Fatalf("could not append, error: %v", err)
+		}
+	}
+	wal.Stop()
+
+	// Note: a crash in the middle of the last append.
+	segment := walSegments(t, dir)[0]
+	info, _ := os.Stat(segment)
+	if err := os.Truncate(segment, info.Size()-3); err != nil {
+		t.Fatalf("could not truncate segment, error: %v", err)
+	}
+
+
+	// when
+	recovered := testWal(t, dir)
+
+
+	// then
+	if len(recovered.recovered) != 2 || recovered.recovered[1].AlarmId != "a1" {
+		t.Errorf("expected the 2 complete entries, got: %v", recovered.recovered)
+	}
+	if recovered.currentSequence() != 2 {
+		t.Errorf("expected the sequence to continue from 2, got: %v", recovered.currentSequence())
+	}
+}
+
+func TestWriteAheadLog_rotatesSegmentsBySize(t *testing.T) {
+
+	// given
+	wal := testWal(t, t.TempDir())
+	workerLog := wal.workerLog(0)
+
+
+	// when
+	for i := 0; i < 100; i++ {
+		if err := workerLog.append(walEntry{Kind: walAlarmStatusChanged, UserId: "u1", AlarmId: "a" + strconv.Itoa(i), Status: "CRITICAL"}); err != nil {
+			t.Fatalf("could not append, error: %v", err)
+		}
+	}
+	wal.Stop()
+
+
+	// then
+	segments := walSegments(t, wal.options.Dir)
+	if len(segments) < 2 {
+		t.Errorf("expected more than one segment of %v bytes, got: %v", wal.options.SegmentBytes, segments)
+	}
+	total := 0
+	for _, segment := range segments {
+		entries, err := readWalSegment(segment)
+		if err != nil {
+			t.Errorf("segment: %v, error: %v", segment, err)
+		}
+		total += len(entries)
+	}
+	if total != 100 {
+		t.Errorf("expected 100 entries, got: %v", total)
+	}
+}
@@ -0,0 +1,213 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Minimal metrics registry (counters and gauges with labels) exposed in the prometheus text format,
+	so we do not need to pull the whole prometheus client for a handful of metrics.
+*/
+
+const (
+	counterKind = "counter"
+	gaugeKind   = "gauge"
+)
+
+type Registry struct {
+	mutex  sync.Mutex
+	vecs   []*metricVec
+	byName map[string]*metricVec
+}
+
+var DefaultRegistry = RegistryCreateNew()
+
+func RegistryCreateNew() *Registry {
+	return &Registry{byName: make(map[string]*metricVec)}
+}
+
+// -------------------
+
+type Value struct {
+	bits uint64
+}
+
+func (v *Value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+func (v *Value) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Set only meaningful for gauges.
+func (v *Value) Set(value float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(value))
+}
+
+// -------------------
+
+type metricVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mutex  sync.Mutex
+	values map[string]*labeledValue
+}
+
+type labeledValue struct {
+	labelValues []string
+	value       *Value
+}
+
+type CounterVec struct {
+	vec *metricVec
+}
+
+type GaugeVec struct {
+	vec *metricVec
+}
+
+func CounterVecCreateNew(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{vec: DefaultRegistry.register(name, help, counterKind, labelNames)}
+}
+
+func GaugeVecCreateNew(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{vec: DefaultRegistry.register(name, help, gaugeKind, labelNames)}
+}
+
+func (c *CounterVec) WithLabelValues(labelValues ...string) *Value {
+	return c.vec.withLabelValues(labelValues)
+}
+
+func (c *CounterVec) Delete(labelValues ...string) {
+	c.vec.delete(labelValues)
+}
+
+func (g *GaugeVec) WithLabelValues(labelValues ...string) *Value {
+	return g.vec.withLabelValues(labelValues)
+}
+
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.vec.delete(labelValues)
+}
+
+// -------------------
+
+// register returns the already registered metric with the same name, so components can be created many times (eg: tests).
+func (r *Registry) register(name string, help string, kind string, labelNames []string) *metricVec {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if existing, exists := r.byName[name]; exists {
+		if existing.kind != kind || len(existing.labelNames) != len(labelNames) {
+			panic("metric: " + name + " is already registered with a different kind or labels")
+		}
+		return existing
+	}
+
+	vec := &metricVec{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     make(map[string]*labeledValue),
+	}
+	r.vecs = append(r.vecs, vec)
+	r.byName[name] = vec
+
+	return vec
+}
+
+func (v *metricVec) withLabelValues(labelValues []string) *Value {
+	if len(labelValues) != len(v.labelNames) {
+		panic("metric: " + v.name + " expects " + strconv.Itoa(len(v.labelNames)) + " label values")
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	lv, exists := v.values[key]
+	if !exists {
+		lv = &labeledValue{labelValues: append([]string(nil), labelValues...), value: &Value{}}
+		v.values[key] = lv
+	}
+	return lv.value
+}
+
+func (v *metricVec) delete(labelValues []string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+// -------------------
+
+func (r *Registry) WritePrometheus(writer io.Writer) error {
+	r.mutex.Lock()
+	vecs := append([]*metricVec(nil), r.vecs...)
+	r.mutex.Unlock()
+
+	sort.Slice(vecs, func(i, j int) bool {
+		return vecs[i].name < vecs[j].name
+	})
+
+	w := bufio.NewWriter(writer)
+	for _, vec := range vecs {
+		vec.write(w)
+	}
+	return w.Flush()
+}
+
+func (v *metricVec) write(w *bufio.Writer) {
+	v.mutex.Lock()
+	values := make([]*labeledValue, 0, len(v.values))
+	for _, lv := range v.values {
+		values = append(values, lv)
+	}
+	v.mutex.Unlock()
+
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labelValues, ",") < strings.Join(values[j].labelValues, ",")
+	})
+
+	_, _ = w.WriteString("# HELP " + v.name + " " + v.help + "\n")
+	_, _ = w.WriteString("# TYPE " + v.name + " " + v.kind + "\n")
+
+	for _, lv := range values {
+		_, _ = w.WriteString(v.name)
+		if len(v.labelNames) > 0 {
+			_, _ = w.WriteString("{")
+			for i, labelName := range v.labelNames {
+				if i > 0 {
+					_, _ = w.WriteString(",")
+				}
+				_, _ = w.WriteString(labelName + "=" + strconv.Quote(lv.labelValues[i]))
+			}
+			_, _ = w.WriteString("}")
+		}
+		_, _ = w.WriteString(" " + strconv.FormatFloat(lv.value.Get(), 'g', -1, 64) + "\n")
+	}
+}
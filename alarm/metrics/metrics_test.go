@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_writePrometheus(t *testing.T) {
+
+	// given
+	registry := RegistryCreateNew()
+	counter := &CounterVec{vec: registry.register("test_messages_total", "total messages", counterKind, []string{"topic"})}
+	gauge := &GaugeVec{vec: registry.register("test_workers", "total workers", gaugeKind, nil)}
+
+	counter.WithLabelValues("AlarmDigest").Inc()
+	counter.WithLabelValues("AlarmDigest").Add(2)
+	counter.WithLabelValues("SendAlarmDigest").Inc()
+	gauge.WithLabelValues().Set(30)
+
+
+	// when
+	var out bytes.Buffer
+	_ = registry.WritePrometheus(&out)
+
+
+	// then
+	expected := `# HELP test_messages_total total messages
+# TYPE test_messages_total counter
+test_messages_total{topic="AlarmDigest"} 3
+test_messages_total{topic="SendAlarmDigest"} 1
+# HELP test_workers total workers
+# TYPE test_workers gauge
+test_workers 30
+`
+	if out.String() != expected {
+		t.Errorf("unexpected output:\n%v", out.String())
+	}
+
+	counter.Delete("SendAlarmDigest")
+	out.Reset()
+	_ = registry.WritePrometheus(&out)
+	if strings.Contains(out.String(), "SendAlarmDigest") {
+		t.Errorf("deleted series should not be written")
+	}
+}
+
+func TestRegistry_registerTwiceReturnsSameMetric(t *testing.T) {
+
+	registry := RegistryCreateNew()
+	first := registry.register("test_total", "help", counterKind, []string{"a"})
+	second := registry.register("test_total", "help", counterKind, []string{"a"})
+
+	if first != second {
+		t.Errorf("same metric should have been returned")
+	}
+}
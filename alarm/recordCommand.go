@@ -0,0 +1,90 @@
+package main
+
+import (
+	. "alarm/error"
+	. "alarm/message"
+	"flag"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func recordCommand(args []string) {
+
+	flags := flag.NewFlagSet("record", flag.ExitOnError)
+	configFile, configOverrides := configFlags(flags)
+	natsUrl := flags.String("nats-url", "", "the nats server of the service (default: natsUrl of the config)")
+	out := flags.String("out", "traffic.jsonl.gz", "the recording file (gzip compressed when it ends with .gz)")
+	subjects := flags.String("subjects", "", "comma separated subjects to record (default: the AlarmStatusChanged and SendAlarmDigest subjects of the config)")
+	duration := flags.Duration("duration", 0, "stop recording after, eg: 10m (0 records until interrupted)")
+	_ = flags.Parse(args)
+
+	serverConnection := connectTo(natsUrlOf(*natsUrl, *configFile, configOverrides))
+	defer serverConnection.Close()
+
+	if len(*subjects) == 0 {
+		*subjects = Topics().AlarmStatusChanged + "," + Topics().SendAlarmDigest
+	}
+
+	recorder, err := TrafficRecorderCreateNew(NatsTransportCreateNew(serverConnection), *out, strings.Split(*subjects, ","))
+	if err != nil {
+		panic(InvalidCommandError{Msg: err.Error()})
+	}
+	recorder.Start()
+
+
+	// record until interrupted (or the duration elapses)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+
+	select {
+	case <-stop:
+	case <-timeout:
+	}
+
+	if err := recorder.Stop(); err != nil {
+		log.Error("could not write the recording, error: ", err)
+	}
+	log.Infof("recorded %v messages to: %v\n", recorder.Recorded(), *out)
+}
+
+func replayCommand(args []string) {
+
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFile, configOverrides := configFlags(flags)
+	natsUrl := flags.String("nats-url", "", "the nats server of the service (default: natsUrl of the config)")
+	in := flags.String("in", "traffic.jsonl.gz", "the recording file (plain or gzip compressed)")
+	speed := flags.Float64("speed", 1, "the replay speed (1: real time, 10: ten times faster, 0: no pauses)")
+	anonymizeUsers := flags.Bool("anonymize-users", false, "replace the user ids with anonymous ones (the same per user)")
+	anonymizeSalt := flags.String("anonymize-salt", "", "the salt of the anonymous user ids (default: random per replay)")
+	_ = flags.Parse(args)
+
+	if len(*anonymizeSalt) == 0 {
+		*anonymizeSalt = uuid.NewString()
+	}
+
+	transport := NatsTransportCreateNew(connectTo(natsUrlOf(*natsUrl, *configFile, configOverrides)))
+
+	startedAt := time.Now()
+	replayed, err := ReplayTraffic(transport, *in, TrafficReplayOptions{
+		Speed:          *speed,
+		AnonymizeUsers: *anonymizeUsers,
+		AnonymizeSalt:  *anonymizeSalt,
+	})
+
+	// Note: drain flushes the messages which are still buffered by the client.
+	_ = transport.Drain()
+	if err != nil {
+		panic(CouldNotPublishMessageError{Msg: err.Error()})
+	}
+	log.Infof("replayed %v messages of: %v in: %v\n", replayed, *in, time.Since(startedAt))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	. "alarm/error"
+	. "alarm/fileutil"
+	. "alarm/message"
+	"flag"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+func serveCommand(args []string) {
+
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile, configOverrides := configFlags(flags)
+	embeddedNats := flags.Bool("embedded-nats", false, "start an in-process nats server instead of connecting to an external one")
+	embeddedNatsPort := flags.Int("embedded-nats-port", nats.DefaultPort, "the port of the embedded nats server (-1 for random)")
+	embeddedNatsJetStream := flags.Bool("embedded-nats-jetstream", false, "enable JetStream on the embedded nats server")
+	embeddedNatsStoreDir := flags.String("embedded-nats-store-dir", "", "the JetStream store directory of the embedded nats server")
+	_ = flags.Parse(args)
+
+
+	// get properties (flags > ALARM_* env variables > config file)
+	props := LoadAlarmServiceConfig(*configFile, configOverrides)
+
+
+	// start the embedded nats server if requested
+	serverUrl := props.FetchAsString("natsUrl")
+	if *embeddedNats {
+		embeddedServer, err := StartEmbeddedServer(EmbeddedServerOptions{
+			Port:      *embeddedNatsPort,
+			JetStream: *embeddedNatsJetStream,
+			StoreDir:  *embeddedNatsStoreDir,
+		})
+		if err != nil {
+			panic(CouldNotStartEmbeddedServerError{Msg: err.Error()})
+		}
+		defer func() {
+			log.Debugf("[DEFER-CLEAR-RESOURCES] will shutdown embedded nats server now...")
+			StopEmbeddedServer(embeddedServer)
+		}()
+
+		serverUrl = embeddedServer.ClientURL()
+	}
+
+
+	// get the connection to nats server
+	serverConnection := connectTo(serverUrl)
+	defer func() {
+		log.Debugf("[DEFER-CLEAR-RESOURCES] will close nats server connection now...")
+		serverConnection.Close()
+	}()
+
+	BootstrapAlarmService(NatsTransportCreateNew(serverConnection), &props, false)
+}
+
+
+// ------------------- shared by the commands -------------------
+
+// configFlags registers the flags which select the config of the service (--config, --set).
+func configFlags(flags *flag.FlagSet) (*string, PropertyOverrides) {
+	configFile := flags.String("config", "config.properties", "the config file of the service (.properties, .yaml, .yml, .toml)")
+	configOverrides := PropertyOverrides{}
+	flags.Var(configOverrides, "set", "overrides a property of the config file, eg: --set adminHttpPort=9090 (repeatable)")
+	return configFile, configOverrides
+}
+
+// loadClientConfig loads the config of the service a client command talks to, without printing it.
+func loadClientConfig(configFile string, configOverrides PropertyOverrides) AppConfigProperties {
+	props, err := LoadConfig(configFile, AlarmServiceConfigSchema, configEnvPrefix, configOverrides)
+	if err != nil {
+		panic(InvalidConfigurationError{Msg: err.Error()})
+	}
+
+	// Note: the clients publish to (and listen on) the subjects of the service.
+	SetTopicNames(topicNames(&props))
+	return props
+}
+
+// natsUrlOf returns the nats server of the flag, or the one of the config (which sets the subjects either way).
+func natsUrlOf(natsUrl string, configFile string, configOverrides PropertyOverrides) string {
+	props := loadClientConfig(configFile, configOverrides)
+	if len(natsUrl) > 0 {
+		return natsUrl
+	}
+	return props.FetchAsString("natsUrl")
+}
+
+func connectTo(serverUrl string) *nats.Conn {
+	serverConnection, err := ServerConnectionTo(serverUrl)
+	if err != nil {
+		panic(CouldNotConnectToServerError{Msg: err.Error()})
+	}
+	return serverConnection
+}
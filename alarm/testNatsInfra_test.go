@@ -0,0 +1,78 @@
+package main
+
+import (
+	. "alarm/fileutil"
+	. "alarm/message"
+	"os"
+	"testing"
+	"time"
+)
+
+// Note: set this env variable (eg: ALARM_TEST_NATS_URL=nats://127.0.0.1:4222) in order to run the tests against
+//		 an external nats server (eg: the be-challenge docker image) instead of an embedded one.
+const testNatsUrlEnv = "ALARM_TEST_NATS_URL"
+
+/*
+	Provides a transport on top of a nats server connection which lives as long as the test/benchmark.
+	By default an embedded nats server with a random port is started per test/benchmark, so tests are hermetic
+	and can safely run in parallel (every test has its own topics).
+*/
+func testNatsTransport(tb testing.TB) *NatsTransport {
+
+	serverUrl := os.Getenv(testNatsUrlEnv)
+
+	if len(serverUrl) == 0 {
+		embeddedServer, err := StartEmbeddedServer(EmbeddedServerOptions{Port: EmbeddedServerRandomPort})
+		if err != nil {
+			tb.Fatalf("could not start embedded nats server, error: %v", err)
+		}
+		tb.Cleanup(func() {
+			StopEmbeddedServer(embeddedServer)
+		})
+
+		serverUrl = embeddedServer.ClientURL()
+	}
+
+	serverConnection, err := ServerConnectionTo(serverUrl)
+	if err != nil {
+		tb.Fatalf("could not connect to nats server: %v, error: %v", serverUrl, err)
+	}
+	tb.Cleanup(func() {
+		serverConnection.Close()
+	})
+
+	return NatsTransportCreateNew(serverConnection)
+}
+
+
+/*
+	Waits until BootstrapAlarmService (which runs in its own goroutine) has registered all of its listeners, so that
+	the messages emulated by the test are not published before anyone listens for them (core nats does not keep them).
+*/
+func waitForServiceSubscriptions(tb testing.TB, transport Transport, props *AppConfigProperties) {
+
+	subscriptionsCounter, ok := transport.(interface{ NumSubscriptions() int })
+	if !ok {
+		tb.Fatalf("transport %T can not report its subscriptions", transport)
+	}
+
+	// Note: listeners + delegator for AlarmStatusChanged and SendAlarmDigest, plus the AlarmDigest debug listener.
+	expectedSubscriptions := props.FetchAsInt("alarmStatusChangedListeners") + 1 +
+		props.FetchAsInt("sendAlarmDigestListeners") + 1 +
+		1
+
+	tries := 100
+	for currentTry := 0; subscriptionsCounter.NumSubscriptions() < expectedSubscriptions; currentTry++ {
+		if currentTry > tries {
+			tb.Fatalf("alarm service did not register its %v subscriptions in time", expectedSubscriptions)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// Note: make sure the subscriptions have been processed from the server too.
+	if natsTransport, isNats := transport.(*NatsTransport); isNats {
+		if err := natsTransport.Connection().Flush(); err != nil {
+			tb.Fatalf("could not flush nats server connection, error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+	OpenTelemetry setup: the components (listeners, consumers, workers, producers) use only the otel api (global
+	tracer provider & propagator), which is a no-op until SetupTracing installs an exporter:
+
+		none   --> no spans (default)
+		stdout --> the spans are printed as json to stdout (local runs)
+		file   --> the spans are appended as json to a file (local runs)
+
+	The W3C trace context (traceparent header) is propagated through the headers of the nats messages.
+	For tests see SetupInMemoryTracing.
+*/
+
+const (
+	NoExporter     = "none"
+	StdoutExporter = "stdout"
+	FileExporter   = "file"
+)
+
+const serviceName = "alarm-digest-service"
+
+type TracingOptions struct {
+	Exporter      string
+	File          string  // Note: only for FileExporter
+	SampleRatio   float64 // Note: 1 samples all the traces, the sampling decision of the parent (upstream service) is respected
+	ShutdownAfter time.Duration
+}
+
+// SetupTracing installs the global tracer provider and propagator, the returned func flushes and stops the exporter.
+func SetupTracing(options TracingOptions) (func(), error) {
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var writer io.Writer
+	var file *os.File
+	switch options.Exporter {
+	case NoExporter, "":
+		return func() {}, nil
+
+	case StdoutExporter:
+		writer = os.Stdout
+
+	case FileExporter:
+		f, err := os.OpenFile(options.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		writer, file = f, f
+
+	default:
+		return nil, errors.New("unknown tracing exporter: " + options.Exporter)
+	}
+
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(writer))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+		sdktrace.WithResource(serviceResource()),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), options.ShutdownAfter)
+		defer cancel()
+
+		_ = provider.Shutdown(ctx)
+		if file != nil {
+			_ = file.Close()
+		}
+	}, nil
+}
+
+// SetupInMemoryTracing installs a tracer provider which keeps all the spans in memory (synchronously), for tests.
+func SetupInMemoryTracing() *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithResource(serviceResource()),
+	))
+
+	return exporter
+}
+
+func serviceResource() *resource.Resource {
+	return resource.NewSchemaless(attribute.String("service.name", serviceName))
+}
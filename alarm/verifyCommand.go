@@ -0,0 +1,82 @@
+package main
+
+import (
+	. "alarm/error"
+	. "alarm/message"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func verifyCommand(args []string) {
+
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	configFile, configOverrides := configFlags(flags)
+	natsUrl := flags.String("nats-url", "", "the nats server of the service (default: natsUrl of the config)")
+	scenarioFiles := flags.String("scenarios", "", "comma separated scenario files (.yaml, .json), default: the built-in scenarios")
+	speed := flags.Float64("speed", 0, "the replay speed of the scenario timelines (1: real time, 60: a minute per second, 0: no pauses)")
+	stepDelayMs := flags.Int("step-delay-ms", 100, "the minimum pause between the steps of a scenario")
+	timeoutMs := flags.Int("timeout-ms", 5000, "how long to wait for the expected digests of a scenario")
+	graceMs := flags.Int("grace-ms", 300, "how long to keep listening for unexpected digests of a scenario")
+	_ = flags.Parse(args)
+
+
+	scenarios := DefaultVerificationScenarios()
+	if len(*scenarioFiles) > 0 {
+		scenarios = loadScenarioFiles(*scenarioFiles)
+	}
+
+	serverConnection := connectTo(natsUrlOf(*natsUrl, *configFile, configOverrides))
+	defer serverConnection.Close()
+
+
+	results := VerifyScenarios(NatsTransportCreateNew(serverConnection), scenarios, VerificationOptions{
+		ReplayOptions: ReplayOptions{
+			Speed:     *speed,
+			StepDelay: time.Duration(*stepDelayMs) * time.Millisecond,
+		},
+		Timeout: time.Duration(*timeoutMs) * time.Millisecond,
+		Grace:   time.Duration(*graceMs) * time.Millisecond,
+	})
+
+	failed := printVerificationResults(results)
+	if failed > 0 {
+		panic(VerificationFailedError{Msg: strconv.Itoa(failed) + " of " + strconv.Itoa(len(results)) + " scenarios failed"})
+	}
+}
+
+// printVerificationResults prints a line per scenario (and its failures) and returns the number of failed scenarios.
+func printVerificationResults(results []VerificationResult) int {
+	failed := 0
+
+	for _, result := range results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+			failed++
+		}
+
+		fmt.Printf("%v  %v (%v)\n", status, result.Scenario, result.Elapsed.Round(time.Millisecond))
+		for _, failure := range result.Failures {
+			fmt.Printf("      %v\n", failure)
+		}
+	}
+
+	fmt.Printf("\n%v passed, %v failed\n", len(results)-failed, failed)
+	return failed
+}
+
+func loadScenarioFiles(filenames string) []VerificationScenario {
+	var scenarios []VerificationScenario
+
+	for _, filename := range strings.Split(filenames, ",") {
+		loaded, err := LoadScenarios(strings.TrimSpace(filename))
+		if err != nil {
+			panic(InvalidCommandError{Msg: err.Error()})
+		}
+		scenarios = append(scenarios, loaded...)
+	}
+	return scenarios
+}